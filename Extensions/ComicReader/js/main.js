@@ -0,0 +1,126 @@
+const image = document.getElementById('comic-render');
+const currentPage = document.getElementById('currentPage');
+const totalPages = document.getElementById('totalPages');
+const directionToggle = document.getElementById('directionToggle');
+const direction = document.getElementById('direction');
+const preload = new Image();
+
+const comicUrl = () => {
+  return "/comic/" + encodeURIComponent(COMIC.volume || "") + COMIC.path.split("/").map(encodeURIComponent).join("/");
+};
+
+// Render the page, pages are numbered from 1 while the archive pages start at 0
+const renderPage = num => {
+  currentPage.innerText = num + " ";
+  image.src = comicUrl() + "?page=" + (num - 1);
+  window.scroll({ top: 0, left: 0, behavior: "smooth" })
+  if (num < COMIC.comic.Pages.length) {
+    preload.src = comicUrl() + "?page=" + num;
+  }
+  updateComicProgress();
+};
+
+// Show Prev Page
+const showPrevPage = () => {
+  if (COMIC.pageNum <= 1) {
+    return;
+  }
+  COMIC.pageNum--;
+  renderPage(COMIC.pageNum);
+};
+
+// Show Next Page
+const showNextPage = () => {
+  if (COMIC.pageNum >= COMIC.comic.Pages.length) {
+    return;
+  }
+  COMIC.pageNum++;
+  renderPage(COMIC.pageNum);
+};
+
+const renderDirection = () => {
+  direction.innerText = COMIC.direction === "rtl" ? "Right to left" : "Left to right";
+};
+
+// The reading direction is a preference of the browser, kept for each comic
+const directionKey = "direction:" + COMIC.hash;
+COMIC.direction = localStorage.getItem(directionKey) || COMIC.direction;
+
+// Get the progress, then the Comic
+fetch("/api/v1/progress/" + encodeURIComponent(COMIC.hash))
+  .then(res => res.ok ? res.json() : null)
+  .catch(() => null)
+  .then(progress => {
+    if (progress && progress.Locator.Page > 0) {
+      COMIC.pageNum = progress.Locator.Page;
+    }
+    return fetch(comicUrl());
+  })
+  .then(res => {
+    if (!res.ok) {
+      throw new Error(res.statusText);
+    }
+    return res.json();
+  })
+  .then(comic => {
+    COMIC.comic = comic;
+    totalPages.innerText = " " + comic.Pages.length;
+    COMIC.pageNum = Math.min(Math.max(COMIC.pageNum, 1), comic.Pages.length);
+    renderDirection();
+    renderPage(COMIC.pageNum);
+  })
+  .catch(err => {
+    // Display error
+    const div = document.createElement('div');
+    div.className = 'error';
+    div.appendChild(document.createTextNode(err.message));
+    document.querySelector('.container').insertBefore(div, image);
+  });
+
+directionToggle.onclick = () => {
+  COMIC.direction = COMIC.direction === "rtl" ? "ltr" : "rtl";
+  localStorage.setItem(directionKey, COMIC.direction);
+  renderDirection();
+};
+
+// Clicking the left or right half of the page turns the page in the reading direction
+image.onclick = e => {
+  const left = e.offsetX < image.width / 2;
+  if (left === (COMIC.direction === "rtl")) {
+    showNextPage();
+  } else {
+    showPrevPage();
+  }
+};
+
+  document.onkeydown = function(e) {
+    // Manga is read from right to left, so the arrow keys are swapped
+    const rtl = COMIC.direction === "rtl";
+    if (e.keyCode == 37){
+        rtl ? showNextPage() : showPrevPage();
+    } else if (e.keyCode == 39){
+        rtl ? showPrevPage() : showNextPage();
+    } else if (e.keyCode == 27){
+        res="";
+        path = COMIC.path.split("/")
+        for(i=1; i < path.length-1;i++)
+          res +="/"+path[i]
+        window.location.href = "/home?volume=" + encodeURIComponent(COMIC.volume || "") + "&path=" + res;
+    }
+}
+
+const updateComicProgress = ()=> {
+    let body = {
+        "Volume": COMIC.volume || "",
+        "Path": COMIC.path,
+        "Format": "comic",
+        "Locator": { "Page": COMIC.pageNum, "Position": "", "Percent": COMIC.pageNum / COMIC.comic.Pages.length },
+        "Device": "Web",
+        "Timestamp": Date.now()
+      }
+    fetch("/api/v1/progress/" + encodeURIComponent(COMIC.hash), {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body)
+    }).catch(err => console.log(err));
+}
@@ -0,0 +1,205 @@
+const frame = document.getElementById('epub-render');
+const toc = document.getElementById('toc');
+const tocToggle = document.getElementById('tocToggle');
+const currentChapter = document.getElementById('currentChapter');
+const totalChapters = document.getElementById('totalChapters');
+
+// The position is written like an EPUB CFI, the spine item is the even step after /6/.
+const parsePosition = position => {
+  const match = /^epubcfi\(\/6\/(\d+)!\)(?:@([0-9.]+))?$/.exec(position || "");
+  if (match === null) {
+    return { spine: 0, progress: 0 };
+  }
+  return { spine: parseInt(match[1]) / 2 - 1, progress: parseFloat(match[2] || "0") };
+};
+
+const formatPosition = () => {
+  return "epubcfi(/6/" + (EPUB.spine + 1) * 2 + "!)@" + EPUB.progress.toFixed(4);
+};
+
+const resourceUrl = href => {
+  return "/epub/" + EPUB.hash + "/" + href.split("/").map(encodeURIComponent).join("/");
+};
+
+// The chapters are sandboxed without scripts, so they are fetched and written into the frame,
+// with a base pointing at the chapter so their stylesheets and images load
+const loadChapter = href => {
+  return fetch(resourceUrl(href))
+    .then(res => {
+      if (!res.ok) {
+        throw new Error(res.statusText);
+      }
+      const type = (res.headers.get("Content-Type") || "text/html").split(";")[0];
+      return res.text().then(text => {
+        const doc = new DOMParser().parseFromString(text, type === "application/xhtml+xml" ? type : "text/html");
+        doc.querySelectorAll("script").forEach(script => script.remove());
+        const head = doc.head || doc.documentElement.insertBefore(doc.createElement("head"), doc.documentElement.firstChild);
+        const base = doc.createElement("base");
+        base.setAttribute("href", location.origin + resourceUrl(href));
+        head.insertBefore(base, head.firstChild);
+        return "<!DOCTYPE html>" + doc.documentElement.outerHTML;
+      });
+    });
+};
+
+// Links between the chapters are opened by the reader, other links in a new tab
+const onLink = e => {
+  const link = e.target.closest("a[href]");
+  if (link === null) {
+    return;
+  }
+  e.preventDefault();
+  const url = new URL(link.href);
+  const prefix = location.origin + "/epub/" + EPUB.hash + "/";
+  if ((url.origin + url.pathname).startsWith(prefix)) {
+    const path = (url.origin + url.pathname).slice(prefix.length).split("/").map(decodeURIComponent).join("/");
+    openHref(path + url.hash);
+  } else if (url.protocol === "http:" || url.protocol === "https:") {
+    window.open(url.href, "_blank", "noopener");
+  }
+};
+
+// Render the spine item, and scroll to how far into it the reader was
+const renderChapter = (index, progress, fragment) => {
+  EPUB.spine = index;
+  EPUB.progress = progress;
+  currentChapter.innerText = (index + 1) + " ";
+  loadChapter(EPUB.book.Spine[index].Href).then(html => {
+    frame.onload = () => {
+      const doc = frame.contentDocument;
+      doc.onkeydown = onKey;
+      doc.onclick = onLink;
+      let element = fragment ? doc.getElementById(fragment) : null;
+      if (element !== null) {
+        element.scrollIntoView();
+      } else {
+        const win = frame.contentWindow;
+        win.scrollTo(0, progress * (doc.documentElement.scrollHeight - win.innerHeight));
+      }
+      frame.contentWindow.onscroll = onScroll;
+      updateEpubProgress();
+    };
+    frame.srcdoc = html;
+  }).catch(showError);
+};
+
+// Show Prev Chapter
+const showPrevChapter = () => {
+  if (EPUB.spine <= 0) {
+    return;
+  }
+  renderChapter(EPUB.spine - 1, 0);
+};
+
+// Show Next Chapter
+const showNextChapter = () => {
+  if (EPUB.spine >= EPUB.book.Spine.length - 1) {
+    return;
+  }
+  renderChapter(EPUB.spine + 1, 0);
+};
+
+// Open the chapter a table of contents entry points at
+const openHref = href => {
+  const [path, fragment] = href.split("#");
+  const index = EPUB.book.Spine.findIndex(item => item.Href === path);
+  if (index >= 0) {
+    renderChapter(index, 0, fragment);
+  }
+  toc.classList.remove("open");
+};
+
+const renderToc = (points, parent) => {
+  const list = document.createElement('ul');
+  (points || []).forEach(point => {
+    const item = document.createElement('li');
+    const link = document.createElement('a');
+    link.innerText = point.Title;
+    if (point.Href) {
+      link.onclick = () => openHref(point.Href);
+    }
+    item.appendChild(link);
+    renderToc(point.Children, item);
+    list.appendChild(item);
+  });
+  parent.appendChild(list);
+};
+
+// Display error
+const showError = err => {
+  const div = document.createElement('div');
+  div.className = 'error';
+  div.appendChild(document.createTextNode(err.message));
+  document.querySelector('.container').insertBefore(div, frame);
+};
+
+// Get the progress, then the Book
+fetch("/api/v1/progress/" + encodeURIComponent(EPUB.hash))
+  .then(res => res.ok ? res.json() : null)
+  .catch(() => null)
+  .then(progress => {
+    if (progress && progress.Locator.Position) {
+      EPUB.position = progress.Locator.Position;
+    }
+    return fetch("/epub/" + EPUB.hash);
+  })
+  .then(res => {
+    if (!res.ok) {
+      throw new Error(res.statusText);
+    }
+    return res.json();
+  })
+  .then(book => {
+    EPUB.book = book;
+    document.title = book.Metadata.Title || document.title;
+    totalChapters.innerText = " " + book.Spine.length;
+    renderToc(book.TOC, toc);
+    // A Position in the link, like from a search hit, is opened instead of the saved position
+    const position = parsePosition(urlParams.get("Position") || EPUB.position);
+    renderChapter(Math.min(Math.max(position.spine, 0), book.Spine.length - 1), position.progress);
+  })
+  .catch(showError);
+
+tocToggle.onclick = () => toc.classList.toggle("open");
+
+let scrollTimeout = null;
+const onScroll = () => {
+  const doc = frame.contentDocument;
+  const win = frame.contentWindow;
+  const height = doc.documentElement.scrollHeight - win.innerHeight;
+  EPUB.progress = height > 0 ? Math.min(win.scrollY / height, 1) : 0;
+  clearTimeout(scrollTimeout);
+  scrollTimeout = setTimeout(updateEpubProgress, 1000);
+};
+
+const onKey = e => {
+  if (e.keyCode == 37){
+      showPrevChapter();
+  } else if (e.keyCode == 39){
+      showNextChapter();
+  } else if (e.keyCode == 27){
+      res="";
+      path = EPUB.path.split("/")
+      for(i=1; i < path.length-1;i++)
+        res +="/"+path[i]
+      window.location.href = "/home?volume=" + encodeURIComponent(EPUB.volume || "") + "&path=" + res;
+  }
+};
+document.onkeydown = onKey;
+
+const updateEpubProgress = ()=> {
+    EPUB.position = formatPosition();
+    let body = {
+        "Volume": EPUB.volume || "",
+        "Path": EPUB.path,
+        "Format": "epub",
+        "Locator": { "Page": 0, "Position": EPUB.position, "Percent": Math.min((EPUB.spine + EPUB.progress) / EPUB.book.Spine.length, 1) },
+        "Device": "Web",
+        "Timestamp": Date.now()
+      }
+    fetch("/api/v1/progress/" + encodeURIComponent(EPUB.hash), {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body)
+    }).catch(err => console.log(err));
+}
@@ -7,6 +7,9 @@ const totalPages = document.getElementById('totalPages');
 
 const canvas = document.querySelector('#pdf-render'),
   ctx = canvas.getContext('2d');
+const annotations = document.getElementById('annotations');
+const annotationsToggle = document.getElementById('annotationsToggle');
+const bookmarkToggle = document.getElementById('bookmarkToggle');
 
 // Render the page
 const renderPage = num => {
@@ -33,6 +36,7 @@ const renderPage = num => {
         }
         window.scroll({ top: 0, left: 0, behavior: "smooth" })
         updatePdfProgress()
+        renderBookmark()
     });
   });
 };
@@ -66,11 +70,23 @@ const showNextPage = () => {
   queueRenderPage(PDF.pageNum);
 };
 
-// Get Document
-pdfjsLib
-  .getDocument(PDF.url)
-  .promise.then(pdfDoc_ => {
+// Get the progress, then the Document
+fetch("/api/v1/progress/" + encodeURIComponent(PDF.hash))
+  .then(res => res.ok ? res.json() : null)
+  .catch(() => null)
+  .then(progress => {
+    // A Page in the link, like from a search hit, is opened instead of the saved page
+    const page = parseInt(urlParams.get("Page"));
+    if (page > 0) {
+      PDF.pageNum = page;
+    } else if (progress && progress.Locator.Page > 0) {
+      PDF.pageNum = progress.Locator.Page;
+    }
+    return pdfjsLib.getDocument(PDF.url).promise;
+  })
+  .then(pdfDoc_ => {
     PDF.doc = pdfDoc_;
+    PDF.pageNum = Math.min(Math.max(PDF.pageNum, 1), PDF.doc.numPages);
     totalPages.innerText = " "+PDF.doc.numPages;
     currentPage.innerText = PDF.pageNum+" ";
     renderPage(PDF.pageNum);
@@ -83,28 +99,106 @@ pdfjsLib
     document.querySelector('.container').insertBefore(div, canvas);
   });
 
+// Show the page of an annotation
+const showAnnotation = element => {
+  const page = parseInt(element.dataset.page);
+  if (page > 0 && PDF.doc && page <= PDF.doc.numPages) {
+    PDF.pageNum = page;
+    currentPage.innerText = PDF.pageNum;
+    queueRenderPage(PDF.pageNum);
+  }
+};
+
+// The bookmark of the current page, which is null if the page isn't bookmarked
+const pageBookmark = () => {
+  return annotations.querySelector('a.annotation[data-kind="bookmark"][data-page="' + PDF.pageNum + '"]');
+};
+
+const renderBookmark = () => {
+  bookmarkToggle.firstElementChild.className = pageBookmark() ? "fas fa-bookmark" : "far fa-bookmark";
+};
+
+// Bookmark the current page, or remove its bookmark
+const toggleBookmark = () => {
+  if (!PDF.doc) {
+    return;
+  }
+  const bookmark = pageBookmark();
+  const url = "/api/v1/annotations/" + encodeURIComponent(PDF.hash);
+  if (bookmark) {
+    fetch(url + "/" + encodeURIComponent(bookmark.dataset.id), { method: 'DELETE' })
+      .then(res => {
+        if (res.ok) {
+          bookmark.remove();
+          renderBookmark();
+        }
+      })
+      .catch(err => console.log(err));
+    return;
+  }
+  let body = {
+    "Kind": "bookmark",
+    "Locator": { "Page": PDF.pageNum, "Position": "", "Percent": PDF.pageNum / PDF.doc.numPages }
+  }
+  fetch(url, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(body)
+  })
+    .then(res => res.ok ? res.json() : Promise.reject(new Error(res.statusText)))
+    .then(annotation => {
+      const element = document.createElement('a');
+      element.className = 'annotation';
+      element.dataset.id = annotation.ID;
+      element.dataset.kind = annotation.Kind;
+      element.dataset.page = annotation.Locator.Page;
+      element.innerText = "Page " + annotation.Locator.Page;
+      annotations.appendChild(element);
+      renderBookmark();
+    })
+    .catch(err => console.log(err));
+};
+
+annotations.querySelectorAll('a.annotation[data-color]').forEach(element => {
+  element.style.borderColor = element.dataset.color || "";
+});
+annotations.onclick = e => {
+  const element = e.target.closest('a.annotation');
+  if (element) {
+    showAnnotation(element);
+  }
+};
+annotationsToggle.onclick = () => annotations.classList.toggle('open');
+bookmarkToggle.onclick = toggleBookmark;
+
   document.onkeydown = function(e) {
     if (e.keyCode == 37){
         showPrevPage();
     } else if (e.keyCode == 39){
         showNextPage();
+    } else if (e.keyCode == 66){
+        toggleBookmark();
     } else if (e.keyCode == 27){
         res="";
         path = PDF.path.split("/")
         for(i=1; i < path.length-1;i++)
           res +="/"+path[i]
-        window.location.href = "/home?path=" + res;
+        window.location.href = "/home?volume=" + encodeURIComponent(PDF.volume || "") + "&path=" + res;
     }
 }
 
 const updatePdfProgress = ()=> {
     let body = {
-        "Result": null,
-        "VariableType": '{"Hash": "TEXT","Username": "TEXT","Page":"INTEGER"}',
-        "Contains": '{"Hash": "'+PDF.hash+'","Username": "'+PDF.user+'"}',
-        "Set": '{"Page":"'+PDF.pageNum+'"}',
-        "TableName": "PDFS",
-        "DatabaseOperation": "UPDATE"
+        "Volume": PDF.volume || "",
+        "Path": PDF.path,
+        "Format": "pdf",
+        "Locator": { "Page": PDF.pageNum, "Position": "", "Percent": PDF.pageNum / PDF.doc.numPages },
+        "Device": "Web",
+        "Timestamp": Date.now()
       }
-    post("/query", body)
+    fetch("/api/v1/progress/" + encodeURIComponent(PDF.hash), {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body)
+    }).catch(err => console.log(err));
 }
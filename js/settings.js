@@ -17,42 +17,47 @@ let Extension = document.getElementById("Extension");
 let ApplicationLink = document.getElementById("ApplicationLink");
 button.onclick = () => {
     let params = {
-        "Result": null,
-        "VariableType": '{"Extension": "TEXT","Username": "TEXT"}',
-        "Contains": '{"Extension": "' + Extension.value + '","Username": "' + username + '"}',
-        "Set": null,
-        "TableName": "FileSettings",
-        "DatabaseOperation": "SELECT"
+        "Extension": Extension.value,
+        "ApplicationLink": ApplicationLink.value
     }
-    post("/query", params, (response) => {
-        console.log(response);
-        response.json().then(data => {
-            if (data) {
-                response = data[0]
-            } else {
-                response.ID = null
-            }
-            if (response.ID != null) {
-                let params = {
-                    "Result": null,
-                    "VariableType": '{"Extension": "TEXT", "ApplicationLink": "TEXT", "Username": "TEXT"}',
-                    "Contains": '{"Extension": "' + Extension.value + '", "Username": "' + username + '"}',
-                    "Set": '{"ApplicationLink": "' + ApplicationLink.value + '"}',
-                    "TableName": "FileSettings",
-                    "DatabaseOperation": "UPDATE"
-                }
-                post("/query", params, (response) => { alert(response.statusText) })
-            } else {
-                let params = {
-                    "Result": null,
-                    "VariableType": '{"Extension": "TEXT", "ApplicationLink": "TEXT", "Icon": "TEXT", "Username": "TEXT"}',
-                    "Contains": '{}',
-                    "Set": '{"Extension": "' + Extension.value + '", "ApplicationLink": "' + ApplicationLink.value + '", "Icon": "' + Extension.value.substr(1) + '", "Username": "' + username + '"}',
-                    "TableName": "FileSettings",
-                    "DatabaseOperation": "INSERT"
-                }
-                post("/query", params, (response) => { alert(response.statusText) })
-            }
-        })
-    })
-}
\ No newline at end of file
+    post("/updateSetting", params, (response) => { alert(response.statusText) })
+}
+
+// < ----- API tokens ----- >
+
+for (const cell of document.getElementsByClassName("time")) {
+    const time = parseInt(cell.dataset.time);
+    cell.textContent = time > 0 ? new Date(time * 1000).toLocaleString() : "Never";
+}
+for (const button of document.getElementsByClassName("revokeButton")) {
+    button.onclick = () => {
+        if (!confirm("Revoke the token? Scripts using it will stop working.")) {
+            return;
+        }
+        fetch("/api/v1/tokens/" + encodeURIComponent(button.dataset.id), { method: "DELETE" })
+            .then(response => response.ok ? location.reload() : alert(response.statusText))
+            .catch(err => console.log(err));
+    }
+}
+let tokenButton = document.getElementById("tokenButton");
+let TokenName = document.getElementById("TokenName");
+tokenButton.onclick = () => {
+    let scopes = [];
+    for (const checkbox of document.getElementsByClassName("tokenScope")) {
+        if (checkbox.checked) {
+            scopes.push(checkbox.value);
+        }
+    }
+    fetch("/api/v1/tokens", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ "Name": TokenName.value, "Scopes": scopes })
+    }).then(response => response.json()).then(token => {
+        if (token.Error) {
+            alert(token.Error.Message);
+            return;
+        }
+        // The token can't be read again, so it's shown until the page is reloaded.
+        document.getElementById("newToken").textContent = "Copy the token now, it won't be shown again: " + token.Token;
+    }).catch(err => console.log(err));
+}
@@ -0,0 +1,185 @@
+package annotation
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+
+	Progress "../progress"
+)
+
+// < ----- Annotations ----- >
+
+// The kinds of annotations.
+const (
+	Bookmark  = "bookmark"
+	Highlight = "highlight"
+	Note      = "note"
+)
+
+// ErrInvalid is returned when an annotation is missing what its kind needs.
+var ErrInvalid = errors.New("invalid annotation")
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Annotation is a bookmark, a highlight or a note a user made in a document, which is identified by its hash.
+type Annotation struct {
+	ID       string           `json:"ID"`
+	Username string           `json:"-"`
+	Hash     string           `json:"Hash"`
+	Kind     string           `json:"Kind"`
+	Locator  Progress.Locator `json:"Locator"`
+	Text     string           `json:"Text"`  // The selected text of a highlight.
+	Color    string           `json:"Color"` // A hex color like #ffeb3b, or empty for the default color of the reader.
+	Note     string           `json:"Note"`
+	Created  int64            `json:"Created"` // In unix time in milliseconds.
+	Updated  int64            `json:"Updated"`
+}
+
+// Annotations is a list of annotations.
+type Annotations []Annotation
+
+// Validate returns ErrInvalid if the annotation is missing what its kind needs.
+// Highlights need the selected text and notes need the note.
+func (annotation *Annotation) Validate() error {
+	if !annotation.Locator.Valid() || (annotation.Color != "" && !colorPattern.MatchString(annotation.Color)) {
+		return ErrInvalid
+	}
+	switch annotation.Kind {
+	case Bookmark:
+		return nil
+	case Highlight:
+		if annotation.Text != "" {
+			return nil
+		}
+	case Note:
+		if annotation.Note != "" {
+			return nil
+		}
+	}
+	return ErrInvalid
+}
+
+// Store stores the annotations of the users in the Annotations table.
+type Store struct {
+	DB *sql.DB
+}
+
+// InitTable creates the annotations table if it doesn't exist.
+func (store *Store) InitTable() error {
+	for _, table := range []string{`
+		CREATE TABLE IF NOT EXISTS Annotations(
+			ID TEXT NOT NULL PRIMARY KEY,
+			Username TEXT NOT NULL,
+			Hash TEXT NOT NULL,
+			Kind TEXT,
+			Page INTEGER,
+			Position TEXT,
+			Percent REAL,
+			Text TEXT,
+			Color TEXT,
+			Note TEXT,
+			Created INTEGER,
+			Updated INTEGER
+		);`,
+		"CREATE INDEX IF NOT EXISTS AnnotationsDocument ON Annotations(Username, Hash);",
+	} {
+		statement, err := store.DB.Prepare(table)
+		if err != nil {
+			return err
+		}
+		_, err = statement.Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the annotations of the user in the document, in the order they appear in it.
+func (store *Store) List(username string, hash string) (Annotations, error) {
+	result, err := store.DB.Query(`
+		SELECT ID, Hash, Kind, Page, Position, Percent, Text, Color, Note, Created, Updated FROM Annotations
+		WHERE Username=$1 AND Hash=$2 ORDER BY Page, Percent, Created
+	`, username, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	annotations := Annotations{}
+	for result.Next() {
+		annotation := Annotation{Username: username}
+		err := result.Scan(&annotation.ID, &annotation.Hash, &annotation.Kind, &annotation.Locator.Page, &annotation.Locator.Position,
+			&annotation.Locator.Percent, &annotation.Text, &annotation.Color, &annotation.Note, &annotation.Created, &annotation.Updated)
+		if err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, annotation)
+	}
+	return annotations, result.Err()
+}
+
+// Get returns the annotation of the user with the id. sql.ErrNoRows is returned if the user has no such annotation.
+func (store *Store) Get(username string, id string) (Annotation, error) {
+	annotation := Annotation{Username: username}
+	result := store.DB.QueryRow("SELECT ID, Hash, Kind, Page, Position, Percent, Text, Color, Note, Created, Updated FROM Annotations WHERE Username=$1 AND ID=$2", username, id)
+	err := result.Scan(&annotation.ID, &annotation.Hash, &annotation.Kind, &annotation.Locator.Page, &annotation.Locator.Position,
+		&annotation.Locator.Percent, &annotation.Text, &annotation.Color, &annotation.Note, &annotation.Created, &annotation.Updated)
+	return annotation, err
+}
+
+// Insert stores a new annotation. The created and updated timestamps are set to now.
+func (store *Store) Insert(annotation *Annotation) error {
+	annotation.Created = Progress.Now()
+	annotation.Updated = annotation.Created
+	statement, err := store.DB.Prepare(`
+		INSERT INTO Annotations (ID, Username, Hash, Kind, Page, Position, Percent, Text, Color, Note, Created, Updated)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(annotation.ID, annotation.Username, annotation.Hash, annotation.Kind, annotation.Locator.Page, annotation.Locator.Position,
+		annotation.Locator.Percent, annotation.Text, annotation.Color, annotation.Note, annotation.Created, annotation.Updated)
+	return err
+}
+
+// Update changes the annotation with the id of the annotation, and sets its updated timestamp to now.
+// sql.ErrNoRows is returned if the user has no such annotation.
+func (store *Store) Update(annotation *Annotation) error {
+	annotation.Updated = Progress.Now()
+	statement, err := store.DB.Prepare(`
+		UPDATE Annotations SET Kind=$1, Page=$2, Position=$3, Percent=$4, Text=$5, Color=$6, Note=$7, Updated=$8
+		WHERE Username=$9 AND ID=$10
+	`)
+	if err != nil {
+		return err
+	}
+	result, err := statement.Exec(annotation.Kind, annotation.Locator.Page, annotation.Locator.Position, annotation.Locator.Percent,
+		annotation.Text, annotation.Color, annotation.Note, annotation.Updated, annotation.Username, annotation.ID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the annotation of the user with the id. sql.ErrNoRows is returned if the user has no such annotation.
+func (store *Store) Delete(username string, id string) error {
+	result, err := store.DB.Exec("DELETE FROM Annotations WHERE Username=$1 AND ID=$2", username, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
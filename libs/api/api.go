@@ -0,0 +1,279 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber"
+)
+
+// < ----- API ----- >
+
+// API is the versioned JSON API of the server. Each version is a router group under /api described by an OpenAPI document.
+type API struct {
+	App *fiber.App
+	V1  *V1
+}
+
+// Init creates the /api/v1 group and its OpenAPI document, which is served at /api/v1/openapi.json.
+// The port and the scheme the server is reached with are the defaults of the server URL in the document.
+// Init should be called before the authentication middleware, so the document can be read without signing in.
+func (api *API) Init(port string, scheme string) error {
+	if scheme != "http" && scheme != "https" {
+		return errors.New("api: unknown scheme " + strconv.Quote(scheme))
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return errors.New("api: invalid port " + strconv.Quote(port))
+	}
+	api.V1 = &V1{
+		Router:   api.App.Group(V1Prefix),
+		Document: NewDocument("Ereader API", "1.0.0", V1Prefix, port, scheme),
+	}
+	api.V1.Handle("GET", "/openapi.json", Operation{
+		ID:      "getOpenAPI",
+		Summary: "The OpenAPI document of the API",
+		Tag:     "api",
+		Public:  true,
+		Result:  map[string]interface{}{},
+	}, api.V1.ServeDocument)
+	return nil
+}
+
+// < ----- V1 ----- >
+
+// V1Prefix is the path the first version of the API is served under.
+const V1Prefix = "/api/v1"
+
+// V1 is the first version of the API. Routes are added with Handle, which describes them in the document too.
+type V1 struct {
+	Router   fiber.Router
+	Document *Document
+}
+
+// Operation describes a route of the API in the OpenAPI document. The parameters and the body are validated
+// before the handlers are called, and the parameters in the path of the route are added to the parameters.
+type Operation struct {
+	ID          string
+	Summary     string
+	Description string
+	Tag         string
+	Parameters  []Parameter
+	Body        interface{} // A value of the type of the JSON body, or nil if the route takes no body.
+	Status      int         // The status of a successful response, 200 if it's 0.
+	Result      interface{} // A value of the type of the JSON response, or nil if the response has no body.
+	Public      bool        // Public routes can be used without signing in.
+}
+
+// Handle adds the route to the router and the document. Errors sent by the handlers without a JSON body
+// are sent as an Error envelope, with the body as the message.
+func (v1 *V1) Handle(method string, path string, operation Operation, handlers ...fiber.Handler) {
+	operation.Parameters = append(pathParameters(path), operation.Parameters...)
+	v1.Document.AddOperation(method, path, operation)
+	handlers = append([]fiber.Handler{envelope, validate(operation)}, handlers...)
+	v1.Router.Add(method, path, handlers...)
+}
+
+// NotFound answers the requests to the routes of the API that don't exist. It has to be added after the routes.
+func (v1 *V1) NotFound() {
+	v1.Router.All("/*", func(c *fiber.Ctx) {
+		Error(c, fiber.StatusNotFound, "no such route", nil)
+	})
+}
+
+// ServeDocument sends the OpenAPI document.
+func (v1 *V1) ServeDocument(c *fiber.Ctx) {
+	SendJSON(c, v1.Document)
+}
+
+// < ----- Errors ----- >
+
+// ErrorBody is the body of an error response, which is sent as the Error field of an object.
+type ErrorBody struct {
+	Status  int         `json:"Status"`
+	Message string      `json:"Message"`
+	Details interface{} `json:"Details,omitempty"` // What caused the error, like the stored progress of a conflict.
+}
+
+// Envelope is the object errors are sent in.
+type Envelope struct {
+	Error ErrorBody `json:"Error"`
+}
+
+// Error sends the error with the status. The message is the text of the status if it's empty.
+func Error(c *fiber.Ctx, status int, message string, details interface{}) {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	c.Status(status)
+	SendJSON(c, Envelope{Error: ErrorBody{Status: status, Message: message, Details: details}})
+}
+
+// SendJSON sends the value as JSON.
+func SendJSON(c *fiber.Ctx, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		data, _ = json.Marshal(Envelope{Error: ErrorBody{Status: fiber.StatusInternalServerError, Message: err.Error()}})
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	c.SendBytes(data)
+}
+
+// envelope turns the errors sent by the handlers as text into an Error envelope.
+func envelope(c *fiber.Ctx) {
+	c.Next()
+	response := &c.Fasthttp.Response
+	status := response.StatusCode()
+	if status < 400 || strings.HasPrefix(string(response.Header.ContentType()), fiber.MIMEApplicationJSON) {
+		return
+	}
+	Error(c, status, strings.TrimSpace(string(response.Body())), nil)
+}
+
+// < ----- Validation ----- >
+
+// validate checks the parameters and the body of the request against the operation.
+func validate(operation Operation) fiber.Handler {
+	return func(c *fiber.Ctx) {
+		for _, parameter := range operation.Parameters {
+			if err := parameter.check(c); err != nil {
+				Error(c, fiber.StatusBadRequest, err.Error(), nil)
+				return
+			}
+		}
+		if operation.Body != nil {
+			body := reflect.New(reflect.TypeOf(operation.Body)).Interface()
+			if err := json.Unmarshal([]byte(c.Body()), body); err != nil {
+				Error(c, fiber.StatusBadRequest, "invalid body: "+err.Error(), nil)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// Parameter is a parameter of an operation, in the query or the path.
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// QueryParameter returns an optional string parameter in the query.
+func QueryParameter(name string, description string) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Schema: &Schema{Type: "string"}}
+}
+
+// IntegerParameter returns an optional integer parameter in the query, from minimum to maximum.
+func IntegerParameter(name string, description string, minimum float64, maximum float64) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Schema: &Schema{Type: "integer", Minimum: &minimum, Maximum: &maximum}}
+}
+
+// ListParameter returns an optional string parameter in the query that can be given more than once.
+func ListParameter(name string, description string) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Schema: &Schema{Type: "array", Items: &Schema{Type: "string"}}}
+}
+
+// Require returns the parameter as a required parameter.
+func (parameter Parameter) Require() Parameter {
+	parameter.Required = true
+	return parameter
+}
+
+// check returns an error if the parameter is missing or isn't an integer in range when it has to be.
+func (parameter *Parameter) check(c *fiber.Ctx) error {
+	var value string
+	if parameter.In == "path" {
+		value = c.Params(parameter.Name)
+	} else {
+		value = c.Query(parameter.Name)
+	}
+	if value == "" {
+		if parameter.Required {
+			return errors.New("missing " + parameter.Name)
+		}
+		return nil
+	}
+	schema := parameter.Schema
+	if schema == nil || schema.Type != "integer" {
+		return nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || schema.Minimum != nil && float64(number) < *schema.Minimum || schema.Maximum != nil && float64(number) > *schema.Maximum {
+		return errors.New("invalid " + parameter.Name)
+	}
+	return nil
+}
+
+// pathParameters returns the parameters in the path of a route, like :hash.
+func pathParameters(path string) []Parameter {
+	var parameters []Parameter
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, ":") {
+			parameters = append(parameters, Parameter{Name: segment[1:], In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+	}
+	return parameters
+}
+
+// < ----- Pagination ----- >
+
+// The number of items on a page of a list, if the limit parameter isn't given, and the largest number allowed.
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+)
+
+// Pagination are the parameters of the routes that return a Page.
+var Pagination = []Parameter{
+	IntegerParameter("limit", "The number of items on a page.", 1, MaxLimit),
+	QueryParameter("cursor", "The Next cursor of the previous page."),
+}
+
+// Page is a page of a list. The next page is read by sending Next as the cursor parameter.
+type Page struct {
+	Items interface{} `json:"Items"`
+	Total int         `json:"Total"`
+	Next  string      `json:"Next"` // Empty on the last page.
+}
+
+// Paginate returns the page of the list selected by the limit and cursor parameters. The list has to be a slice.
+func Paginate(c *fiber.Ctx, list interface{}) (Page, error) {
+	items := reflect.ValueOf(list)
+	if items.IsNil() {
+		items = reflect.MakeSlice(items.Type(), 0, 0)
+	}
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	start := 0
+	if cursor := c.Query("cursor"); cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			start, err = strconv.Atoi(string(data))
+		}
+		if err != nil || start < 0 || start > items.Len() {
+			return Page{}, errors.New("invalid cursor")
+		}
+	}
+	end := start + limit
+	if end > items.Len() {
+		end = items.Len()
+	}
+	page := Page{Items: items.Slice(start, end).Interface(), Total: items.Len()}
+	if end < items.Len() {
+		page.Next = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(end)))
+	}
+	return page, nil
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// < ----- OpenAPI ----- >
+
+// Document is an OpenAPI 3 document describing a version of the API. The schemas of the bodies and the results
+// of the operations are generated from their Go types, where the fields are named by their json tags.
+type Document struct {
+	OpenAPI    string                               `json:"openapi"`
+	Info       Info                                 `json:"info"`
+	Servers    []Server                             `json:"servers"`
+	Tags       []Tag                                `json:"tags"`
+	Paths      map[string]map[string]*PathOperation `json:"paths"`
+	Components Components                           `json:"components"`
+	Security   []map[string][]string                `json:"security"`
+	types      map[reflect.Type]string
+}
+
+// Info is the title and the version of the API.
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// Server is the URL the API is served at, where the variables are written in braces.
+type Server struct {
+	URL       string                    `json:"url"`
+	Variables map[string]ServerVariable `json:"variables,omitempty"`
+}
+
+// ServerVariable is a variable of the URL of a server.
+type ServerVariable struct {
+	Default     string `json:"default"`
+	Description string `json:"description,omitempty"`
+}
+
+// Tag groups the operations of the document.
+type Tag struct {
+	Name string `json:"name"`
+}
+
+// Components are the schemas the document refers to, and how the requests are authenticated.
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes"`
+}
+
+// SecurityScheme is a way of authenticating the requests.
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Schema describes a JSON value.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+}
+
+// PathOperation is an operation in the document.
+type PathOperation struct {
+	OperationID string                 `json:"operationId"`
+	Summary     string                 `json:"summary,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Tags        []string               `json:"tags,omitempty"`
+	Parameters  []Parameter            `json:"parameters,omitempty"`
+	RequestBody *RequestBody           `json:"requestBody,omitempty"`
+	Responses   map[string]*Response   `json:"responses"`
+	Security    *[]map[string][]string `json:"security,omitempty"`
+}
+
+// RequestBody is the JSON body of an operation.
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response is a response of an operation.
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+// MediaType is the schema of a body.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// NewDocument returns a document without operations for the API served at the prefix.
+// The host, port and scheme of the server are variables, defaulting to localhost and the given port and scheme.
+func NewDocument(title string, version string, prefix string, port string, scheme string) *Document {
+	document := &Document{
+		OpenAPI: "3.0.3",
+		Info:    Info{Title: title, Version: version},
+		Servers: []Server{{
+			URL: "{scheme}://{host}:{port}" + prefix,
+			Variables: map[string]ServerVariable{
+				"scheme": {Default: scheme},
+				"host":   {Default: "localhost"},
+				"port":   {Default: port},
+			},
+		}},
+		Tags: []Tag{},
+		Components: Components{
+			Schemas: make(map[string]*Schema),
+			SecuritySchemes: map[string]*SecurityScheme{
+				"cookie": {Type: "apiKey", In: "cookie", Name: "token", Description: "The token set by /signin."},
+			},
+		},
+		Security: []map[string][]string{{"cookie": {}}},
+		Paths:    make(map[string]map[string]*PathOperation),
+		types:    make(map[reflect.Type]string),
+	}
+	return document
+}
+
+// AddSecurityScheme adds a way of authenticating the requests, which can be used instead of the others.
+func (document *Document) AddSecurityScheme(name string, scheme *SecurityScheme) {
+	document.Components.SecuritySchemes[name] = scheme
+	document.Security = append(document.Security, map[string][]string{name: {}})
+}
+
+// AddOperation describes the route in the document. Parameters in the path like :hash are written as {hash}.
+func (document *Document) AddOperation(method string, path string, operation Operation) {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	path = strings.Join(segments, "/")
+	item := &PathOperation{
+		OperationID: operation.ID,
+		Summary:     operation.Summary,
+		Description: operation.Description,
+		Parameters:  operation.Parameters,
+		Responses:   make(map[string]*Response),
+	}
+	if operation.Tag != "" {
+		item.Tags = []string{operation.Tag}
+		document.addTag(operation.Tag)
+	}
+	if operation.Public {
+		item.Security = &[]map[string][]string{}
+	}
+	if operation.Body != nil {
+		item.RequestBody = &RequestBody{Required: true, Content: map[string]*MediaType{
+			"application/json": {Schema: document.Schema(operation.Body)},
+		}}
+	}
+	status := operation.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := &Response{Description: http.StatusText(status)}
+	if operation.Result != nil {
+		response.Content = map[string]*MediaType{"application/json": {Schema: document.Schema(operation.Result)}}
+	}
+	item.Responses[strconv.Itoa(status)] = response
+	item.Responses["default"] = &Response{Description: "An error", Content: map[string]*MediaType{
+		"application/json": {Schema: document.Schema(Envelope{})},
+	}}
+	if document.Paths[path] == nil {
+		document.Paths[path] = make(map[string]*PathOperation)
+	}
+	document.Paths[path][strings.ToLower(method)] = item
+}
+
+func (document *Document) addTag(name string) {
+	for _, tag := range document.Tags {
+		if tag.Name == name {
+			return
+		}
+	}
+	document.Tags = append(document.Tags, Tag{Name: name})
+}
+
+// Schema returns the schema of the value. Named structs are added to the components and referred to,
+// except structs with interface fields, which are described by the values in those fields.
+func (document *Document) Schema(value interface{}) *Schema {
+	return document.schema(reflect.ValueOf(value), reflect.TypeOf(value))
+}
+
+func (document *Document) schema(value reflect.Value, kind reflect.Type) *Schema {
+	if kind == nil {
+		return &Schema{}
+	}
+	switch kind.Kind() {
+	case reflect.Ptr:
+		var elem reflect.Value
+		if value.IsValid() && !value.IsNil() {
+			elem = value.Elem()
+		}
+		return document.schema(elem, kind.Elem())
+	case reflect.Interface:
+		if value.IsValid() && !value.IsNil() {
+			return document.schema(value.Elem(), value.Elem().Type())
+		}
+		return &Schema{}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if kind.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		var elem reflect.Value
+		if value.IsValid() && value.Len() > 0 {
+			elem = value.Index(0)
+		}
+		return &Schema{Type: "array", Items: document.schema(elem, kind.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: document.schema(reflect.Value{}, kind.Elem())}
+	case reflect.Struct:
+		if kind.Name() == "" || hasInterface(kind) {
+			return document.object(value, kind)
+		}
+		name, ok := document.types[kind]
+		if !ok {
+			name = kind.Name()
+			if _, taken := document.Components.Schemas[name]; taken {
+				// Types of different packages can have the same name.
+				name = strings.Title(kind.PkgPath()[strings.LastIndex(kind.PkgPath(), "/")+1:]) + name
+			}
+			document.types[kind] = name
+			document.Components.Schemas[name] = &Schema{}
+			*document.Components.Schemas[name] = *document.object(value, kind)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	return &Schema{}
+}
+
+// object returns the schema of the fields of the struct. Embedded structs add their fields.
+func (document *Document) object(value reflect.Value, kind reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < kind.NumField(); i++ {
+		field := kind.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		var fieldValue reflect.Value
+		if value.IsValid() {
+			fieldValue = value.Field(i)
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for property, fieldSchema := range document.object(fieldValue, field.Type).Properties {
+				schema.Properties[property] = fieldSchema
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = document.schema(fieldValue, field.Type)
+	}
+	return schema
+}
+
+// hasInterface reports whether the struct has a JSON field of an interface type, directly or in an embedded struct.
+func hasInterface(kind reflect.Type) bool {
+	for i := 0; i < kind.NumField(); i++ {
+		field := kind.Field(i)
+		if field.Tag.Get("json") == "-" {
+			continue
+		}
+		if field.Type.Kind() == reflect.Interface || field.Anonymous && field.Type.Kind() == reflect.Struct && hasInterface(field.Type) {
+			return true
+		}
+	}
+	return false
+}
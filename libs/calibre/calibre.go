@@ -0,0 +1,175 @@
+package calibre
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// < ----- Calibre ----- >
+
+// MetadataFile is the name of the database in the root of a Calibre library.
+const MetadataFile = "metadata.db"
+
+// ErrNoLibrary is returned when a folder has no Calibre database.
+var ErrNoLibrary = errors.New("calibre: the folder is not a calibre library")
+
+// Library is a Calibre library, which is a folder with a metadata.db file and a folder for each book.
+type Library struct {
+	Path string // The folder of the library.
+
+	db *sql.DB
+}
+
+// Book is a book in a Calibre library.
+type Book struct {
+	ID          int64    `json:"ID"`
+	Title       string   `json:"Title"`
+	Authors     []string `json:"Authors"`
+	Series      string   `json:"Series"`
+	SeriesIndex float64  `json:"SeriesIndex"`
+	Tags        []string `json:"Tags"`
+	Rating      int      `json:"Rating"` // From 0 to 10, where each star is 2.
+	Publisher   string   `json:"Publisher"`
+	Language    string   `json:"Language"` // An ISO 639 code, like eng.
+	Comments    string   `json:"Comments"` // The description of the book in HTML.
+	Published   string   `json:"Published"`
+	ISBNs       []string `json:"ISBNs"`
+	Path        string   `json:"Path"` // The folder of the book relative to the library, using forward slashes.
+	HasCover    bool     `json:"HasCover"`
+	Formats     []Format `json:"Formats"`
+}
+
+// Format is a file of a book in one of its formats.
+type Format struct {
+	Format string `json:"Format"` // Like EPUB or PDF.
+	Name   string `json:"Name"`   // The name of the file without its extension.
+	Size   int64  `json:"Size"`
+}
+
+// Open opens the Calibre library in the folder, or the folder of the metadata.db file. The database is opened read only.
+func Open(path string) (*Library, error) {
+	if filepath.Base(path) == MetadataFile {
+		path = filepath.Dir(path)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(path, MetadataFile)); err != nil {
+		return nil, ErrNoLibrary
+	}
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(path, MetadataFile)+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	return &Library{Path: path, db: db}, nil
+}
+
+// Close closes the database of the library.
+func (library *Library) Close() error {
+	return library.db.Close()
+}
+
+// Books returns the books in the library.
+func (library *Library) Books() ([]Book, error) {
+	// Lists are separated by the unit separator, as the values can contain commas.
+	result, err := library.db.Query(`
+		SELECT books.id, books.title, books.path, books.has_cover, COALESCE(books.pubdate, ''), COALESCE(books.series_index, 1),
+			COALESCE((SELECT group_concat(name, char(31)) FROM (SELECT authors.name AS name FROM authors JOIN books_authors_link ON books_authors_link.author=authors.id WHERE books_authors_link.book=books.id ORDER BY books_authors_link.id)), ''),
+			COALESCE((SELECT series.name FROM series JOIN books_series_link ON books_series_link.series=series.id WHERE books_series_link.book=books.id), ''),
+			COALESCE((SELECT group_concat(tags.name, char(31)) FROM tags JOIN books_tags_link ON books_tags_link.tag=tags.id WHERE books_tags_link.book=books.id), ''),
+			COALESCE((SELECT ratings.rating FROM ratings JOIN books_ratings_link ON books_ratings_link.rating=ratings.id WHERE books_ratings_link.book=books.id), 0),
+			COALESCE((SELECT publishers.name FROM publishers JOIN books_publishers_link ON books_publishers_link.publisher=publishers.id WHERE books_publishers_link.book=books.id), ''),
+			COALESCE((SELECT languages.lang_code FROM languages JOIN books_languages_link ON books_languages_link.lang_code=languages.id WHERE books_languages_link.book=books.id ORDER BY books_languages_link.item_order LIMIT 1), ''),
+			COALESCE((SELECT comments.text FROM comments WHERE comments.book=books.id), ''),
+			COALESCE((SELECT group_concat(identifiers.val, char(31)) FROM identifiers WHERE identifiers.book=books.id AND identifiers.type='isbn'), '')
+		FROM books ORDER BY books.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	var books []Book
+	for result.Next() {
+		book := Book{}
+		var published, authors, tags, isbns string
+		err := result.Scan(&book.ID, &book.Title, &book.Path, &book.HasCover, &published, &book.SeriesIndex, &authors, &book.Series, &tags, &book.Rating, &book.Publisher, &book.Language, &book.Comments, &isbns)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		// Calibre writes the commas in the names of authors as |.
+		book.Authors = split(strings.ReplaceAll(authors, "|", ","))
+		book.Tags = split(tags)
+		book.ISBNs = split(isbns)
+		// Books without a date get the year 101.
+		if len(published) >= 10 && published[:4] >= "1000" {
+			book.Published = published[:10]
+		}
+		books = append(books, book)
+	}
+	result.Close()
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+	for i := range books {
+		books[i].Formats, err = library.formats(books[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return books, nil
+}
+
+// formats returns the formats of the book.
+func (library *Library) formats(id int64) ([]Format, error) {
+	result, err := library.db.Query("SELECT format, name, COALESCE(uncompressed_size, 0) FROM data WHERE book=$1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	formats := []Format{}
+	for result.Next() {
+		format := Format{}
+		if err := result.Scan(&format.Format, &format.Name, &format.Size); err != nil {
+			return nil, err
+		}
+		formats = append(formats, format)
+	}
+	return formats, result.Err()
+}
+
+// Folder returns the folder of the book on disk.
+func (library *Library) Folder(book Book) string {
+	return filepath.Join(library.Path, filepath.FromSlash(book.Path))
+}
+
+// Cover returns the path of the cover of the book on disk, or an empty string if it has no cover.
+func (library *Library) Cover(book Book) string {
+	if !book.HasCover {
+		return ""
+	}
+	return filepath.Join(library.Folder(book), "cover.jpg")
+}
+
+// File returns the path of the file of the book in the format relative to the library, using forward slashes.
+func (book *Book) File(format Format) string {
+	return "/" + book.Path + "/" + format.Name + format.Extension()
+}
+
+// Extension returns the extension of the files in the format, like .epub.
+func (format *Format) Extension() string {
+	return "." + strings.ToLower(format.Format)
+}
+
+func split(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, "\x1f") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,401 @@
+package comic
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/nwaples/rardecode"
+)
+
+// < ----- Comic ----- >
+
+// Format is the archive format of a comic.
+type Format string
+
+// The archive formats used for comics.
+const (
+	CBZ Format = "cbz" // A zip archive.
+	CBR Format = "cbr" // A rar archive.
+	CB7 Format = "cb7" // A 7z archive.
+)
+
+// ErrUnknownFormat is returned when a file isn't a zip, rar or 7z archive.
+var ErrUnknownFormat = errors.New("comic: unknown archive format")
+
+// ErrNoPage is returned when a page index is out of range.
+var ErrNoPage = errors.New("comic: no such page")
+
+// ImageExtensions are the extensions of the files in an archive that are used as pages.
+var ImageExtensions = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".avif"}
+
+// Comic is the list of pages in a comic archive.
+type Comic struct {
+	Format Format `json:"Format"`
+	Pages  []Page `json:"Pages"`
+}
+
+// Page is a single image in a comic archive.
+type Page struct {
+	Index     int    `json:"Index"`
+	Name      string `json:"Name"` // The path of the image inside the archive.
+	Size      int64  `json:"Size"` // The size is -1 if the archive doesn't know it.
+	MediaType string `json:"MediaType"`
+}
+
+// archive is the part of an archive format used to read the pages.
+type archive interface {
+	// names returns the files in the archive with their sizes.
+	names() (map[string]int64, error)
+	// open opens a file in the archive. The reader is valid until the archive is closed.
+	open(name string) (io.Reader, error)
+	Close() error
+}
+
+// Open lists the pages of the comic archive, in natural order of their names.
+func Open(name string) (*Comic, error) {
+	format, err := DetectFormat(name)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := openArchive(name, format)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	return listPages(archive, format)
+}
+
+// OpenPage opens the page with the given index. The page has to be closed when it has been read.
+func OpenPage(name string, index int) (io.ReadCloser, Page, error) {
+	format, err := DetectFormat(name)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	archive, err := openArchive(name, format)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	comic, err := listPages(archive, format)
+	if err != nil {
+		archive.Close()
+		return nil, Page{}, err
+	}
+	if index < 0 || index >= len(comic.Pages) {
+		archive.Close()
+		return nil, Page{}, ErrNoPage
+	}
+	page := comic.Pages[index]
+	reader, err := openEntry(archive, name, format, page.Name)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	return reader, page, nil
+}
+
+// OpenFile opens a file in the archive that isn't a page, like ComicInfo.xml. The name of the file is matched without regard to case.
+// os.ErrNotExist is returned if the archive has no such file. The file has to be closed when it has been read.
+func OpenFile(name string, file string) (io.ReadCloser, error) {
+	format, err := DetectFormat(name)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := openArchive(name, format)
+	if err != nil {
+		return nil, err
+	}
+	names, err := archive.names()
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	for entry := range names {
+		if strings.EqualFold(entry, file) {
+			return openEntry(archive, name, format, entry)
+		}
+	}
+	archive.Close()
+	return nil, os.ErrNotExist
+}
+
+// openEntry opens the file in the archive, which has been read to list the files. The archive is closed together with the file.
+func openEntry(archive archive, name string, format Format, entry string) (io.ReadCloser, error) {
+	// A rar archive can only be read from the start, so it is opened again to find the file.
+	if format == CBR {
+		archive.Close()
+		var err error
+		archive, err = openArchive(name, format)
+		if err != nil {
+			return nil, err
+		}
+	}
+	reader, err := archive.open(entry)
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	return &pageReader{Reader: reader, archive: archive}, nil
+}
+
+// DetectFormat detects the format of the archive from the first bytes of the file.
+// The extension isn't used, as comics are often given the wrong one.
+func DetectFormat(name string) (Format, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	magic := make([]byte, 6)
+	n, _ := io.ReadFull(file, magic)
+	magic = magic[:n]
+	switch {
+	case strings.HasPrefix(string(magic), "PK\x03\x04"), strings.HasPrefix(string(magic), "PK\x05\x06"):
+		return CBZ, nil
+	case strings.HasPrefix(string(magic), "Rar!\x1a\x07"):
+		return CBR, nil
+	case strings.HasPrefix(string(magic), "7z\xbc\xaf\x27\x1c"):
+		return CB7, nil
+	}
+	return "", ErrUnknownFormat
+}
+
+// IsImage reports whether the file in an archive is used as a page.
+// Folders and hidden files, like the ones added by macOS, are left out.
+func IsImage(name string) bool {
+	for _, element := range strings.Split(name, "/") {
+		if strings.HasPrefix(element, ".") || element == "__MACOSX" {
+			return false
+		}
+	}
+	extension := strings.ToLower(path.Ext(name))
+	for _, imageExtension := range ImageExtensions {
+		if extension == imageExtension {
+			return true
+		}
+	}
+	return false
+}
+
+// NaturalLess reports whether a sorts before b, comparing runs of digits by their value,
+// so page2.jpg comes before page10.jpg. Names that only differ in case or leading zeros are compared byte by byte,
+// so the order doesn't depend on the order of the archive.
+func NaturalLess(a string, b string) bool {
+	if order := naturalCompare(strings.ToLower(a), strings.ToLower(b)); order != 0 {
+		return order < 0
+	}
+	return a < b
+}
+
+// naturalCompare returns -1, 0 or 1 as a sorts before, with or after b, comparing runs of digits by their value.
+func naturalCompare(a string, b string) int {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			numberA, restA := splitNumber(a)
+			numberB, restB := splitNumber(b)
+			trimmedA, trimmedB := strings.TrimLeft(numberA, "0"), strings.TrimLeft(numberB, "0")
+			if len(trimmedA) != len(trimmedB) {
+				return compareInts(len(trimmedA), len(trimmedB))
+			}
+			if trimmedA != trimmedB {
+				return strings.Compare(trimmedA, trimmedB)
+			}
+			a, b = restA, restB
+			continue
+		}
+		if a[0] != b[0] {
+			return compareInts(int(a[0]), int(b[0]))
+		}
+		a, b = a[1:], b[1:]
+	}
+	return compareInts(len(a), len(b))
+}
+
+func compareInts(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// listPages lists the images in the archive as pages.
+func listPages(archive archive, format Format) (*Comic, error) {
+	names, err := archive.names()
+	if err != nil {
+		return nil, err
+	}
+	comic := &Comic{Format: format, Pages: []Page{}}
+	for name, size := range names {
+		if IsImage(name) {
+			comic.Pages = append(comic.Pages, Page{Name: name, Size: size, MediaType: mime.TypeByExtension(strings.ToLower(path.Ext(name)))})
+		}
+	}
+	sort.Slice(comic.Pages, func(i, j int) bool {
+		return NaturalLess(comic.Pages[i].Name, comic.Pages[j].Name)
+	})
+	for i := range comic.Pages {
+		comic.Pages[i].Index = i
+	}
+	return comic, nil
+}
+
+func openArchive(name string, format Format) (archive, error) {
+	switch format {
+	case CBZ:
+		reader, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, err
+		}
+		return &zipArchive{reader}, nil
+	case CBR:
+		reader, err := rardecode.OpenReader(name, "")
+		if err != nil {
+			return nil, err
+		}
+		return &rarArchive{reader}, nil
+	case CB7:
+		reader, err := sevenzip.OpenReader(name)
+		if err != nil {
+			return nil, err
+		}
+		return &sevenZipArchive{reader: reader}, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// pageReader closes the archive together with the page.
+type pageReader struct {
+	io.Reader
+	archive archive
+}
+
+func (page *pageReader) Close() error {
+	if closer, ok := page.Reader.(io.Closer); ok {
+		closer.Close()
+	}
+	return page.archive.Close()
+}
+
+// < ----- Formats ----- >
+
+type zipArchive struct {
+	reader *zip.ReadCloser
+}
+
+func (archive *zipArchive) names() (map[string]int64, error) {
+	names := make(map[string]int64)
+	for _, file := range archive.reader.File {
+		if !file.FileInfo().IsDir() {
+			names[file.Name] = int64(file.UncompressedSize64)
+		}
+	}
+	return names, nil
+}
+
+func (archive *zipArchive) open(name string) (io.Reader, error) {
+	for _, file := range archive.reader.File {
+		if file.Name == name {
+			return file.Open()
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (archive *zipArchive) Close() error {
+	return archive.reader.Close()
+}
+
+type rarArchive struct {
+	reader *rardecode.ReadCloser
+}
+
+func (archive *rarArchive) names() (map[string]int64, error) {
+	names := make(map[string]int64)
+	for {
+		header, err := archive.reader.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("comic: %w", err)
+		}
+		if header.IsDir {
+			continue
+		}
+		names[header.Name] = header.UnPackedSize
+		if header.UnKnownSize {
+			names[header.Name] = -1
+		}
+	}
+}
+
+func (archive *rarArchive) open(name string) (io.Reader, error) {
+	for {
+		header, err := archive.reader.Next()
+		if err == io.EOF {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, fmt.Errorf("comic: %w", err)
+		}
+		if header.Name == name {
+			// The reader reads the current file until the next call to Next.
+			return &archive.reader.Reader, nil
+		}
+	}
+}
+
+func (archive *rarArchive) Close() error {
+	return archive.reader.Close()
+}
+
+type sevenZipArchive struct {
+	reader *sevenzip.ReadCloser
+}
+
+func (archive *sevenZipArchive) names() (map[string]int64, error) {
+	names := make(map[string]int64)
+	for _, file := range archive.reader.File {
+		if !file.FileInfo().IsDir() {
+			names[file.Name] = int64(file.UncompressedSize)
+		}
+	}
+	return names, nil
+}
+
+func (archive *sevenZipArchive) open(name string) (io.Reader, error) {
+	for _, file := range archive.reader.File {
+		if file.Name == name {
+			return file.Open()
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (archive *sevenZipArchive) Close() error {
+	return archive.reader.Close()
+}
+
+// < ----- Helpers ----- >
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// splitNumber splits the leading digits from the rest of the string.
+func splitNumber(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
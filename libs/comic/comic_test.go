@@ -0,0 +1,42 @@
+package comic
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "page2.jpg", b: "page10.jpg", want: true},
+		{a: "page10.jpg", b: "page2.jpg"},
+		{a: "Page1.jpg", b: "page2.jpg", want: true},
+		{a: "page01.jpg", b: "page1.jpg", want: true},
+		{a: "page1.jpg", b: "page01.jpg"},
+		{a: "PAGE.jpg", b: "page.jpg", want: true},
+		{a: "page.jpg", b: "PAGE.jpg"},
+		{a: "page.jpg", b: "page.jpg"},
+		{a: "a/1.png", b: "a/1.png.jpg", want: true},
+	}
+	for _, test := range tests {
+		if got := NaturalLess(test.a, test.b); got != test.want {
+			t.Errorf("NaturalLess(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestNaturalLessOrder(t *testing.T) {
+	want := []string{"Cover.jpg", "cover.jpg", "Page1.jpg", "page001.jpg", "page01.jpg", "page1.jpg", "page2.jpg", "page10.jpg"}
+	for i := 0; i < 20; i++ {
+		names := append([]string{}, want...)
+		rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+		sort.Slice(names, func(i, j int) bool { return NaturalLess(names[i], names[j]) })
+		if strings.Join(names, " ") != strings.Join(want, " ") {
+			t.Fatalf("got %v, want %v", names, want)
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package enrich
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	Files "../files"
+)
+
+// < ----- Enrichment ----- >
+
+// Candidate is a record a provider found for a book.
+type Candidate struct {
+	Provider string     `json:"Provider"` // The name of the provider that found the record.
+	Key      string     `json:"Key"`      // The key of the record, like calibre:12 or openlibrary:/books/OL1M.
+	Book     Files.Book `json:"Book"`
+	Cover    string     `json:"Cover"` // Where the provider finds the cover of the record. It's empty if the record has no cover.
+	Score    float64    `json:"Score"` // How well the record matches the book, from 0 to 1.
+}
+
+// Provider finds metadata for books. The records imported from the dumps are a provider,
+// and the HTTP provider lets a local stand-in for Open Library be used instead of the dumps.
+type Provider interface {
+	Name() string
+	// ByISBN returns the records with the ISBN.
+	ByISBN(isbn string) ([]Candidate, error)
+	// Search returns the records that might be the book with the title and authors. The candidates are scored by the enricher.
+	Search(title string, authors []string) ([]Candidate, error)
+	// Cover returns the cover image of the candidate.
+	Cover(candidate Candidate) ([]byte, error)
+}
+
+// ErrRunning is returned when the books are already being enriched.
+var ErrRunning = errors.New("enrich: the books are already being enriched")
+
+// ErrNoReview is returned when a review doesn't exist, or the chosen candidate isn't in it.
+var ErrNoReview = errors.New("enrich: no such review")
+
+// Enricher matches the books in the catalog against the providers and fills in their blank fields.
+// A book is matched by its ISBN first, and then by its title and authors. Ambiguous matches are put in a review queue.
+type Enricher struct {
+	DB        *sql.DB
+	Catalog   *Files.Catalog
+	Index     *Files.Index // Used to match books without a title by their file name.
+	Providers []Provider
+	// AutoScore is the score a title and author match needs to be applied without a review.
+	AutoScore float64
+	// ReviewScore is the score a title and author match needs to be put in the review queue.
+	ReviewScore float64
+
+	running bool
+	mutex   sync.Mutex
+}
+
+// Outcome is what happened to a book when it was enriched.
+type Outcome string
+
+// The outcomes of enriching a book.
+const (
+	Matched   Outcome = "matched"   // The book was enriched with a record.
+	Queued    Outcome = "queued"    // The book has several likely records and is waiting for a review.
+	Unmatched Outcome = "unmatched" // No record was found for the book.
+)
+
+// Review is a book waiting for a person to choose which of the candidates it is.
+type Review struct {
+	ID         int64       `json:"ID"`
+	Hash       string      `json:"Hash"`
+	Book       Files.Book  `json:"Book"`
+	Candidates []Candidate `json:"Candidates"`
+	Created    int64       `json:"Created"`
+}
+
+// InitTables creates the review queue if it doesn't exist, and sets the default scores.
+func (enricher *Enricher) InitTables() error {
+	if enricher.AutoScore == 0 {
+		enricher.AutoScore = 0.9
+	}
+	if enricher.ReviewScore == 0 {
+		enricher.ReviewScore = 0.6
+	}
+	statement, err := enricher.DB.Prepare(`
+		CREATE TABLE IF NOT EXISTS EnrichmentReviews(
+			ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			Hash TEXT UNIQUE,
+			Candidates TEXT,
+			Created INTEGER
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec()
+	return err
+}
+
+// Run enriches the books in the catalog that haven't been enriched, and returns how many books had each outcome.
+func (enricher *Enricher) Run() (map[Outcome]int, error) {
+	enricher.mutex.Lock()
+	if enricher.running {
+		enricher.mutex.Unlock()
+		return nil, ErrRunning
+	}
+	enricher.running = true
+	enricher.mutex.Unlock()
+	defer func() {
+		enricher.mutex.Lock()
+		enricher.running = false
+		enricher.mutex.Unlock()
+	}()
+
+	outcomes := make(map[Outcome]int)
+	hashes, err := enricher.Catalog.Unenriched()
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range hashes {
+		outcome, err := enricher.Enrich(hash)
+		if err != nil {
+			fmt.Println("Error enriching the book", hash+":", err.Error())
+			continue
+		}
+		outcomes[outcome]++
+	}
+	return outcomes, nil
+}
+
+// Enrich matches the book with the hash against the providers.
+func (enricher *Enricher) Enrich(hash string) (Outcome, error) {
+	book, err := enricher.Catalog.Lookup(hash)
+	if err != nil {
+		return "", err
+	}
+	title := book.Title
+	if title == "" {
+		title = enricher.fileName(hash)
+	}
+
+	// An ISBN is trusted when it leads to a single record, or when the title tells the records apart.
+	if book.ISBN != "" {
+		for _, provider := range enricher.Providers {
+			candidates, err := provider.ByISBN(book.ISBN)
+			if err != nil {
+				return "", err
+			}
+			if len(candidates) == 1 {
+				return Matched, enricher.Apply(hash, candidates[0])
+			}
+			if len(candidates) > 1 {
+				return enricher.decide(hash, title, book.Authors, candidates)
+			}
+		}
+	}
+	if title == "" {
+		return Unmatched, enricher.Catalog.MarkEnriched(hash)
+	}
+	var candidates []Candidate
+	for _, provider := range enricher.Providers {
+		found, err := provider.Search(title, book.Authors)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, found...)
+	}
+	return enricher.decide(hash, title, book.Authors, candidates)
+}
+
+// decide scores the candidates and applies the best one if it is a clear match, or queues them for a review.
+func (enricher *Enricher) decide(hash string, title string, authors []string, candidates []Candidate) (Outcome, error) {
+	for i := range candidates {
+		candidates[i].Score = Score(title, authors, candidates[i].Book)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	likely := []Candidate{}
+	for _, candidate := range candidates {
+		if candidate.Score >= enricher.ReviewScore {
+			likely = append(likely, candidate)
+		}
+	}
+	if len(likely) == 0 {
+		return Unmatched, enricher.Catalog.MarkEnriched(hash)
+	}
+	// The best candidate is only applied if no other candidate comes close to it.
+	if likely[0].Score >= enricher.AutoScore && (len(likely) == 1 || likely[0].Score-likely[1].Score >= 0.05) {
+		return Matched, enricher.Apply(hash, likely[0])
+	}
+	if len(likely) > 10 {
+		likely = likely[:10]
+	}
+	err := enricher.queue(hash, likely)
+	if err != nil {
+		return "", err
+	}
+	return Queued, enricher.Catalog.MarkEnriched(hash)
+}
+
+// Apply enriches the book with the candidate. The fields read from the file are kept, and the blank fields are filled in.
+func (enricher *Enricher) Apply(hash string, candidate Candidate) error {
+	book, err := enricher.Catalog.Lookup(hash)
+	if err != nil {
+		return err
+	}
+	record := candidate.Book
+	fill(&book.Title, record.Title)
+	if len(book.Authors) == 0 {
+		book.Authors = record.Authors
+	}
+	fill(&book.Series, record.Series)
+	fill(&book.SeriesIndex, record.SeriesIndex)
+	fill(&book.ISBN, record.ISBN)
+	fill(&book.Language, record.Language)
+	fill(&book.Publisher, record.Publisher)
+	fill(&book.Description, record.Description)
+	fill(&book.Date, record.Date)
+	if len(book.Tags) == 0 {
+		book.Tags = record.Tags
+	}
+	if book.Rating == 0 {
+		book.Rating = record.Rating
+	}
+	book.Source = candidate.Key
+	book.Enriched = time.Now().Unix()
+	if candidate.Cover != "" {
+		if provider := enricher.provider(candidate.Provider); provider != nil {
+			data, err := provider.Cover(candidate)
+			if err != nil {
+				fmt.Println("Error reading the cover of", candidate.Key+":", err.Error())
+			} else if len(data) > 0 {
+				err = enricher.Catalog.StoreCover(hash, http.DetectContentType(data), data)
+				if err != nil {
+					return err
+				}
+				book.Cover = "/cover/" + hash
+			}
+		}
+	}
+	return enricher.Catalog.Store(book)
+}
+
+// < ----- Reviews ----- >
+
+// Reviews returns the books waiting for a review, oldest first.
+func (enricher *Enricher) Reviews() ([]Review, error) {
+	result, err := enricher.DB.Query("SELECT ID, Hash, Candidates, Created FROM EnrichmentReviews ORDER BY ID")
+	if err != nil {
+		return nil, err
+	}
+	reviews := []Review{}
+	for result.Next() {
+		review := Review{}
+		candidates := ""
+		if err := result.Scan(&review.ID, &review.Hash, &candidates, &review.Created); err != nil {
+			result.Close()
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(candidates), &review.Candidates); err != nil {
+			review.Candidates = []Candidate{}
+		}
+		reviews = append(reviews, review)
+	}
+	result.Close()
+	for i := range reviews {
+		reviews[i].Book, _ = enricher.Catalog.Lookup(reviews[i].Hash)
+	}
+	return reviews, nil
+}
+
+// Resolve applies the chosen candidate of the review and removes the review from the queue.
+// A negative choice dismisses the review without enriching the book.
+func (enricher *Enricher) Resolve(id int64, choice int) error {
+	var hash, candidates string
+	err := enricher.DB.QueryRow("SELECT Hash, Candidates FROM EnrichmentReviews WHERE ID=$1", id).Scan(&hash, &candidates)
+	if err == sql.ErrNoRows {
+		return ErrNoReview
+	}
+	if err != nil {
+		return err
+	}
+	if choice >= 0 {
+		var list []Candidate
+		err = json.Unmarshal([]byte(candidates), &list)
+		if err != nil {
+			return err
+		}
+		if choice >= len(list) {
+			return ErrNoReview
+		}
+		err = enricher.Apply(hash, list[choice])
+		if err != nil {
+			return err
+		}
+	}
+	statement, err := enricher.DB.Prepare("DELETE FROM EnrichmentReviews WHERE ID=$1")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(id)
+	return err
+}
+
+// queue puts the candidates of the book in the review queue, replacing the review it had.
+func (enricher *Enricher) queue(hash string, candidates []Candidate) error {
+	data, err := json.Marshal(candidates)
+	if err != nil {
+		return err
+	}
+	statement, err := enricher.DB.Prepare("INSERT OR REPLACE INTO EnrichmentReviews (Hash, Candidates, Created) VALUES (?,?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(hash, string(data), time.Now().Unix())
+	return err
+}
+
+func (enricher *Enricher) provider(name string) Provider {
+	for _, provider := range enricher.Providers {
+		if provider.Name() == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+// fileName returns the name of an indexed file with the hash without its extension.
+func (enricher *Enricher) fileName(hash string) string {
+	if enricher.Index == nil {
+		return ""
+	}
+	entries, err := enricher.Index.LookupHash(hash)
+	if err != nil || len(entries) == 0 {
+		return ""
+	}
+	name := path.Base(entries[0].Path)
+	return strings.NewReplacer("_", " ", ".", " ").Replace(strings.TrimSuffix(name, path.Ext(name)))
+}
+
+func fill(field *string, value string) {
+	if strings.TrimSpace(*field) == "" {
+		*field = value
+	}
+}
+
+// < ----- Scoring ----- >
+
+// Score returns how well the record matches the title and authors, from 0 to 1.
+// The title weighs the most. A subtitle is ignored if only one of the titles has it.
+func Score(title string, authors []string, record Files.Book) float64 {
+	titleScore := similarity(Normalize(title), Normalize(record.Title))
+	if main := Normalize(mainTitle(title)); main != "" {
+		if score := similarity(main, Normalize(mainTitle(record.Title))); score > titleScore {
+			titleScore = score
+		}
+	}
+	return 0.7*titleScore + 0.3*authorScore(authors, record.Authors)
+}
+
+// authorScore is the share of the authors of the book whose last name is among the names of the record.
+// It's neutral when either side has no authors.
+func authorScore(authors []string, recordAuthors []string) float64 {
+	if len(authors) == 0 || len(recordAuthors) == 0 {
+		return 0.5
+	}
+	names := make(map[string]bool)
+	for _, author := range recordAuthors {
+		for _, word := range strings.Fields(Normalize(author)) {
+			names[word] = true
+		}
+	}
+	found := 0
+	for _, author := range authors {
+		words := strings.Fields(Normalize(author))
+		for _, word := range words {
+			// Names are written both as "First Last" and "Last, First", so any longer word of the name may be the last name.
+			if len(word) > 2 && names[word] {
+				found++
+				break
+			}
+		}
+	}
+	return float64(found) / float64(len(authors))
+}
+
+// Normalize lowercases the text, removes punctuation and a leading article, so titles written differently compare equal.
+func Normalize(text string) string {
+	var builder strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			builder.WriteRune(r)
+		} else {
+			builder.WriteRune(' ')
+		}
+	}
+	words := strings.Fields(builder.String())
+	if len(words) > 1 && (words[0] == "the" || words[0] == "a" || words[0] == "an") {
+		words = words[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// mainTitle returns the title without its subtitle.
+func mainTitle(title string) string {
+	if index := strings.IndexAny(title, ":("); index > 0 {
+		return title[:index]
+	}
+	return title
+}
+
+// similarity returns 1 minus the edit distance between the strings relative to the longest of them.
+func similarity(a string, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func levenshtein(a []rune, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minimum(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minimum(values ...int) int {
+	smallest := values[0]
+	for _, value := range values[1:] {
+		if value < smallest {
+			smallest = value
+		}
+	}
+	return smallest
+}
@@ -0,0 +1,258 @@
+package enrich
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	Files "../files"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		name     string
+		title    string
+		authors  []string
+		record   Files.Book
+		min, max float64
+	}{
+		{
+			name:  "same book",
+			title: "Moby Dick", authors: []string{"Herman Melville"},
+			record: Files.Book{Title: "Moby Dick", Authors: []string{"Herman Melville"}},
+			min:    1, max: 1,
+		},
+		{
+			name:  "written differently",
+			title: "The Hobbit", authors: []string{"J. R. R. Tolkien"},
+			record: Files.Book{Title: "Hobbit!", Authors: []string{"Tolkien, J.R.R."}},
+			min:    1, max: 1,
+		},
+		{
+			name:  "subtitle on one side",
+			title: "Dune", authors: []string{"Frank Herbert"},
+			record: Files.Book{Title: "Dune: Deluxe Edition", Authors: []string{"Frank Herbert"}},
+			min:    1, max: 1,
+		},
+		{
+			name:   "no authors",
+			title:  "Dune",
+			record: Files.Book{Title: "Dune", Authors: []string{"Frank Herbert"}},
+			min:    0.85, max: 0.85,
+		},
+		{
+			name:  "other author",
+			title: "Dune", authors: []string{"Frank Herbert"},
+			record: Files.Book{Title: "Dune", Authors: []string{"Kevin J. Anderson"}},
+			min:    0.7, max: 0.7,
+		},
+		{
+			name:  "typo",
+			title: "Moby Dick", authors: []string{"Herman Melville"},
+			record: Files.Book{Title: "Moby Dikc", Authors: []string{"Herman Melville"}},
+			min:    0.8, max: 0.9,
+		},
+		{
+			name:  "other book by the author",
+			title: "Emma", authors: []string{"Jane Austen"},
+			record: Files.Book{Title: "Persuasion", Authors: []string{"Jane Austen"}},
+			min:    0, max: 0.6,
+		},
+		{
+			name:   "no title",
+			record: Files.Book{Title: "Emma"},
+			min:    0.15, max: 0.15,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			score := Score(test.title, test.authors, test.record)
+			if score < test.min-1e-9 || score > test.max+1e-9 {
+				t.Errorf("got %.3f, want %.2f to %.2f", score, test.min, test.max)
+			}
+		})
+	}
+}
+
+// stubProvider finds the candidates it has for the ISBNs and titles.
+type stubProvider struct {
+	isbns  map[string][]Candidate
+	titles map[string][]Candidate
+}
+
+func (provider *stubProvider) Name() string {
+	return "stub"
+}
+
+func (provider *stubProvider) ByISBN(isbn string) ([]Candidate, error) {
+	return append([]Candidate{}, provider.isbns[isbn]...), nil
+}
+
+func (provider *stubProvider) Search(title string, authors []string) ([]Candidate, error) {
+	return append([]Candidate{}, provider.titles[title]...), nil
+}
+
+func (provider *stubProvider) Cover(candidate Candidate) ([]byte, error) {
+	return nil, nil
+}
+
+func candidate(key string, title string, authors ...string) Candidate {
+	return Candidate{Provider: "stub", Key: "stub:" + key, Book: Files.Book{Title: title, Authors: authors, Publisher: key}}
+}
+
+func enricher(t *testing.T, provider Provider) *Enricher {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	catalog := &Files.Catalog{DB: db}
+	if err := catalog.InitTable(); err != nil {
+		t.Fatal(err)
+	}
+	enricher := &Enricher{DB: db, Catalog: catalog, Providers: []Provider{provider}}
+	if err := enricher.InitTables(); err != nil {
+		t.Fatal(err)
+	}
+	return enricher
+}
+
+func TestEnrich(t *testing.T) {
+	provider := &stubProvider{
+		isbns: map[string][]Candidate{
+			"9780306406157": {candidate("isbn", "Physics", "Ann Author")},
+			"9780140434262": {candidate("persuasion", "Persuasion", "Jane Austen"), candidate("emma", "Emma", "Jane Austen")},
+		},
+		titles: map[string][]Candidate{
+			"Moby Dick": {candidate("mobile", "Mobile Dicks"), candidate("moby", "Moby-Dick", "Herman Melville")},
+			"Dune":      {candidate("frank", "Dune", "Frank Herbert"), candidate("brian", "Dune", "Brian Herbert")},
+			"Emma":      {candidate("ignored", "Emma", "Jane Austen")},
+		},
+	}
+	tests := []struct {
+		book    Files.Book
+		outcome Outcome
+		source  string // The record the book was enriched from.
+		reviews []string
+	}{
+		{book: Files.Book{Hash: "isbn", ISBN: "9780306406157"}, outcome: Matched, source: "stub:isbn"},
+		{book: Files.Book{Hash: "isbn-title", Title: "Emma", Authors: []string{"Jane Austen"}, ISBN: "9780140434262"}, outcome: Matched, source: "stub:emma"},
+		{book: Files.Book{Hash: "fuzzy", Title: "Moby Dick", Authors: []string{"Herman Melville"}}, outcome: Matched, source: "stub:moby"},
+		{book: Files.Book{Hash: "ambiguous", Title: "Dune"}, outcome: Queued, reviews: []string{"stub:frank", "stub:brian"}},
+		{book: Files.Book{Hash: "unknown", Title: "Zzyzx Road"}, outcome: Unmatched},
+		{book: Files.Book{Hash: "untitled"}, outcome: Unmatched},
+	}
+	for _, test := range tests {
+		t.Run(test.book.Hash, func(t *testing.T) {
+			enricher := enricher(t, provider)
+			if err := enricher.Catalog.Store(test.book); err != nil {
+				t.Fatal(err)
+			}
+			outcome, err := enricher.Enrich(test.book.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outcome != test.outcome {
+				t.Errorf("got %s, want %s", outcome, test.outcome)
+			}
+			book, err := enricher.Catalog.Lookup(test.book.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if book.Source != test.source {
+				t.Errorf("enriched from %q, want %q", book.Source, test.source)
+			}
+			if test.source != "" && (book.Publisher != strings.TrimPrefix(test.source, "stub:") || book.Title == "") {
+				t.Errorf("the blank fields weren't filled in: %+v", book)
+			}
+			if book.Enriched == 0 {
+				t.Error("the book wasn't marked as enriched")
+			}
+			reviews, err := enricher.Reviews()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, review := range reviews {
+				for _, candidate := range review.Candidates {
+					keys = append(keys, candidate.Key)
+				}
+			}
+			if strings.Join(keys, " ") != strings.Join(test.reviews, " ") {
+				t.Errorf("got the reviews %v, want %v", keys, test.reviews)
+			}
+		})
+	}
+}
+
+func TestOpenLibrary(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/isbn/9780306406157.json":
+			w.Write([]byte(`{"key": "/books/OL1M", "title": "Physics", "subtitle": "An Introduction", "authors": [{"key": "/authors/OL1A"}],
+				"isbn_10": ["0306406152"], "publishers": ["Plenum"], "publish_date": "1980", "languages": [{"key": "/languages/eng"}],
+				"covers": [-1, 12], "series": ["Science ; 3"], "description": {"type": "/type/text", "value": "About physics."}}`))
+		case "/authors/OL1A.json":
+			w.Write([]byte(`{"name": "Ann Author"}`))
+		case "/search.json":
+			if r.URL.Query().Get("title") != "Dune" || r.URL.Query().Get("author") != "Frank Herbert" {
+				w.Write([]byte(`{"docs": []}`))
+				return
+			}
+			w.Write([]byte(`{"docs": [{"key": "/works/OL2W", "title": "Dune", "author_name": ["Frank Herbert"], "isbn": ["x", "9780441013593"],
+				"first_publish_year": 1965, "cover_i": 34}, {"key": "/works/OL3W", "title": "Dune Messiah"}]}`))
+		case "/b/id/12-L.jpg":
+			w.Write([]byte("cover"))
+		case "/broken.json":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer service.Close()
+	library := &OpenLibrary{URL: service.URL + "/", CoversURL: service.URL, Client: service.Client()}
+
+	candidates, err := library.ByISBN("9780306406157")
+	if err != nil || len(candidates) != 1 {
+		t.Fatalf("got %v, %v, want one candidate", candidates, err)
+	}
+	physics := candidates[0]
+	want := Files.Book{Title: "Physics: An Introduction", Authors: []string{"Ann Author"}, ISBN: "0306406152", Publisher: "Plenum",
+		Date: "1980", Language: "eng", Series: "Science", SeriesIndex: "3", Description: "About physics."}
+	if physics.Key != "openlibrary:/books/OL1M" || physics.Cover != "12" || !reflect.DeepEqual(physics.Book, want) {
+		t.Errorf("got %+v, want %+v", physics, want)
+	}
+
+	candidates, err = library.ByISBN("9780140434262")
+	if err != nil || len(candidates) != 0 {
+		t.Errorf("got %v, %v for a missing ISBN", candidates, err)
+	}
+
+	candidates, err = library.Search("Dune", []string{"Frank Herbert"})
+	if err != nil || len(candidates) != 2 {
+		t.Fatalf("got %v, %v, want two candidates", candidates, err)
+	}
+	dune := candidates[0]
+	if dune.Key != "openlibrary:/works/OL2W" || dune.Book.ISBN != "9780441013593" || dune.Book.Date != "1965" || dune.Cover != "34" {
+		t.Errorf("got %+v", dune)
+	}
+	if candidates[1].Book.Authors == nil || candidates[1].Cover != "" {
+		t.Errorf("got %+v", candidates[1])
+	}
+
+	data, err := library.Cover(physics)
+	if err != nil || string(data) != "cover" {
+		t.Errorf("got the cover %q, %v", data, err)
+	}
+	if _, err := library.Cover(dune); err == nil {
+		t.Error("got a missing cover")
+	}
+	if _, err := library.get("/broken.json", &struct{}{}); err == nil {
+		t.Error("got no error from a broken response")
+	}
+}
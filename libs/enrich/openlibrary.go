@@ -0,0 +1,241 @@
+package enrich
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	Files "../files"
+	Metadata "../metadata"
+)
+
+// < ----- Open Library ----- >
+
+// OpenLibrary is a Provider using the API of Open Library. The URLs can point to a local service with the same API,
+// which stands in for Open Library on servers without internet access.
+type OpenLibrary struct {
+	URL       string // Like https://openlibrary.org.
+	CoversURL string // Like https://covers.openlibrary.org.
+	Client    *http.Client
+}
+
+// Name implements Provider.
+func (library *OpenLibrary) Name() string {
+	return "openlibrary"
+}
+
+// ByISBN implements Provider.
+func (library *OpenLibrary) ByISBN(isbn string) ([]Candidate, error) {
+	var edition olEdition
+	found, err := library.get("/isbn/"+url.PathEscape(isbn)+".json", &edition)
+	if err != nil || !found {
+		return nil, err
+	}
+	book, cover := edition.book()
+	for _, author := range edition.Authors {
+		var record struct {
+			Name string `json:"name"`
+		}
+		found, err := library.get(author.Key+".json", &record)
+		if err != nil {
+			return nil, err
+		}
+		if found && record.Name != "" {
+			book.Authors = append(book.Authors, record.Name)
+		}
+	}
+	return []Candidate{{Provider: library.Name(), Key: "openlibrary:" + edition.Key, Book: book, Cover: cover}}, nil
+}
+
+// Search implements Provider.
+func (library *OpenLibrary) Search(title string, authors []string) ([]Candidate, error) {
+	query := url.Values{}
+	query.Set("title", title)
+	if len(authors) > 0 {
+		query.Set("author", authors[0])
+	}
+	query.Set("limit", "10")
+	var result struct {
+		Docs []struct {
+			Key              string   `json:"key"`
+			Title            string   `json:"title"`
+			Subtitle         string   `json:"subtitle"`
+			Authors          []string `json:"author_name"`
+			ISBNs            []string `json:"isbn"`
+			Publishers       []string `json:"publisher"`
+			Languages        []string `json:"language"`
+			FirstPublishYear int      `json:"first_publish_year"`
+			Cover            int64    `json:"cover_i"`
+		} `json:"docs"`
+	}
+	found, err := library.get("/search.json?"+query.Encode(), &result)
+	if err != nil || !found {
+		return nil, err
+	}
+	candidates := []Candidate{}
+	for _, doc := range result.Docs {
+		book := Files.Book{Title: joinTitle(doc.Title, doc.Subtitle), Authors: doc.Authors, ISBN: firstISBN(doc.ISBNs), Publisher: first(doc.Publishers), Language: first(doc.Languages)}
+		if book.Authors == nil {
+			book.Authors = []string{}
+		}
+		if doc.FirstPublishYear > 0 {
+			book.Date = strconv.Itoa(doc.FirstPublishYear)
+		}
+		candidate := Candidate{Provider: library.Name(), Key: "openlibrary:" + doc.Key, Book: book}
+		if doc.Cover > 0 {
+			candidate.Cover = strconv.FormatInt(doc.Cover, 10)
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// Cover implements Provider. The cover of a candidate is the id of the cover on Open Library.
+func (library *OpenLibrary) Cover(candidate Candidate) ([]byte, error) {
+	response, err := library.client().Get(strings.TrimRight(library.CoversURL, "/") + "/b/id/" + url.PathEscape(candidate.Cover) + "-L.jpg")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("enrich: the cover returned " + response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// get decodes the JSON at the path of the API. False is returned if it isn't found.
+func (library *OpenLibrary) get(path string, v interface{}) (bool, error) {
+	response, err := library.client().Get(strings.TrimRight(library.URL, "/") + path)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, errors.New("enrich: " + path + " returned " + response.Status)
+	}
+	return true, json.NewDecoder(response.Body).Decode(v)
+}
+
+func (library *OpenLibrary) client() *http.Client {
+	if library.Client != nil {
+		return library.Client
+	}
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+// < ----- Editions ----- >
+
+// olEdition is an edition record, as returned by the API and written in the dumps.
+type olEdition struct {
+	Key         string   `json:"key"`
+	Title       string   `json:"title"`
+	Subtitle    string   `json:"subtitle"`
+	Authors     []olRef  `json:"authors"`
+	ISBN10      []string `json:"isbn_10"`
+	ISBN13      []string `json:"isbn_13"`
+	Publishers  []string `json:"publishers"`
+	PublishDate string   `json:"publish_date"`
+	Languages   []olRef  `json:"languages"`
+	Covers      []int64  `json:"covers"`
+	Series      []string `json:"series"`
+	Description olText   `json:"description"`
+}
+
+type olRef struct {
+	Key string `json:"key"`
+}
+
+// olText is a text field, which is either a string or an object with the text as its value.
+type olText string
+
+func (text *olText) UnmarshalJSON(data []byte) error {
+	var value string
+	if json.Unmarshal(data, &value) == nil {
+		*text = olText(value)
+		return nil
+	}
+	var object struct {
+		Value string `json:"value"`
+	}
+	if json.Unmarshal(data, &object) == nil {
+		*text = olText(object.Value)
+	}
+	return nil
+}
+
+// book returns the metadata of the edition without the authors, which are records of their own, and the id of its cover.
+func (edition *olEdition) book() (Files.Book, string) {
+	book := Files.Book{
+		Title:       joinTitle(edition.Title, edition.Subtitle),
+		Authors:     []string{},
+		ISBN:        firstISBN(append(edition.ISBN13, edition.ISBN10...)),
+		Publisher:   first(edition.Publishers),
+		Description: strings.TrimSpace(string(edition.Description)),
+		Date:        strings.TrimSpace(edition.PublishDate),
+	}
+	if len(edition.Languages) > 0 {
+		book.Language = strings.TrimPrefix(edition.Languages[0].Key, "/languages/")
+	}
+	if len(edition.Series) > 0 {
+		book.Series, book.SeriesIndex = splitSeries(edition.Series[0])
+	}
+	cover := ""
+	for _, id := range edition.Covers {
+		// Removed covers are written as -1.
+		if id > 0 {
+			cover = strconv.FormatInt(id, 10)
+			break
+		}
+	}
+	return book, cover
+}
+
+// splitSeries splits a series like "Discworld ; 5" or "Dune Chronicles -- 1" into the series and the position in it.
+func splitSeries(series string) (string, string) {
+	for _, separator := range []string{";", "--", "#", ","} {
+		index := strings.LastIndex(series, separator)
+		if index == -1 {
+			continue
+		}
+		position := strings.TrimSpace(series[index+len(separator):])
+		position = strings.TrimSpace(strings.TrimPrefix(strings.ToLower(position), "no."))
+		if _, err := strconv.ParseFloat(position, 64); err == nil {
+			return strings.TrimSpace(series[:index]), position
+		}
+	}
+	return strings.TrimSpace(series), ""
+}
+
+func joinTitle(title string, subtitle string) string {
+	title, subtitle = strings.TrimSpace(title), strings.TrimSpace(subtitle)
+	if subtitle == "" {
+		return title
+	}
+	return title + ": " + subtitle
+}
+
+func firstISBN(identifiers []string) string {
+	for _, identifier := range identifiers {
+		if isbn := Metadata.ISBN(identifier); isbn != "" {
+			return isbn
+		}
+	}
+	return ""
+}
+
+func first(values []string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
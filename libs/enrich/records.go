@@ -0,0 +1,363 @@
+package enrich
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	Calibre "../calibre"
+	Files "../files"
+)
+
+// < ----- Records ----- >
+
+// Records is a Provider backed by the metadata dumps imported into the EnrichmentRecords table.
+// Calibre libraries and Open Library dumps can be imported, so books can be enriched without internet access.
+type Records struct {
+	DB *sql.DB
+}
+
+// batchSize is the number of records imported in each transaction.
+const batchSize = 10000
+
+// InitTables creates the tables of the records if they don't exist.
+func (records *Records) InitTables() error {
+	for _, table := range []string{`
+		CREATE TABLE IF NOT EXISTS EnrichmentRecords(
+			ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			Source TEXT,
+			Key TEXT,
+			Title TEXT,
+			TitleKey TEXT,
+			Authors TEXT,
+			AuthorKeys TEXT,
+			Series TEXT,
+			SeriesIndex TEXT,
+			ISBN TEXT,
+			Language TEXT,
+			Publisher TEXT,
+			Description TEXT,
+			Date TEXT,
+			Cover TEXT,
+			UNIQUE(Source, Key)
+		);`, `
+		CREATE INDEX IF NOT EXISTS EnrichmentRecordsTitle ON EnrichmentRecords(TitleKey);`, `
+		CREATE TABLE IF NOT EXISTS EnrichmentISBNs(
+			ISBN TEXT,
+			Record INTEGER,
+			PRIMARY KEY(ISBN, Record)
+		);`, `
+		CREATE TABLE IF NOT EXISTS EnrichmentAuthors(
+			Key TEXT NOT NULL PRIMARY KEY,
+			Name TEXT
+		);`,
+	} {
+		statement, err := records.DB.Prepare(table)
+		if err != nil {
+			return err
+		}
+		_, err = statement.Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name implements Provider.
+func (records *Records) Name() string {
+	return "records"
+}
+
+// ByISBN implements Provider.
+func (records *Records) ByISBN(isbn string) ([]Candidate, error) {
+	return records.query("SELECT "+recordColumns+" FROM EnrichmentRecords WHERE ID IN (SELECT Record FROM EnrichmentISBNs WHERE ISBN=$1)", isbn)
+}
+
+// Search implements Provider. The records sharing the longest word of the title are returned.
+func (records *Records) Search(title string, authors []string) ([]Candidate, error) {
+	longest := ""
+	for _, word := range strings.Fields(Normalize(title)) {
+		if len(word) > len(longest) {
+			longest = word
+		}
+	}
+	if longest == "" {
+		return nil, nil
+	}
+	return records.query("SELECT "+recordColumns+" FROM EnrichmentRecords WHERE TitleKey LIKE $1 LIMIT 200", "%"+longest+"%")
+}
+
+// Cover implements Provider. The cover of a record is the path of the image on disk.
+func (records *Records) Cover(candidate Candidate) ([]byte, error) {
+	return ioutil.ReadFile(candidate.Cover)
+}
+
+const recordColumns = "Source, Key, Title, Authors, AuthorKeys, Series, SeriesIndex, ISBN, Language, Publisher, Description, Date, Cover"
+
+// query returns the records as candidates. The authors of Open Library records are looked up by their keys.
+func (records *Records) query(query string, args ...interface{}) ([]Candidate, error) {
+	result, err := records.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []Candidate{}
+	authorKeys := [][]string{}
+	for result.Next() {
+		var source, key, authors, keys string
+		book := Files.Book{}
+		candidate := Candidate{Provider: records.Name()}
+		err := result.Scan(&source, &key, &book.Title, &authors, &keys, &book.Series, &book.SeriesIndex, &book.ISBN, &book.Language, &book.Publisher, &book.Description, &book.Date, &candidate.Cover)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		json.Unmarshal([]byte(authors), &book.Authors)
+		if book.Authors == nil {
+			book.Authors = []string{}
+		}
+		var recordKeys []string
+		json.Unmarshal([]byte(keys), &recordKeys)
+		candidate.Key = source + ":" + key
+		candidate.Book = book
+		candidates = append(candidates, candidate)
+		authorKeys = append(authorKeys, recordKeys)
+	}
+	result.Close()
+	for i := range candidates {
+		for _, key := range authorKeys[i] {
+			var name string
+			err := records.DB.QueryRow("SELECT Name FROM EnrichmentAuthors WHERE Key=$1", key).Scan(&name)
+			if err == nil && name != "" {
+				candidates[i].Book.Authors = append(candidates[i].Book.Authors, name)
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// < ----- Imports ----- >
+
+// Import imports a Calibre library from its metadata.db file, or an Open Library dump from any other file.
+// The covers folder holds the Open Library covers named by their id, like 12345.jpg. It can be empty.
+func (records *Records) Import(path string, covers string) (int, error) {
+	if strings.EqualFold(filepath.Ext(path), ".db") {
+		return records.ImportCalibre(path)
+	}
+	return records.ImportOpenLibrary(path, covers)
+}
+
+// ImportCalibre imports the books of the Calibre library with the metadata.db file at the path.
+// The covers are read from the library when a book is enriched.
+func (records *Records) ImportCalibre(path string) (int, error) {
+	library, err := Calibre.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer library.Close()
+	books, err := library.Books()
+	if err != nil {
+		return 0, err
+	}
+	importer, err := records.newImporter()
+	if err != nil {
+		return 0, err
+	}
+	for _, calibreBook := range books {
+		book := CalibreBook(calibreBook)
+		err = importer.add("calibre", library.Folder(calibreBook), book, nil, calibreBook.ISBNs, library.Cover(calibreBook))
+		if err != nil {
+			importer.rollback()
+			return 0, err
+		}
+	}
+	return importer.count, importer.commit()
+}
+
+// CalibreBook converts a book from a Calibre library to the metadata of a book in the catalog.
+func CalibreBook(calibreBook Calibre.Book) Files.Book {
+	book := Files.Book{
+		Title:       calibreBook.Title,
+		Authors:     calibreBook.Authors,
+		Series:      calibreBook.Series,
+		ISBN:        firstISBN(calibreBook.ISBNs),
+		Language:    calibreBook.Language,
+		Publisher:   calibreBook.Publisher,
+		Description: calibreBook.Comments,
+		Date:        calibreBook.Published,
+		Tags:        calibreBook.Tags,
+		Rating:      float64(calibreBook.Rating) / 2,
+	}
+	if book.Series != "" {
+		book.SeriesIndex = strconv.FormatFloat(calibreBook.SeriesIndex, 'f', -1, 64)
+	}
+	return book
+}
+
+// ImportOpenLibrary imports the editions and authors of an Open Library dump, which can be gzipped.
+// Each line of a dump is the type, key, revision, modification time and JSON of a record, separated by tabs.
+func (records *Records) ImportOpenLibrary(path string, covers string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.EqualFold(filepath.Ext(path), ".gz") {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	lines := bufio.NewReaderSize(reader, 1<<20)
+	importer, err := records.newImporter()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		line, err := lines.ReadString('\n')
+		if err != nil && err != io.EOF {
+			importer.rollback()
+			return 0, err
+		}
+		fields := strings.SplitN(strings.TrimRight(line, "\r\n"), "\t", 5)
+		if len(fields) == 5 {
+			if addErr := importer.addOpenLibrary(fields[0], fields[1], fields[4], covers); addErr != nil {
+				importer.rollback()
+				return 0, addErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return importer.count, importer.commit()
+}
+
+// importer writes records in batches of transactions.
+type importer struct {
+	records *Records
+	tx      *sql.Tx
+	count   int
+	pending int
+}
+
+func (records *Records) newImporter() (*importer, error) {
+	tx, err := records.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &importer{records: records, tx: tx}, nil
+}
+
+// add inserts or replaces the record, together with all its ISBNs.
+func (importer *importer) add(source string, key string, book Files.Book, authorKeys []string, identifiers []string, cover string) error {
+	if strings.TrimSpace(book.Title) == "" {
+		return nil
+	}
+	if authorKeys == nil {
+		authorKeys = []string{}
+	}
+	authors, _ := json.Marshal(book.Authors)
+	keys, _ := json.Marshal(authorKeys)
+	_, err := importer.tx.Exec(`
+		INSERT INTO EnrichmentRecords (Source, Key, Title, TitleKey, Authors, AuthorKeys, Series, SeriesIndex, ISBN, Language, Publisher, Description, Date, Cover)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+		ON CONFLICT(Source, Key) DO UPDATE SET Title=excluded.Title, TitleKey=excluded.TitleKey, Authors=excluded.Authors, AuthorKeys=excluded.AuthorKeys,
+			Series=excluded.Series, SeriesIndex=excluded.SeriesIndex, ISBN=excluded.ISBN, Language=excluded.Language, Publisher=excluded.Publisher,
+			Description=excluded.Description, Date=excluded.Date, Cover=excluded.Cover
+	`, source, key, book.Title, Normalize(book.Title), string(authors), string(keys), book.Series, book.SeriesIndex, book.ISBN, book.Language, book.Publisher, book.Description, book.Date, cover)
+	if err != nil {
+		return err
+	}
+	var id int64
+	err = importer.tx.QueryRow("SELECT ID FROM EnrichmentRecords WHERE Source=$1 AND Key=$2", source, key).Scan(&id)
+	if err != nil {
+		return err
+	}
+	_, err = importer.tx.Exec("DELETE FROM EnrichmentISBNs WHERE Record=$1", id)
+	if err != nil {
+		return err
+	}
+	for _, identifier := range identifiers {
+		if isbn := firstISBN([]string{identifier}); isbn != "" {
+			_, err = importer.tx.Exec("INSERT OR IGNORE INTO EnrichmentISBNs (ISBN, Record) VALUES (?,?)", isbn, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	importer.count++
+	return importer.next()
+}
+
+// addOpenLibrary adds a line of an Open Library dump. Other types than editions and authors are skipped.
+func (importer *importer) addOpenLibrary(recordType string, key string, data string, covers string) error {
+	switch recordType {
+	case "/type/author":
+		var author struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal([]byte(data), &author) != nil || author.Name == "" {
+			return nil
+		}
+		_, err := importer.tx.Exec("INSERT OR REPLACE INTO EnrichmentAuthors (Key, Name) VALUES (?,?)", key, author.Name)
+		if err != nil {
+			return err
+		}
+		return importer.next()
+	case "/type/edition":
+		var edition olEdition
+		if json.Unmarshal([]byte(data), &edition) != nil {
+			return nil
+		}
+		book, coverID := edition.book()
+		authorKeys := []string{}
+		for _, author := range edition.Authors {
+			authorKeys = append(authorKeys, author.Key)
+		}
+		cover := ""
+		if covers != "" && coverID != "" {
+			for _, name := range []string{coverID + ".jpg", coverID + "-L.jpg"} {
+				if _, err := os.Stat(filepath.Join(covers, name)); err == nil {
+					cover = filepath.Join(covers, name)
+					break
+				}
+			}
+		}
+		return importer.add("openlibrary", key, book, authorKeys, append(edition.ISBN13, edition.ISBN10...), cover)
+	}
+	return nil
+}
+
+// next commits the transaction when a batch is full.
+func (importer *importer) next() error {
+	importer.pending++
+	if importer.pending < batchSize {
+		return nil
+	}
+	err := importer.tx.Commit()
+	if err != nil {
+		return err
+	}
+	importer.pending = 0
+	importer.tx, err = importer.records.DB.Begin()
+	return err
+}
+
+func (importer *importer) commit() error {
+	return importer.tx.Commit()
+}
+
+func (importer *importer) rollback() {
+	importer.tx.Rollback()
+}
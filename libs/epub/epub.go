@@ -0,0 +1,535 @@
+package epub
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// < ----- EPUB ----- >
+
+// ErrNoPackage is returned when the container doesn't point at a package document.
+var ErrNoPackage = errors.New("epub: no package document")
+
+// Book is an opened EPUB file. It has to be closed when it is no longer used.
+// All hrefs are paths inside the zip container, with the fragment kept if there is one.
+type Book struct {
+	Version  string          `json:"Version"`
+	Metadata Metadata        `json:"Metadata"`
+	Manifest map[string]Item `json:"Manifest"` // The items of the book by their id.
+	Spine    []Item          `json:"Spine"`    // The items in reading order.
+	TOC      []NavPoint      `json:"TOC"`
+	Cover    string          `json:"Cover"` // The href of the cover image, if the book has one.
+
+	reader *zip.ReadCloser
+	files  map[string]*zip.File
+}
+
+// Metadata is the Dublin Core metadata of a book.
+type Metadata struct {
+	Title       string   `json:"Title"`
+	Creators    []string `json:"Creators"`
+	Language    string   `json:"Language"`
+	Identifier  string   `json:"Identifier"`
+	Publisher   string   `json:"Publisher"`
+	Description string   `json:"Description"`
+	Date        string   `json:"Date"`
+	Identifiers []string `json:"Identifiers"` // All the identifiers of the book, like its ISBN and UUID.
+	Series      string   `json:"Series"`
+	SeriesIndex string   `json:"SeriesIndex"` // The position of the book in the series, like 2 or 1.5.
+}
+
+// Item is a file in the manifest of a book.
+type Item struct {
+	ID         string `json:"ID"`
+	Href       string `json:"Href"`
+	MediaType  string `json:"MediaType"`
+	Properties string `json:"Properties"`
+	Linear     bool   `json:"Linear"` // Only set for spine items. Non linear items are only reached through links.
+}
+
+// NavPoint is an entry in the table of contents.
+type NavPoint struct {
+	Title    string     `json:"Title"`
+	Href     string     `json:"Href"`
+	Children []NavPoint `json:"Children"`
+}
+
+// Open opens the EPUB file and parses its package document and table of contents.
+func Open(name string) (*Book, error) {
+	reader, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	book := &Book{reader: reader, files: make(map[string]*zip.File)}
+	for _, file := range reader.File {
+		book.files[file.Name] = file
+	}
+	err = book.parse()
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return book, nil
+}
+
+// Close closes the underlying zip file.
+func (book *Book) Close() error {
+	return book.reader.Close()
+}
+
+// Open opens a file inside the book. The fragment of the href is ignored.
+func (book *Book) Open(href string) (io.ReadCloser, error) {
+	file, ok := book.files[stripFragment(href)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return file.Open()
+}
+
+// Size returns the uncompressed size of a file inside the book.
+func (book *Book) Size(href string) (int64, error) {
+	file, ok := book.files[stripFragment(href)]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(file.UncompressedSize64), nil
+}
+
+// MediaType returns the media type the manifest gives a file inside the book.
+func (book *Book) MediaType(href string) string {
+	href = stripFragment(href)
+	for _, item := range book.Manifest {
+		if item.Href == href {
+			return item.MediaType
+		}
+	}
+	return ""
+}
+
+// MaxTextSize is the largest file inside a book whose text is read.
+const MaxTextSize = 16 * 1024 * 1024
+
+var invisible = regexp.MustCompile(`(?is)<head[\s>].*?</head>|<script[\s>].*?</script>|<style[\s>].*?</style>`)
+
+// Text returns the text of a file inside the book, like a spine item, without its markup and with the whitespace collapsed.
+func (book *Book) Text(href string) (string, error) {
+	reader, err := book.Open(href)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	markup, err := ioutil.ReadAll(io.LimitReader(reader, MaxTextSize))
+	if err != nil {
+		return "", err
+	}
+	// Tags are replaced with spaces, so the words of adjacent paragraphs aren't joined.
+	text := tags.ReplaceAllString(invisible.ReplaceAllString(string(markup), " "), " ")
+	return strings.Join(strings.Fields(html.UnescapeString(text)), " "), nil
+}
+
+// < ----- Parsing ----- >
+
+type container struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type packageDocument struct {
+	Version  string `xml:"version,attr"`
+	Metadata struct {
+		Titles      []string `xml:"title"`
+		Creators    []string `xml:"creator"`
+		Languages   []string `xml:"language"`
+		Identifiers []string `xml:"identifier"`
+		Publishers  []string `xml:"publisher"`
+		Description []string `xml:"description"`
+		Dates       []string `xml:"date"`
+		Meta        []struct {
+			Name     string `xml:"name,attr"`
+			Content  string `xml:"content,attr"`
+			ID       string `xml:"id,attr"`
+			Property string `xml:"property,attr"`
+			Refines  string `xml:"refines,attr"`
+			Value    string `xml:",chardata"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		TOC      string `xml:"toc,attr"`
+		Itemrefs []struct {
+			IDRef  string `xml:"idref,attr"`
+			Linear string `xml:"linear,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+type ncxDocument struct {
+	NavPoints []ncxNavPoint `xml:"navMap>navPoint"`
+}
+
+type ncxNavPoint struct {
+	Label     string        `xml:"navLabel>text"`
+	Content   ncxContent    `xml:"content"`
+	NavPoints []ncxNavPoint `xml:"navPoint"`
+}
+
+type ncxContent struct {
+	Src string `xml:"src,attr"`
+}
+
+type navList struct {
+	Items []navItem `xml:"li"`
+}
+
+type navItem struct {
+	Link struct {
+		Href  string `xml:"href,attr"`
+		Inner string `xml:",innerxml"`
+	} `xml:"a"`
+	Span     string  `xml:"span"`
+	Children navList `xml:"ol"`
+}
+
+// parse reads the container, the package document and the table of contents.
+func (book *Book) parse() error {
+	var container container
+	err := book.decode("META-INF/container.xml", &container)
+	if err != nil {
+		return err
+	}
+	opf := ""
+	for _, rootfile := range container.Rootfiles {
+		if rootfile.MediaType == "" || rootfile.MediaType == "application/oebps-package+xml" {
+			opf = rootfile.FullPath
+			break
+		}
+	}
+	if opf == "" {
+		return ErrNoPackage
+	}
+	var pkg packageDocument
+	err = book.decode(opf, &pkg)
+	if err != nil {
+		return err
+	}
+	book.Version = pkg.Version
+	book.Metadata = Metadata{
+		Title:       first(pkg.Metadata.Titles),
+		Creators:    trimAll(pkg.Metadata.Creators),
+		Language:    first(pkg.Metadata.Languages),
+		Identifier:  first(pkg.Metadata.Identifiers),
+		Publisher:   first(pkg.Metadata.Publishers),
+		Description: first(pkg.Metadata.Description),
+		Date:        first(pkg.Metadata.Dates),
+		Identifiers: trimAll(pkg.Metadata.Identifiers),
+	}
+	book.Metadata.Series, book.Metadata.SeriesIndex = findSeries(pkg)
+	book.Manifest = make(map[string]Item)
+	for _, item := range pkg.Manifest {
+		book.Manifest[item.ID] = Item{ID: item.ID, Href: resolve(opf, item.Href), MediaType: item.MediaType, Properties: item.Properties}
+	}
+	for _, itemref := range pkg.Spine.Itemrefs {
+		item, ok := book.Manifest[itemref.IDRef]
+		if !ok {
+			continue
+		}
+		item.Linear = itemref.Linear != "no"
+		book.Spine = append(book.Spine, item)
+	}
+	book.Cover = book.findCover(pkg)
+
+	// EPUB 3 books have a navigation document, older books have a NCX file.
+	for _, item := range book.Manifest {
+		if hasProperty(item.Properties, "nav") {
+			book.TOC, err = book.parseNav(item.Href)
+			if err == nil && len(book.TOC) > 0 {
+				return nil
+			}
+		}
+	}
+	if item, ok := book.Manifest[pkg.Spine.TOC]; ok {
+		book.TOC, err = book.parseNCX(item.Href)
+		if err != nil {
+			return fmt.Errorf("epub: invalid table of contents: %w", err)
+		}
+	}
+	return nil
+}
+
+// findSeries returns the series of the book and the position in it.
+// EPUB 3 books declare the series as a collection, older books use the meta tags added by Calibre.
+func findSeries(pkg packageDocument) (string, string) {
+	for _, meta := range pkg.Metadata.Meta {
+		if meta.Property != "belongs-to-collection" {
+			continue
+		}
+		collectionType, position := "", ""
+		for _, refinement := range pkg.Metadata.Meta {
+			if meta.ID == "" || refinement.Refines != "#"+meta.ID {
+				continue
+			}
+			switch refinement.Property {
+			case "collection-type":
+				collectionType = strings.TrimSpace(refinement.Value)
+			case "group-position":
+				position = strings.TrimSpace(refinement.Value)
+			}
+		}
+		if collectionType == "" || collectionType == "series" {
+			return strings.TrimSpace(meta.Value), position
+		}
+	}
+	series, position := "", ""
+	for _, meta := range pkg.Metadata.Meta {
+		switch meta.Name {
+		case "calibre:series":
+			series = strings.TrimSpace(meta.Content)
+		case "calibre:series_index":
+			position = strings.TrimSpace(meta.Content)
+		}
+	}
+	return series, position
+}
+
+// findCover returns the href of the cover image declared in the package document.
+func (book *Book) findCover(pkg packageDocument) string {
+	for _, item := range book.Manifest {
+		if hasProperty(item.Properties, "cover-image") {
+			return item.Href
+		}
+	}
+	for _, meta := range pkg.Metadata.Meta {
+		if meta.Name == "cover" {
+			if item, ok := book.Manifest[meta.Content]; ok {
+				return item.Href
+			}
+		}
+	}
+	if item, ok := book.Manifest["cover"]; ok && strings.HasPrefix(item.MediaType, "image/") {
+		return item.Href
+	}
+	return ""
+}
+
+// parseNCX parses the navigation map of a NCX file.
+func (book *Book) parseNCX(href string) ([]NavPoint, error) {
+	var ncx ncxDocument
+	err := book.decode(href, &ncx)
+	if err != nil {
+		return nil, err
+	}
+	var convert func(points []ncxNavPoint) []NavPoint
+	convert = func(points []ncxNavPoint) []NavPoint {
+		var navPoints []NavPoint
+		for _, point := range points {
+			navPoints = append(navPoints, NavPoint{
+				Title:    strings.TrimSpace(point.Label),
+				Href:     resolve(href, point.Content.Src),
+				Children: convert(point.NavPoints),
+			})
+		}
+		return navPoints
+	}
+	return convert(ncx.NavPoints), nil
+}
+
+// parseNav parses the toc nav element of an EPUB 3 navigation document.
+func (book *Book) parseNav(href string) ([]NavPoint, error) {
+	file, err := book.Open(href)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := newDecoder(file)
+	// The navigation document is HTML, where elements like meta and link are often left unclosed.
+	decoder.AutoClose = xml.HTMLAutoClose
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "nav" || !isTOC(start) {
+			continue
+		}
+		var nav struct {
+			List navList `xml:"ol"`
+		}
+		err = decoder.DecodeElement(&nav, &start)
+		if err != nil {
+			return nil, err
+		}
+		var convert func(list navList) []NavPoint
+		convert = func(list navList) []NavPoint {
+			var navPoints []NavPoint
+			for _, item := range list.Items {
+				title := stripTags(item.Link.Inner)
+				if title == "" {
+					title = strings.TrimSpace(item.Span)
+				}
+				point := NavPoint{Title: title, Children: convert(item.Children)}
+				if item.Link.Href != "" {
+					point.Href = resolve(href, item.Link.Href)
+				}
+				navPoints = append(navPoints, point)
+			}
+			return navPoints
+		}
+		return convert(nav.List), nil
+	}
+}
+
+// decode unmarshals a XML file inside the book.
+func (book *Book) decode(href string, v interface{}) error {
+	file, err := book.Open(href)
+	if err != nil {
+		return fmt.Errorf("epub: missing %s", href)
+	}
+	defer file.Close()
+	return newDecoder(file).Decode(v)
+}
+
+// newDecoder returns a XML decoder which accepts the HTML entities found in real books.
+// HTML elements aren't closed automatically, as the package document has meta elements with content.
+func newDecoder(r io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		// Books are almost always UTF-8, and the ASCII compatible charsets decode fine for the markup that is read.
+		return input, nil
+	}
+	return decoder
+}
+
+// isTOC reports whether the nav element is the table of contents.
+func isTOC(start xml.StartElement) bool {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "type" && hasProperty(attr.Value, "toc") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve resolves a href relative to the file it was found in, to a path inside the zip container.
+func resolve(base string, href string) string {
+	fragment := ""
+	if i := strings.Index(href, "#"); i >= 0 {
+		href, fragment = href[:i], href[i:]
+	}
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+	if href == "" {
+		return base + fragment
+	}
+	return strings.TrimPrefix(path.Join(path.Dir(base), href), "/") + fragment
+}
+
+// stripFragment removes the fragment from a href.
+func stripFragment(href string) string {
+	if i := strings.Index(href, "#"); i >= 0 {
+		return href[:i]
+	}
+	return href
+}
+
+var tags = regexp.MustCompile(`<[^>]*>`)
+
+// stripTags returns the text of a piece of markup, with the whitespace collapsed.
+func stripTags(markup string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(tags.ReplaceAllString(markup, ""))), " ")
+}
+
+// hasProperty reports whether the space separated list of properties contains the property.
+func hasProperty(properties string, property string) bool {
+	for _, value := range strings.Fields(properties) {
+		if value == property {
+			return true
+		}
+	}
+	return false
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
+
+func trimAll(values []string) []string {
+	trimmed := []string{}
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			trimmed = append(trimmed, value)
+		}
+	}
+	return trimmed
+}
+
+// < ----- Position ----- >
+
+// Position is a reading position in a book, written like an EPUB CFI.
+// The spine step is followed by how far into the spine item the reader is, e.g. epubcfi(/6/4!)@0.2500.
+type Position struct {
+	Spine    int     // The index of the spine item.
+	Progress float64 // How far into the spine item the reader is, from 0 to 1.
+}
+
+var positionPattern = regexp.MustCompile(`^epubcfi\(/6/(\d+)!\)(?:@([0-9.]+))?$`)
+
+// ParsePosition parses a position written by Position.String.
+func ParsePosition(position string) (Position, error) {
+	match := positionPattern.FindStringSubmatch(position)
+	if match == nil {
+		return Position{}, fmt.Errorf("epub: invalid position %q", position)
+	}
+	step, err := strconv.Atoi(match[1])
+	if err != nil || step < 2 || step%2 != 0 {
+		return Position{}, fmt.Errorf("epub: invalid position %q", position)
+	}
+	pos := Position{Spine: step/2 - 1}
+	if match[2] != "" {
+		pos.Progress, err = strconv.ParseFloat(match[2], 64)
+		if err != nil || pos.Progress > 1 {
+			return Position{}, fmt.Errorf("epub: invalid position %q", position)
+		}
+	}
+	return pos, nil
+}
+
+// String returns the position written like an EPUB CFI. Spine items are even steps starting from 2.
+func (pos Position) String() string {
+	return fmt.Sprintf("epubcfi(/6/%d!)@%.4f", (pos.Spine+1)*2, pos.Progress)
+}
+
+// Percent returns how far into the whole book the position is, from 0 to 100.
+func (book *Book) Percent(pos Position) float64 {
+	if len(book.Spine) == 0 {
+		return 0
+	}
+	return (float64(pos.Spine) + pos.Progress) / float64(len(book.Spine)) * 100
+}
@@ -5,8 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
+	Annotation "../annotation"
 	Files "../files"
+	Shelf "../shelf"
 	User "../user"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gofiber/fiber"
@@ -14,13 +20,13 @@ import (
 
 // < ----- Extension Generators ----- >
 
-//Extension descripes the structure of an extension.
+// Extension descripes the structure of an extension.
 type Extension struct {
-	Name           string          `json:"Name"`
-	Path           string          `json:"Path"`
-	Views          []View          `json:"Views"`
-	Volume         Files.Volume    `json:"Volume"`
-	DatabaseTables []DatabaseTable `json:"DatabaseTable"`
+	Name           string         `json:"Name"`
+	Path           string         `json:"Path"`
+	Views          []View         `json:"Views"`
+	Volumes        Files.Volumes  `json:"Volumes"`
+	DatabaseTables DatabaseTables `json:"DatabaseTable"`
 }
 
 // LoadExtension loads the extension from the config file.
@@ -61,7 +67,7 @@ func (extension *Extension) Setup(app *fiber.App, DB *sql.DB) error {
 	}
 	for _, view := range extension.Views {
 		if view.Path != "" {
-			view.GenerateView(app, DB, extension.Volume)
+			view.GenerateView(app, DB, extension.Volumes, extension.DatabaseTables)
 		}
 	}
 	return nil
@@ -82,7 +88,7 @@ func (extension *Extension) InterfaceToExtension(space string, m map[string]inte
 			}
 			Extension.Views = Views
 		} else if k == "DatabaseTables" {
-			var DatabaseTables []DatabaseTable
+			var DatabaseTables DatabaseTables
 			if mv, ok := v.(map[string]interface{}); ok {
 				for _, v := range mv {
 					DatabaseTables = append(DatabaseTables, extension.InterfaceToTable(v.(map[string]interface{})))
@@ -181,16 +187,22 @@ type Extensions struct {
 }
 
 // LoadExtensions loads all extensions from the extensions folder.
-func (extensions *Extensions) LoadExtensions(app *fiber.App, DB *sql.DB, Volume Files.Volume) {
+func (extensions *Extensions) LoadExtensions(app *fiber.App, DB *sql.DB, Volumes Files.Volumes) {
 	files, err := ioutil.ReadDir("./Extensions")
 	if err != nil {
 		fmt.Println(err.Error())
 	}
 	for _, file := range files {
 		if file.IsDir() {
-			Extension := Extension{Path: "./Extensions/" + file.Name(), Volume: Volume}
+			Extension := Extension{Path: "./Extensions/" + file.Name(), Volumes: Volumes}
 			Extension.LoadExtension()
-			err := Extension.Setup(app, DB)
+			// Each extension owns the namespace of its tables, so it cannot be loaded if it declares a table it doesn't own.
+			err := extensions.CheckNamespace(Extension)
+			if err != nil {
+				fmt.Println("Error loading extension", Extension.Name+":", err.Error())
+				continue
+			}
+			err = Extension.Setup(app, DB)
 			if err != nil {
 				fmt.Println("Error loading extension", Extension.Name+":", err.Error())
 			}
@@ -199,6 +211,65 @@ func (extensions *Extensions) LoadExtensions(app *fiber.App, DB *sql.DB, Volume
 	}
 }
 
+// CheckNamespace checks that the extension has a unique name and that its tables are neither reserved nor declared by another extension.
+func (extensions *Extensions) CheckNamespace(extension Extension) error {
+	if extension.Name == "" {
+		return &NamespaceError{Extension: extension.Name, Reason: "the extension has no name"}
+	}
+	if _, err := extensions.Find(extension.Name); err == nil {
+		return &NamespaceError{Extension: extension.Name, Reason: "the extension name is already in use"}
+	}
+	for _, table := range extension.DatabaseTables {
+		if table.TableName == "" {
+			continue
+		}
+		if IsReservedTable(table.TableName) {
+			return &NamespaceError{Extension: extension.Name, TableName: table.TableName, Reason: "the table is reserved by the main program"}
+		}
+		for _, other := range extensions.Extensions {
+			for _, otherTable := range other.DatabaseTables {
+				if strings.EqualFold(table.TableName, otherTable.TableName) {
+					return &NamespaceError{Extension: extension.Name, TableName: table.TableName, Reason: "the table is owned by " + other.Name}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// DatabaseTables returns the database tables declared by all the loaded extensions.
+func (extensions *Extensions) DatabaseTables() DatabaseTables {
+	var tables DatabaseTables
+	for _, extension := range extensions.Extensions {
+		tables = append(tables, extension.DatabaseTables...)
+	}
+	return tables
+}
+
+// ProgressTables returns the names of the tables with both a Hash and a Path column.
+// These tables store progress for a file, and their Path is updated when the file moves.
+func (extensions *Extensions) ProgressTables() []string {
+	var names []string
+	for _, table := range extensions.DatabaseTables() {
+		_, hashErr := table.Column("Hash")
+		_, pathErr := table.Column("Path")
+		if table.TableName != "" && hashErr == nil && pathErr == nil {
+			names = append(names, table.TableName)
+		}
+	}
+	return names
+}
+
+// Find returns the loaded extension with the given name.
+func (extensions *Extensions) Find(name string) (*Extension, error) {
+	for i := range extensions.Extensions {
+		if extensions.Extensions[i].Name == name {
+			return &extensions.Extensions[i], nil
+		}
+	}
+	return nil, &UnknownExtensionError{Extension: name}
+}
+
 // View descripes the structure of an view.
 type View struct {
 	Path               string        `json:"Path"`               // The path the view will be rendered to.
@@ -210,7 +281,8 @@ type View struct {
 }
 
 // GenerateView generates a view based on the view structure.
-func (view *View) GenerateView(app *fiber.App, DB *sql.DB, Volume Files.Volume) {
+// The tables are the database tables owned by the extension, which the DatabaseQuery is validated against.
+func (view *View) GenerateView(app *fiber.App, DB *sql.DB, Volumes Files.Volumes, tables DatabaseTables) {
 	app.Get(view.Path, func(c *fiber.Ctx) {
 		// Get current user information from the claims map.
 		bind := fiber.Map{}
@@ -240,35 +312,70 @@ func (view *View) GenerateView(app *fiber.App, DB *sql.DB, Volume Files.Volume)
 		bind = fiber.Map{
 			"user": tUser,
 		}
+		// Views opened for a book get its metadata from the catalog, and the annotations of the user in it.
+		if hash := c.Query("Hash"); hash != "" {
+			catalog := Files.Catalog{DB: DB}
+			book, err := catalog.Lookup(hash)
+			if err == nil {
+				bind["book"] = book
+			}
+			annotations := Annotation.Store{DB: DB}
+			list, err := annotations.List(tUser.Username, hash)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+			bind["annotations"] = list
+		}
 		if view.NeedsQuerying {
+			// Copy the query so concurrent requests don't share Contains and Result.
+			query := view.DatabaseQuery
+			query.Result = nil
+			query.Contains = make(map[string]string)
+			for key, value := range view.DatabaseQuery.Contains {
+				query.Contains[key] = value
+			}
 			for _, variable := range view.QueryVariableNames {
-				view.DatabaseQuery.Contains[variable] = c.Query(variable)
+				query.Contains[variable] = c.Query(variable)
 			}
-			_, err := view.DatabaseQuery.GenerateQuery(DB)
+			_, err := query.GenerateScopedQuery(DB, tables, tUser.Username)
 			if err != nil {
 				fmt.Println(err.Error())
 			}
-			for k := range view.DatabaseQuery.Result {
-				for key, value := range view.DatabaseQuery.Result[k] {
+			for k := range query.Result {
+				for key, value := range query.Result[k] {
 					bind[key] = value
 				}
 			}
 		}
 		if view.NeedsFiles {
-			qPath := Volume.Path
-			if len(c.Query("path")) == 0 {
-				qPath += "/"
-			} else {
-				qPath += c.Query("path")
+			// The volume is selected with the volume query parameter, the first volume is used by default.
+			// The shelves of the user are listed as the folders of the Shelves volume, after the real volumes.
+			shelves := Shelf.Store{DB: DB}
+			Volume, files, err := shelves.ListFolder(tUser.Username, c.Query("volume"), c.Query("path"), Volumes)
+			if err == sql.ErrNoRows {
+				c.Status(fiber.StatusNotFound).Send("no such shelf")
+				return
+			}
+			if _, ok := err.(*Files.UnknownVolumeError); ok {
+				c.Status(fiber.StatusNotFound).Send(err.Error())
+				return
+			}
+			if err == Files.ErrOutsideVolume {
+				c.SendStatus(fiber.StatusForbidden)
+				return
+			}
+			if err == Files.ErrInvalidPath {
+				c.SendStatus(fiber.StatusBadRequest)
+				return
 			}
-			files, err := Volume.WalkFolder(qPath)
 			if err != nil {
 				fmt.Println(err.Error())
 			}
 			settingsMap := tUser.FileSettings.ToMap()
-			files = files.AddFileSetting(settingsMap, make(map[string]bool))
+			files = files.AddFileSetting(settingsMap)
 			bind["files"] = files
 			bind["volume"] = Volume
+			bind["volumes"] = append(Volumes[:len(Volumes):len(Volumes)], Files.Volume{Name: Files.ShelvesVolume})
 		}
 		if err := c.Render(view.ViewPath, bind); err != nil {
 			c.Status(500).Send(err.Error())
@@ -340,7 +447,7 @@ const (
 // This is made so that a the database item name can be mapped to it's type.
 type DatabaseItems map[string]DatabaseItemType
 
-//DatabaseTable Descripes the structure of a database table.
+// DatabaseTable Descripes the structure of a database table.
 type DatabaseTable struct {
 	TableName string        `json:"TableName"`
 	Items     DatabaseItems `json:"Items"`
@@ -348,10 +455,21 @@ type DatabaseTable struct {
 
 // GenerateTable generates the given database table if it doesn't exist'.
 func (database *DatabaseTable) GenerateTable(DB *sql.DB) error {
+	if !IsIdentifier(database.TableName) {
+		return &UnknownTableError{TableName: database.TableName}
+	}
 	// Setup the FileSettings table if it doesn't exist'
 	Query := "CREATE TABLE IF NOT EXISTS " + database.TableName + "("
 	Query += "ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT"
-	for key, sqlType := range database.Items {
+	for _, key := range sortedKeys(database.Items) {
+		// The ID column is always generated as the primary key.
+		if key == "ID" {
+			continue
+		}
+		sqlType := database.Items[key]
+		if !IsIdentifier(key) || sqlType.String() == "" {
+			return &UnknownColumnError{TableName: database.TableName, Column: key}
+		}
 		Query += ", " + key + " " + sqlType.String()
 	}
 	Query += ");"
@@ -363,7 +481,62 @@ func (database *DatabaseTable) GenerateTable(DB *sql.DB) error {
 	return nil
 }
 
-//DatabaseQuery the structure that containse teh data representation of a database query.
+// Column returns the type of the given column. The ID column is always present.
+func (database *DatabaseTable) Column(name string) (DatabaseItemType, error) {
+	if name == "ID" {
+		return INTEGER, nil
+	}
+	itemType, ok := database.Items[name]
+	if !ok || !IsIdentifier(name) {
+		return "", &UnknownColumnError{TableName: database.TableName, Column: name}
+	}
+	return itemType, nil
+}
+
+// Value converts a value send by the client into the type declared for the given column.
+func (database *DatabaseTable) Value(name string, value string) (interface{}, error) {
+	itemType, err := database.Column(name)
+	if err != nil {
+		return nil, err
+	}
+	switch itemType {
+	case INTEGER:
+		integer, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, &InvalidValueError{TableName: database.TableName, Column: name, Value: value}
+		}
+		return integer, nil
+	case REAL:
+		real, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, &InvalidValueError{TableName: database.TableName, Column: name, Value: value}
+		}
+		return real, nil
+	case BLOB:
+		return []byte(value), nil
+	case NULL:
+		return nil, nil
+	}
+	return value, nil
+}
+
+// DatabaseTables is a array of containing multiple instances of DatabaseTable.
+type DatabaseTables []DatabaseTable
+
+// Find returns the table with the given name.
+func (tables DatabaseTables) Find(name string) (DatabaseTable, error) {
+	if IsReservedTable(name) {
+		return DatabaseTable{}, &UnknownTableError{TableName: name}
+	}
+	for _, table := range tables {
+		if table.TableName != "" && table.TableName == name {
+			return table, nil
+		}
+	}
+	return DatabaseTable{}, &UnknownTableError{TableName: name}
+}
+
+// DatabaseQuery the structure that containse teh data representation of a database query.
 type DatabaseQuery struct {
 	Result            []map[string]interface{}    `json:"Result"`
 	VariableType      map[string]DatabaseItemType `json:"VariableType"`
@@ -373,24 +546,35 @@ type DatabaseQuery struct {
 	DatabaseOperation DatabaseOperationType       `json:"DatabaseOperation"`
 }
 
-// GenerateQuery constructs the query based on the information provided from the DatabaseQuery
-func (query *DatabaseQuery) GenerateQuery(DB *sql.DB) (string, error) {
-	Query := ""
-	query.TypeCorretor()
+// GenerateQuery constructs the query based on the information provided from the DatabaseQuery.
+// The table and the columns are validated against the given tables, and all values are bound as parameters.
+func (query *DatabaseQuery) GenerateQuery(DB *sql.DB, tables DatabaseTables) (string, error) {
+	table, err := tables.Find(query.TableName)
+	if err != nil {
+		return "", err
+	}
+	var Query string
+	var args []interface{}
 	switch query.DatabaseOperation {
 	case INSERT:
-		Query = query.Insert()
+		Query, args, err = query.Insert(table)
 	case SELECT:
-		Query = query.Select()
+		Query, args, err = query.Select(table)
 	case UPDATE:
-		Query = query.Update()
+		Query, args, err = query.Update(table)
 	case DELETE:
-		Query = query.Delete()
+		Query, args, err = query.Delete(table)
+	default:
+		err = &UnknownOperationError{DatabaseOperation: query.DatabaseOperation}
 	}
-	rows, err := DB.Query(Query)
 	if err != nil {
 		return "", err
 	}
+	rows, err := DB.Query(Query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
 	err = query.LoadResultIntoMap(rows)
 	if err != nil {
 		return "", err
@@ -404,101 +588,127 @@ func (query *DatabaseQuery) GenerateQuery(DB *sql.DB) (string, error) {
 	return resultJSON, nil
 }
 
-// TypeCorretor insures that items have the correct type.
-func (query *DatabaseQuery) TypeCorretor() {
-	for key, value := range query.Contains {
-		if query.VariableType[key] == TEXT {
-			query.Contains[key] = "\"" + value + "\""
-		}
+// GenerateScopedQuery generates the query like GenerateQuery, but limits it to the rows belonging to the given user.
+// Only tables with a Username column can be queried this way.
+func (query *DatabaseQuery) GenerateScopedQuery(DB *sql.DB, tables DatabaseTables, username string) (string, error) {
+	table, err := tables.Find(query.TableName)
+	if err != nil {
+		return "", err
 	}
-	for key, value := range query.Set {
-		if query.VariableType[key] == TEXT {
-			query.Set[key] = "\"" + value + "\""
+	err = query.ScopeToUser(table, username)
+	if err != nil {
+		return "", err
+	}
+	return query.GenerateQuery(DB, tables)
+}
+
+// ScopeToUser forces the Username column of the query to the given user,
+// so the query can only read and write the rows belonging to that user.
+func (query *DatabaseQuery) ScopeToUser(table DatabaseTable, username string) error {
+	if _, err := table.Column(UserColumn); err != nil {
+		return &UnscopedTableError{TableName: table.TableName}
+	}
+	if query.Contains == nil {
+		query.Contains = make(map[string]string)
+	}
+	if query.DatabaseOperation == INSERT {
+		if query.Set == nil {
+			query.Set = make(map[string]string)
 		}
+		query.Set[UserColumn] = username
+		return nil
+	}
+	if _, ok := query.Set[UserColumn]; ok {
+		query.Set[UserColumn] = username
 	}
+	query.Contains[UserColumn] = username
+	return nil
 }
 
 // Insert sqlite3. SQLite INSERT INTO Statement is used to add new rows of data into a table in the database.
-func (query *DatabaseQuery) Insert() string {
-	Query := query.DatabaseOperation.String() + " INTO " + query.TableName + " ("
-	keyMap := make(map[int]string)
-	i := 0
-	for key := range query.Set {
-		keyMap[i] = key
-		if i < len(query.Set)-1 {
-			Query += key + ","
-		} else {
-			Query += key + ")"
-		}
-		i++
-	}
-	Query += " VALUES ("
-	for j := 0; j < i; j++ {
-		if j < i-1 {
-			Query += query.Set[keyMap[j]] + ","
-		} else {
-			Query += query.Set[keyMap[j]] + ")"
+func (query *DatabaseQuery) Insert(table DatabaseTable) (string, []interface{}, error) {
+	if len(query.Set) == 0 {
+		return "", nil, &MissingValuesError{TableName: table.TableName, DatabaseOperation: INSERT}
+	}
+	var columns, placeholders []string
+	var args []interface{}
+	for _, key := range sortedKeys(query.Set) {
+		value, err := table.Value(key, query.Set[key])
+		if err != nil {
+			return "", nil, err
 		}
+		columns = append(columns, key)
+		placeholders = append(placeholders, "?")
+		args = append(args, value)
 	}
-	return Query
+	Query := "INSERT INTO " + table.TableName + " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(placeholders, ", ") + ")"
+	return Query, args, nil
 }
 
 // Select sqlite3. SQLite SELECT statement is used to fetch the data from a SQLite database table which returns data in the form of a result table.
-func (query *DatabaseQuery) Select() string {
-	Query := query.DatabaseOperation.String() + " * FROM " + query.TableName
-	i := 0
-	if len(query.Contains) > 0 {
-		Query += " WHERE "
-		for key, value := range query.Contains {
-			if i < len(query.Contains)-1 {
-				Query += key + "=" + value + " AND "
-			} else {
-				Query += key + "=" + value
-			}
-			i++
-		}
+func (query *DatabaseQuery) Select(table DatabaseTable) (string, []interface{}, error) {
+	where, args, err := query.where(table)
+	if err != nil {
+		return "", nil, err
 	}
-	return Query
+	Query := "SELECT * FROM " + table.TableName
+	if where != "" {
+		Query += " WHERE " + where
+	}
+	return Query, args, nil
 }
 
-// Update sqlite3. SQLite UPDATE statement is used to  modify the existing records in a table. You can use WHERE clause with UPDATE query to update selected rows, otherwise all the rows would be updated.
-func (query *DatabaseQuery) Update() string {
-	Query := query.DatabaseOperation.String() + " " + query.TableName + " SET "
-	i := 0
-	for key, value := range query.Set {
-		if i < len(query.Set)-1 {
-			Query += key + "=" + value + " AND "
-		} else {
-			Query += key + "=" + value
-		}
-		i++
+// Update sqlite3. SQLite UPDATE statement is used to  modify the existing records in a table.
+// A WHERE clause is required so a query can never update every row in the table.
+func (query *DatabaseQuery) Update(table DatabaseTable) (string, []interface{}, error) {
+	if len(query.Set) == 0 || len(query.Contains) == 0 {
+		return "", nil, &MissingValuesError{TableName: table.TableName, DatabaseOperation: UPDATE}
 	}
-	Query += " WHERE "
-	i = 0
-	for key, value := range query.Contains {
-		if i < len(query.Contains)-1 {
-			Query += key + "=" + value + " AND "
-		} else {
-			Query += key + "=" + value
+	var assignments []string
+	var args []interface{}
+	for _, key := range sortedKeys(query.Set) {
+		value, err := table.Value(key, query.Set[key])
+		if err != nil {
+			return "", nil, err
 		}
-		i++
+		assignments = append(assignments, key+"=?")
+		args = append(args, value)
 	}
-	return Query
+	where, whereArgs, err := query.where(table)
+	if err != nil {
+		return "", nil, err
+	}
+	Query := "UPDATE " + table.TableName + " SET " + strings.Join(assignments, ", ") + " WHERE " + where
+	return Query, append(args, whereArgs...), nil
+}
+
+// Delete sqlite3. SQLite DELETE statement is used to delete  the existing records from a table.
+// A WHERE clause is required so a query can never delete every row in the table.
+func (query *DatabaseQuery) Delete(table DatabaseTable) (string, []interface{}, error) {
+	if len(query.Contains) == 0 {
+		return "", nil, &MissingValuesError{TableName: table.TableName, DatabaseOperation: DELETE}
+	}
+	where, args, err := query.where(table)
+	if err != nil {
+		return "", nil, err
+	}
+	Query := "DELETE FROM " + table.TableName + " WHERE " + where
+	return Query, args, nil
 }
 
-// Delete sqlite3. SQLite DELETE statement is used to delete  the existing records from a table. You can use WHERE clause with DELETE query to delete the selected rows, otherwise all the records would be deleted.
-func (query *DatabaseQuery) Delete() string {
-	Query := query.DatabaseOperation.String() + " FROM " + query.TableName + " WHERE "
-	i := 0
-	for key, value := range query.Contains {
-		if i < len(query.Contains)-1 {
-			Query += key + "=" + value + " AND "
-		} else {
-			Query += key + "=" + value
+// where generates the conditions of the WHERE clause from Contains.
+func (query *DatabaseQuery) where(table DatabaseTable) (string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
+	for _, key := range sortedKeys(query.Contains) {
+		value, err := table.Value(key, query.Contains[key])
+		if err != nil {
+			return "", nil, err
 		}
-		i++
+		conditions = append(conditions, key+"=?")
+		args = append(args, value)
 	}
-	return Query
+	return strings.Join(conditions, " AND "), args, nil
 }
 
 // LoadResultIntoMap Loads the result of a database query into a map.
@@ -535,3 +745,149 @@ func (query *DatabaseQuery) LoadResultIntoMap(rows *sql.Rows) error {
 	}
 	return nil
 }
+
+// < ----- Query Errors ----- >
+
+// UnknownTableError is returned when a table isn't declared by the extension.
+type UnknownTableError struct {
+	TableName string
+}
+
+func (err *UnknownTableError) Error() string {
+	return "unknown table: " + err.TableName
+}
+
+// UnknownColumnError is returned when a column isn't declared in the Items of the table.
+type UnknownColumnError struct {
+	TableName string
+	Column    string
+}
+
+func (err *UnknownColumnError) Error() string {
+	return "unknown column: " + err.TableName + "." + err.Column
+}
+
+// InvalidValueError is returned when a value cannot be converted to the type of its column.
+type InvalidValueError struct {
+	TableName string
+	Column    string
+	Value     string
+}
+
+func (err *InvalidValueError) Error() string {
+	return "invalid value for " + err.TableName + "." + err.Column + ": " + strconv.Quote(err.Value)
+}
+
+// UnknownOperationError is returned when the DatabaseOperation isn't one of INSERT, SELECT, UPDATE or DELETE.
+type UnknownOperationError struct {
+	DatabaseOperation DatabaseOperationType
+}
+
+func (err *UnknownOperationError) Error() string {
+	return "unknown database operation: " + strconv.Quote(string(err.DatabaseOperation))
+}
+
+// MissingValuesError is returned when a query is missing the Set or Contains values needed by its operation.
+type MissingValuesError struct {
+	TableName         string
+	DatabaseOperation DatabaseOperationType
+}
+
+func (err *MissingValuesError) Error() string {
+	return "missing values for " + string(err.DatabaseOperation) + " on " + err.TableName
+}
+
+// UnscopedTableError is returned when a table without a Username column is queried on behalf of a user.
+type UnscopedTableError struct {
+	TableName string
+}
+
+func (err *UnscopedTableError) Error() string {
+	return "the table " + err.TableName + " has no " + UserColumn + " column and cannot be queried by users"
+}
+
+// UnknownExtensionError is returned when no extension with the given name is loaded.
+type UnknownExtensionError struct {
+	Extension string
+}
+
+func (err *UnknownExtensionError) Error() string {
+	return "unknown extension: " + strconv.Quote(err.Extension)
+}
+
+// NamespaceError is returned when an extension declares a name or table it doesn't own.
+type NamespaceError struct {
+	Extension string
+	TableName string
+	Reason    string
+}
+
+func (err *NamespaceError) Error() string {
+	if err.TableName == "" {
+		return strconv.Quote(err.Extension) + ": " + err.Reason
+	}
+	return err.TableName + ": " + err.Reason
+}
+
+// IsQueryError reports whether the error was caused by an invalid query rather than the database.
+func IsQueryError(err error) bool {
+	switch err.(type) {
+	case *UnknownColumnError, *InvalidValueError, *UnknownOperationError, *MissingValuesError:
+		return true
+	}
+	return false
+}
+
+// IsAccessError reports whether the error was caused by a query outside the namespace of the extension or user.
+func IsAccessError(err error) bool {
+	switch err.(type) {
+	case *UnknownExtensionError, *UnknownTableError, *UnscopedTableError, *NamespaceError:
+		return true
+	}
+	return false
+}
+
+// < ----- Namespaces ----- >
+
+// UserColumn is the column used to scope the rows of a table to a user.
+const UserColumn = "Username"
+
+// ReservedTables are the tables of the main program. Extensions can neither declare nor query them.
+var ReservedTables = []string{"Users", "FileSettings", "FileIndex", "Uploads", "UploadSessions", "Trash", "Books", "BookCovers", "EnrichmentRecords", "EnrichmentISBNs", "EnrichmentAuthors", "EnrichmentReviews", "Volumes", "SyncKeys", "SyncProgress", "Progress", "Annotations", "SearchText", "SearchDocuments", "Shelves", "ShelfBooks", "UserTags", "ApiTokens"}
+
+// IsReservedTable reports whether the table belongs to the main program.
+// Table names in SQLite are case insensitive, so they are compared that way.
+func IsReservedTable(name string) bool {
+	for _, reserved := range ReservedTables {
+		if strings.EqualFold(name, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// < ----- Helpers ----- >
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// IsIdentifier reports whether the name can be used as a table or column name.
+func IsIdentifier(name string) bool {
+	return identifier.MatchString(name)
+}
+
+// sortedKeys returns the keys of the map in sorted order, so the generated statements are stable.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]string:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case DatabaseItems:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,283 @@
+package files
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// < ----- Catalog ----- >
+
+// Book is the metadata of a book, read from the file itself.
+type Book struct {
+	Hash        string   `json:"Hash"`
+	Title       string   `json:"Title"`
+	Authors     []string `json:"Authors"`
+	Series      string   `json:"Series"`
+	SeriesIndex string   `json:"SeriesIndex"` // The position of the book in the series, like 2 or 1.5.
+	ISBN        string   `json:"ISBN"`
+	Language    string   `json:"Language"`
+	Publisher   string   `json:"Publisher"`
+	Description string   `json:"Description"`
+	Date        string   `json:"Date"`
+	Tags        []string `json:"Tags"`
+	Rating      float64  `json:"Rating"` // From 0 to 5 stars, where 0 is unrated.
+	Cover       string   `json:"Cover"`  // The URL of the cover found when the book was enriched, if it has one.
+	Source      string   `json:"Source"` // The record the book was enriched from, like calibre:12.
+	Enriched    int64    `json:"-"`      // When the book was last matched against the metadata providers, in unix time.
+}
+
+// ErrNoMetadata is returned by an Extractor when the file type has no metadata.
+var ErrNoMetadata = errors.New("the file type has no metadata")
+
+// Extractor reads the metadata of the file at the path on disk.
+type Extractor func(path string) (Book, error)
+
+// Catalog stores the metadata of the books in the Books table by the hash of the file,
+// so the metadata is only extracted once for each version of a file.
+type Catalog struct {
+	DB      *sql.DB
+	Extract Extractor // The extractor used for files that aren't in the catalog. Only stored books are returned if it's nil.
+}
+
+// InitTable creates the Books table if it doesn't exist.
+func (catalog *Catalog) InitTable() error {
+	statement, err := catalog.DB.Prepare(`
+		CREATE TABLE IF NOT EXISTS Books(
+			Hash TEXT NOT NULL PRIMARY KEY,
+			Title TEXT,
+			Authors TEXT,
+			Series TEXT,
+			SeriesIndex TEXT,
+			ISBN TEXT,
+			Language TEXT,
+			Publisher TEXT,
+			Description TEXT,
+			Date TEXT,
+			Extracted INTEGER,
+			Cover TEXT,
+			Source TEXT,
+			Enriched INTEGER,
+			Tags TEXT,
+			Rating REAL
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		return err
+	}
+	// Catalogs created before books were enriched or imported from Calibre lack the newer columns.
+	err = addColumns(catalog.DB, "Books", map[string]string{"Cover": "TEXT", "Source": "TEXT", "Enriched": "INTEGER", "Tags": "TEXT", "Rating": "REAL"})
+	if err != nil {
+		return err
+	}
+	statement, err = catalog.DB.Prepare(`
+		CREATE TABLE IF NOT EXISTS BookCovers(
+			Hash TEXT NOT NULL PRIMARY KEY,
+			MediaType TEXT,
+			Data BLOB
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec()
+	return err
+}
+
+// Lookup returns the book with the given hash. sql.ErrNoRows is returned if the book isn't in the catalog.
+func (catalog *Catalog) Lookup(hash string) (Book, error) {
+	book := Book{}
+	authors := ""
+	var cover, source, tags sql.NullString
+	var enriched sql.NullInt64
+	var rating sql.NullFloat64
+	result := catalog.DB.QueryRow("SELECT Hash, Title, Authors, Series, SeriesIndex, ISBN, Language, Publisher, Description, Date, Cover, Source, Enriched, Tags, Rating FROM Books WHERE Hash=$1", hash)
+	err := result.Scan(&book.Hash, &book.Title, &authors, &book.Series, &book.SeriesIndex, &book.ISBN, &book.Language, &book.Publisher, &book.Description, &book.Date, &cover, &source, &enriched, &tags, &rating)
+	if err != nil {
+		return Book{}, err
+	}
+	book.Cover, book.Source, book.Enriched, book.Rating = cover.String, source.String, enriched.Int64, rating.Float64
+	err = json.Unmarshal([]byte(authors), &book.Authors)
+	if err != nil {
+		book.Authors = []string{}
+	}
+	err = json.Unmarshal([]byte(tags.String), &book.Tags)
+	if err != nil {
+		book.Tags = []string{}
+	}
+	return book, nil
+}
+
+// Store inserts the book, or replaces it if the hash is already in the catalog.
+func (catalog *Catalog) Store(book Book) error {
+	if book.Authors == nil {
+		book.Authors = []string{}
+	}
+	if book.Tags == nil {
+		book.Tags = []string{}
+	}
+	authors, err := json.Marshal(book.Authors)
+	if err != nil {
+		return err
+	}
+	tags, err := json.Marshal(book.Tags)
+	if err != nil {
+		return err
+	}
+	statement, err := catalog.DB.Prepare(`
+		INSERT OR REPLACE INTO Books (Hash, Title, Authors, Series, SeriesIndex, ISBN, Language, Publisher, Description, Date, Extracted, Cover, Source, Enriched, Tags, Rating)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(book.Hash, book.Title, string(authors), book.Series, book.SeriesIndex, book.ISBN, book.Language, book.Publisher, book.Description, book.Date, time.Now().Unix(), book.Cover, book.Source, book.Enriched, string(tags), book.Rating)
+	return err
+}
+
+// Unenriched returns the hashes of the books that haven't been matched against the metadata providers.
+func (catalog *Catalog) Unenriched() ([]string, error) {
+	result, err := catalog.DB.Query("SELECT Hash FROM Books WHERE Enriched IS NULL OR Enriched=0")
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	var hashes []string
+	for result.Next() {
+		var hash string
+		if err := result.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, result.Err()
+}
+
+// MarkEnriched records that the book has been matched against the metadata providers, so it isn't matched again.
+func (catalog *Catalog) MarkEnriched(hash string) error {
+	statement, err := catalog.DB.Prepare("UPDATE Books SET Enriched=$1 WHERE Hash=$2")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(time.Now().Unix(), hash)
+	return err
+}
+
+// ResetUnmatched lets the books that weren't enriched from any record be matched again, like when new records have been imported.
+func (catalog *Catalog) ResetUnmatched() error {
+	statement, err := catalog.DB.Prepare("UPDATE Books SET Enriched=0 WHERE Source IS NULL OR Source=''")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec()
+	return err
+}
+
+// StoreCover stores the cover image of the book, replacing the cover it had.
+func (catalog *Catalog) StoreCover(hash string, mediaType string, data []byte) error {
+	statement, err := catalog.DB.Prepare("INSERT OR REPLACE INTO BookCovers (Hash, MediaType, Data) VALUES (?,?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(hash, mediaType, data)
+	return err
+}
+
+// Cover returns the cover image of the book and its media type. sql.ErrNoRows is returned if the book has no cover.
+func (catalog *Catalog) Cover(hash string) ([]byte, string, error) {
+	var data []byte
+	var mediaType string
+	err := catalog.DB.QueryRow("SELECT Data, MediaType FROM BookCovers WHERE Hash=$1", hash).Scan(&data, &mediaType)
+	return data, mediaType, err
+}
+
+// addColumns adds the columns missing from the table, given by name and type.
+func addColumns(DB *sql.DB, table string, columns map[string]string) error {
+	existing, err := tableColumns(DB, table)
+	if err != nil {
+		return err
+	}
+	for name, columnType := range columns {
+		if existing[name] {
+			continue
+		}
+		_, err := DB.Exec("ALTER TABLE " + table + " ADD COLUMN " + name + " " + columnType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the names of the columns of the table.
+func tableColumns(DB *sql.DB, table string) (map[string]bool, error) {
+	result, err := DB.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	columns := make(map[string]bool)
+	for result.Next() {
+		var id, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := result.Scan(&id, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, result.Err()
+}
+
+// Book returns the book of the file at the path on disk with the given hash, and extracts it if it isn't in the catalog.
+// nil is returned if the file type has no metadata. A file the metadata can't be read from is stored without metadata,
+// so it isn't read again until the file changes.
+func (catalog *Catalog) Book(path string, hash string) (*Book, error) {
+	book, err := catalog.Lookup(hash)
+	if err == nil {
+		return &book, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+	if catalog.Extract == nil {
+		return nil, nil
+	}
+	book, err = catalog.extract(path)
+	if err == ErrNoMetadata {
+		return nil, nil
+	}
+	if err != nil {
+		fmt.Println("Error reading the metadata of", path+":", err.Error())
+		book = Book{}
+	}
+	book.Hash = hash
+	if book.Authors == nil {
+		book.Authors = []string{}
+	}
+	if book.Tags == nil {
+		book.Tags = []string{}
+	}
+	err = catalog.Store(book)
+	if err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// extract reads the metadata of the file. A panic of the extractor is returned as an error,
+// so a broken file is stored without metadata instead of stopping the server.
+func (catalog *Catalog) extract(path string) (book Book, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			book, err = Book{}, fmt.Errorf("files: reading the metadata failed: %v", r)
+		}
+	}()
+	return catalog.Extract(path)
+}
@@ -1,14 +1,20 @@
 package files
 
 import (
+	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/sger/go-hashdir"
 )
@@ -25,6 +31,9 @@ type File struct {
 	FileSetting FileSetting `json:"FileSetting"`
 	Hash        string      `json:"Hash"`
 	User        string      `json:"User"`
+	Volume      string      `json:"Volume"`
+	Thumbnail   string      `json:"Thumbnail"` // The URL of the thumbnail, if the file type has one.
+	Book        *Book       `json:"Book"`      // The metadata of the book, if the file type has metadata.
 }
 
 // Files is a array of containing multiple instances of file.
@@ -69,21 +78,75 @@ func (file *File) FileSizeToSI() {
 		float64(file.Size)/float64(div), "kMGTPE"[exp])
 }
 
+// < ----- Hashing ----- >
+
+// HashMode selects how the files of a volume are hashed.
+type HashMode string
+
+const (
+	// FullHash hashes the whole file.
+	FullHash HashMode = "full"
+	// PartialHash hashes the head and the tail of the file together with its size.
+	// Files smaller than two chunks are hashed fully, so they get the same hash in both modes.
+	PartialHash HashMode = "partial"
+)
+
+// hashBufferSize is the size of the buffer used to stream files through the hasher.
+const hashBufferSize = 64 * 1024
+
+// PartialHashChunk is the number of bytes hashed from both the head and the tail of a file in the PartialHash mode.
+const PartialHashChunk = 4 * 1024 * 1024
+
 // CreateFileHash creates a sha256 hash of the given file.
+// The file is streamed through the hasher, so only a small buffer is kept in memory.
 func (file *File) CreateFileHash() (string, error) {
+	reader, err := os.Open(file.Path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	hasher := sha256.New()
+	_, err = io.CopyBuffer(hasher, reader, make([]byte, hashBufferSize))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// CreatePartialHash creates a sha256 hash of the first and last PartialHashChunk bytes of the file and its size.
+// It is much faster than CreateFileHash for huge files, but does not notice changes in the middle of the file.
+func (file *File) CreatePartialHash() (string, error) {
+	reader, err := os.Open(file.Path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	info, err := reader.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	if size <= 2*PartialHashChunk {
+		return file.CreateFileHash()
+	}
 	hasher := sha256.New()
-	bytes, err := ioutil.ReadFile(file.Path)
-	hasher.Write(bytes)
+	buffer := make([]byte, hashBufferSize)
+	_, err = io.CopyBuffer(hasher, io.NewSectionReader(reader, 0, PartialHashChunk), buffer)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.CopyBuffer(hasher, io.NewSectionReader(reader, size-PartialHashChunk, PartialHashChunk), buffer)
 	if err != nil {
 		return "", err
 	}
+	hasher.Write([]byte(strconv.FormatInt(size, 10)))
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 // ToString creates a string representation of the file structure.
 func (file *File) ToString() string {
 	return "Name: " + file.Name +
-		"\nSize: " + string(file.Size) +
+		"\nSize: " + strconv.FormatInt(file.Size, 10) +
 		"\nPath: " + file.Path +
 		"\nExtension: " + file.Extension +
 		"\nIsDir: " + strconv.FormatBool(file.IsDir) +
@@ -167,59 +230,403 @@ func (settings *FileSettings) ToMap() map[string]FileSetting {
 
 // Volume contains the information about a given volume.
 type Volume struct {
-	Name string
-	Path string
-	Size int64
+	Name  string `json:"Name"`
+	Path  string `json:"-"`
+	Route string `json:"Route"` // The route the files of the volume are served from.
+	Size  int64  `json:"Size"`
+	Index *Index `json:"-"` // The index used to cache the hashes of the files. The files are hashed on every listing if it's nil.
+	// HashMode is how the files of the volume are hashed. Changing it gives changed files a new hash,
+	// while unchanged files keep the hash stored in the index.
+	HashMode HashMode `json:"HashMode"`
+	// Thumbnails gives the files of the volume a thumbnail. The files don't have thumbnails if it's nil.
+	Thumbnails Thumbnailer `json:"-"`
+	// Catalog gives the books of the volume their metadata. The files have no metadata if it's nil.
+	Catalog *Catalog `json:"-"`
+	// Library is the kind of library the volume was imported from, like calibre. It's empty for plain folders.
+	Library string `json:"Library"`
+}
+
+// Thumbnailer returns the URL of the thumbnail of the file at the path with the given hash.
+// An empty string is returned if the file type has no thumbnail.
+type Thumbnailer interface {
+	Thumbnail(path string, hash string) string
+}
+
+// UploadFolder is the hidden folder in the root of a volume where unfinished uploads are stored.
+const UploadFolder = ".uploads"
+
+// TrashFolder is the hidden folder in the root of a volume where deleted files are kept until the trash is emptied.
+const TrashFolder = ".trash"
+
+// HiddenFolders are the folders in the root of a volume used by the server, which are left out of listings.
+var HiddenFolders = []string{UploadFolder, TrashFolder}
+
+// IsHidden reports whether the path relative to the volume is inside one of the HiddenFolders.
+func IsHidden(path string) bool {
+	for _, folder := range HiddenFolders {
+		if path == "/"+folder || strings.HasPrefix(path, "/"+folder+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 // Volumes is a array of containing multiple instances of Volume.
 type Volumes []Volume
 
-// WalkFolder takes in a path to a folder and returns a list of all the files inside the folder.
+// ShelvesVolume is the name of the virtual volume the shelves of the user are listed in as folders.
+const ShelvesVolume = "Shelves"
+
+// ErrShelvesVolume is returned when a volume is given the name of the virtual volume of the shelves.
+var ErrShelvesVolume = errors.New("the volume name " + strconv.Quote(ShelvesVolume) + " is used for the shelves")
+
+// ParseVolumes parses a comma separated list of name=path pairs into volumes.
+// Each volume is served under /volume/<name>.
+func ParseVolumes(list string) (Volumes, error) {
+	var volumes Volumes
+	for _, pair := range strings.Split(list, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.New("invalid volume " + strconv.Quote(pair) + ", expected name=path")
+		}
+		name := strings.TrimSpace(parts[0])
+		if name == ShelvesVolume {
+			return nil, ErrShelvesVolume
+		}
+		if _, err := volumes.Get(name); err == nil {
+			return nil, errors.New("the volume " + strconv.Quote(name) + " is declared twice")
+		}
+		volumes = append(volumes, Volume{
+			Name:     name,
+			Path:     strings.TrimRight(strings.TrimSpace(parts[1]), "/"),
+			Route:    "/volume/" + url.PathEscape(name),
+			HashMode: FullHash,
+		})
+	}
+	if len(volumes) == 0 {
+		return nil, errors.New("no volumes declared")
+	}
+	return volumes, nil
+}
+
+// Get returns the volume with the given name. If the name is empty the first volume is returned.
+func (volumes Volumes) Get(name string) (*Volume, error) {
+	if name == "" && len(volumes) > 0 {
+		return &volumes[0], nil
+	}
+	for i := range volumes {
+		if volumes[i].Name == name {
+			return &volumes[i], nil
+		}
+	}
+	return nil, &UnknownVolumeError{Name: name}
+}
+
+// UnknownVolumeError is returned when no volume with the given name exists.
+type UnknownVolumeError struct {
+	Name string
+}
+
+func (err *UnknownVolumeError) Error() string {
+	return "unknown volume: " + strconv.Quote(err.Name)
+}
+
+// WalkFolder takes in a path to a folder relative to the volume and returns a list of all the files inside the folder.
+// The path of each file is relative to the volume. The hashes are served from the index when the volume has one.
 func (volume *Volume) WalkFolder(path string) (Files, error) {
 	var files Files
-	path = volume.CleanPath(path) + "/"
-	filesInfo, err := ioutil.ReadDir(path)
+	folder, err := volume.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool)
+	filesInfo, err := ioutil.ReadDir(folder)
 	if err != nil {
 		return nil, err
 	}
 	for _, info := range filesInfo {
-		IsDir := info.IsDir()
-		Size := info.Size()
-		Path := path + info.Name()
-		var file File
-		if !IsDir {
-			Extension := filepath.Ext(path + info.Name())
-			Name := strings.Split(info.Name(), Extension)[0]
-			file = File{Name: Name, Path: Path, Size: Size, IsDir: IsDir, Extension: Extension}
-			file.FileSizeToSI()
-			Hash, err := file.CreateFileHash()
-			if err != nil {
-				return nil, err
-			}
-			file.Hash = Hash
-			file.Path = file.CleanPath(volume.Path)
-		} else {
-			Name := info.Name()
-			fcount, err := ioutil.ReadDir(Path)
+		entry := filepath.Join(folder, info.Name())
+		if IsHidden(volume.Rel(entry)) {
+			continue
+		}
+		// Symlinks are only followed if they stay inside the volume.
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := volume.Resolve(volume.Rel(entry))
 			if err != nil {
-				return nil, err
+				continue
 			}
-			file = File{Name: Name, Path: Path, Size: Size, IsDir: IsDir, FileCount: len(fcount)}
-			Hash, err := hashdir.Create(file.Path, "sha256")
+			info, err = os.Stat(target)
 			if err != nil {
-				return nil, err
+				continue
 			}
-			file.Hash = Hash
-			file.Path = file.CleanPath(volume.Path)
 		}
+		file, err := volume.newFile(entry, info)
+		if err != nil {
+			return nil, err
+		}
+		keep[file.Path] = true
 		files = append(files, file)
 	}
+	if volume.Index != nil {
+		err = volume.Index.Prune(volume.Name, volume.Rel(folder), keep)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return files, nil
 }
 
-// CleanPath cleans the path so the user cannot escape outside the specifiede volume
-func (volume *Volume) CleanPath(path string) string {
-	path = strings.Replace(path, "../", "", -1)
-	return strings.Replace(path, "..", "", -1)
+// Stat returns the file or folder at the path relative to the volume.
+func (volume *Volume) Stat(path string) (File, error) {
+	resolved, err := volume.Resolve(path)
+	if err != nil {
+		return File{}, err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return File{}, err
+	}
+	return volume.newFile(resolved, info)
+}
+
+// newFile creates the file structure for the path on disk. The path of the file is made relative to the volume.
+func (volume *Volume) newFile(path string, info os.FileInfo) (File, error) {
+	var file File
+	if !info.IsDir() {
+		Extension := filepath.Ext(path)
+		Name := strings.Split(filepath.Base(path), Extension)[0]
+		file = File{Name: Name, Path: path, Size: info.Size(), IsDir: false, Extension: Extension}
+		file.FileSizeToSI()
+		Hash, err := volume.hash(volume.Rel(path), info, func() (string, error) {
+			return volume.HashFile(&file)
+		})
+		if err != nil {
+			return File{}, err
+		}
+		if volume.Index != nil {
+			// The digest lets KOReader find the file when it syncs the progress.
+			_, err = volume.Index.Digest(volume.Name, volume.Rel(path), path)
+			if err != nil {
+				return File{}, err
+			}
+		}
+		file.Hash = Hash
+		if volume.Thumbnails != nil {
+			file.Thumbnail = volume.Thumbnails.Thumbnail(path, Hash)
+		}
+		if volume.Catalog != nil {
+			file.Book, err = volume.Catalog.Book(path, Hash)
+			if err != nil {
+				return File{}, err
+			}
+		}
+	} else {
+		Name := filepath.Base(path)
+		fcount, err := ioutil.ReadDir(path)
+		if err != nil {
+			return File{}, err
+		}
+		file = File{Name: Name, Path: path, Size: info.Size(), IsDir: true, FileCount: len(fcount)}
+		Hash, err := volume.hash(volume.Rel(path), info, func() (string, error) {
+			return hashdir.Create(file.Path, "sha256")
+		})
+		if err != nil {
+			return File{}, err
+		}
+		file.Hash = Hash
+	}
+	file.Path = volume.Rel(path)
+	file.Volume = volume.Name
+	return file, nil
+}
+
+// PartialMD5 returns the digest KOReader identifies documents by, which is an md5 hash of 1 KB samples
+// taken at the start of the file and at 1 KB times the powers of 4 up to 1 GB.
+func PartialMD5(path string) (string, error) {
+	reader, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	hasher := md5.New()
+	sample := make([]byte, 1024)
+	for i := -1; i <= 10; i++ {
+		var offset int64
+		if i >= 0 {
+			offset = 1024 << uint(2*i)
+		}
+		n, err := reader.ReadAt(sample, offset)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n == 0 {
+			break
+		}
+		hasher.Write(sample[:n])
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// HashFile creates the hash of the file using the HashMode of the volume.
+func (volume *Volume) HashFile(file *File) (string, error) {
+	if volume.HashMode == PartialHash {
+		return file.CreatePartialHash()
+	}
+	return file.CreateFileHash()
+}
+
+// hash returns the hash of the file from the index, or creates it if the volume has no index.
+// The hash of a folder is only created again when the folder itself changes, not when a file deeper down changes.
+func (volume *Volume) hash(path string, info os.FileInfo, create func() (string, error)) (string, error) {
+	if volume.Index == nil {
+		return create()
+	}
+	return volume.Index.Hash(volume.Name, path, info, create)
+}
+
+// < ----- Path Confinement ----- >
+
+// ErrOutsideVolume is returned when a path resolves to a location outside of the volume.
+var ErrOutsideVolume = errors.New("the path is outside of the volume")
+
+// ErrInvalidPath is returned for paths that no file can have, like paths with a NUL byte.
+var ErrInvalidPath = errors.New("the path is invalid")
+
+// ErrTooManyLinks is returned when resolving a path follows more than maxLinks symlinks, like a symlink pointing at itself.
+var ErrTooManyLinks = errors.New("too many links in the path")
+
+// Resolve resolves a path relative to the volume to a path on disk.
+// The path is cleaned and symlinks are resolved, and if the result is not inside the volume ErrOutsideVolume is returned.
+// The path does not need to exist, in which case the deepest existing parent is used to resolve symlinks.
+func (volume *Volume) Resolve(path string) (string, error) {
+	if strings.ContainsRune(path, 0) {
+		return "", ErrInvalidPath
+	}
+	// Paths that are still percent encoded are rejected if the decoded path would escape the volume.
+	decoded := path
+	for i := 0; i < 3; i++ {
+		unescaped, err := url.PathUnescape(decoded)
+		if err != nil || unescaped == decoded {
+			break
+		}
+		decoded = unescaped
+		if escapesRoot(decoded) {
+			return "", ErrOutsideVolume
+		}
+	}
+	if escapesRoot(path) {
+		return "", ErrOutsideVolume
+	}
+	relative := strings.TrimLeft(filepath.FromSlash(path), string(filepath.Separator)+"/")
+	if filepath.IsAbs(relative) || filepath.VolumeName(relative) != "" {
+		return "", ErrOutsideVolume
+	}
+	root, err := volume.Root()
+	if err != nil {
+		return "", err
+	}
+	resolved, err := evalExistingSymlinks(filepath.Join(root, relative))
+	if err != nil {
+		return "", err
+	}
+	if !isInside(root, resolved) {
+		return "", ErrOutsideVolume
+	}
+	return resolved, nil
+}
+
+// Root returns the absolute path of the volume with all symlinks resolved.
+func (volume *Volume) Root() (string, error) {
+	root, err := filepath.Abs(volume.Path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(root)
+}
+
+// Rel returns the path relative to the volume, using forward slashes and a leading slash.
+func (volume *Volume) Rel(path string) string {
+	root, err := volume.Root()
+	if err != nil {
+		return "/"
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+// escapesRoot reports whether the path climbs above the root with .. elements.
+func escapesRoot(path string) bool {
+	depth := 0
+	for _, element := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		switch element {
+		case ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// isInside reports whether the path is the root or inside the root.
+func isInside(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// maxLinks is how many symlinks are followed while resolving a path, like the limit of the system.
+const maxLinks = 255
+
+// evalExistingSymlinks resolves the symlinks of the deepest existing part of the path, and appends the rest of the path.
+// Symlinks pointing at missing files are followed to where they point, since a file written through them is created there.
+func evalExistingSymlinks(path string) (string, error) {
+	rest := ""
+	links := 0
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			// The error of EvalSymlinks for a loop can't be told apart from others, unlike the error of Stat.
+			if _, statErr := os.Stat(path); errors.Is(statErr, syscall.ELOOP) {
+				return "", ErrTooManyLinks
+			}
+			return "", err
+		}
+		if info, lstatErr := os.Lstat(path); lstatErr == nil && info.Mode()&os.ModeSymlink != 0 {
+			links++
+			if links > maxLinks {
+				return "", ErrTooManyLinks
+			}
+			target, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			path = target
+			continue
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
 }
@@ -0,0 +1,139 @@
+package files
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// volume returns a volume in a temporary folder, next to a folder outside of it. The volume has a book in a folder,
+// and symlinks to the folder, to the outside, and to missing files inside and outside.
+func volume(t *testing.T) (*Volume, string, string) {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "volume")
+	outside := filepath.Join(base, "outside")
+	for _, folder := range []string{filepath.Join(root, "books"), outside} {
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "books", "book.pdf"), []byte("book"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"shelf":          "books",
+		"absolute-shelf": filepath.Join(root, "books"),
+		"out":            outside,
+		"relative-out":   filepath.Join("..", "outside"),
+		"missing":        "books/missing.pdf",
+		"missing-out":    filepath.Join(outside, "missing.pdf"),
+		"missing-folder": filepath.Join(outside, "missing"),
+		"chain":          "missing-out",
+		"loop":           "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skip("symlinks aren't supported:", err)
+		}
+	}
+	return &Volume{Name: "Test", Path: root}, root, outside
+}
+
+func TestResolve(t *testing.T) {
+	volume, root, outside := volume(t)
+	tests := []struct {
+		path string
+		want string // Relative to the root, empty if the path is refused.
+		err  error  // The error of a refused path, ErrOutsideVolume if nil.
+	}{
+		{path: "/", want: "."},
+		{path: "", want: "."},
+		{path: "/books/book.pdf", want: "books/book.pdf"},
+		{path: "books/new.pdf", want: "books/new.pdf"},
+		{path: "/books/../books/book.pdf", want: "books/book.pdf"},
+		{path: "/new/folder/book.pdf", want: "new/folder/book.pdf"},
+		{path: "/.."},
+		{path: "/../volume/books/book.pdf"},
+		{path: "/books/../../outside"},
+		{path: "..\\outside"},
+		{path: "/%2e%2e/outside"},
+		{path: "/%252e%252e/outside"},
+		{path: "/books/\x00", err: ErrInvalidPath},
+		{path: "/etc/passwd", want: "etc/passwd"},
+		{path: "//etc/passwd", want: "etc/passwd"},
+		{path: "/shelf/book.pdf", want: "books/book.pdf"},
+		{path: "/absolute-shelf/new.pdf", want: "books/new.pdf"},
+		{path: "/out"},
+		{path: "/out/new.pdf"},
+		{path: "/relative-out/new.pdf"},
+		{path: "/missing", want: "books/missing.pdf"},
+		{path: "/missing-out"},
+		{path: "/missing-folder/new.pdf"},
+		{path: "/chain"},
+		{path: "/loop", err: ErrTooManyLinks},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			resolved, err := volume.Resolve(test.path)
+			if test.want == "" {
+				want := test.err
+				if want == nil {
+					want = ErrOutsideVolume
+				}
+				if !errors.Is(err, want) {
+					t.Fatalf("resolved to %q, %v, want %v", resolved, err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(root, test.want); resolved != want {
+				t.Errorf("resolved to %s, want %s", resolved, want)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(outside, "missing.pdf")); !os.IsNotExist(err) {
+		t.Error("a file was created outside of the volume")
+	}
+}
+
+// hashSizes are the sizes of the files the hashes are benchmarked on, from a small epub to a large scanned pdf.
+// The partial hash only differs from the full hash above 2*PartialHashChunk.
+var hashSizes = []int{64 << 10, 1 << 20, 16 << 20, 64 << 20}
+
+// benchmarkHash runs the hash on files of each of the hashSizes.
+func benchmarkHash(b *testing.B, hash func(file *File) (string, error)) {
+	random := rand.New(rand.NewSource(1))
+	for _, size := range hashSizes {
+		data := make([]byte, size)
+		random.Read(data)
+		path := filepath.Join(b.TempDir(), "book.pdf")
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(strconv.Itoa(size>>10)+"KiB", func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if _, err := hash(&File{Path: path}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCreateFileHash(b *testing.B) {
+	benchmarkHash(b, (*File).CreateFileHash)
+}
+
+func BenchmarkCreatePartialHash(b *testing.B) {
+	benchmarkHash(b, (*File).CreatePartialHash)
+}
@@ -0,0 +1,335 @@
+package files
+
+import (
+	"database/sql"
+	"os"
+	"path"
+	"time"
+)
+
+// < ----- Index ----- >
+
+// Index is a cache of the hashes of the files in the volumes, stored in the FileIndex table.
+// A file is only hashed again when its size or modification time changes, so the hashes stay stable
+// and the progress stored by hash is kept.
+type Index struct {
+	DB             *sql.DB
+	ProgressTables []string // The tables storing progress with a Hash and a Path column, which are updated when files move.
+}
+
+// IndexEntry is a single file or folder in the index.
+type IndexEntry struct {
+	Volume  string `json:"Volume"`
+	Path    string `json:"Path"` // The path relative to the volume.
+	Size    int64  `json:"Size"`
+	ModTime int64  `json:"ModTime"` // Unix time in nanoseconds.
+	IsDir   bool   `json:"IsDir"`
+	Hash    string `json:"Hash"`
+	Digest  string `json:"Digest"` // The partial MD5 KOReader identifies the file by. It's empty until it has been computed.
+}
+
+// InitTable creates the FileIndex table if it doesn't exist.
+func (index *Index) InitTable() error {
+	statement, err := index.DB.Prepare(`
+		CREATE TABLE IF NOT EXISTS FileIndex(
+			ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			Volume TEXT,
+			Path TEXT,
+			Size INTEGER,
+			ModTime INTEGER,
+			IsDir INTEGER,
+			Hash TEXT,
+			UNIQUE(Volume, Path)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		return err
+	}
+	// Indexes created before the files were synced with KOReader or searched lack the digests and the added times.
+	err = addColumns(index.DB, "FileIndex", map[string]string{"Digest": "TEXT", "Added": "INTEGER"})
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		`CREATE INDEX IF NOT EXISTS FileIndexHash ON FileIndex(Hash);`,
+		`CREATE INDEX IF NOT EXISTS FileIndexDigest ON FileIndex(Digest);`,
+	} {
+		statement, err = index.DB.Prepare(query)
+		if err != nil {
+			return err
+		}
+		_, err = statement.Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup returns the entry of the given path. sql.ErrNoRows is returned if the path isn't indexed.
+func (index *Index) Lookup(volume string, path string) (IndexEntry, error) {
+	entry := IndexEntry{}
+	var digest sql.NullString
+	result := index.DB.QueryRow("SELECT Volume, Path, Size, ModTime, IsDir, Hash, Digest FROM FileIndex WHERE Volume=$1 AND Path=$2", volume, path)
+	err := result.Scan(&entry.Volume, &entry.Path, &entry.Size, &entry.ModTime, &entry.IsDir, &entry.Hash, &digest)
+	entry.Digest = digest.String
+	return entry, err
+}
+
+// LookupHash returns the entries with the given hash.
+func (index *Index) LookupHash(hash string) ([]IndexEntry, error) {
+	return index.lookupFiles("Hash", hash)
+}
+
+// LookupDigest returns the entries with the given KOReader digest.
+func (index *Index) LookupDigest(digest string) ([]IndexEntry, error) {
+	return index.lookupFiles("Digest", digest)
+}
+
+// lookupFiles returns the files where the column has the value.
+func (index *Index) lookupFiles(column string, value string) ([]IndexEntry, error) {
+	result, err := index.DB.Query("SELECT Volume, Path, Size, ModTime, IsDir, Hash, Digest FROM FileIndex WHERE "+column+"=$1 AND IsDir=0", value)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	var entries []IndexEntry
+	for result.Next() {
+		entry := IndexEntry{}
+		var digest sql.NullString
+		err := result.Scan(&entry.Volume, &entry.Path, &entry.Size, &entry.ModTime, &entry.IsDir, &entry.Hash, &digest)
+		if err != nil {
+			return nil, err
+		}
+		entry.Digest = digest.String
+		entries = append(entries, entry)
+	}
+	return entries, result.Err()
+}
+
+// Store inserts the entry, or updates it if the path is already indexed. The time a path is first indexed is kept as when it was added.
+func (index *Index) Store(entry IndexEntry) error {
+	statement, err := index.DB.Prepare(`
+		INSERT INTO FileIndex (Volume, Path, Size, ModTime, IsDir, Hash, Digest, Added) VALUES (?,?,?,?,?,?,?,?)
+		ON CONFLICT(Volume, Path) DO UPDATE SET Size=excluded.Size, ModTime=excluded.ModTime, IsDir=excluded.IsDir, Hash=excluded.Hash, Digest=excluded.Digest
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(entry.Volume, entry.Path, entry.Size, entry.ModTime, entry.IsDir, entry.Hash, entry.Digest, time.Now().Unix())
+	return err
+}
+
+// Digest returns the KOReader digest of the indexed file at the path, where disk is the path of the file on disk.
+// The digest is computed and stored if the file doesn't have one yet.
+func (index *Index) Digest(volume string, path string, disk string) (string, error) {
+	entry, err := index.Lookup(volume, path)
+	if err != nil {
+		return "", err
+	}
+	if entry.Digest != "" || entry.IsDir {
+		return entry.Digest, nil
+	}
+	digest, err := PartialMD5(disk)
+	if err != nil {
+		return "", err
+	}
+	statement, err := index.DB.Prepare("UPDATE FileIndex SET Digest=$1 WHERE Volume=$2 AND Path=$3")
+	if err != nil {
+		return "", err
+	}
+	_, err = statement.Exec(digest, volume, path)
+	return digest, err
+}
+
+// Remove removes the path and everything below it from the index.
+func (index *Index) Remove(volume string, path string) error {
+	statement, err := index.DB.Prepare("DELETE FROM FileIndex WHERE Volume=$1 AND (Path=$2 OR substr(Path, 1, length($2)+1)=$2 || '/')")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(volume, path)
+	return err
+}
+
+// Move updates the path of the entry and everything below it, so moved files keep their hashes without being hashed again.
+func (index *Index) Move(volume string, oldPath string, newPath string) error {
+	// Entries left behind at the new path are stale, as the path was free when the file was moved.
+	err := index.Remove(volume, newPath)
+	if err != nil {
+		return err
+	}
+	statement, err := index.DB.Prepare("UPDATE FileIndex SET Path=$1 || substr(Path, length($2)+1) WHERE Volume=$3 AND (Path=$2 OR substr(Path, 1, length($2)+1)=$2 || '/')")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(newPath, oldPath, volume)
+	return err
+}
+
+// Prune removes the entries directly inside the folder that are no longer on disk.
+// The keep map contains the paths of the files that are still in the folder.
+func (index *Index) Prune(volume string, folder string, keep map[string]bool) error {
+	prefix := folder
+	if prefix != "/" {
+		prefix += "/"
+	}
+	result, err := index.DB.Query("SELECT Path FROM FileIndex WHERE Volume=$1 AND substr(Path, 1, length($2))=$2", volume, prefix)
+	if err != nil {
+		return err
+	}
+	var removed []string
+	for result.Next() {
+		var entry string
+		if err := result.Scan(&entry); err != nil {
+			result.Close()
+			return err
+		}
+		if entry != folder && path.Dir(entry) == folder && !keep[entry] {
+			removed = append(removed, entry)
+		}
+	}
+	result.Close()
+	for _, entry := range removed {
+		if err := index.Remove(volume, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hash returns the hash of the path from the index if the size and modification time are unchanged.
+// Otherwise the hash is created with the given function and stored in the index.
+func (index *Index) Hash(volume string, path string, info os.FileInfo, create func() (string, error)) (string, error) {
+	entry, err := index.Lookup(volume, path)
+	if err == nil && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() && entry.IsDir == info.IsDir() && entry.Hash != "" {
+		return entry.Hash, nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	hash, err := create()
+	if err != nil {
+		return "", err
+	}
+	err = index.Store(IndexEntry{
+		Volume:  volume,
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		IsDir:   info.IsDir(),
+		Hash:    hash,
+	})
+	return hash, err
+}
+
+// < ----- Progress ----- >
+
+// MoveProgress updates the Path of the progress stored for a file that has been moved from one path to another in the volume.
+// Paths below the old path are moved too, so it can be used for folders. It's used after the index entries have been moved.
+func (index *Index) MoveProgress(volume string, oldPath string, newPath string) error {
+	for _, table := range index.ProgressTables {
+		columns, err := tableColumns(index.DB, table)
+		if err != nil {
+			return err
+		}
+		// Other volumes can have files at the same paths, so only the progress of the files now at the new path is moved.
+		// Progress that knows its volume is moved by the volume.
+		moved := "Hash IN (SELECT Hash FROM FileIndex WHERE Volume=$3 AND (Path=$1 OR substr(Path, 1, length($1)+1)=$1 || '/'))"
+		set := "Path=$1 || substr(Path, length($2)+1)"
+		if columns["Volume"] {
+			moved = "(Volume=$3 OR IFNULL(Volume, '')='' AND " + moved + ")"
+			set += ", Volume=$3"
+		}
+		statement, err := index.DB.Prepare("UPDATE " + table + " SET " + set + " WHERE (Path=$2 OR substr(Path, 1, length($2)+1)=$2 || '/') AND " + moved)
+		if err != nil {
+			return err
+		}
+		_, err = statement.Exec(newPath, oldPath, volume)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateProgress points the progress stored for the hash at the new path in the volume, if the file it points to is gone.
+// This is used when a file has been moved outside of the server, where only the hash is known to be the same.
+// Progress of other volumes is left alone.
+func (index *Index) MigrateProgress(volume *Volume, hash string, newPath string) error {
+	for _, table := range index.ProgressTables {
+		columns, err := tableColumns(index.DB, table)
+		if err != nil {
+			return err
+		}
+		find := "SELECT DISTINCT Path FROM " + table + " WHERE Hash=$1 AND Path<>$2"
+		args := []interface{}{hash, newPath}
+		move := "UPDATE " + table + " SET Path=$1 WHERE Hash=$2 AND Path=$3"
+		if columns["Volume"] {
+			find += " AND IFNULL(Volume, '') IN ('', $3)"
+			args = append(args, volume.Name)
+			move = "UPDATE " + table + " SET Path=$1, Volume=$2 WHERE Hash=$3 AND Path=$4 AND IFNULL(Volume, '') IN ('', $2)"
+		}
+		result, err := index.DB.Query(find, args...)
+		if err != nil {
+			return err
+		}
+		var stale []string
+		for result.Next() {
+			var oldPath string
+			if err := result.Scan(&oldPath); err != nil {
+				result.Close()
+				return err
+			}
+			stale = append(stale, oldPath)
+		}
+		result.Close()
+		for _, oldPath := range stale {
+			gone, err := index.gone(volume, oldPath, hash)
+			if err != nil {
+				return err
+			}
+			if !gone {
+				continue
+			}
+			if columns["Volume"] {
+				_, err = index.DB.Exec(move, newPath, volume.Name, hash, oldPath)
+			} else {
+				_, err = index.DB.Exec(move, newPath, hash, oldPath)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gone reports whether the file with the hash is no longer at the path in the volume. It's gone if another file
+// has been indexed at the path, or if there is nothing on disk at the path. The index alone can lag behind the disk,
+// as the watcher may index the new path of a moved file before it notices the old one is gone.
+func (index *Index) gone(volume *Volume, path string, hash string) (bool, error) {
+	entry, err := index.Lookup(volume.Name, path)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == nil && entry.Hash != hash {
+		return true, nil
+	}
+	resolved, err := volume.Resolve(path)
+	if err == ErrOutsideVolume {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Lstat(resolved)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,149 @@
+package files
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// progressIndex returns an index with a progress table that knows the volumes of the progress, like the Progress table,
+// and one that doesn't, like the tables of the extensions.
+func progressIndex(t *testing.T) *Index {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	index := &Index{DB: db, ProgressTables: []string{"Scoped", "Unscoped"}}
+	if err := index.InitTable(); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"CREATE TABLE Scoped (Username TEXT, Hash TEXT, Volume TEXT, Path TEXT)",
+		"CREATE TABLE Unscoped (Username TEXT, Hash TEXT, Path TEXT)",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return index
+}
+
+func mustExec(t *testing.T, index *Index, query string, args ...interface{}) {
+	if _, err := index.DB.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// progressPaths returns the volume and path of the progress in the table by hash.
+func progressPaths(t *testing.T, index *Index, table string) map[string]string {
+	column := "''"
+	if table == "Scoped" {
+		column = "Volume"
+	}
+	result, err := index.DB.Query("SELECT Hash, " + column + " || ':' || Path FROM " + table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Close()
+	paths := make(map[string]string)
+	for result.Next() {
+		var hash, path string
+		result.Scan(&hash, &path)
+		paths[hash] = path
+	}
+	return paths
+}
+
+func TestMoveProgress(t *testing.T) {
+	index := progressIndex(t)
+	// Both volumes have a folder at /books, and the folder of C has been moved to /shelf.
+	for _, entry := range []IndexEntry{
+		{Volume: "C", Path: "/shelf/a.pdf", Hash: "a"},
+		{Volume: "C", Path: "/shelf/sub/b.pdf", Hash: "b"},
+		{Volume: "D", Path: "/books/a.pdf", Hash: "d"},
+	} {
+		if err := index.Store(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustExec(t, index, `INSERT INTO Scoped (Hash, Volume, Path) VALUES
+		('a', 'C', '/books/a.pdf'), ('b', '', '/books/sub/b.pdf'), ('d', 'D', '/books/a.pdf'), ('e', '', '/books/e.pdf'), ('f', 'C', '/booksf.pdf')`)
+	mustExec(t, index, `INSERT INTO Unscoped (Hash, Path) VALUES ('a', '/books/a.pdf'), ('b', '/books/sub/b.pdf'), ('d', '/books/a.pdf')`)
+	if err := index.MoveProgress("C", "/books", "/shelf"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		table string
+		want  map[string]string
+	}{
+		{table: "Scoped", want: map[string]string{
+			"a": "C:/shelf/a.pdf",
+			"b": "C:/shelf/sub/b.pdf",
+			"d": "D:/books/a.pdf",
+			"e": ":/books/e.pdf",
+			"f": "C:/booksf.pdf",
+		}},
+		{table: "Unscoped", want: map[string]string{
+			"a": ":/shelf/a.pdf",
+			"b": ":/shelf/sub/b.pdf",
+			"d": ":/books/a.pdf",
+		}},
+	}
+	for _, test := range tests {
+		got := progressPaths(t, index, test.table)
+		for hash, want := range test.want {
+			if got[hash] != want {
+				t.Errorf("%s: %s is at %s, want %s", test.table, hash, got[hash], want)
+			}
+		}
+	}
+}
+
+func TestMigrateProgress(t *testing.T) {
+	index := progressIndex(t)
+	root := t.TempDir()
+	volume := &Volume{Name: "C", Path: root}
+	for _, name := range []string{"new.pdf", "kept.pdf", "replaced.pdf"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The index still has the old path of the moved file, as the watcher hasn't noticed it's gone yet.
+	for _, entry := range []IndexEntry{
+		{Volume: "C", Path: "/old.pdf", Hash: "h"},
+		{Volume: "C", Path: "/kept.pdf", Hash: "h"},
+		{Volume: "C", Path: "/replaced.pdf", Hash: "other"},
+	} {
+		if err := index.Store(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		volume string
+		path   string
+		want   string
+	}{
+		{volume: "C", path: "/old.pdf", want: "C:/new.pdf"},
+		{volume: "", path: "/gone.pdf", want: "C:/new.pdf"},
+		{volume: "C", path: "/kept.pdf", want: "C:/kept.pdf"},
+		{volume: "C", path: "/replaced.pdf", want: "C:/new.pdf"},
+		{volume: "D", path: "/old.pdf", want: "D:/old.pdf"},
+		{volume: "C", path: "/../outside.pdf", want: "C:/new.pdf"},
+	}
+	for _, test := range tests {
+		t.Run(test.volume+":"+test.path, func(t *testing.T) {
+			mustExec(t, index, "DELETE FROM Scoped")
+			mustExec(t, index, "INSERT INTO Scoped (Hash, Volume, Path) VALUES ('h', $1, $2)", test.volume, test.path)
+			if err := index.MigrateProgress(volume, "h", "/new.pdf"); err != nil {
+				t.Fatal(err)
+			}
+			if got := progressPaths(t, index, "Scoped")["h"]; got != test.want {
+				t.Errorf("the progress is at %s, want %s", got, test.want)
+			}
+		})
+	}
+}
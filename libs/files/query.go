@@ -0,0 +1,802 @@
+package files
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// < ----- Catalog search ----- >
+
+// FacetLimit is the largest number of values returned for each facet.
+const FacetLimit = 50
+
+// The facets of a catalog search.
+const (
+	FacetAuthor   = "Author"
+	FacetSeries   = "Series"
+	FacetTag      = "Tag"
+	FacetFormat   = "Format"
+	FacetLanguage = "Language"
+	FacetVolume   = "Volume"
+	FacetUserTag  = "UserTag"
+)
+
+// The orders of a catalog search. The order is reversed if it's prefixed with a minus, except for relevance.
+var Sorts = []string{"relevance", "title", "author", "series", "name", "added", "size"}
+
+// ErrInvalidCursor is returned when the cursor of a catalog search can't be read, or was made for another order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrInvalidSort is returned when a catalog search is sorted by something that isn't in Sorts.
+var ErrInvalidSort = errors.New("invalid sort")
+
+// ErrInvalidDate is returned when the added dates of a catalog search can't be read.
+var ErrInvalidDate = errors.New("invalid date")
+
+// CatalogQuery is a search of the files in the index and their metadata. Empty filters match every file,
+// and a filter with several values matches the files with any of them.
+type CatalogQuery struct {
+	Text        string   // The words to find in the title, authors, series, tags and file name. All of them have to be found.
+	Authors     []string // Filters are matched against the whole value, ignoring the case of ASCII letters.
+	Series      []string
+	Tags        []string
+	Formats     []string // Extensions without the dot, like epub.
+	Languages   []string
+	Volumes     []string
+	AddedAfter  int64    // In unix time, 0 means no limit.
+	AddedBefore int64    // In unix time, 0 means no limit.
+	Sort        string   // One of Sorts. Relevance is used if it's empty and there is text, otherwise title.
+	Cursor      string   // The Next cursor of the previous page, or empty for the first page.
+	Limit       int      // The number of files on a page, 0 returns all of them.
+	Library     []string // The volumes that are served. Files of other volumes are left out.
+	// The tags a user gave the books by hash, which are found like the tags of the books and filtered by Tagged.
+	UserTags map[string][]string
+	Tagged   []string
+}
+
+// CatalogEntry is a file found by a catalog search.
+type CatalogEntry struct {
+	Volume string  `json:"Volume"`
+	Path   string  `json:"Path"` // The path relative to the volume.
+	Hash   string  `json:"Hash"`
+	Size   int64   `json:"Size"`
+	Added  int64   `json:"Added"` // When the file was first indexed, in unix time.
+	Book   Book    `json:"Book"`  // Empty if the file has no metadata.
+	Score  float64 `json:"Score"` // How well the file matches the text, 0 if there is no text.
+	// The tags the user of the search gave the file.
+	UserTags []string `json:"UserTags"`
+
+	position cursor // The position of the file in the order of the search.
+}
+
+// FacetCount is a value of a facet and the number of files with it.
+type FacetCount struct {
+	Value string `json:"Value"`
+	Count int    `json:"Count"`
+}
+
+// CatalogResults is a page of the files found by a catalog search.
+type CatalogResults struct {
+	Entries []CatalogEntry `json:"Entries"`
+	// The values of each facet, counted among the files matching the text and the filters of the other facets,
+	// so the counts of a facet don't change when one of its own values is picked.
+	Facets map[string][]FacetCount `json:"Facets"`
+	Total  int                     `json:"Total"`
+	Next   string                  `json:"Next"` // The cursor of the next page, empty on the last page.
+}
+
+// cursor is the position of the last file of a page in the order of the search.
+type cursor struct {
+	Sort   string  `json:"s"`
+	Key    string  `json:"k"`
+	Number float64 `json:"n"`
+	Volume string  `json:"v"`
+	Path   string  `json:"p"`
+}
+
+// Search finds the files matching the query. Files that haven't been indexed yet aren't found,
+// and files without metadata are only found by their file name.
+// The filters, the order and the pages are left to SQLite. When there is text, the files passing the filters are scored here,
+// along with the files failing a single filter, which are counted in the facets.
+func (catalog *Catalog) Search(query CatalogQuery) (CatalogResults, error) {
+	order, descending, err := parseSort(query)
+	if err != nil {
+		return CatalogResults{}, err
+	}
+	var after *cursor
+	if query.Cursor != "" {
+		after, err = decodeCursor(query.Cursor, query.Sort)
+		if err != nil {
+			return CatalogResults{}, err
+		}
+	}
+	userTags, err := json.Marshal(query.UserTags)
+	if err != nil {
+		return CatalogResults{}, err
+	}
+	search := catalogSearch{query: query, order: order, descending: descending, userTags: string(userTags)}
+	search.filters = []filter{
+		{facet: FacetAuthor, values: query.Authors, condition: "EXISTS (SELECT 1 FROM json_each(Keyed.Authors) WHERE lower(value) IN (SELECT lower(value) FROM json_each(?)))"},
+		{facet: FacetSeries, values: query.Series, condition: "lower(Keyed.Series) IN (SELECT lower(value) FROM json_each(?))"},
+		{facet: FacetTag, values: query.Tags, condition: "EXISTS (SELECT 1 FROM json_each(Keyed.Tags) WHERE lower(value) IN (SELECT lower(value) FROM json_each(?)))"},
+		{facet: FacetFormat, values: query.Formats, condition: "Keyed.Format IN (SELECT lower(value) FROM json_each(?))"},
+		{facet: FacetLanguage, values: query.Languages, condition: "lower(Keyed.Language) IN (SELECT lower(value) FROM json_each(?))"},
+		{facet: FacetVolume, values: query.Volumes, condition: "lower(Keyed.Volume) IN (SELECT lower(value) FROM json_each(?))"},
+		{facet: FacetUserTag, values: query.Tagged, condition: `Keyed.Hash IN (
+			SELECT Tagged.key FROM json_each(?) AS Tagged, json_each(Tagged.value) AS Tag
+			WHERE lower(Tag.value) IN (SELECT lower(value) FROM json_each(?)))`, args: []interface{}{search.userTags}},
+	}
+	if terms := words(query.Text); len(terms) > 0 {
+		return catalog.scored(search, terms, after)
+	}
+	return catalog.sorted(search, after)
+}
+
+// catalogSearch is a catalog search being turned into SQL.
+type catalogSearch struct {
+	query      CatalogQuery
+	order      string
+	descending bool
+	filters    []filter // In the order of their bits in the failed filters of the scored files.
+	userTags   string   // The UserTags of the query in JSON.
+}
+
+// filter is a facet filter of a catalog search, as a condition on the Keyed rows. The values of the filter are the last argument.
+type filter struct {
+	facet     string
+	values    []string
+	condition string
+	args      []interface{}
+}
+
+// sql returns the condition of the filter with its arguments.
+func (filter *filter) sql() (string, []interface{}) {
+	values, _ := json.Marshal(filter.values)
+	return filter.condition, append(append([]interface{}{}, filter.args...), string(values))
+}
+
+// with returns the WITH clause of the Keyed rows, which are the files of the library with their metadata and their position
+// in the order. Folders, hidden files and files added outside of the dates are left out.
+func (search *catalogSearch) with() (string, []interface{}) {
+	library, _ := json.Marshal(search.query.Library)
+	args := []interface{}{string(library)}
+	where := "FileIndex.IsDir = 0 AND FileIndex.Volume IN (SELECT value FROM json_each(?))"
+	for _, folder := range HiddenFolders {
+		where += " AND FileIndex.Path <> ? AND substr(FileIndex.Path, 1, ?) <> ?"
+		args = append(args, "/"+folder, len(folder)+2, "/"+folder+"/")
+	}
+	// Files indexed before the added time was stored count as added when they were last changed.
+	added := "COALESCE(FileIndex.Added, FileIndex.ModTime / 1000000000)"
+	if search.query.AddedAfter > 0 {
+		where += " AND " + added + " >= ?"
+		args = append(args, search.query.AddedAfter)
+	}
+	if search.query.AddedBefore > 0 {
+		where += " AND " + added + " < ?"
+		args = append(args, search.query.AddedBefore)
+	}
+	key, number := sortColumns(search.order)
+	// The name of a file is the part of its path after the last slash, and its format the part of the name after the last dot.
+	return `
+		WITH Entries AS (
+			SELECT FileIndex.Volume, FileIndex.Path, FileIndex.Size, ` + added + ` AS Added, FileIndex.Hash,
+				Books.Title, CASE WHEN json_valid(Books.Authors) THEN Books.Authors ELSE '[]' END AS Authors,
+				Books.Series, Books.SeriesIndex, Books.Language, CASE WHEN json_valid(Books.Tags) THEN Books.Tags ELSE '[]' END AS Tags,
+				Books.Publisher, Books.Date, substr(FileIndex.Path, length(rtrim(FileIndex.Path, replace(FileIndex.Path, '/', ''))) + 1) AS Base
+			FROM FileIndex LEFT JOIN Books ON Books.Hash = FileIndex.Hash
+			WHERE ` + where + `
+		), Named AS (
+			SELECT *,
+				CASE WHEN instr(Base, '.') = 0 THEN Base ELSE substr(Base, 1, length(rtrim(Base, replace(Base, '.', ''))) - 1) END AS Name,
+				CASE WHEN instr(Base, '.') = 0 THEN '' ELSE lower(substr(Base, length(rtrim(Base, replace(Base, '.', ''))) + 1)) END AS Format
+			FROM Entries
+		), Keyed AS (
+			SELECT *, ` + key + ` AS SortKey, ` + number + ` AS SortNumber FROM Named
+		)`, args
+}
+
+// where returns the conditions of the filters of the search, except the filter of the facet.
+func (search *catalogSearch) where(except string) (string, []interface{}) {
+	where := "1"
+	var args []interface{}
+	for i := range search.filters {
+		if len(search.filters[i].values) == 0 || search.filters[i].facet == except {
+			continue
+		}
+		condition, conditionArgs := search.filters[i].sql()
+		where += " AND " + condition
+		args = append(args, conditionArgs...)
+	}
+	return where, args
+}
+
+// sortColumns returns the SQL of the key and the number the Named rows are ordered by, which make up the cursor of a page.
+// Rows are ordered by the key, then the number, then the volume and the path.
+func sortColumns(order string) (string, string) {
+	title := "lower(COALESCE(NULLIF(Title, ''), Name))"
+	switch order {
+	case "title":
+		return title, "0"
+	case "author":
+		// Books without authors come last.
+		return "COALESCE(lower(json_extract(Authors, '$[0]')), char(65535)) || char(1) || " + title, "0"
+	case "series":
+		return "COALESCE(lower(NULLIF(Series, '')), char(65535))", "COALESCE(CAST(SeriesIndex AS REAL), 0)"
+	case "name":
+		return "lower(Base)", "0"
+	case "added":
+		return "''", "Added"
+	case "size":
+		return "''", "Size"
+	}
+	// The files are ordered by their score once they are scored.
+	return "''", "0"
+}
+
+// entryColumns are the columns of the Keyed rows read by scanEntry.
+const entryColumns = "Volume, Path, Size, Added, Hash, Title, Authors, Series, SeriesIndex, Language, Tags, Publisher, Date, SortKey, SortNumber"
+
+// scanEntry reads the entryColumns of a row, followed by the extra columns.
+func scanEntry(result *sql.Rows, query CatalogQuery, extra ...interface{}) (CatalogEntry, error) {
+	entry := CatalogEntry{}
+	var hash, title, authors, series, seriesIndex, language, tags, publisher, date sql.NullString
+	err := result.Scan(append([]interface{}{&entry.Volume, &entry.Path, &entry.Size, &entry.Added, &hash,
+		&title, &authors, &series, &seriesIndex, &language, &tags, &publisher, &date, &entry.position.Key, &entry.position.Number}, extra...)...)
+	if err != nil {
+		return CatalogEntry{}, err
+	}
+	entry.position.Volume, entry.position.Path = entry.Volume, entry.Path
+	entry.Hash = hash.String
+	entry.Book = Book{Hash: hash.String, Title: title.String, Series: series.String, SeriesIndex: seriesIndex.String,
+		Language: language.String, Publisher: publisher.String, Date: date.String, Authors: []string{}, Tags: []string{}}
+	json.Unmarshal([]byte(authors.String), &entry.Book.Authors)
+	json.Unmarshal([]byte(tags.String), &entry.Book.Tags)
+	entry.UserTags = query.UserTags[entry.Hash]
+	if entry.UserTags == nil {
+		entry.UserTags = []string{}
+	}
+	return entry, nil
+}
+
+// sorted finds the files of a search without text, and counts the facets, in SQL.
+func (catalog *Catalog) sorted(search catalogSearch, after *cursor) (CatalogResults, error) {
+	with, withArgs := search.with()
+	where, whereArgs := search.where("")
+	args := append(withArgs, whereArgs...)
+	results := CatalogResults{Entries: []CatalogEntry{}, Facets: make(map[string][]FacetCount)}
+	err := catalog.DB.QueryRow(with+" SELECT COUNT(*) FROM Keyed WHERE "+where, args...).Scan(&results.Total)
+	if err != nil {
+		return CatalogResults{}, err
+	}
+
+	direction, comparison := "", ">"
+	if search.descending {
+		direction, comparison = " DESC", "<"
+	}
+	page := with + " SELECT " + entryColumns + " FROM Keyed WHERE " + where
+	if after != nil {
+		page += " AND (SortKey, SortNumber, Volume, Path) " + comparison + " (?, ?, ?, ?)"
+		args = append(args, after.Key, after.Number, after.Volume, after.Path)
+	}
+	page += " ORDER BY SortKey" + direction + ", SortNumber" + direction + ", Volume" + direction + ", Path" + direction
+	if search.query.Limit > 0 {
+		// One more file is read to know if there is a next page.
+		page += " LIMIT ?"
+		args = append(args, search.query.Limit+1)
+	}
+	result, err := catalog.DB.Query(page, args...)
+	if err != nil {
+		return CatalogResults{}, err
+	}
+	for result.Next() {
+		entry, err := scanEntry(result, search.query)
+		if err != nil {
+			result.Close()
+			return CatalogResults{}, err
+		}
+		results.Entries = append(results.Entries, entry)
+	}
+	result.Close()
+	if err := result.Err(); err != nil {
+		return CatalogResults{}, err
+	}
+	if search.query.Limit > 0 && len(results.Entries) > search.query.Limit {
+		results.Entries = results.Entries[:search.query.Limit]
+		results.Next = nextCursor(results.Entries, search.query.Sort)
+	}
+
+	for _, filter := range search.filters {
+		results.Facets[filter.facet], err = catalog.countFacet(search, filter.facet)
+		if err != nil {
+			return CatalogResults{}, err
+		}
+	}
+	return results, nil
+}
+
+// countFacet returns the most common values of the facet among the files matching the filters of the other facets.
+func (catalog *Catalog) countFacet(search catalogSearch, facet string) ([]FacetCount, error) {
+	with, args := search.with()
+	join, value := "", ""
+	switch facet {
+	case FacetAuthor:
+		join, value = "JOIN json_each(Keyed.Authors) AS Facet", "Facet.value"
+	case FacetSeries:
+		value = "NULLIF(Keyed.Series, '')"
+	case FacetTag:
+		join, value = "JOIN json_each(Keyed.Tags) AS Facet", "Facet.value"
+	case FacetFormat:
+		value = "NULLIF(Keyed.Format, '')"
+	case FacetLanguage:
+		value = "NULLIF(Keyed.Language, '')"
+	case FacetVolume:
+		value = "Keyed.Volume"
+	case FacetUserTag:
+		join, value = "JOIN json_each(?) AS Tagged ON Tagged.key = Keyed.Hash JOIN json_each(Tagged.value) AS Facet", "Facet.value"
+		args = append(args, search.userTags)
+	}
+	where, whereArgs := search.where(facet)
+	args = append(args, whereArgs...)
+	result, err := catalog.DB.Query(with+" SELECT "+value+", COUNT(*) FROM Keyed "+join+" WHERE "+value+" IS NOT NULL AND "+where+`
+		GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT `+strconv.Itoa(FacetLimit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	facets := []FacetCount{}
+	for result.Next() {
+		count := FacetCount{}
+		if err := result.Scan(&count.Value, &count.Count); err != nil {
+			return nil, err
+		}
+		facets = append(facets, count)
+	}
+	return facets, result.Err()
+}
+
+// scored finds the files of a search with text. The files passing the filters are scored and ordered here,
+// and the files failing a single filter are scored to be counted in the facet of the filter.
+func (catalog *Catalog) scored(search catalogSearch, terms []string, after *cursor) (CatalogResults, error) {
+	with, args := search.with()
+	// Each bit of Failed is a filter the file doesn't pass.
+	failed := "0"
+	for i := range search.filters {
+		if len(search.filters[i].values) == 0 {
+			continue
+		}
+		condition, conditionArgs := search.filters[i].sql()
+		failed += " + CASE WHEN " + condition + " THEN 0 ELSE " + strconv.Itoa(1<<uint(i)) + " END"
+		args = append(args, conditionArgs...)
+	}
+	text, textArgs := textFilter(terms, search.query.UserTags)
+	args = append(args, textArgs...)
+	result, err := catalog.DB.Query(with+" SELECT "+entryColumns+", Failed FROM (SELECT *, "+failed+" AS Failed FROM Keyed WHERE "+text+") WHERE (Failed & (Failed - 1)) = 0", args...)
+	if err != nil {
+		return CatalogResults{}, err
+	}
+	counts := make(map[string]map[string]int)
+	for _, filter := range search.filters {
+		counts[filter.facet] = make(map[string]int)
+	}
+	var matches []CatalogEntry
+	for result.Next() {
+		var failed int
+		entry, err := scanEntry(result, search.query, &failed)
+		if err != nil {
+			result.Close()
+			return CatalogResults{}, err
+		}
+		entry.Score = score(entry, terms)
+		if entry.Score == 0 {
+			continue
+		}
+		if search.order == "relevance" {
+			entry.position.Number = -entry.Score
+		}
+		for i, filter := range search.filters {
+			if failed&^(1<<uint(i)) != 0 {
+				continue
+			}
+			for _, value := range facetValues(entry, filter.facet) {
+				counts[filter.facet][value]++
+			}
+		}
+		if failed == 0 {
+			matches = append(matches, entry)
+		}
+	}
+	result.Close()
+	if err := result.Err(); err != nil {
+		return CatalogResults{}, err
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return compare(matches[i].position, matches[j].position, search.descending) < 0
+	})
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matches), func(i int) bool {
+			return compare(*after, matches[i].position, search.descending) < 0
+		})
+	}
+	end := start + search.query.Limit
+	if end > len(matches) || search.query.Limit <= 0 {
+		end = len(matches)
+	}
+	results := CatalogResults{Entries: matches[start:end], Facets: make(map[string][]FacetCount), Total: len(matches)}
+	if results.Entries == nil {
+		results.Entries = []CatalogEntry{}
+	}
+	if end < len(matches) {
+		results.Next = nextCursor(results.Entries, search.query.Sort)
+	}
+	for facet, values := range counts {
+		results.Facets[facet] = topFacets(values)
+	}
+	return results, nil
+}
+
+// nextCursor returns the cursor of the page after the entries.
+func nextCursor(entries []CatalogEntry, sort string) string {
+	last := entries[len(entries)-1].position
+	last.Sort = sort
+	return encodeCursor(last)
+}
+
+// ParseCatalogQuery reads a catalog search from the parameters of a URL, where the filters can be given more than once.
+// The q parameter holds the text, and author, series, tag, format, language, volume and usertag filter the files.
+// The addedAfter and addedBefore dates are written like 2006-01-02 or in unix time.
+func ParseCatalogQuery(values url.Values) (CatalogQuery, error) {
+	query := CatalogQuery{
+		Text:      values.Get("q"),
+		Authors:   nonEmpty(values["author"]),
+		Series:    nonEmpty(values["series"]),
+		Tags:      nonEmpty(values["tag"]),
+		Formats:   nonEmpty(values["format"]),
+		Languages: nonEmpty(values["language"]),
+		Volumes:   nonEmpty(values["volume"]),
+		Tagged:    nonEmpty(values["usertag"]),
+		Sort:      values.Get("sort"),
+		Cursor:    values.Get("cursor"),
+	}
+	if limit, err := strconv.Atoi(values.Get("limit")); err == nil && limit > 0 {
+		query.Limit = limit
+	}
+	var ok bool
+	query.AddedAfter, ok = parseDate(values.Get("addedAfter"))
+	if !ok {
+		return CatalogQuery{}, ErrInvalidDate
+	}
+	query.AddedBefore, ok = parseDate(values.Get("addedBefore"))
+	if !ok {
+		return CatalogQuery{}, ErrInvalidDate
+	}
+	if _, _, err := parseSort(query); err != nil {
+		return CatalogQuery{}, err
+	}
+	return query, nil
+}
+
+// parseDate parses a date written as 2006-01-02 or in unix time. An empty date is 0.
+func parseDate(date string) (int64, bool) {
+	if date == "" {
+		return 0, true
+	}
+	if parsed, err := time.Parse("2006-01-02", date); err == nil {
+		return parsed.Unix(), true
+	}
+	unix, err := strconv.ParseInt(date, 10, 64)
+	return unix, err == nil && unix >= 0
+}
+
+func nonEmpty(values []string) []string {
+	var result []string
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// Files returns the files of the entries like WalkFolder does, leaving out the files that are gone since they were indexed.
+func (volumes Volumes) Files(entries []CatalogEntry) (Files, error) {
+	files := Files{}
+	for _, entry := range entries {
+		volume, err := volumes.Get(entry.Volume)
+		if err != nil {
+			continue
+		}
+		file, err := volume.Stat(entry.Path)
+		if os.IsNotExist(err) {
+			// The watcher removes the file from the index.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// parseSort returns the order of the query and whether it's reversed.
+func parseSort(query CatalogQuery) (string, bool, error) {
+	order := query.Sort
+	if order == "" {
+		order = "title"
+		if strings.TrimSpace(query.Text) != "" {
+			order = "relevance"
+		}
+	}
+	descending := strings.HasPrefix(order, "-")
+	order = strings.TrimPrefix(order, "-")
+	for _, known := range Sorts {
+		if order == known {
+			return order, descending && order != "relevance", nil
+		}
+	}
+	return "", false, ErrInvalidSort
+}
+
+// compare returns -1, 0 or 1 as a comes before, at or after b.
+func compare(a, b cursor, descending bool) int {
+	result := strings.Compare(a.Key, b.Key)
+	if result == 0 && a.Number != b.Number {
+		result = 1
+		if a.Number < b.Number {
+			result = -1
+		}
+	}
+	if result == 0 {
+		result = strings.Compare(a.Volume, b.Volume)
+	}
+	if result == 0 {
+		result = strings.Compare(a.Path, b.Path)
+	}
+	if descending {
+		return -result
+	}
+	return result
+}
+
+func encodeCursor(position cursor) string {
+	data, _ := json.Marshal(position)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(text string, order string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(text)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	position := cursor{}
+	if json.Unmarshal(data, &position) != nil || position.Sort != order {
+		return nil, ErrInvalidCursor
+	}
+	return &position, nil
+}
+
+// facetValues returns the values the entry has for the facet.
+func facetValues(entry CatalogEntry, facet string) []string {
+	switch facet {
+	case FacetAuthor:
+		return entry.Book.Authors
+	case FacetSeries:
+		if entry.Book.Series != "" {
+			return []string{entry.Book.Series}
+		}
+	case FacetTag:
+		return entry.Book.Tags
+	case FacetFormat:
+		if extension := strings.ToLower(path.Ext(entry.Path)); extension != "" {
+			return []string{extension[1:]}
+		}
+	case FacetLanguage:
+		if entry.Book.Language != "" {
+			return []string{entry.Book.Language}
+		}
+	case FacetVolume:
+		return []string{entry.Volume}
+	case FacetUserTag:
+		return entry.UserTags
+	}
+	return nil
+}
+
+// topFacets returns the most common values, with the values of the same count in alphabetical order.
+func topFacets(values map[string]int) []FacetCount {
+	facets := []FacetCount{}
+	for value, count := range values {
+		facets = append(facets, FacetCount{Value: value, Count: count})
+	}
+	sort.Slice(facets, func(i, j int) bool {
+		if facets[i].Count != facets[j].Count {
+			return facets[i].Count > facets[j].Count
+		}
+		return facets[i].Value < facets[j].Value
+	})
+	if len(facets) > FacetLimit {
+		facets = facets[:FacetLimit]
+	}
+	return facets
+}
+
+// < ----- Matching ----- >
+
+// textFilter returns a condition on the Keyed rows that the files matching the terms pass, so the other files aren't scored.
+// Some files failing to match pass it too. A term is found in the text of the file, or with typos, a piece of it is.
+// Terms with letters SQLite doesn't lower aren't filtered.
+func textFilter(terms []string, userTags map[string][]string) (string, []interface{}) {
+	text := "lower(COALESCE(Keyed.Title, '') || ' ' || Keyed.Authors || ' ' || COALESCE(Keyed.Series, '') || ' ' || Keyed.Tags || ' ' || Keyed.Path)"
+	where := "1"
+	var args []interface{}
+	for _, term := range terms {
+		if strings.IndexFunc(term, func(r rune) bool { return r > unicode.MaxASCII }) >= 0 {
+			continue
+		}
+		var conditions []string
+		for _, piece := range pieces(term, typoLimit(term)) {
+			conditions = append(conditions, "instr("+text+", ?) > 0")
+			args = append(args, piece)
+		}
+		// The user tags aren't in the database, the files they match are found here.
+		hashes := []string{}
+		for hash, tags := range userTags {
+			for _, word := range words(strings.Join(tags, " ")) {
+				if matchWord(term, word) > 0 {
+					hashes = append(hashes, hash)
+					break
+				}
+			}
+		}
+		tagged, _ := json.Marshal(hashes)
+		conditions = append(conditions, "Keyed.Hash IN (SELECT value FROM json_each(?))")
+		args = append(args, string(tagged))
+		where += " AND (" + strings.Join(conditions, " OR ") + ")"
+	}
+	return where, args
+}
+
+// pieces splits the term into typos+1 pieces with a letter left out between them.
+// A typo changes at most one of the pieces, so a word with that many typos holds one of the pieces unchanged.
+func pieces(term string, typos int) []string {
+	if typos == 0 {
+		return []string{term}
+	}
+	var pieces []string
+	length := (len(term) - typos) / (typos + 1)
+	start := 0
+	for i := 0; i < typos; i++ {
+		pieces = append(pieces, term[start:start+length])
+		start += length + 1
+	}
+	return append(pieces, term[start:])
+}
+
+// The weights of the fields the words of a search are found in.
+var fieldWeights = []float64{3, 2, 2, 1.5, 1}
+
+// score returns how well the entry matches the words, or 0 if one of them isn't found.
+// Each word counts the most where it's a whole word, then the start of a word, then anywhere in a word,
+// and least where it's a word with a typo or two.
+func score(entry CatalogEntry, terms []string) float64 {
+	fields := [][]string{
+		words(entry.Book.Title),
+		words(strings.Join(entry.Book.Authors, " ")),
+		words(entry.Book.Series),
+		words(strings.Join(entry.Book.Tags, " ") + " " + strings.Join(entry.UserTags, " ")),
+		words(fileName(entry.Path)),
+	}
+	total := 0.0
+	for _, term := range terms {
+		best := 0.0
+		for i, field := range fields {
+			for _, word := range field {
+				if match := matchWord(term, word) * fieldWeights[i]; match > best {
+					best = match
+				}
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		total += best
+	}
+	return total
+}
+
+// matchWord returns how well the term matches the word, or 0 if it doesn't.
+func matchWord(term string, word string) float64 {
+	switch {
+	case term == word:
+		return 1
+	case strings.HasPrefix(word, term):
+		return 0.75
+	case len(term) >= 3 && strings.Contains(word, term):
+		return 0.5
+	}
+	if typos := typoLimit(term); typos > 0 && distance([]rune(term), []rune(word), typos) <= typos {
+		return 0.25
+	}
+	return 0
+}
+
+// typoLimit returns how many typos a word matching the term may have. Longer words may have more typos.
+func typoLimit(term string) int {
+	switch length := len([]rune(term)); {
+	case length >= 8:
+		return 2
+	case length >= 4:
+		return 1
+	}
+	return 0
+}
+
+// distance returns the edit distance between a and b, where swapping two letters is one edit,
+// or a number above limit if it's above the limit.
+func distance(a []rune, b []rune, limit int) int {
+	if len(a)-len(b) > limit || len(b)-len(a) > limit {
+		return limit + 1
+	}
+	before := make([]int, len(b)+1)
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		smallest := i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				current[j] = minInt(current[j], before[j-2]+1)
+			}
+			if current[j] < smallest {
+				smallest = current[j]
+			}
+		}
+		if smallest > limit {
+			return limit + 1
+		}
+		before, previous, current = previous, current, before
+	}
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	smallest := values[0]
+	for _, value := range values[1:] {
+		if value < smallest {
+			smallest = value
+		}
+	}
+	return smallest
+}
+
+// words splits the text into lower case words.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// fileName returns the name of the file without the folder and the extension.
+func fileName(file string) string {
+	return strings.TrimSuffix(path.Base(file), path.Ext(file))
+}
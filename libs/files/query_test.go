@@ -0,0 +1,140 @@
+package files
+
+import (
+	"database/sql"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// searchCatalog returns a catalog with books in two volumes of the library, and files that the searches leave out.
+func searchCatalog(t *testing.T) *Catalog {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	index := &Index{DB: db}
+	catalog := &Catalog{DB: db}
+	for _, init := range []func() error{index.InitTable, catalog.InitTable} {
+		if err := init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, entry := range []IndexEntry{
+		{Volume: "C", Path: "/dune.epub", Size: 5, Hash: "dune"},
+		{Volume: "C", Path: "/messiah.pdf", Size: 3, Hash: "messiah"},
+		{Volume: "C", Path: "/emma.epub", Size: 9, Hash: "emma"},
+		{Volume: "D", Path: "/notes/untitled.pdf", Size: 1, Hash: "untitled"},
+		{Volume: "C", Path: "/.trash/dune.epub", Size: 5, Hash: "dune"},
+		{Volume: "C", Path: "/dune", IsDir: true},
+		{Volume: "X", Path: "/dune.epub", Size: 5, Hash: "dune"},
+	} {
+		if err := index.Store(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, book := range []Book{
+		{Hash: "dune", Title: "Dune", Authors: []string{"Frank Herbert"}, Series: "Dune", SeriesIndex: "1", Tags: []string{"SF"}, Language: "en"},
+		{Hash: "messiah", Title: "Dune Messiah", Authors: []string{"Frank Herbert"}, Series: "Dune", SeriesIndex: "2", Language: "en"},
+		{Hash: "emma", Title: "Emma", Authors: []string{"Jane Austen"}, Tags: []string{"Classic"}, Language: "EN"},
+	} {
+		if err := catalog.Store(book); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return catalog
+}
+
+func TestSearch(t *testing.T) {
+	catalog := searchCatalog(t)
+	tests := []struct {
+		query  string
+		want   []string
+		facets map[string][]FacetCount // Some of the facets of the results.
+	}{
+		{query: "", want: []string{"C:/dune.epub", "C:/messiah.pdf", "C:/emma.epub", "D:/notes/untitled.pdf"}},
+		{query: "sort=-size", want: []string{"C:/emma.epub", "C:/dune.epub", "C:/messiah.pdf", "D:/notes/untitled.pdf"}},
+		{query: "sort=author", want: []string{"C:/dune.epub", "C:/messiah.pdf", "C:/emma.epub", "D:/notes/untitled.pdf"}},
+		{query: "sort=-series", want: []string{"D:/notes/untitled.pdf", "C:/emma.epub", "C:/messiah.pdf", "C:/dune.epub"}},
+		{query: "sort=name", want: []string{"C:/dune.epub", "C:/emma.epub", "C:/messiah.pdf", "D:/notes/untitled.pdf"}},
+		{query: "author=frank+herbert&sort=-title", want: []string{"C:/messiah.pdf", "C:/dune.epub"}},
+		{
+			query: "format=PDF",
+			want:  []string{"C:/messiah.pdf", "D:/notes/untitled.pdf"},
+			facets: map[string][]FacetCount{
+				FacetFormat: {{Value: "epub", Count: 2}, {Value: "pdf", Count: 2}},
+				FacetAuthor: {{Value: "Frank Herbert", Count: 1}},
+			},
+		},
+		{query: "language=en&tag=sf&tag=classic", want: []string{"C:/dune.epub", "C:/emma.epub"}},
+		{query: "usertag=FAV", want: []string{"C:/emma.epub"}, facets: map[string][]FacetCount{FacetUserTag: {{Value: "fav", Count: 1}}}},
+		{query: "volume=d", want: []string{"D:/notes/untitled.pdf"}, facets: map[string][]FacetCount{FacetVolume: {{Value: "C", Count: 3}, {Value: "D", Count: 1}}}},
+		{query: "q=dune", want: []string{"C:/dune.epub", "C:/messiah.pdf"}},
+		{query: "q=austin", want: []string{"C:/emma.epub"}},
+		{query: "q=messaih", want: []string{"C:/messiah.pdf"}},
+		{query: "q=herbrt+fav"},
+		{query: "q=fav", want: []string{"C:/emma.epub"}},
+		{query: "q=dune+messiah", want: []string{"C:/messiah.pdf"}},
+		{
+			query:  "q=dune&format=pdf&sort=-title",
+			want:   []string{"C:/messiah.pdf"},
+			facets: map[string][]FacetCount{FacetFormat: {{Value: "epub", Count: 1}, {Value: "pdf", Count: 1}}},
+		},
+		{query: "q=untitled", want: []string{"D:/notes/untitled.pdf"}},
+		{query: "q=nothing"},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			query, err := ParseCatalogQuery(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query.Library = []string{"C", "D"}
+			query.UserTags = map[string][]string{"emma": {"fav"}}
+			results, err := catalog.Search(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := paths(results.Entries); strings.Join(got, " ") != strings.Join(test.want, " ") || results.Total != len(test.want) {
+				t.Errorf("got %v of %d, want %v", got, results.Total, test.want)
+			}
+			for facet, want := range test.facets {
+				if got := results.Facets[facet]; !reflect.DeepEqual(got, want) {
+					t.Errorf("got the %s facet %v, want %v", facet, got, want)
+				}
+			}
+
+			// The pages hold the same files in the same order.
+			var paged []string
+			query.Limit = 1
+			for page := 0; page <= len(test.want); page++ {
+				results, err := catalog.Search(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				paged = append(paged, paths(results.Entries)...)
+				if results.Next == "" {
+					break
+				}
+				query.Cursor = results.Next
+			}
+			if strings.Join(paged, " ") != strings.Join(test.want, " ") {
+				t.Errorf("got the pages %v, want %v", paged, test.want)
+			}
+		})
+	}
+}
+
+func paths(entries []CatalogEntry) []string {
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, entry.Volume+":"+entry.Path)
+	}
+	return paths
+}
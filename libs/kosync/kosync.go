@@ -0,0 +1,129 @@
+package kosync
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// < ----- KOReader Sync ----- >
+
+// Error is an error in the format of the KOReader sync protocol, sent with the status code.
+type Error struct {
+	Status  int    `json:"-"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// The errors of the protocol.
+var (
+	ErrInternal        = &Error{Status: 502, Code: 2000, Message: "Unknown server error."}
+	ErrUnauthorized    = &Error{Status: 401, Code: 2001, Message: "Unauthorized"}
+	ErrUserExists      = &Error{Status: 402, Code: 2002, Message: "Username is already registered."}
+	ErrInvalidFields   = &Error{Status: 403, Code: 2003, Message: "Invalid request"}
+	ErrMissingDocument = &Error{Status: 403, Code: 2004, Message: "Field 'document' not provided."}
+)
+
+// Progress is the position in a document, as synced by KOReader.
+type Progress struct {
+	Document   string  `json:"document"`   // The partial MD5 of the document, or of its file name.
+	Progress   string  `json:"progress"`   // A page number for pdfs and comics, and an XPointer for reflowable documents.
+	Percentage float64 `json:"percentage"` // From 0 to 1.
+	Device     string  `json:"device"`
+	DeviceID   string  `json:"device_id"`
+	Timestamp  int64   `json:"timestamp"` // When the progress was synced, in unix time.
+}
+
+// Store stores the sync keys of the users in the SyncKeys table and their progress in the SyncProgress table.
+type Store struct {
+	DB *sql.DB
+}
+
+// InitTables creates the tables of the store if they don't exist.
+func (store *Store) InitTables() error {
+	for _, table := range []string{`
+		CREATE TABLE IF NOT EXISTS SyncKeys(
+			Username TEXT NOT NULL PRIMARY KEY,
+			Key TEXT
+		);`, `
+		CREATE TABLE IF NOT EXISTS SyncProgress(
+			Username TEXT NOT NULL,
+			Document TEXT NOT NULL,
+			Progress TEXT,
+			Percentage REAL,
+			Device TEXT,
+			DeviceID TEXT,
+			Timestamp INTEGER,
+			PRIMARY KEY(Username, Document)
+		);`,
+	} {
+		statement, err := store.DB.Prepare(table)
+		if err != nil {
+			return err
+		}
+		_, err = statement.Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Key returns the key KOReader signs in with for the password, which is the md5 hash of the password.
+func Key(password string) string {
+	sum := md5.Sum([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetKey sets the key the user signs in to the sync with. Only a bcrypt hash of the key is stored.
+func (store *Store) SetKey(username string, key string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(key), 8)
+	if err != nil {
+		return err
+	}
+	statement, err := store.DB.Prepare("INSERT OR REPLACE INTO SyncKeys (Username, Key) VALUES (?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(username, string(hashed))
+	return err
+}
+
+// Authorize reports whether the key is the sync key of the user.
+func (store *Store) Authorize(username string, key string) bool {
+	var hashed string
+	err := store.DB.QueryRow("SELECT Key FROM SyncKeys WHERE Username=$1", username).Scan(&hashed)
+	if err != nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(key)) == nil
+}
+
+// Progress returns the progress of the user in the document. sql.ErrNoRows is returned if it hasn't been synced.
+func (store *Store) Progress(username string, document string) (Progress, error) {
+	progress := Progress{}
+	result := store.DB.QueryRow("SELECT Document, Progress, Percentage, Device, DeviceID, Timestamp FROM SyncProgress WHERE Username=$1 AND Document=$2", username, document)
+	err := result.Scan(&progress.Document, &progress.Progress, &progress.Percentage, &progress.Device, &progress.DeviceID, &progress.Timestamp)
+	return progress, err
+}
+
+// Update stores the progress of the user in the document, and sets its timestamp to now.
+func (store *Store) Update(username string, progress *Progress) error {
+	progress.Timestamp = time.Now().Unix()
+	statement, err := store.DB.Prepare(`
+		INSERT OR REPLACE INTO SyncProgress (Username, Document, Progress, Percentage, Device, DeviceID, Timestamp)
+		VALUES (?,?,?,?,?,?,?)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(username, progress.Document, progress.Progress, progress.Percentage, progress.Device, progress.DeviceID, progress.Timestamp)
+	return err
+}
@@ -0,0 +1,191 @@
+package metadata
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	Comic "../comic"
+	Epub "../epub"
+	Files "../files"
+)
+
+// < ----- Metadata ----- >
+
+// Extractors are the extractors used for each file extension.
+var Extractors = map[string]Files.Extractor{
+	".pdf":  PDF,
+	".epub": EPUB,
+	".cbz":  ComicInfo,
+	".cbr":  ComicInfo,
+	".cb7":  ComicInfo,
+}
+
+// Extract reads the metadata of the book at the path with the extractor for its extension.
+// Files.ErrNoMetadata is returned if there is no extractor for the extension. It implements Files.Extractor.
+func Extract(path string) (Files.Book, error) {
+	extractor, ok := Extractors[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return Files.Book{}, Files.ErrNoMetadata
+	}
+	book, err := extractor(path)
+	if err != nil {
+		return Files.Book{}, err
+	}
+	if book.Authors == nil {
+		book.Authors = []string{}
+	}
+	return book, nil
+}
+
+// EPUB reads the metadata from the package document of the EPUB.
+func EPUB(path string) (Files.Book, error) {
+	book, err := Epub.Open(path)
+	if err != nil {
+		return Files.Book{}, err
+	}
+	defer book.Close()
+	metadata := book.Metadata
+	isbn := ""
+	for _, identifier := range metadata.Identifiers {
+		if isbn = ISBN(identifier); isbn != "" {
+			break
+		}
+	}
+	return Files.Book{
+		Title:       metadata.Title,
+		Authors:     metadata.Creators,
+		Series:      metadata.Series,
+		SeriesIndex: metadata.SeriesIndex,
+		ISBN:        isbn,
+		Language:    metadata.Language,
+		Publisher:   metadata.Publisher,
+		Description: metadata.Description,
+		Date:        metadata.Date,
+	}, nil
+}
+
+// comicInfo is the ComicInfo.xml file used by comic managers like ComicRack.
+type comicInfo struct {
+	Title       string `xml:"Title"`
+	Series      string `xml:"Series"`
+	Number      string `xml:"Number"`
+	Writer      string `xml:"Writer"`
+	Publisher   string `xml:"Publisher"`
+	LanguageISO string `xml:"LanguageISO"`
+	Summary     string `xml:"Summary"`
+	Year        int    `xml:"Year"`
+	Month       int    `xml:"Month"`
+	Day         int    `xml:"Day"`
+	GTIN        string `xml:"GTIN"`
+}
+
+// ComicInfo reads the metadata from the ComicInfo.xml file in the root of the comic archive.
+// A comic without the file has no metadata, but isn't an error.
+func ComicInfo(path string) (Files.Book, error) {
+	file, err := Comic.OpenFile(path, "ComicInfo.xml")
+	if os.IsNotExist(err) {
+		return Files.Book{}, nil
+	}
+	if err != nil {
+		return Files.Book{}, err
+	}
+	defer file.Close()
+	var info comicInfo
+	err = xml.NewDecoder(io.LimitReader(file, 1<<20)).Decode(&info)
+	if err != nil {
+		return Files.Book{}, err
+	}
+	book := Files.Book{
+		Title:       strings.TrimSpace(info.Title),
+		Authors:     split(info.Writer, ","),
+		Series:      strings.TrimSpace(info.Series),
+		SeriesIndex: strings.TrimSpace(info.Number),
+		ISBN:        ISBN(info.GTIN),
+		Language:    strings.TrimSpace(info.LanguageISO),
+		Publisher:   strings.TrimSpace(info.Publisher),
+		Description: strings.TrimSpace(info.Summary),
+	}
+	// Issues of a series often have no title of their own.
+	if book.Title == "" && book.Series != "" {
+		book.Title = book.Series
+		if book.SeriesIndex != "" {
+			book.Title += " #" + book.SeriesIndex
+		}
+	}
+	if info.Year > 0 {
+		book.Date = strconv.Itoa(info.Year)
+		if info.Month > 0 {
+			book.Date += "-" + twoDigits(info.Month)
+			if info.Day > 0 {
+				book.Date += "-" + twoDigits(info.Day)
+			}
+		}
+	}
+	return book, nil
+}
+
+// < ----- Helpers ----- >
+
+// ISBN returns the ISBN in the identifier without dashes, or an empty string if the identifier isn't a valid ISBN-10 or ISBN-13.
+// Identifiers like urn:isbn:978-0-00-000000-2 are accepted.
+func ISBN(identifier string) string {
+	identifier = strings.TrimSpace(identifier)
+	if index := strings.LastIndex(strings.ToLower(identifier), "isbn:"); index != -1 {
+		identifier = identifier[index+len("isbn:"):]
+	}
+	digits := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(identifier))
+	switch len(digits) {
+	case 10:
+		sum := 0
+		for i, digit := range digits {
+			value := int(digit - '0')
+			if digit == 'X' && i == 9 {
+				value = 10
+			} else if digit < '0' || digit > '9' {
+				return ""
+			}
+			sum += (10 - i) * value
+		}
+		if sum%11 == 0 {
+			return digits
+		}
+	case 13:
+		sum := 0
+		for i, digit := range digits {
+			if digit < '0' || digit > '9' {
+				return ""
+			}
+			if i%2 == 0 {
+				sum += int(digit - '0')
+			} else {
+				sum += 3 * int(digit-'0')
+			}
+		}
+		if sum%10 == 0 {
+			return digits
+		}
+	}
+	return ""
+}
+
+// split splits the list by the separator and leaves out the blank values.
+func split(list string, separator string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, separator) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func twoDigits(number int) string {
+	if number < 10 {
+		return "0" + strconv.Itoa(number)
+	}
+	return strconv.Itoa(number)
+}
@@ -0,0 +1,639 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	Files "../files"
+)
+
+// < ----- PDF ----- >
+
+// PDFWindow is the number of bytes read from both the start and the end of a PDF.
+// The metadata is written at one of the ends of the file, so huge files don't have to be read fully.
+const PDFWindow = 8 * 1024 * 1024
+
+// maxStreamSize is the largest stream that is decompressed.
+const maxStreamSize = 16 * 1024 * 1024
+
+// ErrNotPDF is returned when a file doesn't start with the PDF header.
+var ErrNotPDF = errors.New("metadata: the file is not a PDF")
+
+// PDF reads the metadata from the XMP packet and the Info dictionary of the PDF.
+// The XMP packet is preferred, as it is the newer of the two and always unicode.
+func PDF(path string) (Files.Book, error) {
+	data, err := readWindow(path)
+	if err != nil {
+		return Files.Book{}, err
+	}
+	header := data
+	if len(header) > 1024 {
+		header = header[:1024]
+	}
+	if !bytes.Contains(header, []byte("%PDF-")) {
+		return Files.Book{}, ErrNotPDF
+	}
+	document := newPDFDocument(data)
+	book := Files.Book{Authors: []string{}}
+	if info, ok := document.resolve(document.trailer("Info")).(map[string]interface{}); ok {
+		book.Title = document.text(info["Title"])
+		book.Authors = split(document.text(info["Author"]), ";")
+		book.Description = document.text(info["Subject"])
+	}
+	if xmp := document.xmp(); xmp != nil {
+		description := xmp.merge()
+		if title := first(description.Titles); title != "" {
+			book.Title = title
+		}
+		if creators := trimmed(description.Creators); len(creators) > 0 {
+			book.Authors = creators
+		}
+		if text := first(description.Descriptions); text != "" {
+			book.Description = text
+		}
+		book.Language = first(description.Languages)
+		book.Publisher = first(description.Publishers)
+		book.Date = first(description.Dates)
+		for _, identifier := range append(description.ISBNs, description.Identifiers...) {
+			if book.ISBN = ISBN(identifier); book.ISBN != "" {
+				break
+			}
+		}
+	}
+	return book, nil
+}
+
+// readWindow reads the first and last PDFWindow bytes of the file, or the whole file if it is small.
+func readWindow(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() <= 2*PDFWindow {
+		return ioutil.ReadAll(file)
+	}
+	data := make([]byte, 2*PDFWindow+1)
+	_, err = io.ReadFull(file, data[:PDFWindow])
+	if err != nil {
+		return nil, err
+	}
+	// The two ends are separated by a newline, so a token can't run from one into the other.
+	data[PDFWindow] = '\n'
+	_, err = file.ReadAt(data[PDFWindow+1:], info.Size()-PDFWindow)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// < ----- Objects ----- >
+
+type pdfName string
+type pdfString []byte
+type pdfRef int
+type pdfKeyword string
+
+// pdfDocument finds the objects of a PDF by scanning for their definitions, instead of reading the cross reference table,
+// so it works on the ends of a file and on files with a broken table.
+type pdfDocument struct {
+	data    []byte
+	offsets map[int]int // The offsets of the objects after the obj keyword. Later definitions replace earlier ones, like in an updated file.
+	packed  map[int]interface{}
+	unpack  bool
+}
+
+var objectPattern = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+
+func newPDFDocument(data []byte) *pdfDocument {
+	document := &pdfDocument{data: data, offsets: make(map[int]int)}
+	for _, match := range objectPattern.FindAllSubmatchIndex(data, -1) {
+		if match[0] > 0 && isDigit(data[match[0]-1]) {
+			continue
+		}
+		number, err := strconv.Atoi(string(data[match[2]:match[3]]))
+		if err == nil {
+			document.offsets[number] = match[1]
+		}
+	}
+	return document
+}
+
+// trailer returns the value of the key in the last trailer of the file, which can also be a cross reference stream.
+func (document *pdfDocument) trailer(key string) interface{} {
+	pattern := regexp.MustCompile(`/` + key + `\s+(\d+)\s+\d+\s+R`)
+	matches := pattern.FindAllSubmatch(document.data, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	number, err := strconv.Atoi(string(matches[len(matches)-1][1]))
+	if err != nil {
+		return nil
+	}
+	return pdfRef(number)
+}
+
+// resolve returns the object a reference points to. Other values are returned as they are.
+func (document *pdfDocument) resolve(value interface{}) interface{} {
+	ref, ok := value.(pdfRef)
+	if !ok {
+		return value
+	}
+	if offset, ok := document.offsets[int(ref)]; ok {
+		lexer := &pdfLexer{data: document.data, pos: offset}
+		object, _ := lexer.object(0)
+		return object
+	}
+	document.unpackObjectStreams()
+	return document.packed[int(ref)]
+}
+
+// stream returns the decoded data of the stream the reference points to.
+func (document *pdfDocument) stream(value interface{}) ([]byte, bool) {
+	ref, ok := value.(pdfRef)
+	if !ok {
+		return nil, false
+	}
+	offset, ok := document.offsets[int(ref)]
+	if !ok {
+		return nil, false
+	}
+	return document.streamAt(offset)
+}
+
+// streamAt reads the dictionary at the offset and the stream following it.
+func (document *pdfDocument) streamAt(offset int) ([]byte, bool) {
+	lexer := &pdfLexer{data: document.data, pos: offset}
+	object, _ := lexer.object(0)
+	dictionary, ok := object.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	lexer.skipSpace()
+	if !bytes.HasPrefix(document.data[lexer.pos:], []byte("stream")) {
+		return nil, false
+	}
+	start := lexer.pos + len("stream")
+	if bytes.HasPrefix(document.data[start:], []byte("\r\n")) {
+		start += 2
+	} else if start < len(document.data) && document.data[start] == '\n' {
+		start++
+	}
+	end := -1
+	// The length is compared to what is left of the data, as a huge length would overflow start+length.
+	if length, ok := document.resolve(dictionary["Length"]).(int); ok && length >= 0 && length <= len(document.data)-start {
+		end = start + length
+	} else if index := bytes.Index(document.data[start:], []byte("endstream")); index != -1 {
+		end = start + index
+	}
+	if end == -1 {
+		return nil, false
+	}
+	data := document.data[start:end]
+	switch filter := dictionary["Filter"].(type) {
+	case nil:
+		return data, true
+	case pdfName:
+		if filter == "FlateDecode" {
+			return inflate(data)
+		}
+	case []interface{}:
+		if len(filter) == 1 && filter[0] == pdfName("FlateDecode") {
+			return inflate(data)
+		}
+	}
+	return nil, false
+}
+
+// unpackObjectStreams reads the objects stored in the compressed object streams of the file.
+func (document *pdfDocument) unpackObjectStreams() {
+	if document.unpack {
+		return
+	}
+	document.unpack = true
+	document.packed = make(map[int]interface{})
+	for _, offset := range document.offsets {
+		lexer := &pdfLexer{data: document.data, pos: offset}
+		object, _ := lexer.object(0)
+		dictionary, ok := object.(map[string]interface{})
+		if !ok || dictionary["Type"] != pdfName("ObjStm") {
+			continue
+		}
+		count, _ := dictionary["N"].(int)
+		first, _ := dictionary["First"].(int)
+		data, ok := document.streamAt(offset)
+		if !ok || first < 0 || first > len(data) || count < 0 {
+			continue
+		}
+		// The stream starts with pairs of object numbers and offsets relative to First.
+		header := &pdfLexer{data: data[:first]}
+		for i := 0; i < count; i++ {
+			numberObject, ok := header.object(0)
+			if !ok {
+				break
+			}
+			relativeObject, ok := header.object(0)
+			if !ok {
+				break
+			}
+			number, isNumber := numberObject.(int)
+			relative, isRelative := relativeObject.(int)
+			if !isNumber || !isRelative || relative < 0 || relative >= len(data)-first {
+				continue
+			}
+			objectLexer := &pdfLexer{data: data, pos: first + relative}
+			if object, ok := objectLexer.object(0); ok {
+				document.packed[number] = object
+			}
+		}
+	}
+}
+
+// text decodes a text string, which is either UTF-16 with a byte order mark or PDFDocEncoding.
+func (document *pdfDocument) text(value interface{}) string {
+	data, ok := document.resolve(value).(pdfString)
+	if !ok {
+		return ""
+	}
+	var text string
+	switch {
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		units := make([]uint16, 0, len(data)/2)
+		for i := 2; i+1 < len(data); i += 2 {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		}
+		text = string(utf16.Decode(units))
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		text = string(data[3:])
+	case utf8.Valid(data):
+		// Many writers use UTF-8 without a byte order mark.
+		text = string(data)
+	default:
+		// PDFDocEncoding matches Latin-1 for the printable characters.
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+	return strings.TrimSpace(strings.Trim(text, "\x00"))
+}
+
+func inflate(data []byte) ([]byte, bool) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	defer reader.Close()
+	inflated, err := ioutil.ReadAll(io.LimitReader(reader, maxStreamSize))
+	// Streams are often cut short without a checksum, so what could be read is used.
+	if len(inflated) == 0 && err != nil {
+		return nil, false
+	}
+	return inflated, true
+}
+
+// < ----- Lexer ----- >
+
+// pdfLexer reads the objects of a PDF. Dictionaries are read as maps by key without the slash,
+// arrays as slices, numbers as int or float64, and references as pdfRef.
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+// maxDepth is the deepest nesting of arrays and dictionaries that is read.
+const maxDepth = 32
+
+func (lexer *pdfLexer) object(depth int) (interface{}, bool) {
+	lexer.skipSpace()
+	if lexer.pos >= len(lexer.data) || depth > maxDepth {
+		return nil, false
+	}
+	data := lexer.data
+	switch c := data[lexer.pos]; {
+	case c == '<' && lexer.pos+1 < len(data) && data[lexer.pos+1] == '<':
+		lexer.pos += 2
+		dictionary := make(map[string]interface{})
+		for {
+			lexer.skipSpace()
+			if lexer.pos+1 >= len(data) {
+				return nil, false
+			}
+			if data[lexer.pos] == '>' && data[lexer.pos+1] == '>' {
+				lexer.pos += 2
+				return dictionary, true
+			}
+			key, ok := lexer.object(depth + 1)
+			if !ok {
+				return nil, false
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, false
+			}
+			value, ok := lexer.object(depth + 1)
+			if !ok {
+				return nil, false
+			}
+			dictionary[string(name)] = value
+		}
+	case c == '<':
+		end := bytes.IndexByte(data[lexer.pos:], '>')
+		if end == -1 {
+			return nil, false
+		}
+		hex := data[lexer.pos+1 : lexer.pos+end]
+		lexer.pos += end + 1
+		return decodeHex(hex), true
+	case c == '[':
+		lexer.pos++
+		array := []interface{}{}
+		for {
+			lexer.skipSpace()
+			if lexer.pos >= len(data) {
+				return nil, false
+			}
+			if data[lexer.pos] == ']' {
+				lexer.pos++
+				return array, true
+			}
+			value, ok := lexer.object(depth + 1)
+			if !ok {
+				return nil, false
+			}
+			array = append(array, value)
+		}
+	case c == '(':
+		return lexer.literal()
+	case c == '/':
+		lexer.pos++
+		start := lexer.pos
+		for lexer.pos < len(data) && !isDelimiter(data[lexer.pos]) {
+			lexer.pos++
+		}
+		return pdfName(decodeName(data[start:lexer.pos])), true
+	case isDigit(c) || c == '-' || c == '+' || c == '.':
+		return lexer.number()
+	case isDelimiter(c):
+		lexer.pos++
+		return nil, false
+	default:
+		start := lexer.pos
+		for lexer.pos < len(data) && !isDelimiter(data[lexer.pos]) {
+			lexer.pos++
+		}
+		return pdfKeyword(data[start:lexer.pos]), true
+	}
+}
+
+// number reads a number, or a reference if the number is followed by a generation and R.
+func (lexer *pdfLexer) number() (interface{}, bool) {
+	start := lexer.pos
+	lexer.pos++
+	for lexer.pos < len(lexer.data) && (isDigit(lexer.data[lexer.pos]) || lexer.data[lexer.pos] == '.') {
+		lexer.pos++
+	}
+	text := string(lexer.data[start:lexer.pos])
+	integer, err := strconv.Atoi(text)
+	if err != nil {
+		float, err := strconv.ParseFloat(text, 64)
+		return float, err == nil
+	}
+	end := lexer.pos
+	lexer.skipSpace()
+	generation := lexer.pos
+	for lexer.pos < len(lexer.data) && isDigit(lexer.data[lexer.pos]) {
+		lexer.pos++
+	}
+	if lexer.pos > generation {
+		lexer.skipSpace()
+		if lexer.pos < len(lexer.data) && lexer.data[lexer.pos] == 'R' && (lexer.pos+1 == len(lexer.data) || isDelimiter(lexer.data[lexer.pos+1])) {
+			lexer.pos++
+			return pdfRef(integer), true
+		}
+	}
+	lexer.pos = end
+	return integer, true
+}
+
+// literal reads a string in parentheses, which can contain balanced parentheses and escapes.
+func (lexer *pdfLexer) literal() (interface{}, bool) {
+	data := lexer.data
+	lexer.pos++
+	var text []byte
+	depth := 1
+	for lexer.pos < len(data) {
+		c := data[lexer.pos]
+		lexer.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfString(text), true
+			}
+		case '\\':
+			if lexer.pos >= len(data) {
+				return nil, false
+			}
+			c = data[lexer.pos]
+			lexer.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// A backslash at the end of a line continues the string on the next line.
+				if lexer.pos < len(data) && data[lexer.pos] == '\n' {
+					lexer.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					value := int(c - '0')
+					for i := 0; i < 2 && lexer.pos < len(data) && data[lexer.pos] >= '0' && data[lexer.pos] <= '7'; i++ {
+						value = value*8 + int(data[lexer.pos]-'0')
+						lexer.pos++
+					}
+					c = byte(value)
+				}
+			}
+		}
+		text = append(text, c)
+	}
+	return nil, false
+}
+
+// skipSpace skips whitespace and comments.
+func (lexer *pdfLexer) skipSpace() {
+	for lexer.pos < len(lexer.data) {
+		c := lexer.data[lexer.pos]
+		if c == '%' {
+			for lexer.pos < len(lexer.data) && lexer.data[lexer.pos] != '\n' && lexer.data[lexer.pos] != '\r' {
+				lexer.pos++
+			}
+			continue
+		}
+		if !isSpace(c) {
+			return
+		}
+		lexer.pos++
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isDelimiter(c byte) bool {
+	return isSpace(c) || strings.IndexByte("()<>[]{}/%", c) != -1
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func decodeHex(hex []byte) pdfString {
+	var digits []byte
+	for _, c := range hex {
+		if !isSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	text := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		value, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		if err != nil {
+			return pdfString(text)
+		}
+		text = append(text, byte(value))
+	}
+	return pdfString(text)
+}
+
+// decodeName decodes the #xx escapes in a name.
+func decodeName(name []byte) string {
+	if bytes.IndexByte(name, '#') == -1 {
+		return string(name)
+	}
+	var decoded []byte
+	for i := 0; i < len(name); i++ {
+		if name[i] == '#' && i+2 < len(name) {
+			if value, err := strconv.ParseUint(string(name[i+1:i+3]), 16, 8); err == nil {
+				decoded = append(decoded, byte(value))
+				i += 2
+				continue
+			}
+		}
+		decoded = append(decoded, name[i])
+	}
+	return string(decoded)
+}
+
+// < ----- XMP ----- >
+
+type xmpPacket struct {
+	Descriptions []xmpDescription `xml:"RDF>Description"`
+}
+
+type xmpDescription struct {
+	Titles       []string `xml:"title>Alt>li"`
+	Creators     []string `xml:"creator>Seq>li"`
+	Descriptions []string `xml:"description>Alt>li"`
+	Languages    []string `xml:"language>Bag>li"`
+	Publishers   []string `xml:"publisher>Bag>li"`
+	Dates        []string `xml:"date>Seq>li"`
+	Identifiers  []string `xml:"identifier"`
+	ISBNs        []string `xml:"isbn"`
+}
+
+// merge combines the descriptions of the packet, as the properties are often split over several of them.
+func (packet *xmpPacket) merge() xmpDescription {
+	merged := xmpDescription{}
+	for _, description := range packet.Descriptions {
+		merged.Titles = append(merged.Titles, description.Titles...)
+		merged.Creators = append(merged.Creators, description.Creators...)
+		merged.Descriptions = append(merged.Descriptions, description.Descriptions...)
+		merged.Languages = append(merged.Languages, description.Languages...)
+		merged.Publishers = append(merged.Publishers, description.Publishers...)
+		merged.Dates = append(merged.Dates, description.Dates...)
+		merged.Identifiers = append(merged.Identifiers, description.Identifiers...)
+		merged.ISBNs = append(merged.ISBNs, description.ISBNs...)
+	}
+	return merged
+}
+
+// xmp reads the XMP packet of the document from the Metadata stream of the catalog.
+// If the catalog can't be read the first packet in the file is used.
+func (document *pdfDocument) xmp() *xmpPacket {
+	var data []byte
+	if catalog, ok := document.resolve(document.trailer("Root")).(map[string]interface{}); ok {
+		data, _ = document.stream(catalog["Metadata"])
+	}
+	if !bytes.Contains(data, []byte("<rdf:RDF")) {
+		data = document.data
+	}
+	start := bytes.Index(data, []byte("<rdf:RDF"))
+	if start == -1 {
+		return nil
+	}
+	end := bytes.Index(data[start:], []byte("</rdf:RDF>"))
+	if end == -1 {
+		return nil
+	}
+	rdf := data[start : start+end+len("</rdf:RDF>")]
+	// The packet is wrapped, as the xmpmeta element around the RDF is optional.
+	var packet xmpPacket
+	err := xml.Unmarshal(append(append([]byte("<xmpmeta>"), rdf...), "</xmpmeta>"...), &packet)
+	if err != nil {
+		return nil
+	}
+	return &packet
+}
+
+func first(values []string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func trimmed(values []string) []string {
+	result := []string{}
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
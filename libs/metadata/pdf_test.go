@@ -0,0 +1,170 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// pdf returns a PDF made of the objects, numbered from 1, with a trailer pointing at the catalog and the info dictionary.
+func pdf(objects ...string) []byte {
+	var data bytes.Buffer
+	data.WriteString("%PDF-1.7\n")
+	for i, object := range objects {
+		data.WriteString(strconv.Itoa(i+1) + " 0 obj\n" + object + "\nendobj\n")
+	}
+	data.WriteString("trailer\n<< /Root 1 0 R /Info 2 0 R >>\n%%EOF\n")
+	return data.Bytes()
+}
+
+// stream returns a stream object with the data, compressed if deflate is set.
+func stream(dictionary string, data string, deflate bool) string {
+	if deflate {
+		var compressed bytes.Buffer
+		writer := zlib.NewWriter(&compressed)
+		writer.Write([]byte(data))
+		writer.Close()
+		data = compressed.String()
+		dictionary += " /Filter /FlateDecode"
+	}
+	return "<< " + dictionary + " /Length " + strconv.Itoa(len(data)) + " >>\nstream\n" + data + "\nendstream"
+}
+
+func writePDF(t testing.TB, data []byte) string {
+	path := filepath.Join(t.TempDir(), "book.pdf")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPDF(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		title   string
+		authors []string
+		err     error
+	}{
+		{
+			name:    "info dictionary",
+			data:    pdf("<< /Type /Catalog >>", "<< /Title (Moby Dick) /Author (Herman Melville) >>"),
+			title:   "Moby Dick",
+			authors: []string{"Herman Melville"},
+		},
+		{
+			name:  "utf-16 title",
+			data:  pdf("<< /Type /Catalog >>", "<< /Title <FEFF00E9007400E9> >>"),
+			title: "été",
+		},
+		{
+			name:  "escaped literal",
+			data:  pdf("<< /Type /Catalog >>", `<< /Title (A \(nested\) \101) >>`),
+			title: "A (nested) A",
+		},
+		{
+			name: "xmp packet",
+			data: pdf("<< /Type /Catalog /Metadata 3 0 R >>", "<< /Title (Old) >>",
+				stream("/Type /Metadata", `<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns:dc="http://purl.org/dc/elements/1.1/">`+
+					`<rdf:Description><dc:title><rdf:Alt><rdf:li>New</rdf:li></rdf:Alt></dc:title></rdf:Description></rdf:RDF>`, false)),
+			title: "New",
+		},
+		{
+			name:  "object stream",
+			data:  pdf("<< /Type /Catalog >>", "<< /Title 4 0 R >>", stream("/Type /ObjStm /N 1 /First 4", "4 0 (Packed)", true)),
+			title: "Packed",
+		},
+		{
+			name: "negative first",
+			data: pdf("<< /Type /Catalog >>", "<< /Title 9 0 R >>", stream("/Type /ObjStm /N 1 /First -5", "9 0 (x)", false)),
+		},
+		{
+			name: "offset past the stream",
+			data: pdf("<< /Type /Catalog >>", "<< /Title 9 0 R >>", stream("/Type /ObjStm /N 1 /First 22", "9 9223372036854775807 (x)", false)),
+		},
+		{
+			name: "huge length",
+			data: pdf("<< /Type /Catalog /Metadata 3 0 R >>", "<< /Title (Long) >>",
+				"<< /Length 9223372036854775807 >>\nstream\nabc\nendstream"),
+			title: "Long",
+		},
+		{
+			name: "negative count",
+			data: pdf("<< /Type /Catalog >>", "<< /Title 9 0 R >>", stream("/Type /ObjStm /N -1 /First 0", "", false)),
+		},
+		{
+			name: "truncated",
+			data: []byte("%PDF-1.4\n1 0 obj << /Title (cut"),
+		},
+		{
+			name: "not a pdf",
+			data: []byte("hello"),
+			err:  ErrNotPDF,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			book, err := PDF(writePDF(t, test.data))
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if book.Title != test.title {
+				t.Errorf("got title %q, want %q", book.Title, test.title)
+			}
+			if test.authors != nil && strings.Join(book.Authors, ";") != strings.Join(test.authors, ";") {
+				t.Errorf("got authors %q, want %q", book.Authors, test.authors)
+			}
+		})
+	}
+}
+
+func TestPDFText(t *testing.T) {
+	// The ranges of the second font end at the largest code, which mustn't wrap around.
+	cmap := "begincodespacerange <00> <FF> endcodespacerange 2 beginbfrange <FFFFFFF0> <FFFFFFFF> <0041> " +
+		"<FFFFFFFE> <FFFFFFFF> [<0042> <0043> <0044>] endbfrange"
+	data := pdf(
+		"<< /Type /Catalog /Pages 3 0 R >>",
+		"<< >>",
+		"<< /Type /Pages /Kids [4 0 R 5 0 R] /Resources << /Font << /F1 << /Type /Font >> /F2 6 0 R >> >> >>",
+		"<< /Type /Page /Contents 7 0 R >>",
+		"<< /Type /Page /Contents [8 0 R] >>",
+		"<< /Type /Font /ToUnicode 9 0 R >>",
+		stream("", "BT /F1 12 Tf (Call me) Tj T* [(Ish) -300 (mael.)] TJ ET", true),
+		stream("", "BT (Second) Tj ET", false),
+		stream("", cmap, false),
+	)
+	sections, err := PDFText(writePDF(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != 2 {
+		t.Fatalf("got %d sections, want 2", len(sections))
+	}
+	if sections[0].Page != 1 || sections[0].Text != "Call me Ish mael." {
+		t.Errorf("got page %d %q", sections[0].Page, sections[0].Text)
+	}
+	if sections[1].Page != 2 || sections[1].Percent != 1 || sections[1].Text != "Second" {
+		t.Errorf("got page %d %q at %v", sections[1].Page, sections[1].Text, sections[1].Percent)
+	}
+
+	unicode := parseCMap([]byte(cmap), &pdfFont{width: 1})
+	if len(unicode) != 16 || unicode[0xfffffff0] != "A" || unicode[0xfffffffe] != "B" || unicode[0xffffffff] != "C" {
+		t.Errorf("got the map %q", unicode)
+	}
+}
+
+func FuzzPDF(f *testing.F) {
+	f.Add(pdf("<< /Type /Catalog >>", "<< /Title (Moby Dick) >>"))
+	f.Add(pdf("<< /Type /Catalog >>", "<< /Title 9 0 R >>", stream("/Type /ObjStm /N 1 /First 4", "9 0 (x)", true)))
+	f.Add(pdf("<< /Type /Catalog /Pages 3 0 R >>", "<< >>", "<< /Kids [4 0 R] >>", "<< /Contents 5 0 R >>",
+		stream("", "BT (text) Tj BI /W 1 ID xx EI ET", false)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := writePDF(t, append([]byte("%PDF-"), data...))
+		PDF(path)
+		PDFText(path)
+	})
+}
@@ -0,0 +1,460 @@
+package metadata
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	Epub "../epub"
+)
+
+// < ----- Text ----- >
+
+// MaxTextFileSize is the largest file whose text is extracted.
+const MaxTextFileSize = 256 * 1024 * 1024
+
+// TextSectionSize is the number of bytes a plain text file is split into sections by.
+const TextSectionSize = 8 * 1024
+
+// ErrNoText is returned when there is no text extractor for the extension of a file.
+var ErrNoText = errors.New("metadata: the text of the file can't be extracted")
+
+// Section is a part of the text of a book, like a page of a pdf or a chapter of an epub, with where it starts in the book.
+type Section struct {
+	Page     int     // The page of a pdf, numbered from 1.
+	Position string  // The EPUB CFI of a chapter of an epub.
+	Percent  float64 // How far into the book the section is, from 0 to 1.
+	Text     string
+}
+
+// TextExtractors extract the text of the books by the extension of their files.
+var TextExtractors = map[string]func(path string) ([]Section, error){
+	".pdf":  PDFText,
+	".epub": EPUBText,
+	".txt":  PlainText,
+}
+
+// Text extracts the text of the book at the path with the extractor for its extension.
+// ErrNoText is returned if there is no extractor for the extension.
+func Text(path string) ([]Section, error) {
+	extractor, ok := TextExtractors[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return nil, ErrNoText
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > MaxTextFileSize {
+		return nil, errors.New("metadata: the file is too large to extract its text")
+	}
+	return extractor(path)
+}
+
+// EPUBText returns the text of each spine item of the EPUB.
+func EPUBText(path string) ([]Section, error) {
+	book, err := Epub.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer book.Close()
+	sections := []Section{}
+	for i, item := range book.Spine {
+		text, err := book.Text(item.Href)
+		if err != nil {
+			return nil, err
+		}
+		if text == "" {
+			continue
+		}
+		position := Epub.Position{Spine: i}
+		sections = append(sections, Section{Position: position.String(), Percent: book.Percent(position) / 100, Text: text})
+	}
+	return sections, nil
+}
+
+// PlainText splits the text file into sections of about TextSectionSize bytes, which end between words.
+func PlainText(path string) ([]Section, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, MaxTextFileSize))
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(data) {
+		data = bytes.ToValidUTF8(data, []byte(" "))
+	}
+	sections := []Section{}
+	for start := 0; start < len(data); {
+		end := start + TextSectionSize
+		if end >= len(data) {
+			end = len(data)
+		} else if space := bytes.LastIndexAny(data[start:end], " \t\r\n"); space > 0 {
+			end = start + space
+		}
+		if text := strings.Join(strings.Fields(string(data[start:end])), " "); text != "" {
+			sections = append(sections, Section{Percent: float64(start) / float64(len(data)), Text: text})
+		}
+		start = end
+	}
+	return sections, nil
+}
+
+// PDFText returns the text of each page of the PDF. The text is decoded with the ToUnicode maps of the fonts when they have one.
+func PDFText(path string) ([]Section, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header := data
+	if len(header) > 1024 {
+		header = header[:1024]
+	}
+	if !bytes.Contains(header, []byte("%PDF-")) {
+		return nil, ErrNotPDF
+	}
+	document := newPDFDocument(data)
+	pages := document.pages()
+	sections := []Section{}
+	for i, page := range pages {
+		text := document.pageText(page)
+		if text == "" {
+			continue
+		}
+		sections = append(sections, Section{Page: i + 1, Percent: float64(i+1) / float64(len(pages)), Text: text})
+	}
+	return sections, nil
+}
+
+// < ----- Pages ----- >
+
+// maxPages is the largest number of pages read from a PDF.
+const maxPages = 100000
+
+// pages returns the pages of the document in order. The resources a page inherits from the page tree are set on the page.
+func (document *pdfDocument) pages() []map[string]interface{} {
+	root, ok := document.resolve(document.trailer("Root")).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	var pages []map[string]interface{}
+	visited := make(map[pdfRef]bool)
+	var walk func(value interface{}, resources interface{}, depth int)
+	walk = func(value interface{}, resources interface{}, depth int) {
+		if ref, ok := value.(pdfRef); ok {
+			if visited[ref] {
+				return
+			}
+			visited[ref] = true
+		}
+		node, ok := document.resolve(value).(map[string]interface{})
+		if !ok || depth > maxDepth || len(pages) >= maxPages {
+			return
+		}
+		if node["Resources"] != nil {
+			resources = node["Resources"]
+		}
+		if kids, ok := document.resolve(node["Kids"]).([]interface{}); ok {
+			for _, kid := range kids {
+				walk(kid, resources, depth+1)
+			}
+			return
+		}
+		node["Resources"] = resources
+		pages = append(pages, node)
+	}
+	walk(root["Pages"], nil, 0)
+	return pages
+}
+
+// pageText returns the text shown by the content streams of the page, with the whitespace collapsed.
+func (document *pdfDocument) pageText(page map[string]interface{}) string {
+	var content []byte
+	switch contents := page["Contents"].(type) {
+	case pdfRef:
+		if resolved, ok := document.resolve(contents).([]interface{}); ok {
+			page["Contents"] = resolved
+			return document.pageText(page)
+		}
+		content, _ = document.stream(contents)
+	case []interface{}:
+		for _, part := range contents {
+			data, _ := document.stream(part)
+			content = append(append(content, data...), '\n')
+		}
+	}
+	fonts := make(map[string]*pdfFont)
+	if resources, ok := document.resolve(page["Resources"]).(map[string]interface{}); ok {
+		if fontDictionary, ok := document.resolve(resources["Font"]).(map[string]interface{}); ok {
+			for name, value := range fontDictionary {
+				fonts[name] = document.font(value)
+			}
+		}
+	}
+	return strings.Join(strings.Fields(showText(content, fonts)), " ")
+}
+
+// showText runs the text operators of a content stream and returns the text they show.
+// Lines are separated by newlines, and large gaps between the strings of a TJ array become spaces.
+func showText(content []byte, fonts map[string]*pdfFont) string {
+	var text strings.Builder
+	var operands []interface{}
+	var font *pdfFont
+	lastY := 0.0
+	lexer := &pdfLexer{data: content}
+	for {
+		lexer.skipSpace()
+		if lexer.pos >= len(content) {
+			break
+		}
+		start := lexer.pos
+		object, ok := lexer.object(0)
+		if !ok {
+			if lexer.pos == start {
+				lexer.pos++
+			}
+			operands = operands[:0]
+			continue
+		}
+		operator, isOperator := object.(pdfKeyword)
+		if !isOperator {
+			operands = append(operands, object)
+			continue
+		}
+		switch operator {
+		case "Tf":
+			if len(operands) > 0 {
+				name, _ := operands[0].(pdfName)
+				font = fonts[string(name)]
+			}
+		case "Tj":
+			if len(operands) > 0 {
+				text.WriteString(font.decode(operands[len(operands)-1]))
+			}
+		case "'", "\"":
+			text.WriteByte('\n')
+			if len(operands) > 0 {
+				text.WriteString(font.decode(operands[len(operands)-1]))
+			}
+		case "TJ":
+			if len(operands) == 0 {
+				break
+			}
+			array, _ := operands[len(operands)-1].([]interface{})
+			for _, value := range array {
+				switch value := value.(type) {
+				case pdfString:
+					text.WriteString(font.decode(value))
+				case int:
+					if value < -200 {
+						text.WriteByte(' ')
+					}
+				case float64:
+					if value < -200 {
+						text.WriteByte(' ')
+					}
+				}
+			}
+		case "Td", "TD":
+			if len(operands) == 2 && number(operands[1]) != 0 {
+				text.WriteByte('\n')
+			} else {
+				text.WriteByte(' ')
+			}
+		case "Tm":
+			if len(operands) == 6 && number(operands[5]) != lastY {
+				lastY = number(operands[5])
+				text.WriteByte('\n')
+			} else {
+				text.WriteByte(' ')
+			}
+		case "T*", "ET":
+			text.WriteByte('\n')
+		case "BI":
+			// The data of an inline image runs from ID to EI and isn't made of objects.
+			end := bytes.Index(content[lexer.pos:], []byte("EI"))
+			for end != -1 && lexer.pos+end+2 < len(content) && !isDelimiter(content[lexer.pos+end+2]) {
+				next := bytes.Index(content[lexer.pos+end+2:], []byte("EI"))
+				if next == -1 {
+					end = -1
+					break
+				}
+				end += next + 2
+			}
+			if end == -1 {
+				lexer.pos = len(content)
+			} else {
+				lexer.pos += end + 2
+			}
+		}
+		operands = operands[:0]
+	}
+	return text.String()
+}
+
+func number(value interface{}) float64 {
+	switch value := value.(type) {
+	case int:
+		return float64(value)
+	case float64:
+		return value
+	}
+	return 0
+}
+
+// < ----- Fonts ----- >
+
+// pdfFont decodes the strings shown with a font. The codes are looked up in the ToUnicode map if the font has one.
+type pdfFont struct {
+	width   int               // The number of bytes of a code.
+	unicode map[uint32]string // The text of the codes, from the ToUnicode map.
+}
+
+// font reads the ToUnicode map of the font. The text of composite fonts without a map isn't known.
+func (document *pdfDocument) font(value interface{}) *pdfFont {
+	dictionary, ok := document.resolve(value).(map[string]interface{})
+	font := &pdfFont{width: 1}
+	if !ok {
+		return font
+	}
+	if dictionary["Subtype"] == pdfName("Type0") {
+		font.width = 2
+	}
+	if data, ok := document.stream(dictionary["ToUnicode"]); ok {
+		font.unicode = parseCMap(data, font)
+	}
+	return font
+}
+
+// decode returns the text of a string shown with the font. Strings shown with an unknown font are decoded as Latin-1.
+func (font *pdfFont) decode(value interface{}) string {
+	data, ok := value.(pdfString)
+	if !ok {
+		return ""
+	}
+	if font != nil && font.unicode != nil {
+		var text strings.Builder
+		for i := 0; i+font.width <= len(data); i += font.width {
+			code := uint32(0)
+			for _, b := range data[i : i+font.width] {
+				code = code<<8 | uint32(b)
+			}
+			text.WriteString(font.unicode[code])
+		}
+		return text.String()
+	}
+	if font != nil && font.width == 2 {
+		return ""
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// parseCMap reads the bfchar and bfrange mappings of a ToUnicode map. The width of the codes is taken from the codespace range.
+func parseCMap(data []byte, font *pdfFont) map[uint32]string {
+	unicode := make(map[uint32]string)
+	var operands []interface{}
+	lexer := &pdfLexer{data: data}
+	section := ""
+	for {
+		lexer.skipSpace()
+		if lexer.pos >= len(data) {
+			break
+		}
+		start := lexer.pos
+		object, ok := lexer.object(0)
+		if !ok {
+			if lexer.pos == start {
+				lexer.pos++
+			}
+			continue
+		}
+		keyword, isKeyword := object.(pdfKeyword)
+		if !isKeyword {
+			operands = append(operands, object)
+			continue
+		}
+		switch keyword {
+		case "begincodespacerange", "beginbfchar", "beginbfrange":
+			section = string(keyword)
+			operands = operands[:0]
+		case "endcodespacerange":
+			if len(operands) > 0 {
+				if low, ok := operands[0].(pdfString); ok && len(low) > 0 && len(low) <= 4 {
+					font.width = len(low)
+				}
+			}
+			section = ""
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				code, ok := operands[i].(pdfString)
+				target, isTarget := operands[i+1].(pdfString)
+				if ok && isTarget {
+					unicode[codeOf(code)] = utf16String(target)
+				}
+			}
+			section = ""
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				low, okLow := operands[i].(pdfString)
+				high, okHigh := operands[i+1].(pdfString)
+				if !okLow || !okHigh || codeOf(high) < codeOf(low) || codeOf(high)-codeOf(low) > 0xffff {
+					continue
+				}
+				switch target := operands[i+2].(type) {
+				case pdfString:
+					// The last unit of the target is incremented through the range.
+					// The codes are counted instead of compared, as the code after 0xffffffff wraps around to 0.
+					units := utf16Units(target)
+					for j := uint32(0); j <= codeOf(high)-codeOf(low) && len(units) > 0; j++ {
+						unicode[codeOf(low)+j] = string(utf16.Decode(units))
+						units[len(units)-1]++
+					}
+				case []interface{}:
+					for j, value := range target {
+						if value, ok := value.(pdfString); ok && uint32(j) <= codeOf(high)-codeOf(low) {
+							unicode[codeOf(low)+uint32(j)] = utf16String(value)
+						}
+					}
+				}
+			}
+			section = ""
+		}
+		if section == "" {
+			operands = operands[:0]
+		}
+	}
+	return unicode
+}
+
+func codeOf(data pdfString) uint32 {
+	code := uint32(0)
+	for _, b := range data {
+		code = code<<8 | uint32(b)
+	}
+	return code
+}
+
+func utf16Units(data pdfString) []uint16 {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return units
+}
+
+func utf16String(data pdfString) string {
+	return string(utf16.Decode(utf16Units(data)))
+}
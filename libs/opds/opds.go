@@ -0,0 +1,179 @@
+package opds
+
+import (
+	"encoding/xml"
+	"strings"
+	"time"
+)
+
+// < ----- OPDS ----- >
+
+// The media types of the catalog documents.
+const (
+	NavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	AcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	OpenSearchType  = "application/opensearchdescription+xml"
+)
+
+// The relations of the links in the feeds.
+const (
+	RelStart       = "start"
+	RelSelf        = "self"
+	RelUp          = "up"
+	RelSubsection  = "subsection"
+	RelSearch      = "search"
+	RelFirst       = "first"
+	RelPrevious    = "previous"
+	RelNext        = "next"
+	RelLast        = "last"
+	RelAcquisition = "http://opds-spec.org/acquisition"
+	RelImage       = "http://opds-spec.org/image"
+	RelThumbnail   = "http://opds-spec.org/image/thumbnail"
+)
+
+// MediaTypes are the media types of the book formats, by their extension.
+var MediaTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".epub": "application/epub+zip",
+	".cbz":  "application/vnd.comicbook+zip",
+	".cbr":  "application/vnd.comicbook-rar",
+	".cb7":  "application/x-cb7",
+	".mobi": "application/x-mobipocket-ebook",
+	".azw3": "application/vnd.amazon.ebook",
+	".fb2":  "application/x-fictionbook+xml",
+	".djvu": "image/vnd.djvu",
+	".txt":  "text/plain",
+}
+
+// MediaType returns the media type of the files with the extension, or an empty string if it isn't a book format.
+func MediaType(extension string) string {
+	return MediaTypes[strings.ToLower(extension)]
+}
+
+// Feed is an OPDS catalog feed, which is an Atom feed of navigation or acquisition entries.
+type Feed struct {
+	XMLName         xml.Name `xml:"feed"`
+	Xmlns           string   `xml:"xmlns,attr"`
+	XmlnsDC         string   `xml:"xmlns:dc,attr"`
+	XmlnsOpenSearch string   `xml:"xmlns:opensearch,attr"`
+	XmlnsOPDS       string   `xml:"xmlns:opds,attr"`
+	ID              string   `xml:"id"`
+	Title           string   `xml:"title"`
+	Updated         string   `xml:"updated"`
+	Author          Author   `xml:"author"`
+	Links           []Link   `xml:"link"`
+	TotalResults    int      `xml:"opensearch:totalResults,omitempty"`
+	ItemsPerPage    int      `xml:"opensearch:itemsPerPage,omitempty"`
+	StartIndex      int      `xml:"opensearch:startIndex,omitempty"`
+	Entries         []Entry  `xml:"entry"`
+}
+
+// Entry is a folder or a book in a feed.
+type Entry struct {
+	Title      string     `xml:"title"`
+	ID         string     `xml:"id"`
+	Updated    string     `xml:"updated"`
+	Authors    []Author   `xml:"author"`
+	Language   string     `xml:"dc:language,omitempty"`
+	Publisher  string     `xml:"dc:publisher,omitempty"`
+	Issued     string     `xml:"dc:issued,omitempty"`
+	Identifier string     `xml:"dc:identifier,omitempty"`
+	Categories []Category `xml:"category"`
+	Content    *Content   `xml:"content"`
+	Links      []Link     `xml:"link"`
+}
+
+// Author is the author of a feed or an entry.
+type Author struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+// Category is a tag of an entry.
+type Category struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+// Content is the description of an entry.
+type Content struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// Link links a feed or an entry to another feed, a file or an image.
+type Link struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+// NewFeed returns an empty feed with the namespaces of OPDS set.
+func NewFeed(id string, title string, updated time.Time) *Feed {
+	return &Feed{
+		Xmlns:           "http://www.w3.org/2005/Atom",
+		XmlnsDC:         "http://purl.org/dc/terms/",
+		XmlnsOpenSearch: "http://a9.com/-/spec/opensearch/1.1/",
+		XmlnsOPDS:       "http://opds-spec.org/2010/catalog",
+		ID:              id,
+		Title:           title,
+		Updated:         Time(updated),
+		Author:          Author{Name: "Ereader"},
+		Entries:         []Entry{},
+	}
+}
+
+// Marshal encodes the feed as an XML document.
+func (feed *Feed) Marshal() ([]byte, error) {
+	return marshal(feed)
+}
+
+// Time formats the time as an Atom date.
+func Time(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// < ----- OpenSearch ----- >
+
+// Description is an OpenSearch description document, which tells clients how to search the catalog.
+type Description struct {
+	XMLName        xml.Name `xml:"OpenSearchDescription"`
+	Xmlns          string   `xml:"xmlns,attr"`
+	ShortName      string   `xml:"ShortName"`
+	Description    string   `xml:"Description"`
+	InputEncoding  string   `xml:"InputEncoding"`
+	OutputEncoding string   `xml:"OutputEncoding"`
+	URL            URL      `xml:"Url"`
+}
+
+// URL is the template of the search URL, where {searchTerms} is replaced with the query.
+type URL struct {
+	Type     string `xml:"type,attr"`
+	Template string `xml:"template,attr"`
+}
+
+// NewDescription returns the description of a catalog searched with the template.
+func NewDescription(name string, description string, template string) *Description {
+	return &Description{
+		Xmlns:          "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:      name,
+		Description:    description,
+		InputEncoding:  "UTF-8",
+		OutputEncoding: "UTF-8",
+		URL:            URL{Type: AcquisitionType, Template: template},
+	}
+}
+
+// Marshal encodes the description as an XML document.
+func (description *Description) Marshal() ([]byte, error) {
+	return marshal(description)
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
@@ -0,0 +1,215 @@
+package progress
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// < ----- Progress ----- >
+
+// Table is the table the progress is stored in. It has a Hash, a Path and a Volume column, so it's kept up to date when files move.
+const Table = "Progress"
+
+// The formats of the documents progress is stored for.
+const (
+	PDF   = "pdf"
+	EPUB  = "epub"
+	Comic = "comic"
+)
+
+// Formats are the formats of the documents, by the extension of their files.
+var Formats = map[string]string{
+	".pdf":  PDF,
+	".epub": EPUB,
+	".cbz":  Comic,
+	".cbr":  Comic,
+	".cb7":  Comic,
+}
+
+// Format returns the format of the files with the extension, or an empty string if progress isn't kept for it.
+func Format(extension string) string {
+	return Formats[strings.ToLower(extension)]
+}
+
+// ErrStale is returned when the progress is older than the progress already stored.
+var ErrStale = errors.New("a newer progress is stored")
+
+// Progress is the position of a user in a document, which is identified by its hash.
+type Progress struct {
+	Username  string  `json:"-"`
+	Hash      string  `json:"Hash"`
+	Volume    string  `json:"Volume"` // The volume of the document, empty if it isn't known.
+	Path      string  `json:"Path"`   // The path of the document relative to its volume.
+	Format    string  `json:"Format"`
+	Locator   Locator `json:"Locator"`
+	Device    string  `json:"Device"`
+	Timestamp int64   `json:"Timestamp"` // When the position was reached, in unix time in milliseconds.
+}
+
+// Locator locates the position in a document. Pages are used for pdfs and comics, and positions for reflowable documents.
+type Locator struct {
+	Page     int     `json:"Page"`     // Pages are numbered from 1, 0 means no page.
+	Position string  `json:"Position"` // An EPUB CFI or a KOReader XPointer.
+	Percent  float64 `json:"Percent"`  // How far into the document the position is, from 0 to 1.
+}
+
+// Valid reports whether the locator locates a position.
+func (locator Locator) Valid() bool {
+	return locator.Page >= 0 && locator.Percent >= 0 && locator.Percent <= 1 && (locator.Page > 0 || locator.Position != "" || locator.Percent > 0)
+}
+
+// Now returns the current time in the unit of the timestamps.
+func Now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// Store stores the progress of the users in the Progress table.
+type Store struct {
+	DB *sql.DB
+}
+
+// InitTable creates the progress table if it doesn't exist.
+func (store *Store) InitTable() error {
+	statement, err := store.DB.Prepare(`
+		CREATE TABLE IF NOT EXISTS Progress(
+			Username TEXT NOT NULL,
+			Hash TEXT NOT NULL,
+			Volume TEXT,
+			Path TEXT,
+			Format TEXT,
+			Page INTEGER,
+			Position TEXT,
+			Percent REAL,
+			Device TEXT,
+			Timestamp INTEGER,
+			PRIMARY KEY(Username, Hash)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		return err
+	}
+	// Tables created before the progress was kept by volume lack the volume.
+	var count int
+	err = store.DB.QueryRow("SELECT COUNT(*) FROM pragma_table_info('Progress') WHERE name='Volume'").Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = store.DB.Exec("ALTER TABLE Progress ADD COLUMN Volume TEXT")
+	return err
+}
+
+// Get returns the progress of the user in the document with the hash. sql.ErrNoRows is returned if there is none.
+func (store *Store) Get(username string, hash string) (Progress, error) {
+	progress := Progress{Username: username}
+	var volume, path, format, position, device sql.NullString
+	result := store.DB.QueryRow("SELECT Hash, Volume, Path, Format, Page, Position, Percent, Device, Timestamp FROM Progress WHERE Username=$1 AND Hash=$2", username, hash)
+	err := result.Scan(&progress.Hash, &volume, &path, &format, &progress.Locator.Page, &position, &progress.Locator.Percent, &device, &progress.Timestamp)
+	progress.Volume = volume.String
+	progress.Path = path.String
+	progress.Format = format.String
+	progress.Locator.Position = position.String
+	progress.Device = device.String
+	return progress, err
+}
+
+// Update stores the progress, unless the stored progress of the user in the document is newer.
+// The timestamp is set to now if it's 0. ErrStale is returned with the stored progress if it's newer.
+func (store *Store) Update(progress Progress) (Progress, error) {
+	if progress.Timestamp == 0 {
+		progress.Timestamp = Now()
+	}
+	statement, err := store.DB.Prepare(`
+		INSERT INTO Progress (Username, Hash, Volume, Path, Format, Page, Position, Percent, Device, Timestamp) VALUES (?,?,?,?,?,?,?,?,?,?)
+		ON CONFLICT(Username, Hash) DO UPDATE SET Volume=excluded.Volume, Path=excluded.Path, Format=excluded.Format, Page=excluded.Page, Position=excluded.Position,
+			Percent=excluded.Percent, Device=excluded.Device, Timestamp=excluded.Timestamp
+		WHERE excluded.Timestamp >= Progress.Timestamp
+	`)
+	if err != nil {
+		return progress, err
+	}
+	result, err := statement.Exec(progress.Username, progress.Hash, progress.Volume, progress.Path, progress.Format, progress.Locator.Page,
+		progress.Locator.Position, progress.Locator.Percent, progress.Device, progress.Timestamp)
+	if err != nil {
+		return progress, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return progress, err
+	}
+	stored, err := store.Get(progress.Username, progress.Hash)
+	if err != nil {
+		return progress, err
+	}
+	return stored, ErrStale
+}
+
+// Migration moves the positions stored by a reader in its own table into the progress table.
+type Migration struct {
+	Table    string // The table of the reader, with an ID, Username, Hash and Path column.
+	Format   string
+	Page     string // The column holding the page, if the reader stores pages.
+	Position string // The column holding the position, if the reader stores positions.
+}
+
+// Migrations are the tables the readers stored their positions in before the progress table.
+var Migrations = []Migration{
+	{Table: "PDFS", Format: PDF, Page: "Page"},
+	{Table: "EPUBS", Format: EPUB, Position: "Position"},
+	{Table: "COMICS", Format: Comic, Page: "Page"},
+}
+
+// Migrate moves the positions in the table of the migration into the progress table, and returns how many were moved.
+// Positions already in the progress table are kept. Rows of the table are only removed once the progress table
+// has the position of their user in their document, so rows that can't be moved are left behind.
+func (store *Store) Migrate(migration Migration) (int64, error) {
+	var count int
+	err := store.DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=$1", migration.Table).Scan(&count)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+	page, position, valid := "0", "''", []string{}
+	if migration.Page != "" {
+		page = migration.Page
+		valid = append(valid, migration.Page+">0")
+	}
+	if migration.Position != "" {
+		position = migration.Position
+		valid = append(valid, "IFNULL("+migration.Position+",'')<>''")
+	}
+	if len(valid) == 0 {
+		return 0, nil
+	}
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	// The table names come from Migrations, never from a request.
+	result, err := tx.Exec(`
+		INSERT OR IGNORE INTO Progress (Username, Hash, Path, Format, Page, Position, Percent, Device, Timestamp)
+		SELECT Username, Hash, Path, $1, IFNULL(`+page+`,0), IFNULL(`+position+`,''), 0, '', 0 FROM `+migration.Table+`
+		WHERE Username IS NOT NULL AND Hash IS NOT NULL AND Hash<>'' AND (`+strings.Join(valid, " OR ")+`)
+		ORDER BY ID DESC
+	`, migration.Format)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	migrated, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	_, err = tx.Exec(`DELETE FROM ` + migration.Table + ` WHERE EXISTS (
+		SELECT 1 FROM Progress WHERE Progress.Username=` + migration.Table + `.Username AND Progress.Hash=` + migration.Table + `.Hash
+	)`)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return migrated, tx.Commit()
+}
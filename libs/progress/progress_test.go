@@ -0,0 +1,92 @@
+package progress
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func open(t *testing.T) *Store {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	store := &Store{DB: db}
+	if err := store.InitTable(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func exec(t *testing.T, store *Store, query string, args ...interface{}) {
+	if _, err := store.DB.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	store := open(t)
+	exec(t, store, "CREATE TABLE PDFS (ID INTEGER PRIMARY KEY, Username TEXT, Hash TEXT, Path TEXT, Page INTEGER)")
+	exec(t, store, "CREATE TABLE EPUBS (ID INTEGER PRIMARY KEY, Username TEXT, Hash TEXT, Path TEXT, Position TEXT)")
+	exec(t, store, "CREATE TABLE COMICS (ID INTEGER PRIMARY KEY, Username TEXT, Hash TEXT, Path TEXT, Page INTEGER, Direction TEXT)")
+	exec(t, store, `INSERT INTO PDFS (Username, Hash, Path, Page) VALUES
+		('bob', 'a', '/a.pdf', 3), ('bob', 'a', '/a.pdf', 7), ('bob', 'b', '/b.pdf', 0), ('bob', 'stored', '/c.pdf', 9)`)
+	exec(t, store, `INSERT INTO EPUBS (Username, Hash, Path, Position) VALUES
+		('bob', 'e', '/e.epub', 'epubcfi(/6/4!)@0.5000'), ('bob', 'f', '/f.epub', NULL)`)
+	exec(t, store, `INSERT INTO COMICS (Username, Hash, Path, Page, Direction) VALUES ('bob', 'c', '/c.cbz', 12, 'rtl')`)
+	if _, err := store.Update(Progress{Username: "bob", Hash: "stored", Path: "/c.pdf", Format: PDF, Locator: Locator{Page: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		migration Migration
+		migrated  int64
+		left      int // The rows left behind in the table.
+	}{
+		{migration: Migrations[0], migrated: 1, left: 1},
+		{migration: Migrations[1], migrated: 1, left: 1},
+		{migration: Migrations[2], migrated: 1, left: 0},
+		{migration: Migration{Table: "Missing", Format: PDF, Page: "Page"}},
+	}
+	for _, test := range tests {
+		migrated, err := store.Migrate(test.migration)
+		if err != nil {
+			t.Fatal(test.migration.Table, err)
+		}
+		if migrated != test.migrated {
+			t.Errorf("%s: migrated %d, want %d", test.migration.Table, migrated, test.migrated)
+		}
+		if test.migrated == 0 {
+			continue
+		}
+		var left int
+		store.DB.QueryRow("SELECT COUNT(*) FROM " + test.migration.Table).Scan(&left)
+		if left != test.left {
+			t.Errorf("%s: left %d rows, want %d", test.migration.Table, left, test.left)
+		}
+	}
+
+	want := map[string]Locator{
+		"a":      {Page: 7},
+		"stored": {Page: 2},
+		"e":      {Position: "epubcfi(/6/4!)@0.5000"},
+		"c":      {Page: 12},
+	}
+	for hash, locator := range want {
+		progress, err := store.Get("bob", hash)
+		if err != nil {
+			t.Fatal(hash, err)
+		}
+		if progress.Locator != locator {
+			t.Errorf("%s: got %+v, want %+v", hash, progress.Locator, locator)
+		}
+	}
+	for _, hash := range []string{"b", "f"} {
+		if _, err := store.Get("bob", hash); err != sql.ErrNoRows {
+			t.Errorf("%s: got %v, want no progress", hash, err)
+		}
+	}
+}
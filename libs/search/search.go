@@ -0,0 +1,241 @@
+package search
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	Files "../files"
+	Metadata "../metadata"
+)
+
+// < ----- Search ----- >
+
+// Index is the full-text index of the text of the books, stored in the SearchText table by hash and section.
+// The table uses the FTS5 extension of SQLite, so the server has to be built with the sqlite_fts5 tag.
+type Index struct {
+	DB *sql.DB
+}
+
+// Hit is a section of a book that matches a search.
+type Hit struct {
+	Hash     string  `json:"Hash"`
+	Page     int     `json:"Page"`
+	Position string  `json:"Position"`
+	Percent  float64 `json:"Percent"`
+	Snippet  string  `json:"Snippet"` // The matching text around the hit, escaped as HTML with the matches in mark tags.
+	Rank     float64 `json:"Rank"`    // Higher is better.
+}
+
+// InitTables creates the tables of the index if they don't exist. An error is returned if SQLite doesn't have FTS5.
+func (index *Index) InitTables() error {
+	for _, table := range []string{`
+		CREATE VIRTUAL TABLE IF NOT EXISTS SearchText USING fts5(
+			Text,
+			Hash UNINDEXED,
+			Page UNINDEXED,
+			Position UNINDEXED,
+			Percent UNINDEXED,
+			tokenize='unicode61 remove_diacritics 2'
+		);`, `
+		CREATE TABLE IF NOT EXISTS SearchDocuments(
+			Hash TEXT NOT NULL PRIMARY KEY,
+			Sections INTEGER,
+			Indexed INTEGER,
+			Error TEXT
+		);`,
+	} {
+		statement, err := index.DB.Prepare(table)
+		if err != nil {
+			return err
+		}
+		_, err = statement.Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Indexed reports whether the book with the hash has been indexed, even if its text couldn't be extracted.
+func (index *Index) Indexed(hash string) (bool, error) {
+	var count int
+	err := index.DB.QueryRow("SELECT COUNT(*) FROM SearchDocuments WHERE Hash=$1", hash).Scan(&count)
+	return count > 0, err
+}
+
+// Store replaces the text of the book with the hash. The error of the extraction is stored instead if there is one,
+// so the book isn't extracted again until it changes.
+func (index *Index) Store(hash string, sections []Metadata.Section, extractErr error) error {
+	tx, err := index.DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM SearchText WHERE Hash=$1", hash)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, section := range sections {
+		_, err = tx.Exec("INSERT INTO SearchText (Text, Hash, Page, Position, Percent) VALUES (?,?,?,?,?)", section.Text, hash, section.Page, section.Position, section.Percent)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	message := ""
+	if extractErr != nil {
+		message = extractErr.Error()
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO SearchDocuments (Hash, Sections, Indexed, Error) VALUES (?,?,?,?)", hash, len(sections), time.Now().Unix(), message)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Prune removes the books that are no longer in the file index.
+func (index *Index) Prune() error {
+	_, err := index.DB.Exec("DELETE FROM SearchText WHERE Hash NOT IN (SELECT Hash FROM FileIndex WHERE Hash IS NOT NULL)")
+	if err != nil {
+		return err
+	}
+	_, err = index.DB.Exec("DELETE FROM SearchDocuments WHERE Hash NOT IN (SELECT Hash FROM FileIndex WHERE Hash IS NOT NULL)")
+	return err
+}
+
+// Search returns the sections matching all the words of the query, best first, and the number of matching sections.
+// The last word also matches the words it's the start of.
+func (index *Index) Search(query string, limit int, offset int) ([]Hit, int, error) {
+	match := Query(query)
+	hits := []Hit{}
+	if match == "" {
+		return hits, 0, nil
+	}
+	var total int
+	err := index.DB.QueryRow("SELECT COUNT(*) FROM SearchText WHERE SearchText MATCH $1", match).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	result, err := index.DB.Query(`
+		SELECT Hash, Page, Position, Percent, snippet(SearchText, 0, char(2), char(3), '…', 24), bm25(SearchText) FROM SearchText
+		WHERE SearchText MATCH $1 ORDER BY bm25(SearchText) LIMIT $2 OFFSET $3
+	`, match, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer result.Close()
+	for result.Next() {
+		hit := Hit{}
+		err := result.Scan(&hit.Hash, &hit.Page, &hit.Position, &hit.Percent, &hit.Snippet, &hit.Rank)
+		if err != nil {
+			return nil, 0, err
+		}
+		hit.Snippet = strings.NewReplacer("\x02", "<mark>", "\x03", "</mark>").Replace(html.EscapeString(hit.Snippet))
+		hit.Rank = -hit.Rank
+		hits = append(hits, hit)
+	}
+	return hits, total, result.Err()
+}
+
+// Query turns the words of a search into an FTS5 query, where each word is a string so it can't be read as an operator.
+func Query(query string) string {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		word = strings.ReplaceAll(word, `"`, `""`)
+		terms = append(terms, `"`+word+`"`)
+	}
+	if len(terms) == 0 {
+		return ""
+	}
+	terms[len(terms)-1] += "*"
+	return strings.Join(terms, " ")
+}
+
+// < ----- Indexer ----- >
+
+// Indexer indexes the books in the volumes in the background. Books are found by their hash,
+// so only new and changed books are extracted, and a book in several places is extracted once.
+type Indexer struct {
+	Index   *Index
+	Volumes Files.Volumes
+}
+
+// Start indexes the volumes in the background, and again after every interval. The volumes are only indexed once if it's 0.
+func (indexer *Indexer) Start(interval time.Duration) {
+	go func() {
+		for {
+			indexer.IndexVolumes()
+			if interval <= 0 {
+				return
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// IndexVolumes indexes the books in the volumes that haven't been indexed yet, and removes the books that are gone.
+func (indexer *Indexer) IndexVolumes() {
+	for i := range indexer.Volumes {
+		err := indexer.indexVolume(&indexer.Volumes[i])
+		if err != nil {
+			fmt.Println("Search:", err.Error())
+		}
+	}
+	err := indexer.Index.Prune()
+	if err != nil {
+		fmt.Println("Search:", err.Error())
+	}
+}
+
+func (indexer *Indexer) indexVolume(volume *Files.Volume) error {
+	root, err := volume.Root()
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		relative := volume.Rel(path)
+		if info.IsDir() {
+			if Files.IsHidden(relative) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := Metadata.TextExtractors[strings.ToLower(filepath.Ext(path))]; !ok || !info.Mode().IsRegular() {
+			return nil
+		}
+		hash, err := indexer.hash(volume, relative, path, info)
+		if err != nil {
+			fmt.Println("Search:", err.Error())
+			return nil
+		}
+		indexed, err := indexer.Index.Indexed(hash)
+		if err != nil || indexed {
+			return err
+		}
+		sections, extractErr := Metadata.Text(path)
+		if extractErr != nil {
+			fmt.Println("Search: the text of", path, "can't be extracted:", extractErr.Error())
+		}
+		return indexer.Index.Store(hash, sections, extractErr)
+	})
+}
+
+// hash returns the hash of the file, from the file index if it's unchanged.
+func (indexer *Indexer) hash(volume *Files.Volume, relative string, path string, info os.FileInfo) (string, error) {
+	create := func() (string, error) {
+		return volume.HashFile(&Files.File{Path: path})
+	}
+	if volume.Index == nil {
+		return create()
+	}
+	return volume.Index.Hash(volume.Name, relative, info, create)
+}
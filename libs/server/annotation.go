@@ -0,0 +1,95 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	Annotation "../annotation"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- Annotations ----- >
+
+// GetAnnotations returns the annotations of the user in the document with the hash.
+func (server *Server) GetAnnotations(c *fiber.Ctx) {
+	annotations, err := server.Annotations.List(username(c), c.Params("hash"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, annotations)
+}
+
+// CreateAnnotation adds the annotation sent as JSON to the document with the hash.
+func (server *Server) CreateAnnotation(c *fiber.Ctx) {
+	annotation := Annotation.Annotation{}
+	if json.Unmarshal([]byte(c.Body()), &annotation) != nil || annotation.Validate() != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid annotation")
+		return
+	}
+	annotation.ID = randomID()
+	annotation.Username = username(c)
+	annotation.Hash = c.Params("hash")
+	entries, err := server.Index.LookupHash(annotation.Hash)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	if len(entries) == 0 {
+		c.Status(fiber.StatusNotFound).Send("unknown document")
+		return
+	}
+	err = server.Annotations.Insert(&annotation)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.Status(fiber.StatusCreated)
+	sendJSON(c, annotation)
+}
+
+// UpdateAnnotation changes the annotation with the id. Only the fields sent as JSON are changed.
+func (server *Server) UpdateAnnotation(c *fiber.Ctx) {
+	annotation, err := server.Annotations.Get(username(c), c.Params("id"))
+	if err == sql.ErrNoRows || (err == nil && annotation.Hash != c.Params("hash")) {
+		c.Status(fiber.StatusNotFound).Send("no such annotation")
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	id, hash := annotation.ID, annotation.Hash
+	if json.Unmarshal([]byte(c.Body()), &annotation) != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid annotation")
+		return
+	}
+	annotation.ID, annotation.Hash = id, hash
+	if annotation.Validate() != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid annotation")
+		return
+	}
+	err = server.Annotations.Update(&annotation)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, annotation)
+}
+
+// DeleteAnnotation removes the annotation with the id.
+func (server *Server) DeleteAnnotation(c *fiber.Ctx) {
+	annotation, err := server.Annotations.Get(username(c), c.Params("id"))
+	if err == sql.ErrNoRows || (err == nil && annotation.Hash != c.Params("hash")) {
+		c.Status(fiber.StatusNotFound).Send("no such annotation")
+		return
+	}
+	if err == nil {
+		err = server.Annotations.Delete(annotation.Username, annotation.ID)
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	Annotation "../annotation"
+	API "../api"
+	Files "../files"
+	Progress "../progress"
+	Shelf "../shelf"
+	Token "../token"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- API v1 ----- >
+
+// Profile is the current user, as returned by the API.
+type Profile struct {
+	ID             string             `json:"ID"`
+	Username       string             `json:"Username"`
+	ProfilePicture string             `json:"ProfilePicture"`
+	FileSettings   Files.FileSettings `json:"FileSettings"`
+}
+
+// SettingBody is the body of a request changing the application a file type is opened with.
+type SettingBody struct {
+	ApplicationLink string `json:"ApplicationLink"`
+}
+
+// RegisterV1 adds the routes of the first version of the API. Routes added after it under /api/v1 are answered with 404.
+func (server *Server) RegisterV1(v1 *API.V1) {
+	v1.Document.AddSecurityScheme("bearer", &API.SecurityScheme{
+		Type:        "http",
+		Scheme:      "bearer",
+		Description: "An API token made on the settings page. Tokens can't be used to manage tokens.",
+	})
+	fileParameters := []API.Parameter{
+		API.QueryParameter("volume", "The name of the volume, or Shelves for the shelves of the user.").Require(),
+		API.QueryParameter("path", "The path relative to the volume."),
+	}
+
+	// Volumes and files
+	v1.Handle("GET", "/volumes", API.Operation{
+		ID:         "listVolumes",
+		Summary:    "The volumes served by the server",
+		Tag:        "files",
+		Parameters: API.Pagination,
+		Result:     API.Page{Items: []Files.Volume{}},
+	}, server.V1Volumes)
+	v1.Handle("GET", "/files", API.Operation{
+		ID:         "listFiles",
+		Summary:    "The files in a folder",
+		Tag:        "files",
+		Parameters: append(fileParameters, API.Pagination...),
+		Result:     API.Page{Items: Files.Files{}},
+	}, server.V1Files)
+	v1.Handle("GET", "/files/stat", API.Operation{
+		ID:      "statFile",
+		Summary: "A file or a folder",
+		Tag:     "files",
+		Parameters: []API.Parameter{
+			API.QueryParameter("volume", "The name of the volume. The books on the shelves are found in the volume they're listed with.").Require(),
+			fileParameters[1],
+		},
+		Result: Files.File{},
+	}, server.V1File)
+
+	// Settings and users
+	v1.Handle("GET", "/settings", API.Operation{
+		ID:         "listSettings",
+		Summary:    "The applications the file types are opened with",
+		Tag:        "settings",
+		Parameters: API.Pagination,
+		Result:     API.Page{Items: Files.FileSettings{}},
+	}, server.V1Settings)
+	v1.Handle("PUT", "/settings/:extension", API.Operation{
+		ID:          "updateSetting",
+		Summary:     "Change the application a file type is opened with",
+		Description: "The extension is given without the leading dot, like pdf.",
+		Tag:         "settings",
+		Body:        SettingBody{},
+		Result:      Files.FileSetting{},
+	}, server.V1UpdateSetting)
+	v1.Handle("GET", "/users/me", API.Operation{
+		ID:      "getCurrentUser",
+		Summary: "The current user",
+		Tag:     "users",
+		Result:  Profile{},
+	}, server.V1Me)
+
+	// Progress and annotations
+	v1.Handle("GET", "/progress/:hash", API.Operation{
+		ID:      "getProgress",
+		Summary: "The reading progress in a document",
+		Tag:     "progress",
+		Result:  Progress.Progress{},
+	}, server.GetProgress)
+	v1.Handle("PUT", "/progress/:hash", API.Operation{
+		ID:          "updateProgress",
+		Summary:     "Store the reading progress in a document",
+		Description: "The newest progress wins. If the stored progress is newer it's sent back as the details of a 409 error.",
+		Tag:         "progress",
+		Body:        Progress.Progress{},
+		Result:      Progress.Progress{},
+	}, server.UpdateProgress)
+	v1.Handle("GET", "/annotations/:hash", API.Operation{
+		ID:      "listAnnotations",
+		Summary: "The bookmarks, highlights and notes in a document",
+		Tag:     "progress",
+		Result:  []Annotation.Annotation{},
+	}, server.GetAnnotations)
+	v1.Handle("POST", "/annotations/:hash", API.Operation{
+		ID:      "createAnnotation",
+		Summary: "Add a bookmark, highlight or note to a document",
+		Tag:     "progress",
+		Body:    Annotation.Annotation{},
+		Status:  fiber.StatusCreated,
+		Result:  Annotation.Annotation{},
+	}, server.CreateAnnotation)
+	v1.Handle("PUT", "/annotations/:hash/:id", API.Operation{
+		ID:      "updateAnnotation",
+		Summary: "Change an annotation, only the fields sent are changed",
+		Tag:     "progress",
+		Body:    Annotation.Annotation{},
+		Result:  Annotation.Annotation{},
+	}, server.UpdateAnnotation)
+	v1.Handle("DELETE", "/annotations/:hash/:id", API.Operation{
+		ID:      "deleteAnnotation",
+		Summary: "Remove an annotation",
+		Tag:     "progress",
+		Status:  fiber.StatusNoContent,
+	}, server.DeleteAnnotation)
+
+	// Search
+	v1.Handle("GET", "/search", API.Operation{
+		ID:      "searchText",
+		Summary: "Search the text of the books",
+		Tag:     "search",
+		Parameters: []API.Parameter{
+			API.QueryParameter("q", "The words to search for.").Require(),
+			API.IntegerParameter("limit", "The number of hits.", 1, 100),
+			API.IntegerParameter("offset", "The number of hits to skip.", 0, 1<<31-1),
+		},
+		Result: SearchResults{},
+	}, server.SearchText)
+	v1.Handle("GET", "/catalog", API.Operation{
+		ID:      "searchCatalog",
+		Summary: "Search the books by their file name and metadata",
+		Tag:     "search",
+		Parameters: []API.Parameter{
+			API.QueryParameter("q", "The words to search for, typos are allowed."),
+			API.ListParameter("author", "Only books by the author."),
+			API.ListParameter("series", "Only books in the series."),
+			API.ListParameter("tag", "Only books with the tag."),
+			API.ListParameter("format", "Only files with the extension, like epub."),
+			API.ListParameter("language", "Only books in the language."),
+			API.ListParameter("volume", "Only files in the volume."),
+			API.ListParameter("usertag", "Only books the user gave the tag."),
+			API.QueryParameter("addedAfter", "Only files added after the date, like 2006-01-02, or unix time."),
+			API.QueryParameter("addedBefore", "Only files added before the date."),
+			API.QueryParameter("sort", "relevance, title, author, series, name, added or size, with a leading - for descending."),
+			API.QueryParameter("cursor", "The Next cursor of the previous page."),
+			API.IntegerParameter("limit", "The number of files on a page.", 1, 200),
+		},
+		Result: CatalogPage{},
+	}, server.SearchCatalog)
+
+	// Shelves and tags
+	v1.Handle("GET", "/shelves", API.Operation{
+		ID:      "listShelves",
+		Summary: "The shelves of the user",
+		Tag:     "shelves",
+		Result:  []Shelf.Shelf{},
+	}, server.GetShelves)
+	v1.Handle("POST", "/shelves", API.Operation{
+		ID:      "createShelf",
+		Summary: "Add a shelf, a shelf with a query is a smart shelf",
+		Tag:     "shelves",
+		Body:    Shelf.Shelf{},
+		Status:  fiber.StatusCreated,
+		Result:  Shelf.Shelf{},
+	}, server.CreateShelf)
+	v1.Handle("GET", "/shelves/:id", API.Operation{
+		ID:      "getShelf",
+		Summary: "A shelf and the books on it",
+		Tag:     "shelves",
+		Result:  ShelfContents{},
+	}, server.GetShelf)
+	v1.Handle("PUT", "/shelves/:id", API.Operation{
+		ID:      "updateShelf",
+		Summary: "Rename a shelf or change its query, only the fields sent are changed",
+		Tag:     "shelves",
+		Body:    Shelf.Shelf{},
+		Result:  Shelf.Shelf{},
+	}, server.UpdateShelf)
+	v1.Handle("DELETE", "/shelves/:id", API.Operation{
+		ID:      "deleteShelf",
+		Summary: "Remove a shelf, the books on it are kept",
+		Tag:     "shelves",
+		Status:  fiber.StatusNoContent,
+	}, server.DeleteShelf)
+	v1.Handle("PUT", "/shelves/:id/books/:hash", API.Operation{
+		ID:      "addShelfBook",
+		Summary: "Put a book on a shelf",
+		Tag:     "shelves",
+		Status:  fiber.StatusNoContent,
+	}, server.AddShelfBook)
+	v1.Handle("DELETE", "/shelves/:id/books/:hash", API.Operation{
+		ID:      "removeShelfBook",
+		Summary: "Take a book off a shelf",
+		Tag:     "shelves",
+		Status:  fiber.StatusNoContent,
+	}, server.RemoveShelfBook)
+	v1.Handle("GET", "/tags", API.Operation{
+		ID:      "listTags",
+		Summary: "The tags of the user with the number of books each was given",
+		Tag:     "shelves",
+		Result:  []Shelf.Tag{},
+	}, server.GetTags)
+	v1.Handle("GET", "/tags/:hash", API.Operation{
+		ID:      "getBookTags",
+		Summary: "The tags the user gave a book",
+		Tag:     "shelves",
+		Result:  []string{},
+	}, server.GetBookTags)
+	v1.Handle("PUT", "/tags/:hash", API.Operation{
+		ID:      "setBookTags",
+		Summary: "Replace the tags the user gave a book",
+		Tag:     "shelves",
+		Body:    []string{},
+		Result:  []string{},
+	}, server.SetBookTags)
+
+	// API tokens
+	v1.Handle("GET", "/tokens", API.Operation{
+		ID:      "listTokens",
+		Summary: "The API tokens of the user, without the tokens themselves",
+		Tag:     "users",
+		Result:  Token.Tokens{},
+	}, server.GetTokens)
+	v1.Handle("POST", "/tokens", API.Operation{
+		ID:          "createToken",
+		Summary:     "Make an API token",
+		Description: "The scopes are read, progress and upload. The token is only sent in this response.",
+		Tag:         "users",
+		Body:        Token.Token{},
+		Status:      fiber.StatusCreated,
+		Result:      Token.Token{},
+	}, server.CreateToken)
+	v1.Handle("DELETE", "/tokens/:id", API.Operation{
+		ID:      "deleteToken",
+		Summary: "Revoke an API token",
+		Tag:     "users",
+		Status:  fiber.StatusNoContent,
+	}, server.DeleteToken)
+
+	v1.NotFound()
+}
+
+// V1Volumes returns a page of the volumes served by the server.
+func (server *Server) V1Volumes(c *fiber.Ctx) {
+	sendPage(c, server.Volumes)
+}
+
+// V1Files returns a page of the files in the folder at the path of the volume, like GetFiles.
+func (server *Server) V1Files(c *fiber.Ctx) {
+	files, err := server.listFolder(username(c), c.Query("volume"), c.Query("path"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	user := server.GetUserByUsername(username(c))
+	sendPage(c, files.AddFileSetting(user.FileSettings.ToMap()))
+}
+
+// V1File returns the file or folder at the path of the volume.
+func (server *Server) V1File(c *fiber.Ctx) {
+	volume, err := server.Volumes.Get(c.Query("volume"))
+	if err != nil {
+		API.Error(c, fiber.StatusNotFound, err.Error(), nil)
+		return
+	}
+	file, err := server.stat(username(c), volume, c.Query("path"))
+	if os.IsNotExist(err) {
+		API.Error(c, fiber.StatusNotFound, "no such file", nil)
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	API.SendJSON(c, file)
+}
+
+// V1Settings returns a page of the file settings of the user.
+func (server *Server) V1Settings(c *fiber.Ctx) {
+	sendPage(c, server.GetFileSettingsByUsername(username(c)))
+}
+
+// V1UpdateSetting changes the application the user opens the files with the extension with.
+func (server *Server) V1UpdateSetting(c *fiber.Ctx) {
+	extension := strings.TrimPrefix(c.Params("extension"), ".")
+	if !validName(extension) || strings.Contains(extension, ".") {
+		API.Error(c, fiber.StatusBadRequest, "invalid extension", nil)
+		return
+	}
+	body := SettingBody{}
+	json.Unmarshal([]byte(c.Body()), &body)
+	setting := Files.FileSetting{Username: username(c), Extension: "." + extension, ApplicationLink: body.ApplicationLink}
+	err := server.UpdateFileSetting(setting.Username, setting.Extension, setting.ApplicationLink)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	API.SendJSON(c, setting)
+}
+
+// V1Me returns the current user without the password.
+func (server *Server) V1Me(c *fiber.Ctx) {
+	user := server.GetUserByUsername(username(c))
+	API.SendJSON(c, Profile{ID: user.ID, Username: user.Username, ProfilePicture: user.ProfilePicture, FileSettings: user.FileSettings})
+}
+
+// sendPage sends the page of the list selected by the limit and cursor parameters.
+func sendPage(c *fiber.Ctx, list interface{}) {
+	page, err := API.Paginate(c, list)
+	if err != nil {
+		API.Error(c, fiber.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	API.SendJSON(c, page)
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	Calibre "../calibre"
+	Enrich "../enrich"
+	Files "../files"
+)
+
+// < ----- Calibre ----- >
+
+// ReaderLinks are the reader extensions the books of an imported library are opened with, by the extension of their files.
+var ReaderLinks = map[string]string{
+	".pdf":  "/pdf",
+	".epub": "/epub",
+	".cbz":  "/comic",
+	".cbr":  "/comic",
+	".cb7":  "/comic",
+}
+
+// ImportResult counts what was imported from a library.
+type ImportResult struct {
+	Books   int
+	Files   int
+	Covers  int
+	Missing int // The files listed by the library which aren't on disk.
+}
+
+// ImportCalibreLibrary registers the Calibre library in the folder as a volume with the given name, and imports the metadata
+// and covers of its books into the catalog. A library can be imported again to pick up the changes made in Calibre.
+// Users get the reader extension of each format the library has, unless they already chose an application for it.
+func (server *Server) ImportCalibreLibrary(name string, path string) (ImportResult, error) {
+	result := ImportResult{}
+	library, err := Calibre.Open(path)
+	if err != nil {
+		return result, err
+	}
+	defer library.Close()
+	volume, err := server.Volumes.Get(name)
+	if err == nil && (volume.Library != "calibre" || volume.Path != library.Path) {
+		return result, errors.New("the volume " + strconv.Quote(name) + " already exists")
+	}
+	if err != nil {
+		volume, err = server.addVolume(Files.Volume{Name: name, Path: library.Path, Library: "calibre", HashMode: Files.FullHash})
+		if err != nil {
+			return result, err
+		}
+	}
+	books, err := library.Books()
+	if err != nil {
+		return result, err
+	}
+	extensions := make(map[string]bool)
+	for _, calibreBook := range books {
+		imported := false
+		for _, format := range calibreBook.Formats {
+			file, err := volume.Stat(calibreBook.File(format))
+			if os.IsNotExist(err) {
+				result.Missing++
+				continue
+			}
+			if err != nil {
+				return result, err
+			}
+			covered, err := server.importCalibreBook(library, calibreBook, file.Hash)
+			if err != nil {
+				return result, err
+			}
+			if covered {
+				result.Covers++
+			}
+			extensions[format.Extension()] = true
+			imported = true
+			result.Files++
+		}
+		if imported {
+			result.Books++
+		}
+	}
+	return result, server.addReaderLinks(extensions)
+}
+
+// importCalibreBook replaces the metadata of the file with the metadata of the book in Calibre, which the user has curated.
+// True is returned if the book has a cover.
+func (server *Server) importCalibreBook(library *Calibre.Library, calibreBook Calibre.Book, hash string) (bool, error) {
+	book := Enrich.CalibreBook(calibreBook)
+	book.Hash = hash
+	book.Source = "calibre:" + library.Folder(calibreBook)
+	book.Enriched = time.Now().Unix()
+	if cover := library.Cover(calibreBook); cover != "" {
+		data, err := ioutil.ReadFile(cover)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if len(data) > 0 {
+			err = server.Catalog.StoreCover(hash, http.DetectContentType(data), data)
+			if err != nil {
+				return false, err
+			}
+			book.Cover = "/cover/" + hash
+		}
+	}
+	return book.Cover != "", server.Catalog.Store(book)
+}
+
+// addReaderLinks gives every user the reader extension of the file extensions they don't have an application for.
+func (server *Server) addReaderLinks(extensions map[string]bool) error {
+	result, err := server.DB.Query("SELECT Username FROM Users")
+	if err != nil {
+		return err
+	}
+	var usernames []string
+	for result.Next() {
+		var username string
+		if err := result.Scan(&username); err != nil {
+			result.Close()
+			return err
+		}
+		usernames = append(usernames, username)
+	}
+	result.Close()
+	for _, username := range usernames {
+		for extension := range extensions {
+			link, ok := ReaderLinks[extension]
+			if !ok || server.GetFileSettingByUsernameAndExtension(username, extension).Extension != "" {
+				continue
+			}
+			err := server.InsertFileSetting(username, extension, link)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// < ----- Volumes ----- >
+
+// addVolume stores the volume, so it's served from then on, and adds it to the volumes of the server.
+func (server *Server) addVolume(volume Files.Volume) (*Files.Volume, error) {
+	if volume.Name == Files.ShelvesVolume {
+		return nil, Files.ErrShelvesVolume
+	}
+	statement, err := server.DB.Prepare("INSERT INTO Volumes (Name, Path, Library, HashMode) VALUES (?,?,?,?)")
+	if err != nil {
+		return nil, err
+	}
+	_, err = statement.Exec(volume.Name, volume.Path, volume.Library, string(volume.HashMode))
+	if err != nil {
+		return nil, err
+	}
+	volume.Route = "/volume/" + url.PathEscape(volume.Name)
+	volume.Index = server.Index
+	volume.Catalog = server.Catalog
+	if server.Thumbnails != nil {
+		volume.Thumbnails = server.Thumbnails
+	}
+	server.Volumes = append(server.Volumes, volume)
+	return &server.Volumes[len(server.Volumes)-1], nil
+}
+
+// loadVolumes adds the stored volumes to the volumes of the server. Volumes given by the volumes flag take precedence.
+func (server *Server) loadVolumes() error {
+	result, err := server.DB.Query("SELECT Name, Path, Library, HashMode FROM Volumes ORDER BY Name")
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+	for result.Next() {
+		volume := Files.Volume{}
+		var hashMode string
+		if err := result.Scan(&volume.Name, &volume.Path, &volume.Library, &hashMode); err != nil {
+			return err
+		}
+		if volume.Name == Files.ShelvesVolume {
+			fmt.Println("The imported volume", strconv.Quote(volume.Name), "is hidden by the shelves")
+			continue
+		}
+		if _, err := server.Volumes.Get(volume.Name); err == nil {
+			fmt.Println("The imported volume", strconv.Quote(volume.Name), "is hidden by a volume with the same name")
+			continue
+		}
+		volume.Route = "/volume/" + url.PathEscape(volume.Name)
+		volume.HashMode = Files.HashMode(strings.TrimSpace(hashMode))
+		if volume.HashMode == "" {
+			volume.HashMode = Files.FullHash
+		}
+		server.Volumes = append(server.Volumes, volume)
+	}
+	return result.Err()
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/url"
+
+	Files "../files"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- Catalog search ----- >
+
+// CatalogPage is a page of the files found by a catalog search.
+type CatalogPage struct {
+	Files  Files.Files                   `json:"Files"`
+	Facets map[string][]Files.FacetCount `json:"Facets"`
+	Total  int                           `json:"Total"`
+	Next   string                        `json:"Next"`
+}
+
+// SearchCatalog finds the files in the volumes by their file name and metadata, with the parameters read by Files.ParseCatalogQuery.
+// The files are returned like GetFiles returns them, a page at a time, with the counts of the values of each facet.
+func (server *Server) SearchCatalog(c *fiber.Ctx) {
+	values, err := url.ParseQuery(string(c.Fasthttp.URI().QueryString()))
+	if err != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid query")
+		return
+	}
+	query, err := Files.ParseCatalogQuery(values)
+	if err != nil {
+		c.Status(fiber.StatusBadRequest).Send(err.Error())
+		return
+	}
+	if query.Limit <= 0 || query.Limit > 200 {
+		query.Limit = 50
+	}
+	for _, volume := range server.Volumes {
+		query.Library = append(query.Library, volume.Name)
+	}
+	query.UserTags, err = server.Shelves.TagMap(username(c))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	results, err := server.Catalog.Search(query)
+	if err == Files.ErrInvalidCursor {
+		c.Status(fiber.StatusBadRequest).Send(err.Error())
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	page := CatalogPage{Facets: results.Facets, Total: results.Total, Next: results.Next}
+	page.Files, err = server.Volumes.Files(results.Entries)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	// The files gone since they were indexed are left out of the total too, until the watcher removes them from the index.
+	page.Total -= len(results.Entries) - len(page.Files)
+	user := server.GetUserByUsername(username(c))
+	page.Files = page.Files.AddFileSetting(user.FileSettings.ToMap())
+	sendJSON(c, page)
+}
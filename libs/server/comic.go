@@ -0,0 +1,70 @@
+package server
+
+import (
+	"os"
+	"path"
+	"strconv"
+
+	Comic "../comic"
+	Files "../files"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- Comics ----- >
+
+// GetComic returns the pages of a comic archive in a volume as JSON.
+// With the page query parameter the image of that page is sent instead.
+func (server *Server) GetComic(c *fiber.Ctx) {
+	volume, err := server.Volumes.Get(c.Params("volume"))
+	if err != nil || c.Params("volume") == "" {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	file, err := volume.Resolve(wildcard(c))
+	if err == Files.ErrOutsideVolume {
+		c.SendStatus(fiber.StatusForbidden)
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	if info, err := os.Stat(file); err != nil || info.IsDir() {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	if c.Query("page") == "" {
+		comic, err := Comic.Open(file)
+		if err != nil {
+			sendComicError(c, err)
+			return
+		}
+		sendJSON(c, comic)
+		return
+	}
+	index, err := strconv.Atoi(c.Query("page"))
+	if err != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid page")
+		return
+	}
+	page, info, err := Comic.OpenPage(file, index)
+	if err != nil {
+		sendComicError(c, err)
+		return
+	}
+	c.Type(path.Ext(info.Name))
+	// The page and the archive are closed by fasthttp once the page has been sent.
+	c.SendStream(page, int(info.Size))
+}
+
+// sendComicError sends the status code matching an error from the comic package.
+func sendComicError(c *fiber.Ctx, err error) {
+	switch err {
+	case Comic.ErrNoPage:
+		c.SendStatus(fiber.StatusNotFound)
+	case Comic.ErrUnknownFormat:
+		c.Status(fiber.StatusUnsupportedMediaType).Send(err.Error())
+	default:
+		sendError(c, err)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	Epub "../epub"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- EPUB ----- >
+
+// MaxEPUBResourceSize is the largest file inside an EPUB that is served.
+const MaxEPUBResourceSize = 64 * 1024 * 1024
+
+// epubResourcePolicy is sent with the files inside the books. The books come from anywhere, so their pages are
+// sandboxed into their own origin without scripts, and can't reach the cookies or the API of the signed in user.
+const epubResourcePolicy = "sandbox"
+
+// GetEPUB returns the metadata, spine and table of contents of the EPUB with the given hash as JSON.
+func (server *Server) GetEPUB(c *fiber.Ctx) {
+	book, err := server.openEPUB(c.Params("hash"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	defer book.Close()
+	sendJSON(c, book)
+}
+
+// GetEPUBResource serves a file from inside the EPUB with the given hash, like a chapter, a stylesheet or an image.
+// The files are served under the book, so the relative links between them work in the reader.
+// They are sandboxed, so a page of a book opened on its own can't run scripts as the user.
+func (server *Server) GetEPUBResource(c *fiber.Ctx) {
+	book, err := server.openEPUB(c.Params("hash"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	defer book.Close()
+	href := wildcard(c)
+	size, err := book.Size(href)
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	if size > MaxEPUBResourceSize {
+		sendError(c, &requestError{Status: fiber.StatusRequestEntityTooLarge, Message: href + " is too large"})
+		return
+	}
+	file, err := book.Open(href)
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	// The book is closed when the handler returns, so the file is read before it is sent.
+	// The size in the zip can't be trusted, so the read is limited too.
+	data, err := ioutil.ReadAll(io.LimitReader(file, MaxEPUBResourceSize+1))
+	file.Close()
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	if len(data) > MaxEPUBResourceSize {
+		sendError(c, &requestError{Status: fiber.StatusRequestEntityTooLarge, Message: href + " is too large"})
+		return
+	}
+	c.Set(fiber.HeaderContentSecurityPolicy, epubResourcePolicy)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	if mediaType := book.MediaType(href); mediaType != "" {
+		c.Set(fiber.HeaderContentType, mediaType)
+	} else {
+		c.Type(filepath.Ext(href))
+	}
+	c.SendBytes(data)
+}
+
+// openEPUB opens the EPUB with the given hash from the first volume it is found in.
+func (server *Server) openEPUB(hash string) (*Epub.Book, error) {
+	entries, err := server.Index.LookupHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		volume, err := server.Volumes.Get(entry.Volume)
+		if err != nil {
+			continue
+		}
+		path, err := volume.Resolve(entry.Path)
+		if err != nil {
+			continue
+		}
+		book, err := Epub.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, &requestError{Status: fiber.StatusUnprocessableEntity, Message: err.Error()}
+		}
+		return book, nil
+	}
+	return nil, &requestError{Status: fiber.StatusNotFound, Message: "no book with the hash " + hash}
+}
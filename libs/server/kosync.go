@@ -0,0 +1,196 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+
+	Kosync "../kosync"
+	Progress "../progress"
+	"github.com/gofiber/fiber"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// < ----- KOReader Sync ----- >
+
+// KOSyncCreateUser registers a user from KOReader. The password is the md5 hash of the password the user typed,
+// which also works as the password of the user on the web.
+func (server *Server) KOSyncCreateUser(c *fiber.Ctx) {
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if json.Unmarshal([]byte(c.Body()), &credentials) != nil || len(credentials.Username) < 3 || credentials.Password == "" {
+		sendSyncError(c, Kosync.ErrInvalidFields)
+		return
+	}
+	if server.GetUserByUsername(credentials.Username).Username == credentials.Username {
+		sendSyncError(c, Kosync.ErrUserExists)
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), 8)
+	if err == nil {
+		err = server.InsertUser(credentials.Username, string(hashedPassword), "")
+	}
+	if err == nil {
+		err = server.Sync.SetKey(credentials.Username, credentials.Password)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		sendSyncError(c, Kosync.ErrInternal)
+		return
+	}
+	sendSync(c, fiber.StatusCreated, fiber.Map{"username": credentials.Username})
+}
+
+// KOSyncAuth authenticates the requests of KOReader with the x-auth-user and x-auth-key headers.
+// The key of a user is set when they sign in on the web or register from KOReader.
+func (server *Server) KOSyncAuth(c *fiber.Ctx) {
+	username := c.Get("x-auth-user")
+	if username == "" || !server.Sync.Authorize(username, c.Get("x-auth-key")) {
+		sendSyncError(c, Kosync.ErrUnauthorized)
+		return
+	}
+	c.Locals("username", username)
+	c.Next()
+}
+
+// KOSyncAuthorize confirms the credentials of the user.
+func (server *Server) KOSyncAuthorize(c *fiber.Ctx) {
+	sendSync(c, fiber.StatusOK, fiber.Map{"authorized": "OK"})
+}
+
+// KOSyncUpdateProgress stores the progress of the user in a document. The page of a pdf is shared with the web reader.
+func (server *Server) KOSyncUpdateProgress(c *fiber.Ctx) {
+	progress := Kosync.Progress{}
+	if json.Unmarshal([]byte(c.Body()), &progress) != nil {
+		sendSyncError(c, Kosync.ErrInvalidFields)
+		return
+	}
+	if progress.Document == "" {
+		sendSyncError(c, Kosync.ErrMissingDocument)
+		return
+	}
+	if progress.Progress == "" || progress.Device == "" {
+		sendSyncError(c, Kosync.ErrInvalidFields)
+		return
+	}
+	username := c.Locals("username").(string)
+	err := server.Sync.Update(username, &progress)
+	if err == nil {
+		err = server.sharePage(username, progress)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		sendSyncError(c, Kosync.ErrInternal)
+		return
+	}
+	sendSync(c, fiber.StatusOK, fiber.Map{"document": progress.Document, "timestamp": progress.Timestamp})
+}
+
+// KOSyncGetProgress sends the progress of the user in a document, or an empty object if there is none.
+// A page turned in the web reader since the last sync is sent as the progress.
+func (server *Server) KOSyncGetProgress(c *fiber.Ctx) {
+	username := c.Locals("username").(string)
+	document := c.Params("document")
+	progress, err := server.Sync.Progress(username, document)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Println(err.Error())
+		sendSyncError(c, Kosync.ErrInternal)
+		return
+	}
+	synced := err == nil
+	web, err := server.webProgress(username, document)
+	if err != nil {
+		fmt.Println(err.Error())
+		sendSyncError(c, Kosync.ErrInternal)
+		return
+	}
+	if web.Locator.Page > 0 && (!synced || web.Timestamp/1000 > progress.Timestamp) {
+		percentage := web.Locator.Percent
+		// The percentage is estimated from the last synced position if the web reader didn't send it.
+		if previous, err := strconv.Atoi(progress.Progress); percentage == 0 && synced && err == nil && previous > 0 {
+			percentage = math.Min(progress.Percentage*float64(web.Locator.Page)/float64(previous), 1)
+		}
+		device := web.Device
+		if device == "" {
+			device = "Ereader"
+		}
+		progress = Kosync.Progress{Document: document, Progress: strconv.Itoa(web.Locator.Page), Percentage: percentage, Device: device, DeviceID: "ereader", Timestamp: web.Timestamp / 1000}
+		synced = true
+	}
+	if !synced {
+		sendSync(c, fiber.StatusOK, fiber.Map{})
+		return
+	}
+	sendSync(c, fiber.StatusOK, progress)
+}
+
+// sharePage stores the page of a pdf synced by KOReader as the progress of the user in the pdf, so the web reader opens it there.
+func (server *Server) sharePage(username string, progress Kosync.Progress) error {
+	page, err := strconv.Atoi(progress.Progress)
+	if err != nil || page < 1 {
+		return nil
+	}
+	entries, err := server.Index.LookupDigest(progress.Document)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if Progress.Format(path.Ext(entry.Path)) != Progress.PDF {
+			continue
+		}
+		_, err := server.Progress.Update(Progress.Progress{
+			Username:  username,
+			Hash:      entry.Hash,
+			Volume:    entry.Volume,
+			Path:      entry.Path,
+			Format:    Progress.PDF,
+			Locator:   Progress.Locator{Page: page, Percent: progress.Percentage},
+			Device:    progress.Device,
+			Timestamp: Progress.Now(),
+		})
+		if err != nil && err != Progress.ErrStale {
+			return err
+		}
+	}
+	return nil
+}
+
+// webProgress returns the progress of the user in the pdf with the digest, which is empty if the user hasn't opened it.
+func (server *Server) webProgress(username string, document string) (Progress.Progress, error) {
+	entries, err := server.Index.LookupDigest(document)
+	if err != nil {
+		return Progress.Progress{}, err
+	}
+	for _, entry := range entries {
+		if Progress.Format(path.Ext(entry.Path)) != Progress.PDF {
+			continue
+		}
+		progress, err := server.Progress.Get(username, entry.Hash)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		return progress, err
+	}
+	return Progress.Progress{}, nil
+}
+
+// sendSync sends the value as JSON with the status code.
+func sendSync(c *fiber.Ctx, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		fmt.Println(err.Error())
+		data, _ = json.Marshal(Kosync.ErrInternal)
+		status = Kosync.ErrInternal.Status
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	c.Status(status).SendBytes(data)
+}
+
+func sendSyncError(c *fiber.Ctx, err *Kosync.Error) {
+	sendSync(c, err.Status, err)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	Files "../files"
+	Kosync "../kosync"
+	Progress "../progress"
+	"github.com/gofiber/fiber"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// kosyncApp returns an app with the routes of the KOReader sync, on a database with the tables they use.
+func kosyncApp(t *testing.T) *fiber.App {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	for _, query := range []string{
+		"CREATE TABLE Users (ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, Username TEXT, Password TEXT, ProfilePicture TEXT)",
+		"CREATE TABLE FileSettings (ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, Username TEXT, Extension TEXT, ApplicationLink TEXT, Icon TEXT)",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := &Server{
+		DB:       db,
+		Index:    &Files.Index{DB: db},
+		Sync:     &Kosync.Store{DB: db},
+		Progress: &Progress.Store{DB: db},
+	}
+	for _, init := range []func() error{server.Index.InitTable, server.Sync.InitTables, server.Progress.InitTable} {
+		if err := init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := fiber.New()
+	kosync := app.Group("/kosync")
+	kosync.Post("/users/create", server.KOSyncCreateUser)
+	kosync.Get("/users/auth", server.KOSyncAuth, server.KOSyncAuthorize)
+	kosync.Put("/syncs/progress", server.KOSyncAuth, server.KOSyncUpdateProgress)
+	kosync.Get("/syncs/progress/:document", server.KOSyncAuth, server.KOSyncGetProgress)
+	return app
+}
+
+// syncRequest sends the request as the user with the key, and returns the status code and the decoded body.
+func syncRequest(t *testing.T, app *fiber.App, method string, url string, body string, username string, key string) (int, map[string]interface{}) {
+	request := httptest.NewRequest(method, url, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	if username != "" {
+		request.Header.Set("x-auth-user", username)
+		request.Header.Set("x-auth-key", key)
+	}
+	response, err := app.Test(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != fiber.MIMEApplicationJSON {
+		t.Errorf("%s %s: got content type %q", method, url, contentType)
+	}
+	data, _ := ioutil.ReadAll(response.Body)
+	value := make(map[string]interface{})
+	if err := json.Unmarshal(data, &value); err != nil {
+		t.Fatalf("%s %s: %v in %q", method, url, err, data)
+	}
+	return response.StatusCode, value
+}
+
+func TestKOSync(t *testing.T) {
+	app := kosyncApp(t)
+	key := Kosync.Key("secret")
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		body     string
+		username string
+		key      string
+		status   int
+		want     map[string]interface{} // The fields the body must have.
+	}{
+		{
+			name: "create", method: "POST", url: "/kosync/users/create", body: `{"username":"bob","password":"` + key + `"}`,
+			status: 201, want: map[string]interface{}{"username": "bob"},
+		},
+		{
+			name: "create existing", method: "POST", url: "/kosync/users/create", body: `{"username":"bob","password":"other"}`,
+			status: 402, want: map[string]interface{}{"code": 2002.0},
+		},
+		{
+			name: "create short username", method: "POST", url: "/kosync/users/create", body: `{"username":"al","password":"` + key + `"}`,
+			status: 403, want: map[string]interface{}{"code": 2003.0},
+		},
+		{
+			name: "create without password", method: "POST", url: "/kosync/users/create", body: `{"username":"alice"}`,
+			status: 403, want: map[string]interface{}{"code": 2003.0},
+		},
+		{
+			name: "create invalid json", method: "POST", url: "/kosync/users/create", body: `{"username":`,
+			status: 403, want: map[string]interface{}{"code": 2003.0},
+		},
+		{
+			name: "auth", method: "GET", url: "/kosync/users/auth", username: "bob", key: key,
+			status: 200, want: map[string]interface{}{"authorized": "OK"},
+		},
+		{
+			name: "auth without headers", method: "GET", url: "/kosync/users/auth",
+			status: 401, want: map[string]interface{}{"code": 2001.0},
+		},
+		{
+			name: "auth wrong key", method: "GET", url: "/kosync/users/auth", username: "bob", key: Kosync.Key("wrong"),
+			status: 401, want: map[string]interface{}{"code": 2001.0},
+		},
+		{
+			name: "auth unknown user", method: "GET", url: "/kosync/users/auth", username: "carol", key: key,
+			status: 401, want: map[string]interface{}{"code": 2001.0},
+		},
+		{
+			name: "update unauthorized", method: "PUT", url: "/kosync/syncs/progress", body: `{"document":"d","progress":"3","device":"kobo"}`,
+			username: "bob", key: Kosync.Key("wrong"),
+			status: 401, want: map[string]interface{}{"code": 2001.0},
+		},
+		{
+			name: "update without document", method: "PUT", url: "/kosync/syncs/progress", body: `{"progress":"3","device":"kobo"}`,
+			username: "bob", key: key,
+			status: 403, want: map[string]interface{}{"code": 2004.0},
+		},
+		{
+			name: "update without progress", method: "PUT", url: "/kosync/syncs/progress", body: `{"document":"d","device":"kobo"}`,
+			username: "bob", key: key,
+			status: 403, want: map[string]interface{}{"code": 2003.0},
+		},
+		{
+			name: "update invalid json", method: "PUT", url: "/kosync/syncs/progress", body: `[]`,
+			username: "bob", key: key,
+			status: 403, want: map[string]interface{}{"code": 2003.0},
+		},
+		{
+			name: "update", method: "PUT", url: "/kosync/syncs/progress", body: `{"document":"d","progress":"3","percentage":0.5,"device":"kobo","device_id":"k1"}`,
+			username: "bob", key: key,
+			status: 200, want: map[string]interface{}{"document": "d"},
+		},
+		{
+			name: "get", method: "GET", url: "/kosync/syncs/progress/d", username: "bob", key: key,
+			status: 200, want: map[string]interface{}{"document": "d", "progress": "3", "percentage": 0.5, "device": "kobo", "device_id": "k1"},
+		},
+		{
+			name: "get unsynced", method: "GET", url: "/kosync/syncs/progress/unknown", username: "bob", key: key,
+			status: 200, want: map[string]interface{}{},
+		},
+		{
+			name: "get unauthorized", method: "GET", url: "/kosync/syncs/progress/d",
+			status: 401, want: map[string]interface{}{"code": 2001.0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, body := syncRequest(t, app, test.method, test.url, test.body, test.username, test.key)
+			if status != test.status {
+				t.Errorf("got status %d, want %d: %v", status, test.status, body)
+			}
+			if len(test.want) == 0 && len(body) != 0 {
+				t.Errorf("got %v, want an empty object", body)
+			}
+			for field, want := range test.want {
+				if body[field] != want {
+					t.Errorf("got %s %v, want %v", field, body[field], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,555 @@
+package server
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	Files "../files"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- File management ----- >
+
+// TrashEntry is a file or folder that has been moved to the trash of a volume.
+type TrashEntry struct {
+	ID       string `json:"ID"`
+	Username string `json:"Username"` // The user who deleted the file.
+	Volume   string `json:"Volume"`
+	Path     string `json:"Path"` // The path relative to the volume the file is restored to.
+	IsDir    bool   `json:"IsDir"`
+	Deleted  int64  `json:"Deleted"`
+}
+
+// trashPath returns the path relative to the volume the trash entry is stored at.
+func (entry *TrashEntry) trashPath() string {
+	return "/" + Files.TrashFolder + "/" + entry.ID
+}
+
+// trashed returns the path on disk the trash entry is stored at.
+// It isn't resolved, so a deleted symlink is handled as the symlink itself.
+func (entry *TrashEntry) trashed(volume *Files.Volume) (string, error) {
+	root, err := volume.Root()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, Files.TrashFolder, entry.ID), nil
+}
+
+// CreateFolder creates the folder named name inside the folder path of the volume.
+func (server *Server) CreateFolder(c *fiber.Ctx) {
+	volume, err := server.Volumes.Get(c.FormValue("volume"))
+	if err != nil {
+		c.Status(fiber.StatusNotFound).Send(err.Error())
+		return
+	}
+	name := c.FormValue("name")
+	if !validName(name) {
+		c.Status(fiber.StatusBadRequest).Send("invalid folder name")
+		return
+	}
+	target, err := server.resolveTarget(volume, c.FormValue("path"), name)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	err = os.Mkdir(target, 0755)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	file, err := server.stat(username(c), volume, volume.Rel(target))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.Status(fiber.StatusCreated)
+	sendJSON(c, file)
+}
+
+// RenameFile gives the file or folder at path the new name, keeping it in the same folder.
+func (server *Server) RenameFile(c *fiber.Ctx) {
+	volume, source, err := server.resolveSource(c.FormValue("volume"), c.FormValue("path"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	name := c.FormValue("name")
+	if !validName(name) {
+		c.Status(fiber.StatusBadRequest).Send("invalid file name")
+		return
+	}
+	target, err := server.resolveTarget(volume, path.Dir(volume.Rel(source)), name)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	server.sendMoved(c, volume, source, target)
+}
+
+// MoveFile moves the file or folder at path into the destination folder of the same volume.
+func (server *Server) MoveFile(c *fiber.Ctx) {
+	volume, source, err := server.resolveSource(c.FormValue("volume"), c.FormValue("path"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	target, err := server.resolveTarget(volume, c.FormValue("destination"), filepath.Base(source))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	server.sendMoved(c, volume, source, target)
+}
+
+// CopyFile copies the file or folder at path into the destination folder of the same volume.
+func (server *Server) CopyFile(c *fiber.Ctx) {
+	volume, source, err := server.resolveSource(c.FormValue("volume"), c.FormValue("path"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	target, err := server.resolveTarget(volume, c.FormValue("destination"), filepath.Base(source))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	// A symlink is copied as the file it points to, as long as that is inside the volume.
+	source, err = volume.Resolve(volume.Rel(source))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	if isBelow(volume.Rel(target), volume.Rel(source)) {
+		c.Status(fiber.StatusBadRequest).Send("a folder can't be copied into itself")
+		return
+	}
+	// The copy counts towards the quota of the user, as an upload of the same files would.
+	if server.Quota > 0 {
+		used, err := server.GetUsedQuota(username(c))
+		if err != nil {
+			sendError(c, err)
+			return
+		}
+		size, err := copySize(source)
+		if err != nil {
+			sendError(c, err)
+			return
+		}
+		if used+size > server.Quota {
+			c.Status(fiber.StatusRequestEntityTooLarge).Send("the copy exceeds the quota")
+			return
+		}
+	}
+	err = copyPath(source, target)
+	if err != nil {
+		os.RemoveAll(target)
+		sendError(c, err)
+		return
+	}
+	err = server.recordCopy(username(c), volume, source, target)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	file, err := server.stat(username(c), volume, volume.Rel(target))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.Status(fiber.StatusCreated)
+	sendJSON(c, file)
+}
+
+// DeleteFile moves the file or folder at path to the trash of the volume.
+// The progress of the file moves with it, so it is kept if the file is restored.
+func (server *Server) DeleteFile(c *fiber.Ctx) {
+	volume, source, err := server.resolveSource(c.FormValue("volume"), c.FormValue("path"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	entry, err := server.trash(username(c), volume, source)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, entry)
+}
+
+// trash moves the file or folder at the path on disk to the trash of the volume. The index and the progress move with it.
+func (server *Server) trash(username string, volume *Files.Volume, source string) (TrashEntry, error) {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	entry := TrashEntry{
+		ID:       randomID(),
+		Username: username,
+		Volume:   volume.Name,
+		Path:     volume.Rel(source),
+		IsDir:    info.IsDir(),
+		Deleted:  time.Now().Unix(),
+	}
+	trashed, err := entry.trashed(volume)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	err = os.MkdirAll(filepath.Dir(trashed), 0755)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	err = server.InsertTrashEntry(entry)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	err = os.Rename(source, trashed)
+	if err != nil {
+		server.DeleteTrashEntry(entry.ID)
+		return TrashEntry{}, err
+	}
+	return entry, server.moveIndexed(volume, entry.Path, entry.trashPath())
+}
+
+// GetTrash returns the files the user deleted that are in the trash of the volume.
+func (server *Server) GetTrash(c *fiber.Ctx) {
+	volume, err := server.Volumes.Get(c.Query("volume"))
+	if err != nil {
+		c.Status(fiber.StatusNotFound).Send(err.Error())
+		return
+	}
+	entries, err := server.GetTrashEntries(volume.Name, username(c))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, entries)
+}
+
+// RestoreFile moves the file with the given trash id back to the path it was deleted from.
+// Missing parent folders are created again. Users can only restore the files they deleted.
+func (server *Server) RestoreFile(c *fiber.Ctx) {
+	volume, err := server.Volumes.Get(c.FormValue("volume"))
+	if err != nil {
+		c.Status(fiber.StatusNotFound).Send(err.Error())
+		return
+	}
+	entry, err := server.GetTrashEntry(volume.Name, username(c), c.FormValue("id"))
+	if err == sql.ErrNoRows {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	} else if err != nil {
+		sendError(c, err)
+		return
+	}
+	source, err := entry.trashed(volume)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	target, err := volume.Resolve(entry.Path)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	if _, err := os.Lstat(target); err == nil {
+		c.Status(fiber.StatusConflict).Send("a file already exists at " + entry.Path)
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	err = os.Rename(source, target)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	err = server.DeleteTrashEntry(entry.ID)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	err = server.moveIndexed(volume, entry.trashPath(), entry.Path)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	file, err := server.stat(username(c), volume, entry.Path)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, file)
+}
+
+// EmptyTrash permanently removes the files the user deleted from the trash of the volume.
+// Progress pointing at the removed files is kept, so it is picked up again if the same file is added later.
+func (server *Server) EmptyTrash(c *fiber.Ctx) {
+	volume, err := server.Volumes.Get(c.FormValue("volume"))
+	if err != nil {
+		c.Status(fiber.StatusNotFound).Send(err.Error())
+		return
+	}
+	entries, err := server.GetTrashEntries(volume.Name, username(c))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	for _, entry := range entries {
+		trashed, err := entry.trashed(volume)
+		if err != nil {
+			sendError(c, err)
+			return
+		}
+		err = os.RemoveAll(trashed)
+		if err != nil {
+			sendError(c, err)
+			return
+		}
+		err = server.DeleteTrashEntry(entry.ID)
+		if err != nil {
+			sendError(c, err)
+			return
+		}
+		err = server.DeleteUploads(volume.Name, entry.trashPath())
+		if err != nil {
+			sendError(c, err)
+			return
+		}
+		if volume.Index != nil {
+			err = volume.Index.Remove(volume.Name, entry.trashPath())
+			if err != nil {
+				sendError(c, err)
+				return
+			}
+		}
+	}
+	c.SendStatus(fiber.StatusOK)
+}
+
+// resolveSource resolves a path of an existing file or folder that can be managed.
+// Only the parent folder is resolved, so a symlink is managed itself instead of the file it points to.
+// The root of a volume and the hidden folders can't be managed.
+func (server *Server) resolveSource(volumeName string, relative string) (*Files.Volume, string, error) {
+	volume, err := server.Volumes.Get(volumeName)
+	if err != nil {
+		return nil, "", &requestError{Status: fiber.StatusNotFound, Message: err.Error()}
+	}
+	cleaned := path.Clean("/" + relative)
+	if cleaned == "/" {
+		return nil, "", &requestError{Status: fiber.StatusBadRequest, Message: "the root of a volume can't be changed"}
+	}
+	folder, err := volume.Resolve(path.Dir(cleaned))
+	if err != nil {
+		return nil, "", err
+	}
+	if !validName(path.Base(cleaned)) {
+		return nil, "", Files.ErrOutsideVolume
+	}
+	source := filepath.Join(folder, path.Base(cleaned))
+	if Files.IsHidden(volume.Rel(source)) {
+		return nil, "", Files.ErrOutsideVolume
+	}
+	if _, err := os.Lstat(source); err != nil {
+		return nil, "", &requestError{Status: fiber.StatusNotFound, Message: "the file does not exist"}
+	}
+	return volume, source, nil
+}
+
+// resolveTarget resolves the path of a new file named name inside the folder of the volume.
+// The folder has to exist, and the file must not.
+func (server *Server) resolveTarget(volume *Files.Volume, folder string, name string) (string, error) {
+	folderPath, err := volume.Resolve(folder)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(folderPath)
+	if err != nil || !info.IsDir() {
+		return "", &requestError{Status: fiber.StatusNotFound, Message: "the folder does not exist"}
+	}
+	target, err := volume.Resolve(joinPath(volume.Rel(folderPath), name))
+	if err != nil {
+		return "", err
+	}
+	if Files.IsHidden(volume.Rel(target)) {
+		return "", Files.ErrOutsideVolume
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return "", &requestError{Status: fiber.StatusConflict, Message: "the file already exists"}
+	}
+	return target, nil
+}
+
+// sendMoved moves the source to the target and sends the moved file.
+func (server *Server) sendMoved(c *fiber.Ctx, volume *Files.Volume, source string, target string) {
+	oldPath, newPath := volume.Rel(source), volume.Rel(target)
+	if isBelow(newPath, oldPath) {
+		c.Status(fiber.StatusBadRequest).Send("a folder can't be moved into itself")
+		return
+	}
+	err := os.Rename(source, target)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	err = server.moveIndexed(volume, oldPath, newPath)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	file, err := server.stat(username(c), volume, newPath)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, file)
+}
+
+// moveIndexed moves the index entries, the uploads and the progress of a file that has been moved inside the volume.
+func (server *Server) moveIndexed(volume *Files.Volume, oldPath string, newPath string) error {
+	err := server.MoveUploads(volume.Name, oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	if volume.Index == nil {
+		return nil
+	}
+	err = volume.Index.Move(volume.Name, oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	return volume.Index.MoveProgress(volume.Name, oldPath, newPath)
+}
+
+// isBelow reports whether the path relative to a volume is inside the folder.
+func isBelow(path string, folder string) bool {
+	return strings.HasPrefix(path, strings.TrimRight(folder, "/")+"/")
+}
+
+// copySize returns the number of bytes copyPath copies from the source.
+func copySize(source string) (int64, error) {
+	var size int64
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return err
+	})
+	return size, err
+}
+
+// recordCopy records the files copied from the source to the target as uploads of the user, so they count towards the quota.
+// A copied file has the same hash as the original, so it's indexed with the hash of the original instead of being hashed again.
+func (server *Server) recordCopy(username string, volume *Files.Volume, source string, target string) error {
+	return filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		relative, err := filepath.Rel(target, path)
+		if err != nil {
+			return err
+		}
+		hash := ""
+		if volume.Index != nil {
+			entry, err := volume.Index.Lookup(volume.Name, volume.Rel(filepath.Join(source, relative)))
+			if err == nil && entry.Size == info.Size() {
+				entry.Path = volume.Rel(path)
+				entry.ModTime = info.ModTime().UnixNano()
+				err = volume.Index.Store(entry)
+				if err != nil {
+					return err
+				}
+				hash = entry.Hash
+			}
+		}
+		return server.UpsertUpload(username, volume.Name, volume.Rel(path), info.Size(), hash)
+	})
+}
+
+// copyPath copies a file, or a folder and everything inside it.
+// Symlinks are left out, as they could point outside of the volume.
+func copyPath(source string, target string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		destination := filepath.Join(target, relative)
+		switch {
+		case info.IsDir():
+			return os.Mkdir(destination, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			return copyFile(path, destination, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// copyFile copies the content of a single file.
+func copyFile(source string, target string, mode os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// < ----- TRASH DB START ----- >
+
+// InsertTrashEntry records a file that has been moved to the trash.
+func (server *Server) InsertTrashEntry(entry TrashEntry) error {
+	_, err := server.DB.Exec("INSERT INTO Trash (ID, Username, Volume, Path, IsDir, Deleted) values (?,?,?,?,?,?)", entry.ID, entry.Username, entry.Volume, entry.Path, entry.IsDir, entry.Deleted)
+	return err
+}
+
+// GetTrashEntry returns the trash entry with the given id in the volume, if it was deleted by the user.
+func (server *Server) GetTrashEntry(volume string, username string, id string) (TrashEntry, error) {
+	entry := TrashEntry{}
+	result := server.DB.QueryRow("SELECT ID, Username, Volume, Path, IsDir, Deleted FROM Trash WHERE Volume=$1 AND Username=$2 AND ID=$3", volume, username, id)
+	err := result.Scan(&entry.ID, &entry.Username, &entry.Volume, &entry.Path, &entry.IsDir, &entry.Deleted)
+	return entry, err
+}
+
+// GetTrashEntries returns the trash entries the user deleted in the volume, the most recently deleted first.
+func (server *Server) GetTrashEntries(volume string, username string) ([]TrashEntry, error) {
+	result, err := server.DB.Query("SELECT ID, Username, Volume, Path, IsDir, Deleted FROM Trash WHERE Volume=$1 AND Username=$2 ORDER BY Deleted DESC", volume, username)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	entries := []TrashEntry{}
+	for result.Next() {
+		entry := TrashEntry{}
+		err := result.Scan(&entry.ID, &entry.Username, &entry.Volume, &entry.Path, &entry.IsDir, &entry.Deleted)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, result.Err()
+}
+
+// DeleteTrashEntry removes a trash entry from the database.
+func (server *Server) DeleteTrashEntry(id string) error {
+	_, err := server.DB.Exec("DELETE FROM Trash WHERE ID=$1", id)
+	return err
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber"
+)
+
+// manageApp returns an app with the routes of the file management, where the user is given by the X-User header.
+func manageApp(server *Server) *fiber.App {
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) {
+		c.Locals("user", &jwt.Token{Claims: jwt.MapClaims{"username": c.Get("X-User")}})
+		c.Next()
+	})
+	app.Post("/files/copy", server.CopyFile)
+	app.Post("/files/delete", server.DeleteFile)
+	app.Get("/trash", server.GetTrash)
+	app.Post("/trash/restore", server.RestoreFile)
+	app.Post("/trash/empty", server.EmptyTrash)
+	return app
+}
+
+// manageRequest sends the form to the route as the user, and returns the status code and the body.
+func manageRequest(t *testing.T, app *fiber.App, method string, route string, username string, form url.Values) (int, string) {
+	request := httptest.NewRequest(method, route, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", fiber.MIMEApplicationForm)
+	request.Header.Set("X-User", username)
+	response, err := app.Test(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(body)
+}
+
+func TestCopyQuota(t *testing.T) {
+	server := volumeServer(t)
+	volume := &server.Volumes[0]
+	writeFiles(t, volume, map[string]string{"/book.pdf": "0123456789", "/series/1.pdf": "0123456789", "/series/2.pdf": "0123456789", "/copies/.keep": ""})
+	server.Quota = 35
+	app := manageApp(server)
+
+	status, body := manageRequest(t, app, "POST", "/files/copy", "bob", url.Values{"volume": {"C"}, "path": {"/series"}, "destination": {"/copies"}})
+	if status != fiber.StatusCreated {
+		t.Fatalf("got %d %q, want the folder copied", status, body)
+	}
+	if used, err := server.GetUsedQuota("bob"); err != nil || used != 20 {
+		t.Errorf("got %d bytes used, %v, want 20", used, err)
+	}
+	if size, err := server.GetUploadSize("bob", "C", "/copies/series/2.pdf"); err != nil || size != 10 {
+		t.Errorf("got the copy counted as %d bytes, %v", size, err)
+	}
+
+	status, _ = manageRequest(t, app, "POST", "/files/copy", "bob", url.Values{"volume": {"C"}, "path": {"/series"}, "destination": {"/"}})
+	if status != fiber.StatusConflict {
+		t.Errorf("got %d, want a conflict for the existing folder", status)
+	}
+	status, _ = manageRequest(t, app, "POST", "/files/copy", "bob", url.Values{"volume": {"C"}, "path": {"/copies/series"}, "destination": {"/series"}})
+	if status != fiber.StatusRequestEntityTooLarge {
+		t.Errorf("got %d, want the copy past the quota refused", status)
+	}
+	if _, err := os.Stat(filepath.Join(volume.Path, "series", "series")); !os.IsNotExist(err) {
+		t.Error("the copy past the quota was made")
+	}
+	status, body = manageRequest(t, app, "POST", "/files/copy", "bob", url.Values{"volume": {"C"}, "path": {"/book.pdf"}, "destination": {"/copies"}})
+	if status != fiber.StatusCreated {
+		t.Errorf("got %d %q, want the file within the quota copied", status, body)
+	}
+}
+
+func TestTrashOwners(t *testing.T) {
+	server := volumeServer(t)
+	volume := &server.Volumes[0]
+	writeFiles(t, volume, map[string]string{"/bob.pdf": "bob", "/alice.pdf": "alice"})
+	app := manageApp(server)
+	ids := make(map[string]string)
+	for _, username := range []string{"bob", "alice"} {
+		status, body := manageRequest(t, app, "POST", "/files/delete", username, url.Values{"volume": {"C"}, "path": {"/" + username + ".pdf"}})
+		if status != fiber.StatusOK {
+			t.Fatalf("got %d %q", status, body)
+		}
+		entries, err := server.GetTrashEntries("C", username)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("got the trash %+v, %v, want the file of %s", entries, err, username)
+		}
+		ids[username] = entries[0].ID
+	}
+
+	if _, body := manageRequest(t, app, "GET", "/trash?volume=C", "bob", nil); strings.Contains(body, "alice") || !strings.Contains(body, "bob.pdf") {
+		t.Errorf("bob got the trash %s", body)
+	}
+	if status, _ := manageRequest(t, app, "POST", "/trash/restore", "bob", url.Values{"volume": {"C"}, "id": {ids["alice"]}}); status != fiber.StatusNotFound {
+		t.Errorf("bob restored the file of alice: %d", status)
+	}
+	if status, _ := manageRequest(t, app, "POST", "/trash/empty", "bob", url.Values{"volume": {"C"}}); status != fiber.StatusOK {
+		t.Errorf("bob couldn't empty the trash: %d", status)
+	}
+	if entries, err := server.GetTrashEntries("C", "alice"); err != nil || len(entries) != 1 {
+		t.Errorf("got the trash of alice %+v, %v after bob emptied theirs", entries, err)
+	}
+	if status, body := manageRequest(t, app, "POST", "/trash/restore", "alice", url.Values{"volume": {"C"}, "id": {ids["alice"]}}); status != fiber.StatusOK {
+		t.Errorf("alice couldn't restore their file: %d %q", status, body)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(volume.Path, "alice.pdf")); err != nil || string(data) != "alice" {
+		t.Errorf("got the restored file %q, %v", data, err)
+	}
+}
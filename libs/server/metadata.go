@@ -0,0 +1,119 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	Enrich "../enrich"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- Metadata ----- >
+
+// InitEnricher sets up the enricher with the imported records, and the Open Library API if an URL is given.
+func (server *Server) InitEnricher() error {
+	records := &Enrich.Records{DB: server.DB}
+	err := records.InitTables()
+	if err != nil {
+		return err
+	}
+	server.Records = records
+	server.Enricher = &Enrich.Enricher{DB: server.DB, Catalog: server.Catalog, Index: server.Index, Providers: []Enrich.Provider{records}}
+	if server.OpenLibrary != "" {
+		server.Enricher.Providers = append(server.Enricher.Providers, &Enrich.OpenLibrary{URL: server.OpenLibrary, CoversURL: server.OpenLibraryCovers})
+	}
+	return server.Enricher.InitTables()
+}
+
+// ImportMetadata imports the metadata dumps and enriches the books with them. It's meant to be run in the background.
+// The books that weren't matched before are matched again, as the dumps may have records for them now.
+func (server *Server) ImportMetadata() {
+	if len(server.MetadataDumps) == 0 && server.OpenLibrary == "" {
+		return
+	}
+	for _, dump := range server.MetadataDumps {
+		count, err := server.Records.Import(dump, server.DumpCovers)
+		if err != nil {
+			fmt.Println("Error importing the metadata dump", dump+":", err.Error())
+			continue
+		}
+		fmt.Println("Imported", count, "records from", dump)
+		if count > 0 {
+			err = server.Catalog.ResetUnmatched()
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+		}
+	}
+	server.enrich()
+}
+
+// Enrich starts enriching the books that haven't been enriched in the background.
+func (server *Server) Enrich(c *fiber.Ctx) {
+	go server.enrich()
+	c.SendStatus(fiber.StatusAccepted)
+}
+
+// GetReviews returns the books waiting for a review of their matches as JSON.
+func (server *Server) GetReviews(c *fiber.Ctx) {
+	reviews, err := server.Enricher.Reviews()
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, reviews)
+}
+
+// ResolveReview enriches the book of the review with the chosen candidate, given by its index.
+// The review is dismissed without enriching the book if the candidate is -1.
+func (server *Server) ResolveReview(c *fiber.Ctx) {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	choice, err := strconv.Atoi(c.FormValue("candidate"))
+	if err != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid candidate")
+		return
+	}
+	err = server.Enricher.Resolve(id, choice)
+	if err == Enrich.ErrNoReview {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.SendStatus(fiber.StatusNoContent)
+}
+
+// GetCover sends the cover a book got when it was enriched.
+func (server *Server) GetCover(c *fiber.Ctx) {
+	data, mediaType, err := server.Catalog.Cover(c.Params("hash"))
+	if err == sql.ErrNoRows {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.Set(fiber.HeaderContentType, mediaType)
+	c.SendBytes(data)
+}
+
+// enrich enriches the books and logs the outcomes.
+func (server *Server) enrich() {
+	outcomes, err := server.Enricher.Run()
+	if err == Enrich.ErrRunning {
+		return
+	}
+	if err != nil {
+		fmt.Println("Error enriching the books:", err.Error())
+		return
+	}
+	fmt.Println("Enriched the books:", outcomes[Enrich.Matched], "matched,", outcomes[Enrich.Queued], "queued for a review,", outcomes[Enrich.Unmatched], "unmatched")
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	Files "../files"
+	Opds "../opds"
+	"github.com/gofiber/fiber"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// < ----- OPDS ----- >
+
+// OPDSPageSize is the number of entries in each page of a feed.
+const OPDSPageSize = 50
+
+// catalogType is the media type of the folder feeds, which are acquisition feeds if they hold books and navigation feeds otherwise.
+const catalogType = "application/atom+xml;profile=opds-catalog"
+
+// BasicAuth authenticates the requests with HTTP Basic against the users, as e-reader apps can't sign in to get the token cookie.
+func (server *Server) BasicAuth(c *fiber.Ctx) {
+	if username := server.basicUser(c.Get(fiber.HeaderAuthorization)); username != "" {
+		c.Locals("username", username)
+		c.Next()
+		return
+	}
+	c.Set(fiber.HeaderWWWAuthenticate, basicChallenge)
+	c.SendStatus(fiber.StatusUnauthorized)
+}
+
+// basicChallenge asks the client to authenticate with HTTP Basic.
+const basicChallenge = `Basic realm="Ereader", charset="UTF-8"`
+
+// basicLoginTime is how long credentials that signed in with HTTP Basic are trusted without checking the password again.
+const basicLoginTime = 5 * time.Minute
+
+// basicLogins caches the users signed in with HTTP Basic by the hash of their authorization header,
+// as readers send it with every feed, cover and thumbnail, and checking the password with bcrypt is slow on purpose.
+var basicLogins = struct {
+	sync.Mutex
+	users map[[sha256.Size]byte]basicLogin
+}{users: make(map[[sha256.Size]byte]basicLogin)}
+
+// basicLogin is a user signed in with HTTP Basic, who is trusted until expires.
+type basicLogin struct {
+	username string
+	expires  time.Time
+}
+
+// basicUser returns the user signed in with the HTTP Basic authorization header, or an empty string if the credentials are wrong.
+func (server *Server) basicUser(header string) string {
+	if !strings.HasPrefix(header, "Basic ") {
+		return ""
+	}
+	key := sha256.Sum256([]byte(header))
+	now := time.Now()
+	basicLogins.Lock()
+	login, ok := basicLogins.users[key]
+	basicLogins.Unlock()
+	if ok && now.Before(login.expires) {
+		return login.username
+	}
+	username := server.checkBasic(header)
+	if username == "" {
+		return ""
+	}
+	basicLogins.Lock()
+	defer basicLogins.Unlock()
+	for key, login := range basicLogins.users {
+		if !now.Before(login.expires) {
+			delete(basicLogins.users, key)
+		}
+	}
+	basicLogins.users[key] = basicLogin{username: username, expires: now.Add(basicLoginTime)}
+	return username
+}
+
+// checkBasic checks the credentials of the HTTP Basic authorization header against the users.
+func (server *Server) checkBasic(header string) string {
+	credentials, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Basic "))
+	parts := strings.SplitN(string(credentials), ":", 2)
+	if err != nil || len(parts) != 2 || parts[0] == "" {
+		return ""
+	}
+	user := server.GetUserByUsername(parts[0])
+	if user.Username != parts[0] || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(parts[1])) != nil {
+		return ""
+	}
+	return user.Username
+}
+
+// OPDSRoot sends the navigation feed of the volumes.
+func (server *Server) OPDSRoot(c *fiber.Ctx) {
+	feed := Opds.NewFeed("urn:ereader:root", "Ereader", time.Now())
+	feed.Links = opdsLinks("/opds", Opds.NavigationType)
+	for _, volume := range server.Volumes {
+		feed.Entries = append(feed.Entries, Opds.Entry{
+			Title:   volume.Name,
+			ID:      "urn:ereader:volume:" + volume.Name,
+			Updated: feed.Updated,
+			Links:   []Opds.Link{{Rel: Opds.RelSubsection, Href: opdsFolder(volume.Name, "/"), Type: catalogType}},
+		})
+	}
+	sendXML(c, Opds.NavigationType, feed)
+}
+
+// OPDSFolder sends the feed of a folder in a volume, with the subfolders as navigation entries and the books as acquisition entries.
+// The feed is paged with the page query parameter.
+func (server *Server) OPDSFolder(c *fiber.Ctx) {
+	volume, err := server.Volumes.Get(c.Params("volume"))
+	if err != nil || c.Params("volume") == "" {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	folder := "/" + strings.Trim(wildcard(c), "/")
+	files, err := volume.WalkFolder(folder)
+	if os.IsNotExist(err) {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	kind := Opds.NavigationType
+	var entries Files.Files
+	for _, file := range files {
+		if !file.IsDir && Opds.MediaType(file.Extension) == "" {
+			continue
+		}
+		if !file.IsDir {
+			kind = Opds.AcquisitionType
+		}
+		entries = append(entries, file)
+	}
+	title := volume.Name
+	if folder != "/" {
+		title = path.Base(folder)
+	}
+	self := opdsFolder(volume.Name, folder)
+	feed := Opds.NewFeed("urn:ereader:folder:"+volume.Name+":"+folder, title, time.Now())
+	feed.Links = opdsLinks(self, kind)
+	up := "/opds"
+	if folder != "/" {
+		up = opdsFolder(volume.Name, path.Dir(folder))
+	}
+	feed.Links = append(feed.Links, Opds.Link{Rel: Opds.RelUp, Href: up, Type: catalogType})
+	start, end := paginate(feed, self, kind, opdsPage(c), len(entries))
+	for _, file := range entries[start:end] {
+		if file.IsDir {
+			feed.Entries = append(feed.Entries, Opds.Entry{
+				Title:   file.Name,
+				ID:      "urn:ereader:folder:" + volume.Name + ":" + file.Path,
+				Updated: feed.Updated,
+				Links:   []Opds.Link{{Rel: Opds.RelSubsection, Href: opdsFolder(volume.Name, file.Path), Type: catalogType}},
+			})
+			continue
+		}
+		feed.Entries = append(feed.Entries, opdsEntry(volume, file))
+	}
+	sendXML(c, kind, feed)
+}
+
+// OPDSSearch sends the acquisition feed of the books matching every word of the q query parameter
+// in their title, authors, series or path.
+func (server *Server) OPDSSearch(c *fiber.Ctx) {
+	words := strings.Fields(c.Query("q"))
+	if len(words) > 8 {
+		words = words[:8]
+	}
+	query := `
+		SELECT FileIndex.Volume, FileIndex.Path FROM FileIndex LEFT JOIN Books ON Books.Hash=FileIndex.Hash
+		WHERE FileIndex.IsDir=0`
+	var args []interface{}
+	for _, word := range words {
+		args = append(args, "%"+escapeLike(word)+"%")
+		n := strconv.Itoa(len(args))
+		query += " AND (Books.Title LIKE $" + n + " ESCAPE '\\' OR Books.Authors LIKE $" + n + " ESCAPE '\\' OR Books.Series LIKE $" + n + " ESCAPE '\\' OR FileIndex.Path LIKE $" + n + " ESCAPE '\\')"
+	}
+	query += " ORDER BY Books.Title, FileIndex.Path"
+	var matches []Files.IndexEntry
+	if len(words) > 0 {
+		result, err := server.DB.Query(query, args...)
+		if err != nil {
+			sendError(c, err)
+			return
+		}
+		for result.Next() {
+			entry := Files.IndexEntry{}
+			if err := result.Scan(&entry.Volume, &entry.Path); err != nil {
+				result.Close()
+				sendError(c, err)
+				return
+			}
+			// The trash and the unfinished uploads are left out, as they are of the listings.
+			if Opds.MediaType(path.Ext(entry.Path)) != "" && !Files.IsHidden(entry.Path) {
+				matches = append(matches, entry)
+			}
+		}
+		result.Close()
+	}
+	self := "/opds/search?q=" + url.QueryEscape(c.Query("q"))
+	feed := Opds.NewFeed("urn:ereader:search:"+c.Query("q"), "Search: "+c.Query("q"), time.Now())
+	feed.Links = opdsLinks(self, Opds.AcquisitionType)
+	start, end := paginate(feed, self, Opds.AcquisitionType, opdsPage(c), len(matches))
+	for _, match := range matches[start:end] {
+		volume, err := server.Volumes.Get(match.Volume)
+		if err != nil || match.Volume == "" {
+			continue
+		}
+		file, err := volume.Stat(match.Path)
+		if err != nil {
+			continue
+		}
+		feed.Entries = append(feed.Entries, opdsEntry(volume, file))
+	}
+	sendXML(c, Opds.AcquisitionType, feed)
+}
+
+// OPDSOpenSearch sends the OpenSearch description of the search feed.
+func (server *Server) OPDSOpenSearch(c *fiber.Ctx) {
+	description := Opds.NewDescription("Ereader", "Search the books by title, author, series or path", "/opds/search?q={searchTerms}")
+	data, err := description.Marshal()
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.Set(fiber.HeaderContentType, Opds.OpenSearchType+"; charset=utf-8")
+	c.SendBytes(data)
+}
+
+// OPDSDownload sends a file from a volume with the media type of its book format.
+func (server *Server) OPDSDownload(c *fiber.Ctx) {
+	server.GetVolumeFile(c)
+	if mediaType := Opds.MediaType(path.Ext(wildcard(c))); mediaType != "" && c.Fasthttp.Response.StatusCode() == fiber.StatusOK {
+		c.Set(fiber.HeaderContentType, mediaType)
+	}
+}
+
+// opdsEntry returns the acquisition entry of the book, with the metadata of the catalog.
+func opdsEntry(volume *Files.Volume, file Files.File) Opds.Entry {
+	entry := Opds.Entry{Title: file.Name, ID: "urn:ereader:book:" + file.Hash, Updated: Opds.Time(time.Now())}
+	if resolved, err := volume.Resolve(file.Path); err == nil {
+		if info, err := os.Stat(resolved); err == nil {
+			entry.Updated = Opds.Time(info.ModTime())
+		}
+	}
+	if book := file.Book; book != nil {
+		if book.Title != "" {
+			entry.Title = book.Title
+		}
+		for _, author := range book.Authors {
+			entry.Authors = append(entry.Authors, Opds.Author{Name: author})
+		}
+		entry.Language, entry.Publisher, entry.Issued = book.Language, book.Publisher, book.Date
+		if book.ISBN != "" {
+			entry.Identifier = "urn:isbn:" + book.ISBN
+		}
+		for _, tag := range book.Tags {
+			entry.Categories = append(entry.Categories, Opds.Category{Term: tag, Label: tag})
+		}
+		if book.Description != "" {
+			entry.Content = &Opds.Content{Type: "html", Text: book.Description}
+		}
+		if book.Cover != "" {
+			entry.Links = append(entry.Links, Opds.Link{Rel: Opds.RelImage, Href: "/opds" + book.Cover})
+		}
+	}
+	if file.Thumbnail != "" {
+		if len(entry.Links) == 0 {
+			entry.Links = append(entry.Links, Opds.Link{Rel: Opds.RelImage, Href: "/opds" + file.Thumbnail + "?size=512", Type: "image/jpeg"})
+		}
+		entry.Links = append(entry.Links, Opds.Link{Rel: Opds.RelThumbnail, Href: "/opds" + file.Thumbnail, Type: "image/jpeg"})
+	}
+	entry.Links = append(entry.Links, Opds.Link{
+		Rel:   Opds.RelAcquisition,
+		Href:  "/opds/download/" + escapePath(volume.Name+file.Path),
+		Type:  Opds.MediaType(file.Extension),
+		Title: file.Name + file.Extension,
+	})
+	return entry
+}
+
+// opdsLinks returns the links every feed has.
+func opdsLinks(self string, kind string) []Opds.Link {
+	return []Opds.Link{
+		{Rel: Opds.RelStart, Href: "/opds", Type: Opds.NavigationType},
+		{Rel: Opds.RelSelf, Href: self, Type: kind},
+		{Rel: Opds.RelSearch, Href: "/opds/opensearch.xml", Type: Opds.OpenSearchType},
+	}
+}
+
+// paginate adds the links to the other pages of the feed, and returns the range of the entries on the page.
+func paginate(feed *Opds.Feed, self string, kind string, page int, total int) (int, int) {
+	pages := (total + OPDSPageSize - 1) / OPDSPageSize
+	if pages == 0 {
+		pages = 1
+	}
+	if page > pages {
+		page = pages
+	}
+	link := func(rel string, page int) Opds.Link {
+		separator := "?"
+		if strings.Contains(self, "?") {
+			separator = "&"
+		}
+		return Opds.Link{Rel: rel, Href: self + separator + "page=" + strconv.Itoa(page), Type: kind}
+	}
+	if pages > 1 {
+		feed.Links = append(feed.Links, link(Opds.RelFirst, 1), link(Opds.RelLast, pages))
+	}
+	if page > 1 {
+		feed.Links = append(feed.Links, link(Opds.RelPrevious, page-1))
+	}
+	if page < pages {
+		feed.Links = append(feed.Links, link(Opds.RelNext, page+1))
+	}
+	start := (page - 1) * OPDSPageSize
+	end := start + OPDSPageSize
+	if end > total {
+		end = total
+	}
+	feed.TotalResults, feed.ItemsPerPage, feed.StartIndex = total, OPDSPageSize, start+1
+	return start, end
+}
+
+// opdsPage returns the page number of the request, which starts at 1.
+func opdsPage(c *fiber.Ctx) int {
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// opdsFolder returns the URL of the feed of the folder.
+func opdsFolder(volume string, folder string) string {
+	return strings.TrimRight("/opds/volumes/"+escapePath(volume+folder), "/")
+}
+
+// sendXML sends the feed as XML with the given media type.
+func sendXML(c *fiber.Ctx, mediaType string, feed *Opds.Feed) {
+	data, err := feed.Marshal()
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.Set(fiber.HeaderContentType, mediaType+";charset=utf-8")
+	c.SendBytes(data)
+}
+
+// escapePath percent encodes each element of the path.
+func escapePath(path string) string {
+	elements := strings.Split(path, "/")
+	for i := range elements {
+		elements[i] = url.PathEscape(elements[i])
+	}
+	return strings.Join(elements, "/")
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
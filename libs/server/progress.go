@@ -0,0 +1,84 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path"
+
+	API "../api"
+	Files "../files"
+	Progress "../progress"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- Progress ----- >
+
+// GetProgress returns the progress of the user in the document with the hash.
+func (server *Server) GetProgress(c *fiber.Ctx) {
+	progress, err := server.Progress.Get(username(c), c.Params("hash"))
+	if err == sql.ErrNoRows {
+		c.Status(fiber.StatusNotFound).Send("no progress")
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, progress)
+}
+
+// UpdateProgress stores the progress of the user in the document with the hash, which is sent as JSON.
+// The newest progress wins: if the stored progress has a later timestamp it's sent back with 409 Conflict.
+func (server *Server) UpdateProgress(c *fiber.Ctx) {
+	progress := Progress.Progress{}
+	if json.Unmarshal([]byte(c.Body()), &progress) != nil || !progress.Locator.Valid() {
+		c.Status(fiber.StatusBadRequest).Send("invalid progress")
+		return
+	}
+	progress.Username = username(c)
+	progress.Hash = c.Params("hash")
+	entries, err := server.Index.LookupHash(progress.Hash)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	if len(entries) == 0 {
+		c.Status(fiber.StatusNotFound).Send("unknown document")
+		return
+	}
+	// The volume and path have to be those of one of the copies of the document, so the progress moves with it.
+	found := false
+	for _, entry := range entries {
+		if !found && entry.Path == progress.Path && (progress.Volume == "" || entry.Volume == progress.Volume) {
+			progress.Volume = entry.Volume
+			found = true
+		}
+	}
+	if !found {
+		// Files in the trash are only used if the document isn't anywhere else.
+		progress.Path = ""
+		for _, entry := range entries {
+			if progress.Path == "" || Files.IsHidden(progress.Path) {
+				progress.Volume = entry.Volume
+				progress.Path = entry.Path
+			}
+		}
+	}
+	if progress.Format == "" {
+		progress.Format = Progress.Format(path.Ext(progress.Path))
+	}
+	// Clocks ahead of the server would keep other devices from updating the progress.
+	if now := Progress.Now(); progress.Timestamp > now {
+		progress.Timestamp = now
+	}
+	progress, err = server.Progress.Update(progress)
+	if err == Progress.ErrStale {
+		API.Error(c, fiber.StatusConflict, "a newer progress is stored", progress)
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, progress)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	Files "../files"
+	Progress "../progress"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- Search ----- >
+
+// SearchHit is a section of a book that matches a search, with where the book is and where the section is in it.
+type SearchHit struct {
+	Hash    string           `json:"Hash"`
+	Volume  string           `json:"Volume"`
+	Path    string           `json:"Path"`
+	Title   string           `json:"Title"`
+	Format  string           `json:"Format"`
+	Locator Progress.Locator `json:"Locator"`
+	Snippet string           `json:"Snippet"`
+	Rank    float64          `json:"Rank"`
+}
+
+// SearchResults is a page of the hits of a search.
+type SearchResults struct {
+	Query  string      `json:"Query"`
+	Total  int         `json:"Total"`
+	Offset int         `json:"Offset"`
+	Hits   []SearchHit `json:"Hits"`
+}
+
+// SearchText searches the text of the books for the words of the q query parameter.
+// The limit and offset parameters page through the hits, which are ranked best first.
+func (server *Server) SearchText(c *fiber.Ctx) {
+	if server.Search == nil {
+		c.Status(fiber.StatusServiceUnavailable).Send("search isn't available, the server has to be built with the sqlite_fts5 tag")
+		return
+	}
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.Status(fiber.StatusBadRequest).Send("missing query")
+		return
+	}
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset, err := strconv.Atoi(c.Query("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	hits, total, err := server.Search.Search(query, limit, offset)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	results := SearchResults{Query: query, Total: total, Offset: offset, Hits: []SearchHit{}}
+	for _, hit := range hits {
+		entries, err := server.Index.LookupHash(hit.Hash)
+		if err != nil {
+			sendError(c, err)
+			return
+		}
+		// Books that are only in the trash aren't found.
+		var location *Files.IndexEntry
+		for i := range entries {
+			if !Files.IsHidden(entries[i].Path) {
+				location = &entries[i]
+				break
+			}
+		}
+		if location == nil {
+			continue
+		}
+		title := ""
+		if book, err := server.Catalog.Lookup(hit.Hash); err == nil {
+			title = book.Title
+		}
+		results.Hits = append(results.Hits, SearchHit{
+			Hash:    hit.Hash,
+			Volume:  location.Volume,
+			Path:    location.Path,
+			Title:   title,
+			Format:  Progress.Format(path.Ext(location.Path)),
+			Locator: Progress.Locator{Page: hit.Page, Position: hit.Position, Percent: hit.Percent},
+			Snippet: hit.Snippet,
+			Rank:    hit.Rank,
+		})
+	}
+	sendJSON(c, results)
+}
@@ -3,12 +3,28 @@ package server
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
+	Annotation "../annotation"
+	API "../api"
+	Enrich "../enrich"
 	ExtensionAPI "../extension"
 	Files "../files"
+	Kosync "../kosync"
+	Metadata "../metadata"
+	Progress "../progress"
+	Search "../search"
+	Shelf "../shelf"
+	Thumbnail "../thumbnail"
+	Token "../token"
 	User "../user"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gofiber/fiber"
@@ -19,14 +35,40 @@ import (
 
 // Server class
 type Server struct {
-	DB       *sql.DB
-	Username string
-	Password string
-	Secret   string
-	HomePath string
-	Port     int
-	Etag     bool
-	Volume   Files.Volume
+	DB          *sql.DB
+	Username    string
+	Password    string
+	Secret      string
+	HomePath    string
+	Port        int
+	Etag        bool
+	Watch       bool
+	Quota       int64 // The number of bytes each user can upload. There is no limit if it's 0.
+	BodyLimit   int
+	Volumes     Files.Volumes
+	Index       *Files.Index
+	Catalog     *Files.Catalog
+	Records     *Enrich.Records
+	Enricher    *Enrich.Enricher
+	Sync        *Kosync.Store
+	Progress    *Progress.Store
+	Annotations *Annotation.Store
+	Search      *Search.Index // Nil if SQLite doesn't have FTS5.
+	Shelves     *Shelf.Store
+	Tokens      *Token.Store
+	Extensions  *ExtensionAPI.Extensions
+	Thumbnails  *Thumbnail.Cache
+	// The Calibre libraries and Open Library dumps imported at startup, and the Open Library API used to enrich the books.
+	MetadataDumps     []string
+	DumpCovers        string
+	OpenLibrary       string
+	OpenLibraryCovers string
+	// The Calibre library imported as a volume when the server is started as a command, given as name=path.
+	ImportCalibre string
+	// The time between looking for new books to index for the search. They are only indexed at startup if it's 0, and never if it's negative.
+	SearchInterval time.Duration
+	// How long a chunked upload can take. Unfinished uploads are removed after it, and kept if it's 0.
+	UploadExpiry time.Duration
 }
 
 // < ----- POST ROUTES ----- >
@@ -50,6 +92,10 @@ func (server *Server) Signup(c *fiber.Ctx) {
 		fmt.Println(err.Error())
 		return
 	}
+	err = server.Sync.SetKey(user.Username, Kosync.Key(user.Password))
+	if err != nil {
+		fmt.Println(err.Error())
+	}
 	c.Redirect("/signin")
 }
 
@@ -62,18 +108,32 @@ func (server *Server) Signin(c *fiber.Ctx) {
 		return
 	}
 	err := bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(user.Password))
+	if err != nil {
+		// Users registered from KOReader have the md5 hash of their password as the password.
+		err = bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(Kosync.Key(user.Password)))
+	}
 	if err != nil {
 		c.SendStatus(fiber.StatusUnauthorized)
 		return
 	}
+	// The sync key is set on sign in, so users who signed up before the sync can sign in to it from KOReader.
+	if !server.Sync.Authorize(user.Username, Kosync.Key(user.Password)) {
+		err = server.Sync.SetKey(user.Username, Kosync.Key(user.Password))
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}
 	server.generateJWTToken(c, user.Username, storedUser.ProfilePicture)
 	c.Redirect(server.HomePath)
 }
 
-// UpdateSetting is used to either update or create a setting.
+// UpdateSetting is used to either update or create a setting for the current user.
 func (server *Server) UpdateSetting(c *fiber.Ctx) {
-	fileSetting := &Files.FileSetting{Username: c.FormValue("Username"), Extension: c.FormValue("Extension"), ApplicationLink: c.FormValue("ApplicationLink")}
-	if fileSetting.Extension[0] != '.' {
+	// Get current user information from the claims map.
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	fileSetting := &Files.FileSetting{Username: claims["username"].(string), Extension: c.FormValue("Extension"), ApplicationLink: c.FormValue("ApplicationLink")}
+	if len(fileSetting.Extension) < 2 || fileSetting.Extension[0] != '.' {
 		c.SendStatus(fiber.StatusBadRequest)
 		return
 	}
@@ -87,7 +147,18 @@ func (server *Server) UpdateSetting(c *fiber.Ctx) {
 }
 
 // Query is the path used by extension to query their database table.
+// The query is limited to the tables declared by the extension named in the Extension field, and to the rows of the current user.
 func (server *Server) Query(c *fiber.Ctx) {
+	// Get current user information from the claims map.
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	extension, err := server.Extensions.Find(c.FormValue("Extension"))
+	if err != nil {
+		c.Status(fiber.StatusForbidden).Send(err.Error())
+		return
+	}
+
 	var databaseQuery ExtensionAPI.DatabaseQuery
 
 	databaseQuery.TableName = c.FormValue("Result")
@@ -108,39 +179,93 @@ func (server *Server) Query(c *fiber.Ctx) {
 
 	databaseQuery.DatabaseOperation = ExtensionAPI.DatabaseOperationType(c.FormValue("DatabaseOperation"))
 
-	result, err := databaseQuery.GenerateQuery(server.DB)
+	result, err := databaseQuery.GenerateScopedQuery(server.DB, extension.DatabaseTables, claims["username"].(string))
 	if err != nil {
 		fmt.Println(err.Error())
+		if ExtensionAPI.IsAccessError(err) {
+			c.Status(fiber.StatusForbidden).Send(err.Error())
+		} else if ExtensionAPI.IsQueryError(err) {
+			c.Status(fiber.StatusBadRequest).Send(err.Error())
+		} else {
+			c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return
 	}
 	c.SendString(result)
 }
 
 // GetFiles is used to retrieve all files from a given path.
+// The volume is selected with the volume query parameter, the first volume is used by default.
+// The shelves of the user are listed as the folders of the Shelves volume.
 func (server *Server) GetFiles(c *fiber.Ctx) {
 	// Get current user information from the claims map.
 	user := c.Locals("user").(*jwt.Token)
 	claims := user.Claims.(jwt.MapClaims)
 
-	qPath := server.Volume.Path
-	if len(c.Query("path")) == 0 {
-		qPath += "/"
-	} else {
-		qPath += c.Query("path")
+	files, err := server.listFolder(claims["username"].(string), c.Query("volume"), c.Query("path"))
+	if err != nil {
+		sendError(c, err)
+		return
 	}
-	Files, err := server.Volume.WalkFolder(qPath)
 	tUser := server.GetUserByUsername(claims["username"].(string))
 
 	settingsMap := tUser.FileSettings.ToMap()
-	Files = Files.AddFileSetting(settingsMap)
+	files = files.AddFileSetting(settingsMap)
 
+	json, err := json.Marshal(files)
 	if err != nil {
 		fmt.Println(err.Error())
 		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	c.SendString(string(json))
+}
+
+// GetVolumeFile is used to serve a file from a volume. The path is confined to the volume.
+func (server *Server) GetVolumeFile(c *fiber.Ctx) {
+	volume, err := server.Volumes.Get(c.Params("volume"))
+	if err != nil || c.Params("volume") == "" {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	// The trash and the unfinished uploads aren't served, as they're left out of the listings.
+	if Files.IsHidden(path.Clean("/" + wildcard(c))) {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	resolved, err := volume.Resolve(wildcard(c))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	// A symlink to a hidden file isn't served either.
+	if Files.IsHidden(volume.Rel(resolved)) {
+		c.SendStatus(fiber.StatusNotFound)
+		return
 	}
-	json, err := json.Marshal(Files)
+	file, err := os.Open(resolved)
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	c.Type(filepath.Ext(resolved))
+	// The stream is closed by fasthttp once it has been sent.
+	c.SendStream(file, int(info.Size()))
+}
+
+// GetVolumes is used to list the volumes served by the server.
+func (server *Server) GetVolumes(c *fiber.Ctx) {
+	json, err := json.Marshal(server.Volumes)
 	if err != nil {
 		fmt.Println(err.Error())
 		c.SendStatus(fiber.StatusInternalServerError)
+		return
 	}
 	c.SendString(string(json))
 }
@@ -166,9 +291,15 @@ func (server *Server) Settings(c *fiber.Ctx) {
 	user := c.Locals("user").(*jwt.Token)
 	claims := user.Claims.(jwt.MapClaims)
 	tUser := server.GetUserByUsername(claims["username"].(string))
+	tokens, err := server.Tokens.List(tUser.Username)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
 	bind := fiber.Map{
 		"user":         tUser,
 		"fileSettings": tUser.FileSettings,
+		"tokens":       tokens,
+		"scopes":       Token.Scopes,
 	}
 	if err := c.Render("./views/settings.pug", bind); err != nil {
 		c.Status(500).Send(err.Error())
@@ -199,9 +330,13 @@ func (server *Server) generateJWTToken(c *fiber.Ctx, username string, profilepic
 	c.Cookie(cookie)
 }
 
-// JwtErrorHandler handles errors involving JWT
+// JwtErrorHandler handles errors involving JWT. Requests to the API are answered with 401 instead of a redirect.
 func (server *Server) JwtErrorHandler(c *fiber.Ctx, err error) {
 	fmt.Println("err:", err.Error())
+	if strings.HasPrefix(c.Path(), "/api/") {
+		API.Error(c, fiber.StatusUnauthorized, "not signed in", nil)
+		return
+	}
 	c.Redirect("/signin", 302)
 }
 
@@ -248,14 +383,143 @@ func (server *Server) InitDB() {
 	}
 	statement.Exec()
 
-	// Setup the pdfs table if it doesn't exist'
+	// Setup the volumes table if it doesn't exist' and add the imported libraries to the volumes.
 	statement, err = server.DB.Prepare(`
-		CREATE TABLE IF NOT EXISTS PDFS(
+		CREATE TABLE IF NOT EXISTS Volumes(
+			Name TEXT NOT NULL PRIMARY KEY,
+			Path TEXT,
+			Library TEXT,
+			HashMode TEXT
+		);
+	`)
+	if err != nil {
+		panic(err)
+	}
+	statement.Exec()
+	err = server.loadVolumes()
+	if err != nil {
+		panic(err)
+	}
+
+	// Setup the file index and let the volumes use it.
+	server.Index = &Files.Index{DB: server.DB}
+	err = server.Index.InitTable()
+	if err != nil {
+		panic(err)
+	}
+	for i := range server.Volumes {
+		server.Volumes[i].Index = server.Index
+	}
+
+	// Setup the catalog of the book metadata and let the volumes use it.
+	server.Catalog = &Files.Catalog{DB: server.DB, Extract: Metadata.Extract}
+	err = server.Catalog.InitTable()
+	if err != nil {
+		panic(err)
+	}
+	for i := range server.Volumes {
+		server.Volumes[i].Catalog = server.Catalog
+		if server.Thumbnails != nil {
+			server.Volumes[i].Thumbnails = server.Thumbnails
+		}
+	}
+
+	// Setup the progress table and move the positions of the readers into it.
+	server.Progress = &Progress.Store{DB: server.DB}
+	err = server.Progress.InitTable()
+	if err != nil {
+		panic(err)
+	}
+	for _, migration := range Progress.Migrations {
+		migrated, err := server.Progress.Migrate(migration)
+		if err != nil {
+			fmt.Println(err.Error())
+		} else if migrated > 0 {
+			fmt.Println("Moved", migrated, migration.Format, "positions into the progress table")
+		}
+	}
+
+	// Setup the annotations table.
+	server.Annotations = &Annotation.Store{DB: server.DB}
+	err = server.Annotations.InitTable()
+	if err != nil {
+		panic(err)
+	}
+
+	// Setup the tables of the shelves and the tags of the users.
+	server.Shelves = &Shelf.Store{DB: server.DB}
+	err = server.Shelves.InitTables()
+	if err != nil {
+		panic(err)
+	}
+
+	// Setup the table of the API tokens.
+	server.Tokens = &Token.Store{DB: server.DB}
+	err = server.Tokens.InitTable()
+	if err != nil {
+		panic(err)
+	}
+
+	// Setup the full-text search, which needs SQLite to be built with FTS5.
+	server.Search = &Search.Index{DB: server.DB}
+	err = server.Search.InitTables()
+	if err != nil {
+		fmt.Println("Search is disabled:", err.Error())
+		server.Search = nil
+	}
+
+	// Setup the tables of the KOReader sync.
+	server.Sync = &Kosync.Store{DB: server.DB}
+	err = server.Sync.InitTables()
+	if err != nil {
+		panic(err)
+	}
+
+	// Setup the uploads table if it doesn't exist'
+	statement, err = server.DB.Prepare(`
+		CREATE TABLE IF NOT EXISTS Uploads(
 			ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
 			Username TEXT,
+			Volume TEXT,
+			Path TEXT,
+			Size INTEGER,
 			Hash TEXT,
+			Created INTEGER
+		);
+	`)
+	if err != nil {
+		panic(err)
+	}
+	statement.Exec()
+
+	// Setup the upload sessions table if it doesn't exist'
+	statement, err = server.DB.Prepare(`
+		CREATE TABLE IF NOT EXISTS UploadSessions(
+			ID TEXT NOT NULL PRIMARY KEY,
+			Username TEXT,
+			Volume TEXT,
+			Folder TEXT,
+			Name TEXT,
+			Length INTEGER,
+			Offset INTEGER,
+			HashState BLOB,
+			Created INTEGER
+		);
+	`)
+	if err != nil {
+		panic(err)
+	}
+	statement.Exec()
+
+	// Setup the trash table if it doesn't exist'
+	statement, err = server.DB.Prepare(`
+		CREATE TABLE IF NOT EXISTS Trash(
+			ID TEXT NOT NULL PRIMARY KEY,
+			Username TEXT,
+			Volume TEXT,
 			Path TEXT,
-			Page INTEGER
+			IsDir INTEGER,
+			Deleted INTEGER
 		);
 	`)
 	if err != nil {
@@ -347,6 +611,88 @@ func (server *Server) GetFileSettingsByUsername(Username string) Files.FileSetti
 }
 
 // < ----- Helpers ----- >
+
+// username returns the username of the current user from the claims map.
+func username(c *fiber.Ctx) string {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	return claims["username"].(string)
+}
+
+// wildcard returns the percent decoded wildcard parameter of the route, as fiber doesn't decode the parameters.
+func wildcard(c *fiber.Ctx) string {
+	param, err := url.PathUnescape(c.Params("*"))
+	if err != nil {
+		return c.Params("*")
+	}
+	return param
+}
+
+// requestError is an error with the status code sent to the client.
+type requestError struct {
+	Status  int
+	Message string
+}
+
+func (err *requestError) Error() string {
+	return err.Message
+}
+
+// sendError sends the status code matching the error.
+func sendError(c *fiber.Ctx, err error) {
+	var reqErr *requestError
+	switch {
+	case errors.As(err, &reqErr):
+		c.Status(reqErr.Status).Send(reqErr.Message)
+	case err == Files.ErrOutsideVolume:
+		c.SendStatus(fiber.StatusForbidden)
+	case err == Files.ErrInvalidPath:
+		c.SendStatus(fiber.StatusBadRequest)
+	default:
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+	}
+}
+
+// validName reports whether the name can be used as the name of a file inside a folder.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// stat returns the file at the path relative to the volume, with the file setting of the user applied.
+func (server *Server) stat(username string, volume *Files.Volume, path string) (Files.File, error) {
+	file, err := volume.Stat(path)
+	if err != nil {
+		return Files.File{}, err
+	}
+	settings := server.GetFileSettingsByUsername(username)
+	files := Files.Files{file}.AddFileSetting(settings.ToMap())
+	return files[0], nil
+}
+
+// listFolder returns the files in the folder at the path of the volume, which can be the virtual volume of the shelves of the user.
+func (server *Server) listFolder(username string, volumeName string, path string) (Files.Files, error) {
+	_, files, err := server.Shelves.ListFolder(username, volumeName, path, server.Volumes)
+	if err == sql.ErrNoRows {
+		return nil, &requestError{Status: fiber.StatusNotFound, Message: "no such shelf"}
+	}
+	if _, ok := err.(*Files.UnknownVolumeError); ok {
+		return nil, &requestError{Status: fiber.StatusNotFound, Message: err.Error()}
+	}
+	return files, err
+}
+
+// sendJSON sends the value as JSON.
+func sendJSON(c *fiber.Ctx, value interface{}) {
+	json, err := json.Marshal(value)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	c.SendString(string(json))
+}
 func deleteEmpty(s []string) []string {
 	var r []string
 	for _, str := range s {
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	Files "../files"
+	Shelf "../shelf"
+	"github.com/gofiber/fiber"
+)
+
+func TestGetVolumeFile(t *testing.T) {
+	server := volumeServer(t)
+	volume := &server.Volumes[0]
+	writeFiles(t, volume, map[string]string{
+		"/book.pdf":            "book",
+		"/.trash/1/book.pdf":   "trashed",
+		"/.uploads/upload.pdf": "upload",
+	})
+	if err := os.Symlink(filepath.Join(".trash", "1", "book.pdf"), filepath.Join(volume.Path, "trashed.pdf")); err != nil {
+		t.Skip("symlinks aren't supported:", err)
+	}
+	app := fiber.New()
+	app.Get("/volume/:volume/*", server.GetVolumeFile)
+	app.Get("/opds/download/:volume/*", server.OPDSDownload)
+	tests := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{url: "/volume/C/book.pdf", status: fiber.StatusOK, body: "book"},
+		{url: "/opds/download/C/book.pdf", status: fiber.StatusOK, body: "book"},
+		{url: "/volume/C/.trash/1/book.pdf", status: fiber.StatusNotFound},
+		{url: "/volume/C/%2Etrash/1/book.pdf", status: fiber.StatusNotFound},
+		{url: "/volume/C/folder/..%2F.trash/1/book.pdf", status: fiber.StatusNotFound},
+		{url: "/volume/C/.uploads/upload.pdf", status: fiber.StatusNotFound},
+		{url: "/opds/download/C/.trash/1/book.pdf", status: fiber.StatusNotFound},
+		{url: "/volume/C/trashed.pdf", status: fiber.StatusNotFound},
+		{url: "/volume/C/missing.pdf", status: fiber.StatusNotFound},
+		{url: "/volume/D/book.pdf", status: fiber.StatusNotFound},
+	}
+	for _, test := range tests {
+		response, err := app.Test(httptest.NewRequest("GET", test.url, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != test.status || test.body != "" && string(body) != test.body {
+			t.Errorf("GET %s: got %d %q, want %d %q", test.url, response.StatusCode, body, test.status, test.body)
+		}
+	}
+}
+
+func TestSearchCatalog(t *testing.T) {
+	server := volumeServer(t)
+	volume := &server.Volumes[0]
+	writeFiles(t, volume, map[string]string{"/dune.epub": "dune", "/emma.epub": "emma"})
+	server.Catalog = &Files.Catalog{DB: server.DB}
+	server.Shelves = &Shelf.Store{DB: server.DB}
+	for _, init := range []func() error{server.Catalog.InitTable, server.Shelves.InitTables} {
+		if err := init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The index still holds a file removed while the watcher wasn't running.
+	for _, entry := range []Files.IndexEntry{
+		{Volume: "C", Path: "/dune.epub", Size: 4, Hash: "dune"},
+		{Volume: "C", Path: "/emma.epub", Size: 4, Hash: "emma"},
+		{Volume: "C", Path: "/gone.epub", Size: 4, Hash: "gone"},
+	} {
+		if err := server.Index.Store(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := manageApp(server)
+	app.Get("/catalog", server.SearchCatalog)
+	status, body := manageRequest(t, app, "GET", "/catalog?format=epub", "bob", nil)
+	var page CatalogPage
+	if err := json.Unmarshal([]byte(body), &page); status != fiber.StatusOK || err != nil {
+		t.Fatalf("got %d %q, %v", status, body, err)
+	}
+	if len(page.Files) != 2 || page.Total != 2 {
+		t.Errorf("got %d files of %d, want the 2 files on disk", len(page.Files), page.Total)
+	}
+}
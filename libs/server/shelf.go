@@ -0,0 +1,220 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	Files "../files"
+	Shelf "../shelf"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- Shelves ----- >
+
+// ShelfContents is a shelf with the books on it.
+type ShelfContents struct {
+	Shelf.Shelf
+	Files Files.Files `json:"Files"`
+}
+
+// GetShelves returns the shelves of the user.
+func (server *Server) GetShelves(c *fiber.Ctx) {
+	shelves, err := server.Shelves.List(username(c))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, shelves)
+}
+
+// GetShelf returns the shelf with the id and the books on it, like GetFiles returns files.
+func (server *Server) GetShelf(c *fiber.Ctx) {
+	shelf, ok := server.shelf(c)
+	if !ok {
+		return
+	}
+	files, err := server.Shelves.Files(&shelf, server.Volumes)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	user := server.GetUserByUsername(shelf.Username)
+	sendJSON(c, ShelfContents{Shelf: shelf, Files: files.AddFileSetting(user.FileSettings.ToMap())})
+}
+
+// CreateShelf adds the shelf sent as JSON. A shelf with a query is a smart shelf.
+func (server *Server) CreateShelf(c *fiber.Ctx) {
+	shelf := Shelf.Shelf{}
+	if json.Unmarshal([]byte(c.Body()), &shelf) != nil || shelf.Validate() != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid shelf")
+		return
+	}
+	shelf.ID = randomID()
+	shelf.Username = username(c)
+	shelf.Books = 0
+	err := server.Shelves.Insert(&shelf)
+	if err == Shelf.ErrExists {
+		c.Status(fiber.StatusConflict).Send(err.Error())
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.Status(fiber.StatusCreated)
+	sendJSON(c, shelf)
+}
+
+// UpdateShelf renames the shelf with the id or changes its query. Only the fields sent as JSON are changed.
+func (server *Server) UpdateShelf(c *fiber.Ctx) {
+	shelf, ok := server.shelf(c)
+	if !ok {
+		return
+	}
+	id := shelf.ID
+	if json.Unmarshal([]byte(c.Body()), &shelf) != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid shelf")
+		return
+	}
+	shelf.ID = id
+	if shelf.Validate() != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid shelf")
+		return
+	}
+	err := server.Shelves.Update(&shelf)
+	if err == Shelf.ErrExists {
+		c.Status(fiber.StatusConflict).Send(err.Error())
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	// The number of books is read again, as it isn't counted for smart shelves.
+	shelf, err = server.Shelves.Get(shelf.Username, shelf.ID)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, shelf)
+}
+
+// DeleteShelf removes the shelf with the id. The books on it are kept.
+func (server *Server) DeleteShelf(c *fiber.Ctx) {
+	err := server.Shelves.Delete(username(c), c.Params("id"))
+	if err == sql.ErrNoRows {
+		c.Status(fiber.StatusNotFound).Send("no such shelf")
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.SendStatus(fiber.StatusNoContent)
+}
+
+// AddShelfBook puts the book with the hash on the shelf with the id.
+func (server *Server) AddShelfBook(c *fiber.Ctx) {
+	shelf, ok := server.shelf(c)
+	if !ok {
+		return
+	}
+	entries, err := server.Index.LookupHash(c.Params("hash"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	if len(entries) == 0 {
+		c.Status(fiber.StatusNotFound).Send("unknown document")
+		return
+	}
+	err = server.Shelves.AddBook(&shelf, c.Params("hash"))
+	if err == Shelf.ErrSmart {
+		c.Status(fiber.StatusConflict).Send(err.Error())
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.SendStatus(fiber.StatusNoContent)
+}
+
+// RemoveShelfBook takes the book with the hash off the shelf with the id.
+func (server *Server) RemoveShelfBook(c *fiber.Ctx) {
+	shelf, ok := server.shelf(c)
+	if !ok {
+		return
+	}
+	err := server.Shelves.RemoveBook(&shelf, c.Params("hash"))
+	switch {
+	case err == Shelf.ErrSmart:
+		c.Status(fiber.StatusConflict).Send(err.Error())
+	case err == sql.ErrNoRows:
+		c.Status(fiber.StatusNotFound).Send("the book isn't on the shelf")
+	case err != nil:
+		sendError(c, err)
+	default:
+		c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// shelf returns the shelf of the user with the id parameter. A response is sent if it can't be found.
+func (server *Server) shelf(c *fiber.Ctx) (Shelf.Shelf, bool) {
+	shelf, err := server.Shelves.Get(username(c), c.Params("id"))
+	if err == sql.ErrNoRows {
+		c.Status(fiber.StatusNotFound).Send("no such shelf")
+		return shelf, false
+	}
+	if err != nil {
+		sendError(c, err)
+		return shelf, false
+	}
+	return shelf, true
+}
+
+// < ----- Tags ----- >
+
+// GetTags returns the tags of the user with the number of books each was given.
+func (server *Server) GetTags(c *fiber.Ctx) {
+	tags, err := server.Shelves.AllTags(username(c))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, tags)
+}
+
+// GetBookTags returns the tags the user gave the book with the hash.
+func (server *Server) GetBookTags(c *fiber.Ctx) {
+	tags, err := server.Shelves.Tags(username(c), c.Params("hash"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, tags)
+}
+
+// SetBookTags replaces the tags the user gave the book with the hash with the list sent as JSON.
+func (server *Server) SetBookTags(c *fiber.Ctx) {
+	var tags []string
+	if json.Unmarshal([]byte(c.Body()), &tags) != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid tags")
+		return
+	}
+	entries, err := server.Index.LookupHash(c.Params("hash"))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	if len(entries) == 0 {
+		c.Status(fiber.StatusNotFound).Send("unknown document")
+		return
+	}
+	tags, err = server.Shelves.SetTags(username(c), c.Params("hash"), tags)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, tags)
+}
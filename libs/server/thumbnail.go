@@ -0,0 +1,58 @@
+package server
+
+import (
+	"os"
+	"strconv"
+
+	Thumbnail "../thumbnail"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- Thumbnails ----- >
+
+// GetThumbnail sends the thumbnail of the file with the given hash as a jpeg.
+// The width is picked with the size query parameter, and rounded up to one of the thumbnail sizes.
+func (server *Server) GetThumbnail(c *fiber.Ctx) {
+	size := Thumbnail.DefaultSize
+	if c.Query("size") != "" {
+		var err error
+		size, err = strconv.Atoi(c.Query("size"))
+		if err != nil || size < 1 {
+			c.Status(fiber.StatusBadRequest).Send("invalid size")
+			return
+		}
+	}
+	hash := c.Params("hash")
+	entries, err := server.Index.LookupHash(hash)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	for _, entry := range entries {
+		volume, err := server.Volumes.Get(entry.Volume)
+		if err != nil {
+			continue
+		}
+		path, err := volume.Resolve(entry.Path)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		thumbnail, err := server.Thumbnails.Get(path, hash, size)
+		if err != nil {
+			c.SendStatus(fiber.StatusNotFound)
+			return
+		}
+		// The thumbnail is stored by the hash of the file, so it never changes. It's private as only signed in users may see it.
+		c.Set(fiber.HeaderCacheControl, "private, max-age=31536000, immutable")
+		c.Type("jpg")
+		err = c.SendFile(thumbnail)
+		if err != nil {
+			sendError(c, err)
+		}
+		return
+	}
+	c.SendStatus(fiber.StatusNotFound)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	API "../api"
+	Token "../token"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- API tokens ----- >
+
+// TokenAuth signs in the requests with an API token in the Authorization header, as Bearer <Token>.
+// The request is refused if the scopes of the token don't allow it. Requests without a token are passed on to the JWT middleware.
+func (server *Server) TokenAuth(c *fiber.Ctx) {
+	authorization := c.Get(fiber.HeaderAuthorization)
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		c.Next()
+		return
+	}
+	token, err := server.Tokens.Authenticate(strings.TrimSpace(authorization[len("Bearer "):]))
+	if err == sql.ErrNoRows {
+		authError(c, fiber.StatusUnauthorized, "invalid token")
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	if !token.Allows(c.Method(), c.Path()) {
+		authError(c, fiber.StatusForbidden, "the scopes of the token don't allow the request")
+		return
+	}
+	// The user is set like the JWT middleware sets it, so the handlers don't know how the request was signed in.
+	c.Locals("user", &jwt.Token{Valid: true, Claims: jwt.MapClaims{"username": token.Username}})
+	c.Next()
+}
+
+// SignedInWithToken reports whether the request was signed in by TokenAuth. The JWT middleware skips these requests.
+func (server *Server) SignedInWithToken(c *fiber.Ctx) bool {
+	return c.Locals("user") != nil
+}
+
+// GetTokens returns the API tokens of the user, without the tokens themselves.
+func (server *Server) GetTokens(c *fiber.Ctx) {
+	tokens, err := server.Tokens.List(username(c))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, tokens)
+}
+
+// CreateToken makes a new API token with the name and scopes sent as JSON. The token is only sent in this response.
+func (server *Server) CreateToken(c *fiber.Ctx) {
+	token := Token.Token{}
+	if json.Unmarshal([]byte(c.Body()), &token) != nil {
+		c.Status(fiber.StatusBadRequest).Send("invalid token")
+		return
+	}
+	token.Username = username(c)
+	err := server.Tokens.Create(&token)
+	if err == Token.ErrInvalid {
+		c.Status(fiber.StatusBadRequest).Send(err.Error())
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.Status(fiber.StatusCreated)
+	sendJSON(c, token)
+}
+
+// DeleteToken revokes the API token with the id.
+func (server *Server) DeleteToken(c *fiber.Ctx) {
+	err := server.Tokens.Delete(username(c), c.Params("id"))
+	if err == sql.ErrNoRows {
+		c.Status(fiber.StatusNotFound).Send("no such token")
+		return
+	}
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.SendStatus(fiber.StatusNoContent)
+}
+
+// authError refuses the request, with an error envelope for the requests to the API.
+func authError(c *fiber.Ctx, status int, message string) {
+	if strings.HasPrefix(strings.ToLower(c.Path()), "/api/") {
+		API.Error(c, status, message, nil)
+		return
+	}
+	c.Status(status).Send(message)
+}
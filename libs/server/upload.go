@@ -0,0 +1,624 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	Files "../files"
+	"github.com/gofiber/fiber"
+)
+
+// < ----- Uploads ----- >
+
+// TusVersion is the version of the tus resumable upload protocol supported by the chunked uploads.
+const TusVersion = "1.0.0"
+
+// UploadSession is a chunked upload that has been started but not finished.
+type UploadSession struct {
+	ID        string `json:"ID"`
+	Username  string `json:"Username"`
+	Volume    string `json:"Volume"`
+	Folder    string `json:"Folder"` // The folder relative to the volume the file is uploaded to.
+	Name      string `json:"Name"`
+	Length    int64  `json:"Length"`
+	Offset    int64  `json:"Offset"`
+	HashState []byte `json:"-"` // The state of the sha256 hasher, so the hash is created while the chunks arrive.
+	Created   int64  `json:"Created"`
+}
+
+// Upload is used to upload a file into a folder of a volume.
+// A multipart form with the fields volume, path and file uploads the file in a single request.
+// A request with the Upload-Length header starts a chunked upload, which is continued with PATCH /upload/:id.
+func (server *Server) Upload(c *fiber.Ctx) {
+	c.Set("Tus-Resumable", TusVersion)
+	if c.Get("Upload-Length") != "" {
+		server.createUploadSession(c)
+		return
+	}
+	username := username(c)
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.Status(fiber.StatusBadRequest).Send("missing file")
+		return
+	}
+	name := header.Filename
+	if c.FormValue("name") != "" {
+		name = c.FormValue("name")
+	}
+	volume, target, err := server.checkUpload(username, c.FormValue("volume"), c.FormValue("path"), name, header.Size)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	source, err := header.Open()
+	if err != nil {
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	defer source.Close()
+	temporary, err := uploadPath(volume, randomID())
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	destination, err := os.Create(temporary)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	// The file is hashed while it is written, so it doesn't have to be read again.
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(destination, hasher), source)
+	destination.Close()
+	if err != nil {
+		os.Remove(temporary)
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	file, err := server.finishUpload(username, volume, temporary, target, hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	c.Status(fiber.StatusCreated)
+	sendJSON(c, file)
+}
+
+// UploadStatus returns the offset of a chunked upload in the Upload-Offset header, so it can be resumed.
+func (server *Server) UploadStatus(c *fiber.Ctx) {
+	c.Set("Tus-Resumable", TusVersion)
+	c.Set("Cache-Control", "no-store")
+	session, err := server.GetUploadSession(c.Params("id"), username(c))
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	c.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	c.SendStatus(fiber.StatusOK)
+}
+
+// UploadChunk appends the body of the request to a chunked upload.
+// The Upload-Offset header has to match the current offset of the upload.
+// When the last chunk has been received the file is moved into the volume and returned as JSON.
+func (server *Server) UploadChunk(c *fiber.Ctx) {
+	c.Set("Tus-Resumable", TusVersion)
+	username := username(c)
+	session, err := server.GetUploadSession(c.Params("id"), username)
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	defer lockUpload(session.ID)()
+	// The upload is read again, as another chunk may have been appended or the upload finished while waiting.
+	session, err = server.GetUploadSession(session.ID, username)
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), "application/offset+octet-stream") {
+		c.Status(fiber.StatusUnsupportedMediaType).Send("expected application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != session.Offset {
+		c.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		c.SendStatus(fiber.StatusConflict)
+		return
+	}
+	body := c.Fasthttp.Request.Body()
+	if session.Offset+int64(len(body)) > session.Length {
+		c.Status(fiber.StatusBadRequest).Send("the chunk is larger than the upload")
+		return
+	}
+	volume, err := server.Volumes.Get(session.Volume)
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	temporary, err := uploadPath(volume, session.ID)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	hasher, err := restoreHasher(session.HashState)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	err = appendChunk(temporary, session.Offset, body, hasher)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	session.Offset += int64(len(body))
+	session.HashState, err = hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	err = server.UpdateUploadSession(session)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	c.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	if session.Offset < session.Length {
+		c.SendStatus(fiber.StatusNoContent)
+		return
+	}
+	// The upload is complete, and the session is removed even if the file can't be moved into place,
+	// as the upload can't be continued and its length would count towards the quota.
+	defer server.DeleteUploadSession(session.ID)
+	target, err := volume.Resolve(joinPath(session.Folder, session.Name))
+	if err != nil {
+		os.Remove(temporary)
+		sendError(c, err)
+		return
+	}
+	file, err := server.finishUpload(username, volume, temporary, target, hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	sendJSON(c, file)
+}
+
+// CancelUpload stops a chunked upload and removes the data received so far.
+func (server *Server) CancelUpload(c *fiber.Ctx) {
+	c.Set("Tus-Resumable", TusVersion)
+	session, err := server.GetUploadSession(c.Params("id"), username(c))
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return
+	}
+	defer lockUpload(session.ID)()
+	if volume, err := server.Volumes.Get(session.Volume); err == nil {
+		if temporary, err := uploadPath(volume, session.ID); err == nil {
+			os.Remove(temporary)
+		}
+	}
+	err = server.DeleteUploadSession(session.ID)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	c.SendStatus(fiber.StatusNoContent)
+}
+
+// ExpireUploads removes the chunked uploads started longer than UploadExpiry ago and the data received for them,
+// so abandoned uploads stop counting towards the quota of their users. It returns the number of uploads removed.
+func (server *Server) ExpireUploads() (int, error) {
+	if server.UploadExpiry <= 0 {
+		return 0, nil
+	}
+	result, err := server.DB.Query("SELECT ID, Volume FROM UploadSessions WHERE Created<$1", time.Now().Add(-server.UploadExpiry).Unix())
+	if err != nil {
+		return 0, err
+	}
+	var sessions []UploadSession
+	for result.Next() {
+		session := UploadSession{}
+		err = result.Scan(&session.ID, &session.Volume)
+		if err != nil {
+			result.Close()
+			return 0, err
+		}
+		sessions = append(sessions, session)
+	}
+	result.Close()
+	for i, session := range sessions {
+		err = server.expireUpload(session)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// expireUpload removes an expired chunked upload, waiting for a chunk that's being appended to it.
+func (server *Server) expireUpload(session UploadSession) error {
+	defer lockUpload(session.ID)()
+	if volume, err := server.Volumes.Get(session.Volume); err == nil {
+		if temporary, err := uploadPath(volume, session.ID); err == nil {
+			os.Remove(temporary)
+		}
+	}
+	return server.DeleteUploadSession(session.ID)
+}
+
+// ExpireUploadsEvery removes the expired chunked uploads in the background, now and then once every interval.
+func (server *Server) ExpireUploadsEvery(interval time.Duration) {
+	go func() {
+		for {
+			count, err := server.ExpireUploads()
+			if err != nil {
+				fmt.Println(err.Error())
+			} else if count > 0 {
+				fmt.Println("Removed", count, "expired uploads")
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// createUploadSession starts a chunked upload. The volume, folder and name are read from the Upload-Metadata header.
+func (server *Server) createUploadSession(c *fiber.Ctx) {
+	username := username(c)
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.Status(fiber.StatusBadRequest).Send("invalid Upload-Length")
+		return
+	}
+	metadata := parseUploadMetadata(c.Get("Upload-Metadata"))
+	volume, _, err := server.checkUpload(username, metadata["volume"], metadata["path"], metadata["filename"], length)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	hashState, err := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	session := UploadSession{
+		ID:        randomID(),
+		Username:  username,
+		Volume:    volume.Name,
+		Folder:    metadata["path"],
+		Name:      metadata["filename"],
+		Length:    length,
+		HashState: hashState,
+		Created:   time.Now().Unix(),
+	}
+	temporary, err := uploadPath(volume, session.ID)
+	if err != nil {
+		sendError(c, err)
+		return
+	}
+	file, err := os.Create(temporary)
+	if err != nil {
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	file.Close()
+	err = server.InsertUploadSession(session)
+	if err != nil {
+		os.Remove(temporary)
+		fmt.Println(err.Error())
+		c.SendStatus(fiber.StatusInternalServerError)
+		return
+	}
+	c.Set("Location", "/upload/"+session.ID)
+	c.Set("Upload-Offset", "0")
+	c.SendStatus(fiber.StatusCreated)
+}
+
+// checkUpload checks that the user may upload a file with the given name and size into the folder of the volume.
+// It returns the volume and the path on disk the file will be written to.
+func (server *Server) checkUpload(username string, volumeName string, folder string, name string, size int64) (*Files.Volume, string, error) {
+	volume, err := server.Volumes.Get(volumeName)
+	if err != nil {
+		return nil, "", &requestError{Status: fiber.StatusNotFound, Message: err.Error()}
+	}
+	if !validName(name) {
+		return nil, "", &requestError{Status: fiber.StatusBadRequest, Message: "invalid file name"}
+	}
+	// Only files with an extension the user has a file setting for can be uploaded.
+	extension := strings.ToLower(filepath.Ext(name))
+	allowed := false
+	for _, setting := range server.GetFileSettingsByUsername(username) {
+		if strings.ToLower(setting.Extension) == extension {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, "", &requestError{Status: fiber.StatusUnsupportedMediaType, Message: "the extension " + strconv.Quote(extension) + " is not allowed"}
+	}
+	if server.Quota > 0 {
+		used, err := server.GetUsedQuota(username)
+		if err != nil {
+			return nil, "", err
+		}
+		if used+size > server.Quota {
+			return nil, "", &requestError{Status: fiber.StatusRequestEntityTooLarge, Message: "the upload exceeds the quota"}
+		}
+	}
+	folderPath, err := volume.Resolve(folder)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := os.Stat(folderPath)
+	if err != nil || !info.IsDir() {
+		return nil, "", &requestError{Status: fiber.StatusNotFound, Message: "the folder does not exist"}
+	}
+	target, err := volume.Resolve(joinPath(folder, name))
+	if err != nil {
+		return nil, "", err
+	}
+	if Files.IsHidden(volume.Rel(target)) {
+		return nil, "", Files.ErrOutsideVolume
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return nil, "", &requestError{Status: fiber.StatusConflict, Message: "the file already exists"}
+	}
+	return volume, target, nil
+}
+
+// finishUpload moves the uploaded file into place, stores its hash in the index and records the upload for the quota.
+func (server *Server) finishUpload(username string, volume *Files.Volume, temporary string, target string, hash string) (Files.File, error) {
+	if _, err := os.Lstat(target); err == nil {
+		os.Remove(temporary)
+		return Files.File{}, &requestError{Status: fiber.StatusConflict, Message: "the file already exists"}
+	}
+	err := os.Rename(temporary, target)
+	if err != nil {
+		os.Remove(temporary)
+		return Files.File{}, err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return Files.File{}, err
+	}
+	path := volume.Rel(target)
+	// The streamed hash is only the hash of the file when the whole file is hashed.
+	if volume.HashMode == Files.PartialHash {
+		hash, err = volume.HashFile(&Files.File{Path: target})
+		if err != nil {
+			return Files.File{}, err
+		}
+	}
+	if volume.Index != nil {
+		err = volume.Index.Store(Files.IndexEntry{Volume: volume.Name, Path: path, Size: info.Size(), ModTime: info.ModTime().UnixNano(), Hash: hash})
+		if err != nil {
+			return Files.File{}, err
+		}
+	}
+	err = server.UpsertUpload(username, volume.Name, path, info.Size(), hash)
+	if err != nil {
+		return Files.File{}, err
+	}
+	return server.stat(username, volume, path)
+}
+
+// uploadLocks holds a lock for each chunked upload that is being written to.
+var uploadLocks = struct {
+	sync.Mutex
+	sessions map[string]*uploadLock
+}{sessions: make(map[string]*uploadLock)}
+
+// uploadLock is the lock of a chunked upload, removed once no request holds or waits for it.
+type uploadLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockUpload locks the chunked upload with the id and returns the function unlocking it,
+// so the chunks sent at the same time to the same upload are appended one after the other.
+func lockUpload(id string) func() {
+	uploadLocks.Lock()
+	lock, ok := uploadLocks.sessions[id]
+	if !ok {
+		lock = &uploadLock{}
+		uploadLocks.sessions[id] = lock
+	}
+	lock.users++
+	uploadLocks.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		uploadLocks.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(uploadLocks.sessions, id)
+		}
+		uploadLocks.Unlock()
+	}
+}
+
+// uploadPath returns the path the data of an unfinished upload is stored at.
+// It is kept inside the volume, so the finished file can be moved into place without copying it.
+func uploadPath(volume *Files.Volume, id string) (string, error) {
+	root, err := volume.Root()
+	if err != nil {
+		return "", err
+	}
+	folder := filepath.Join(root, Files.UploadFolder)
+	err = os.MkdirAll(folder, 0755)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(folder, id), nil
+}
+
+// appendChunk writes the chunk at the offset of the file, and feeds it to the hasher.
+func appendChunk(path string, offset int64, chunk []byte, hasher hash.Hash) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Anything written after the offset is from a chunk that didn't finish, so it is thrown away.
+	err = file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.MultiWriter(file, hasher).Write(chunk)
+	return err
+}
+
+// restoreHasher restores a sha256 hasher from its marshaled state.
+func restoreHasher(state []byte) (hash.Hash, error) {
+	hasher := sha256.New()
+	err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if err != nil {
+		return nil, err
+	}
+	return hasher, nil
+}
+
+// parseUploadMetadata parses the Upload-Metadata header, which is a comma separated list of keys and base64 encoded values.
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		metadata[parts[0]] = value
+	}
+	return metadata
+}
+
+// joinPath joins a folder and a file name relative to a volume.
+func joinPath(folder string, name string) string {
+	return strings.TrimRight(folder, "/") + "/" + name
+}
+
+// randomID returns a random hex encoded id.
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// < ----- UPLOADS DB START ----- >
+
+// UpsertUpload records a finished upload, which counts towards the quota of the user.
+// An earlier upload of the same path is replaced, so a file written again only counts once.
+func (server *Server) UpsertUpload(username string, volume string, path string, size int64, hash string) error {
+	tx, err := server.DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM Uploads WHERE Volume=$1 AND Path=$2", volume, path)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO Uploads (Username, Volume, Path, Size, Hash, Created) values (?,?,?,?,?,?)", username, volume, path, size, hash, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUploadSize returns the size the file at the path counts towards the quota of the user, or 0 if the user didn't upload it.
+func (server *Server) GetUploadSize(username string, volume string, path string) (int64, error) {
+	var size int64
+	err := server.DB.QueryRow("SELECT COALESCE(SUM(Size), 0) FROM Uploads WHERE Username=$1 AND Volume=$2 AND Path=$3", username, volume, path).Scan(&size)
+	return size, err
+}
+
+// MoveUploads moves the uploads of a file or folder that has been moved inside the volume.
+func (server *Server) MoveUploads(volume string, oldPath string, newPath string) error {
+	// Uploads left behind at the new path are of files that are gone, as the path was free when the file was moved.
+	err := server.DeleteUploads(volume, newPath)
+	if err != nil {
+		return err
+	}
+	_, err = server.DB.Exec("UPDATE Uploads SET Path=$1 || substr(Path, length($2)+1) WHERE Volume=$3 AND (Path=$2 OR substr(Path, 1, length($2)+1)=$2 || '/')", newPath, oldPath, volume)
+	return err
+}
+
+// DeleteUploads removes the uploads of a file or folder that has been removed, which frees the quota they used.
+func (server *Server) DeleteUploads(volume string, path string) error {
+	_, err := server.DB.Exec("DELETE FROM Uploads WHERE Volume=$1 AND (Path=$2 OR substr(Path, 1, length($2)+1)=$2 || '/')", volume, path)
+	return err
+}
+
+// GetUsedQuota returns the number of bytes uploaded by the user, including the full length of unfinished uploads.
+// Files in the trash don't count, so deleting a file frees its quota, and restoring it uses it again.
+func (server *Server) GetUsedQuota(username string) (int64, error) {
+	var uploaded, pending int64
+	err := server.DB.QueryRow("SELECT COALESCE(SUM(Size), 0) FROM Uploads WHERE Username=$1 AND substr(Path, 1, length($2))<>$2", username, "/"+Files.TrashFolder+"/").Scan(&uploaded)
+	if err != nil {
+		return 0, err
+	}
+	err = server.DB.QueryRow("SELECT COALESCE(SUM(Length), 0) FROM UploadSessions WHERE Username=$1", username).Scan(&pending)
+	if err != nil {
+		return 0, err
+	}
+	return uploaded + pending, nil
+}
+
+// InsertUploadSession inserts a chunked upload into the database.
+func (server *Server) InsertUploadSession(session UploadSession) error {
+	_, err := server.DB.Exec("INSERT INTO UploadSessions (ID, Username, Volume, Folder, Name, Length, Offset, HashState, Created) values (?,?,?,?,?,?,?,?,?)", session.ID, session.Username, session.Volume, session.Folder, session.Name, session.Length, session.Offset, session.HashState, session.Created)
+	return err
+}
+
+// GetUploadSession returns the chunked upload with the given id, if it belongs to the user.
+func (server *Server) GetUploadSession(id string, username string) (UploadSession, error) {
+	session := UploadSession{}
+	result := server.DB.QueryRow("SELECT ID, Username, Volume, Folder, Name, Length, Offset, HashState, Created FROM UploadSessions WHERE ID=$1 AND Username=$2", id, username)
+	err := result.Scan(&session.ID, &session.Username, &session.Volume, &session.Folder, &session.Name, &session.Length, &session.Offset, &session.HashState, &session.Created)
+	return session, err
+}
+
+// UpdateUploadSession stores the offset and hash state of a chunked upload.
+func (server *Server) UpdateUploadSession(session UploadSession) error {
+	_, err := server.DB.Exec("UPDATE UploadSessions SET Offset=$1, HashState=$2 WHERE ID=$3", session.Offset, session.HashState, session.ID)
+	return err
+}
+
+// DeleteUploadSession removes a chunked upload from the database.
+func (server *Server) DeleteUploadSession(id string) error {
+	_, err := server.DB.Exec("DELETE FROM UploadSessions WHERE ID=$1", id)
+	return err
+}
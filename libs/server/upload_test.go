@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExpireUploads(t *testing.T) {
+	server := volumeServer(t)
+	volume := &server.Volumes[0]
+	now := time.Now()
+	sessions := []UploadSession{
+		{ID: "abandoned", Username: "bob", Volume: "C", Name: "old.pdf", Length: 100, Created: now.Add(-25 * time.Hour).Unix()},
+		{ID: "running", Username: "bob", Volume: "C", Name: "new.pdf", Length: 10, Created: now.Add(-time.Hour).Unix()},
+	}
+	for _, session := range sessions {
+		if err := server.InsertUploadSession(session); err != nil {
+			t.Fatal(err)
+		}
+		temporary, err := uploadPath(volume, session.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(temporary, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Uploads are kept when they don't expire.
+	if count, err := server.ExpireUploads(); err != nil || count != 0 {
+		t.Errorf("removed %d uploads, %v, without an expiry", count, err)
+	}
+
+	server.UploadExpiry = 24 * time.Hour
+	if count, err := server.ExpireUploads(); err != nil || count != 1 {
+		t.Errorf("removed %d uploads, %v, want 1", count, err)
+	}
+	if _, err := server.GetUploadSession("abandoned", "bob"); err == nil {
+		t.Error("the abandoned upload is still there")
+	}
+	if _, err := server.GetUploadSession("running", "bob"); err != nil {
+		t.Errorf("the running upload was removed: %v", err)
+	}
+	for id, kept := range map[string]bool{"abandoned": false, "running": true} {
+		temporary, _ := uploadPath(volume, id)
+		if _, err := os.Stat(temporary); (err == nil) != kept {
+			t.Errorf("the data of the %s upload: got %v, want it kept %v", id, err, kept)
+		}
+	}
+	if used, err := server.GetUsedQuota("bob"); err != nil || used != 10 {
+		t.Errorf("got %d bytes used, %v, want 10", used, err)
+	}
+}
@@ -0,0 +1,453 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	Files "../files"
+	"github.com/gofiber/fiber"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/webdav"
+)
+
+// < ----- WebDAV ----- >
+
+// DAVPrefix is the path the volumes are mounted at over WebDAV. Each volume is a collection below it.
+const DAVPrefix = "/dav"
+
+// davLocks holds the WebDAV locks of each volume, so locks taken by one request are seen by the next.
+var davLocks = struct {
+	sync.Mutex
+	systems map[string]webdav.LockSystem
+}{systems: make(map[string]webdav.LockSystem)}
+
+// Listen serves the app on the port of the server, with the volumes mounted over WebDAV.
+func (server *Server) Listen(app *fiber.App) error {
+	return server.HTTPServer(app).ListenAndServe(":" + strconv.Itoa(server.Port))
+}
+
+// HTTPServer returns the server of the app, with the volumes mounted over WebDAV.
+// WebDAV is served in front of fiber, as fiber rejects the methods WebDAV adds to HTTP, so the server is set up
+// from the settings of the app as fiber would. The request bodies are streamed, so files of any size can be written
+// over WebDAV without holding them in memory, while the bodies sent to fiber are still limited to its BodyLimit.
+func (server *Server) HTTPServer(app *fiber.App) *fasthttp.Server {
+	settings := app.Settings
+	return &fasthttp.Server{
+		Handler: closeUnread(server.DAVHandler(limitBody(app, app.Handler()))),
+		ErrorHandler: func(fctx *fasthttp.RequestCtx, err error) {
+			ctx := app.AcquireCtx(fctx)
+			defer app.ReleaseCtx(ctx)
+			if _, ok := err.(*fasthttp.ErrSmallBuffer); ok {
+				settings.ErrorHandler(ctx, fiber.ErrRequestHeaderFieldsTooLarge)
+			} else if netErr, ok := err.(*net.OpError); ok && netErr.Timeout() {
+				settings.ErrorHandler(ctx, fiber.ErrRequestTimeout)
+			} else {
+				settings.ErrorHandler(ctx, fiber.ErrBadRequest)
+			}
+		},
+		Name:                          settings.ServerHeader,
+		Concurrency:                   settings.Concurrency,
+		NoDefaultDate:                 settings.DisableDefaultDate,
+		NoDefaultContentType:          settings.DisableDefaultContentType,
+		DisableHeaderNamesNormalizing: settings.DisableHeaderNormalizing,
+		DisableKeepalive:              settings.DisableKeepalive,
+		NoDefaultServerHeader:         settings.ServerHeader == "",
+		ReadTimeout:                   settings.ReadTimeout,
+		WriteTimeout:                  settings.WriteTimeout,
+		IdleTimeout:                   settings.IdleTimeout,
+		ReadBufferSize:                settings.ReadBufferSize,
+		WriteBufferSize:               settings.WriteBufferSize,
+		MaxRequestBodySize:            settings.BodyLimit,
+		StreamRequestBody:             true,
+		// Forms are read by fiber once the body passed limitBody, instead of while the request is read.
+		DisablePreParseMultipartForm: true,
+	}
+}
+
+// closeUnread closes the connection after a request with a body that was refused, as the body may not have been read
+// to the end, and the rest of it would be read as the next request.
+func closeUnread(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		next(ctx)
+		if ctx.Response.StatusCode() >= fiber.StatusBadRequest && ctx.Request.Header.ContentLength() != 0 {
+			ctx.SetConnectionClose()
+		}
+	}
+}
+
+// limitBody rejects the requests to the app with a body larger than its BodyLimit.
+// Streamed bodies are read in whole by fiber, so they're limited before they get to it.
+func limitBody(app *fiber.App, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(fctx *fasthttp.RequestCtx) {
+		limit := app.Settings.BodyLimit
+		length := fctx.Request.Header.ContentLength()
+		// The length of a chunked body is only known once it has been read.
+		if limit > 0 && length == -1 && fctx.RequestBodyStream() != nil {
+			body, err := ioutil.ReadAll(io.LimitReader(fctx.RequestBodyStream(), int64(limit)+1))
+			if err != nil {
+				length = limit + 1
+			} else {
+				length = len(body)
+				fctx.Request.SetBody(body)
+			}
+		}
+		if limit > 0 && length > limit {
+			ctx := app.AcquireCtx(fctx)
+			defer app.ReleaseCtx(ctx)
+			app.Settings.ErrorHandler(ctx, fiber.ErrRequestEntityTooLarge)
+			return
+		}
+		next(fctx)
+	}
+}
+
+// DAVHandler serves the requests below DAVPrefix over WebDAV and passes the other requests to the next handler.
+// Users sign in with HTTP Basic authentication. Files written over WebDAV are indexed and count towards the quota of the user.
+func (server *Server) DAVHandler(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		requestPath := string(ctx.Path())
+		if requestPath != DAVPrefix && !strings.HasPrefix(requestPath, DAVPrefix+"/") {
+			next(ctx)
+			return
+		}
+		username := server.basicUser(string(ctx.Request.Header.Peek(fiber.HeaderAuthorization)))
+		if username == "" {
+			ctx.Response.Header.Set(fiber.HeaderWWWAuthenticate, basicChallenge)
+			ctx.SetStatusCode(fiber.StatusUnauthorized)
+			return
+		}
+		name := strings.SplitN(strings.TrimPrefix(requestPath, DAVPrefix+"/"), "/", 2)[0]
+		if name == "" {
+			server.serveDAVRoot(ctx)
+			return
+		}
+		volume, err := server.Volumes.Get(name)
+		if err != nil {
+			ctx.SetStatusCode(fiber.StatusNotFound)
+			return
+		}
+		fs := &davFS{server: server, volume: volume, username: username}
+		// Files sent with their length are refused right away when they don't fit in the quota.
+		// Files sent in chunks are checked against the quota while they're written, see davFile.
+		if string(ctx.Method()) == fiber.MethodPut && server.Quota > 0 {
+			remaining, err := fs.remainingQuota(path.Clean("/" + strings.TrimPrefix(requestPath, DAVPrefix+"/"+name)))
+			if err != nil {
+				ctx.SetStatusCode(fiber.StatusInternalServerError)
+				return
+			}
+			if int64(ctx.Request.Header.ContentLength()) > remaining {
+				ctx.SetStatusCode(fiber.StatusInsufficientStorage)
+				return
+			}
+		}
+		handler := &webdav.Handler{
+			Prefix:     DAVPrefix + "/" + volume.Name,
+			FileSystem: fs,
+			LockSystem: volumeLocks(volume.Name),
+		}
+		serveDAV(ctx, handler)
+	}
+}
+
+// serveDAVRoot lists the volumes as read only collections.
+func (server *Server) serveDAVRoot(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Method()) {
+	case fiber.MethodOptions, "PROPFIND", fiber.MethodGet, fiber.MethodHead:
+	default:
+		ctx.SetStatusCode(fiber.StatusMethodNotAllowed)
+		return
+	}
+	root := webdav.NewMemFS()
+	for _, volume := range server.Volumes {
+		root.Mkdir(context.Background(), "/"+volume.Name, 0755)
+	}
+	handler := &webdav.Handler{Prefix: DAVPrefix, FileSystem: root, LockSystem: webdav.NewMemLS()}
+	serveDAV(ctx, handler)
+}
+
+// serveDAV serves the request with the WebDAV handler. Unlike fasthttpadaptor, which reads the whole body first,
+// the body is streamed to the handler, so a file written over WebDAV is copied straight into a davFile.
+func serveDAV(ctx *fasthttp.RequestCtx, handler http.Handler) {
+	var body io.Reader = ctx.RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(ctx.Request.Body())
+	}
+	request, err := http.NewRequest(string(ctx.Method()), string(ctx.RequestURI()), body)
+	if err != nil {
+		ctx.SetStatusCode(fiber.StatusBadRequest)
+		return
+	}
+	request.RequestURI = string(ctx.RequestURI())
+	request.Host = string(ctx.Host())
+	request.RemoteAddr = ctx.RemoteAddr().String()
+	request.ContentLength = int64(ctx.Request.Header.ContentLength())
+	if request.ContentLength < 0 {
+		request.ContentLength = -1
+	}
+	ctx.Request.Header.VisitAll(func(key []byte, value []byte) {
+		request.Header.Add(string(key), string(value))
+	})
+	response := &davResponse{header: make(http.Header), status: fiber.StatusOK}
+	handler.ServeHTTP(response, request.WithContext(ctx))
+	ctx.SetStatusCode(response.status)
+	for key, values := range response.header {
+		for _, value := range values {
+			ctx.Response.Header.Add(key, value)
+		}
+	}
+	if response.header.Get(fiber.HeaderContentType) == "" {
+		ctx.Response.Header.SetContentType(http.DetectContentType(response.body.Bytes()))
+	}
+	ctx.Write(response.body.Bytes())
+}
+
+// davResponse is the response of the WebDAV handler, which serveDAV copies into the fasthttp response.
+type davResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (response *davResponse) Header() http.Header {
+	return response.header
+}
+
+func (response *davResponse) WriteHeader(status int) {
+	response.status = status
+}
+
+func (response *davResponse) Write(p []byte) (int, error) {
+	return response.body.Write(p)
+}
+
+// volumeLocks returns the lock system of the volume.
+func volumeLocks(name string) webdav.LockSystem {
+	davLocks.Lock()
+	defer davLocks.Unlock()
+	locks, ok := davLocks.systems[name]
+	if !ok {
+		locks = webdav.NewMemLS()
+		davLocks.systems[name] = locks
+	}
+	return locks
+}
+
+// davFS is the file system of a volume served over WebDAV. Paths are confined to the volume, and the hidden folders are left out.
+type davFS struct {
+	server   *Server
+	volume   *Files.Volume
+	username string
+}
+
+// resolve resolves the WebDAV path to a path on disk. Paths outside of the volume and in the hidden folders aren't allowed.
+func (fs *davFS) resolve(name string) (string, error) {
+	name = path.Clean("/" + name)
+	if Files.IsHidden(name) {
+		return "", os.ErrNotExist
+	}
+	resolved, err := fs.volume.Resolve(name)
+	if errors.Is(err, Files.ErrOutsideVolume) || errors.Is(err, Files.ErrInvalidPath) {
+		return "", os.ErrPermission
+	}
+	if err != nil {
+		return "", err
+	}
+	if Files.IsHidden(fs.volume.Rel(resolved)) {
+		return "", os.ErrNotExist
+	}
+	return resolved, nil
+}
+
+// resolveLink resolves the WebDAV path of a file to remove or move. Only the parent folder is resolved,
+// so a symlink is managed itself instead of the file it points to, as resolveSource does.
+func (fs *davFS) resolveLink(name string) (string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "", os.ErrPermission
+	}
+	folder, err := fs.resolve(path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(folder, path.Base(name))
+	if Files.IsHidden(fs.volume.Rel(resolved)) {
+		return "", os.ErrNotExist
+	}
+	return resolved, nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	resolved, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(resolved, perm)
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	resolved, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(-1)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && fs.server.Quota > 0 {
+		limit, err = fs.remainingQuota(fs.volume.Rel(resolved))
+		if err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(resolved, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	// Files are created and replaced with O_TRUNC, other writes only count once something is written.
+	written := flag&(os.O_WRONLY|os.O_RDWR) != 0 && flag&(os.O_CREATE|os.O_TRUNC) != 0
+	return &davFile{File: file, fs: fs, written: written, limit: limit}, nil
+}
+
+// remainingQuota returns how large the file at the path can be written before the quota of the user is exceeded.
+// The file is written over, so what it counted before is freed.
+func (fs *davFS) remainingQuota(path string) (int64, error) {
+	used, err := fs.server.GetUsedQuota(fs.username)
+	if err != nil {
+		return 0, err
+	}
+	size, err := fs.server.GetUploadSize(fs.username, fs.volume.Name, path)
+	if err != nil {
+		return 0, err
+	}
+	if remaining := fs.server.Quota - used + size; remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
+// RemoveAll moves the file or folder to the trash of the volume, as deleting it from the web does.
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	resolved, err := fs.resolveLink(name)
+	if err != nil {
+		return err
+	}
+	_, err = fs.server.trash(fs.username, fs.volume, resolved)
+	return err
+}
+
+// Rename moves the file or folder, and moves its index entries and progress with it.
+func (fs *davFS) Rename(ctx context.Context, oldName string, newName string) error {
+	source, err := fs.resolveLink(oldName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(source); err != nil {
+		return err
+	}
+	target, err := fs.resolveLink(newName)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(source, target)
+	if err != nil {
+		return err
+	}
+	return fs.server.moveIndexed(fs.volume, fs.volume.Rel(source), fs.volume.Rel(target))
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	resolved, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(resolved)
+}
+
+// indexWritten indexes a file written over WebDAV. Progress stored for the hash of the file follows it to its path,
+// and the file counts towards the quota of the user.
+func (fs *davFS) indexWritten(disk string) error {
+	info, err := os.Stat(disk)
+	if err != nil || info.IsDir() {
+		return err
+	}
+	relative := fs.volume.Rel(disk)
+	file, err := fs.volume.Stat(relative)
+	if err != nil {
+		return err
+	}
+	if fs.volume.Index != nil {
+		err = fs.volume.Index.MigrateProgress(fs.volume, file.Hash, relative)
+		if err != nil {
+			return err
+		}
+	}
+	return fs.server.UpsertUpload(fs.username, fs.volume.Name, relative, info.Size(), file.Hash)
+}
+
+// errQuotaExceeded is returned when a file written over WebDAV grows past the quota of the user.
+var errQuotaExceeded = errors.New("webdav: the quota is exceeded")
+
+// davFile is a file opened over WebDAV. A file opened for writing is indexed when it's closed.
+// Writes past the quota of the user fail, and the file is removed when it's closed.
+type davFile struct {
+	*os.File
+	fs       *davFS
+	written  bool
+	limit    int64 // How many bytes can be written, -1 if there is no quota.
+	size     int64 // How many bytes have been written.
+	exceeded bool
+}
+
+func (file *davFile) Write(p []byte) (int, error) {
+	if file.limit >= 0 && file.size+int64(len(p)) > file.limit {
+		file.exceeded = true
+		return 0, errQuotaExceeded
+	}
+	n, err := file.File.Write(p)
+	file.size += int64(n)
+	file.written = true
+	return n, err
+}
+
+// ReadFrom copies the reader into the file with Write, so the writes are counted.
+// The ReadFrom of the embedded file would write past the quota.
+func (file *davFile) ReadFrom(reader io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{file}, reader)
+}
+
+// WriteString writes the string with Write, so the write is counted.
+func (file *davFile) WriteString(s string) (int, error) {
+	return file.Write([]byte(s))
+}
+
+// Readdir leaves the hidden folders out of the listing.
+func (file *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := file.File.Readdir(count)
+	listed := infos[:0]
+	for _, info := range infos {
+		if !Files.IsHidden(path.Join(file.fs.volume.Rel(file.Name()), info.Name())) {
+			listed = append(listed, info)
+		}
+	}
+	return listed, err
+}
+
+func (file *davFile) Close() error {
+	err := file.File.Close()
+	if file.exceeded {
+		os.Remove(file.Name())
+		return errQuotaExceeded
+	}
+	if err != nil || !file.written {
+		return err
+	}
+	return file.fs.indexWritten(file.Name())
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	Files "../files"
+	"github.com/gofiber/fiber"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// volumeServer returns a server with the volume C in a temporary folder, on a database with the tables the file management uses.
+// The user bob signs in with the password secret.
+func volumeServer(t *testing.T) *Server {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	for _, query := range []string{
+		"CREATE TABLE Users (ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, Username TEXT, Password TEXT, ProfilePicture TEXT)",
+		"CREATE TABLE FileSettings (ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, Username TEXT, Extension TEXT, ApplicationLink TEXT, Icon TEXT)",
+		"CREATE TABLE Uploads (ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, Username TEXT, Volume TEXT, Path TEXT, Size INTEGER, Hash TEXT, Created INTEGER)",
+		"CREATE TABLE UploadSessions (ID TEXT NOT NULL PRIMARY KEY, Username TEXT, Volume TEXT, Folder TEXT, Name TEXT, Length INTEGER, Offset INTEGER, HashState BLOB, Created INTEGER)",
+		"CREATE TABLE Trash (ID TEXT NOT NULL PRIMARY KEY, Username TEXT, Volume TEXT, Path TEXT, IsDir INTEGER, Deleted INTEGER)",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := &Server{DB: db, Index: &Files.Index{DB: db}}
+	if err := server.Index.InitTable(); err != nil {
+		t.Fatal(err)
+	}
+	server.Volumes, err = Files.ParseVolumes("C=" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Volumes[0].Index = server.Index
+	password, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.InsertUser("bob", string(password), ""); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// writeFiles writes the files, given by their paths relative to the volume, with their content.
+func writeFiles(t *testing.T, volume *Files.Volume, files map[string]string) {
+	for name, content := range files {
+		file := filepath.Join(volume.Path, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDAVSymlinks(t *testing.T) {
+	server := volumeServer(t)
+	volume := &server.Volumes[0]
+	writeFiles(t, volume, map[string]string{"/book.pdf": "book", "/folder/other.pdf": "other"})
+	for _, link := range []string{"deleted.pdf", "moved.pdf"} {
+		if err := os.Symlink("book.pdf", filepath.Join(volume.Path, link)); err != nil {
+			t.Skip("symlinks aren't supported:", err)
+		}
+	}
+	fs := &davFS{server: server, volume: volume, username: "bob"}
+	ctx := context.Background()
+
+	if err := fs.RemoveAll(ctx, "/deleted.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(volume.Path, "deleted.pdf")); !os.IsNotExist(err) {
+		t.Errorf("the deleted symlink is still there: %v", err)
+	}
+	entries, err := server.GetTrashEntries(volume.Name, "bob")
+	if err != nil || len(entries) != 1 || entries[0].Path != "/deleted.pdf" {
+		t.Errorf("got the trash %+v, %v, want the symlink", entries, err)
+	}
+
+	if err := fs.Rename(ctx, "/moved.pdf", "/folder/moved.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Lstat(filepath.Join(volume.Path, "folder", "moved.pdf")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("the symlink wasn't moved: %v", err)
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(volume.Path, "book.pdf")); err != nil || string(data) != "book" {
+		t.Errorf("the file the symlinks point to was changed: %q, %v", data, err)
+	}
+
+	for _, name := range []string{"/", "/.trash", "/missing/book.pdf"} {
+		if err := fs.RemoveAll(ctx, name); err == nil {
+			t.Errorf("removed %s", name)
+		}
+	}
+	if err := fs.Rename(ctx, "/book.pdf", "/.uploads/book.pdf"); err == nil {
+		t.Error("moved a file into a hidden folder")
+	}
+}
+
+func TestDAVStream(t *testing.T) {
+	server := volumeServer(t)
+	volume := &server.Volumes[0]
+	app := fiber.New(&fiber.Settings{BodyLimit: 1024, ServerHeader: "Ereader"})
+	app.Post("/length", func(c *fiber.Ctx) {
+		c.Send(strconv.Itoa(len(c.Body())))
+	})
+	listener := fasthttputil.NewInmemoryListener()
+	defer listener.Close()
+	go server.HTTPServer(app).Serve(listener)
+	client := &http.Client{Transport: &http.Transport{Dial: func(network, address string) (net.Conn, error) {
+		return listener.Dial()
+	}}}
+	send := func(method string, url string, body io.Reader, length int64) (*http.Response, string) {
+		request, err := http.NewRequest(method, "http://ereader"+url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.ContentLength = length
+		request.SetBasicAuth("bob", "secret")
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		data, _ := ioutil.ReadAll(response.Body)
+		return response, string(data)
+	}
+
+	// Files larger than the body limit can be written over WebDAV, with and without their length.
+	content := strings.Repeat("0123456789", 1000)
+	for _, length := range []int64{int64(len(content)), -1} {
+		name := "/book" + strconv.FormatInt(length, 10) + ".pdf"
+		response, body := send("PUT", DAVPrefix+"/C"+name, struct{ io.Reader }{strings.NewReader(content)}, length)
+		if response.StatusCode != http.StatusCreated {
+			t.Fatalf("PUT %s: got %d %q", name, response.StatusCode, body)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(volume.Path, name)); err != nil || string(data) != content {
+			t.Errorf("PUT %s: got %d bytes, %v", name, len(data), err)
+		}
+		if response, body := send("GET", DAVPrefix+"/C"+name, nil, 0); response.StatusCode != http.StatusOK || body != content {
+			t.Errorf("GET %s: got %d with %d bytes", name, response.StatusCode, len(body))
+		}
+	}
+	if response, body := send("PROPFIND", DAVPrefix+"/C/", nil, 0); response.StatusCode != http.StatusMultiStatus || !strings.Contains(body, "book-1.pdf") {
+		t.Errorf("PROPFIND: got %d %q", response.StatusCode, body)
+	}
+
+	// Files past the quota are refused, before they're sent when their length is known, and while they're written otherwise.
+	server.Quota = int64(2*len(content) + 100)
+	for _, length := range []int64{int64(len(content)), -1} {
+		name := "/over" + strconv.FormatInt(length, 10) + ".pdf"
+		response, _ := send("PUT", DAVPrefix+"/C"+name, struct{ io.Reader }{strings.NewReader(content)}, length)
+		if response.StatusCode < http.StatusBadRequest {
+			t.Errorf("PUT %s: got %d past the quota", name, response.StatusCode)
+		}
+		if _, err := os.Stat(filepath.Join(volume.Path, name)); !os.IsNotExist(err) {
+			t.Errorf("PUT %s: the file was kept past the quota", name)
+		}
+	}
+	server.Quota = 0
+
+	// The app gets the bodies within its limit, whole, and the settings of the app are kept.
+	// Refused bodies aren't read as the next request on the connection.
+	for _, test := range []struct {
+		length int
+		chunk  bool
+		status int
+	}{
+		{length: 1000, status: http.StatusOK},
+		{length: 1000, chunk: true, status: http.StatusOK},
+		{length: 1025, status: http.StatusRequestEntityTooLarge},
+		{length: 1000, status: http.StatusOK},
+		{length: 1025, chunk: true, status: http.StatusRequestEntityTooLarge},
+		{length: 1000, chunk: true, status: http.StatusOK},
+	} {
+		var body io.Reader = strings.NewReader(strings.Repeat("x", test.length))
+		length := int64(test.length)
+		if test.chunk {
+			body, length = struct{ io.Reader }{body}, -1
+		}
+		response, data := send("POST", "/length", body, length)
+		if response.StatusCode != test.status || test.status == http.StatusOK && data != strconv.Itoa(test.length) {
+			t.Errorf("POST %d bytes, chunked %v: got %d %q, want %d", test.length, test.chunk, response.StatusCode, data, test.status)
+		}
+		if response.Header.Get("Server") != "Ereader" {
+			t.Errorf("got the server header %q", response.Header.Get("Server"))
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package shelf
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+
+	Files "../files"
+	Progress "../progress"
+)
+
+// < ----- Shelves ----- >
+
+// ErrInvalid is returned when a shelf has no name or its query can't be read.
+var ErrInvalid = errors.New("invalid shelf")
+
+// ErrExists is returned when the user already has a shelf with the name.
+var ErrExists = errors.New("a shelf with the name exists")
+
+// ErrSmart is returned when books are added to or removed from a smart shelf, whose books are found by its query.
+var ErrSmart = errors.New("the books of a smart shelf are found by its query")
+
+// Shelf is a named collection of books of a user. The books are kept by hash, so they stay on the shelf when they are moved.
+// A smart shelf has a query instead, written like the parameters of /api/v1/catalog, and holds the books the query finds.
+type Shelf struct {
+	ID       string `json:"ID"`
+	Username string `json:"-"`
+	Name     string `json:"Name"`
+	Query    string `json:"Query"`
+	Books    int    `json:"Books"`   // The number of books on the shelf. It isn't counted for smart shelves.
+	Created  int64  `json:"Created"` // In unix time in milliseconds.
+	Updated  int64  `json:"Updated"`
+}
+
+// Shelves is a list of shelves.
+type Shelves []Shelf
+
+// Smart reports whether the books of the shelf are found by its query.
+func (shelf *Shelf) Smart() bool {
+	return shelf.Query != ""
+}
+
+// CatalogQuery returns the catalog search of a smart shelf, which finds all the books instead of a page.
+func (shelf *Shelf) CatalogQuery() (Files.CatalogQuery, error) {
+	values, err := url.ParseQuery(strings.TrimPrefix(shelf.Query, "?"))
+	if err != nil {
+		return Files.CatalogQuery{}, ErrInvalid
+	}
+	query, err := Files.ParseCatalogQuery(values)
+	if err != nil {
+		return Files.CatalogQuery{}, ErrInvalid
+	}
+	query.Cursor, query.Limit = "", 0
+	return query, nil
+}
+
+// Validate returns ErrInvalid if the shelf has no name or its query can't be read.
+func (shelf *Shelf) Validate() error {
+	shelf.Name = strings.TrimSpace(shelf.Name)
+	if shelf.Name == "" {
+		return ErrInvalid
+	}
+	if shelf.Smart() {
+		_, err := shelf.CatalogQuery()
+		return err
+	}
+	return nil
+}
+
+// Tag is a tag of a user and the number of books the user gave it.
+type Tag struct {
+	Name  string `json:"Name"`
+	Books int    `json:"Books"`
+}
+
+// Store stores the shelves and the tags of the users in the Shelves, ShelfBooks and UserTags tables.
+type Store struct {
+	DB *sql.DB
+}
+
+// InitTables creates the tables of the shelves and the tags if they don't exist.
+func (store *Store) InitTables() error {
+	for _, table := range []string{`
+		CREATE TABLE IF NOT EXISTS Shelves(
+			ID TEXT NOT NULL PRIMARY KEY,
+			Username TEXT NOT NULL,
+			Name TEXT NOT NULL,
+			Query TEXT,
+			Created INTEGER,
+			Updated INTEGER,
+			UNIQUE(Username, Name)
+		);`, `
+		CREATE TABLE IF NOT EXISTS ShelfBooks(
+			Shelf TEXT NOT NULL,
+			Hash TEXT NOT NULL,
+			Added INTEGER,
+			PRIMARY KEY(Shelf, Hash)
+		);`, `
+		CREATE TABLE IF NOT EXISTS UserTags(
+			Username TEXT NOT NULL,
+			Hash TEXT NOT NULL,
+			Tag TEXT NOT NULL,
+			PRIMARY KEY(Username, Hash, Tag)
+		);`,
+	} {
+		statement, err := store.DB.Prepare(table)
+		if err != nil {
+			return err
+		}
+		_, err = statement.Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the shelves of the user by name.
+func (store *Store) List(username string) (Shelves, error) {
+	result, err := store.DB.Query(`
+		SELECT ID, Name, Query, Created, Updated, (SELECT COUNT(*) FROM ShelfBooks WHERE Shelf=Shelves.ID) FROM Shelves
+		WHERE Username=$1 ORDER BY Name COLLATE NOCASE
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	shelves := Shelves{}
+	for result.Next() {
+		shelf := Shelf{Username: username}
+		err := result.Scan(&shelf.ID, &shelf.Name, &shelf.Query, &shelf.Created, &shelf.Updated, &shelf.Books)
+		if err != nil {
+			return nil, err
+		}
+		if shelf.Smart() {
+			shelf.Books = 0
+		}
+		shelves = append(shelves, shelf)
+	}
+	return shelves, result.Err()
+}
+
+// Get returns the shelf of the user with the id. sql.ErrNoRows is returned if the user has no such shelf.
+func (store *Store) Get(username string, id string) (Shelf, error) {
+	shelf := Shelf{Username: username}
+	result := store.DB.QueryRow(`
+		SELECT ID, Name, Query, Created, Updated, (SELECT COUNT(*) FROM ShelfBooks WHERE Shelf=Shelves.ID) FROM Shelves
+		WHERE Username=$1 AND ID=$2
+	`, username, id)
+	err := result.Scan(&shelf.ID, &shelf.Name, &shelf.Query, &shelf.Created, &shelf.Updated, &shelf.Books)
+	if shelf.Smart() {
+		shelf.Books = 0
+	}
+	return shelf, err
+}
+
+// Insert stores a new shelf. ErrExists is returned if the user has a shelf with the same name.
+func (store *Store) Insert(shelf *Shelf) error {
+	if err := store.unique(shelf); err != nil {
+		return err
+	}
+	shelf.Created = Progress.Now()
+	shelf.Updated = shelf.Created
+	statement, err := store.DB.Prepare("INSERT INTO Shelves (ID, Username, Name, Query, Created, Updated) VALUES (?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(shelf.ID, shelf.Username, shelf.Name, shelf.Query, shelf.Created, shelf.Updated)
+	return err
+}
+
+// Update renames the shelf with the id of the shelf and changes its query.
+// sql.ErrNoRows is returned if the user has no such shelf, and ErrExists if the user has another shelf with the name.
+func (store *Store) Update(shelf *Shelf) error {
+	if err := store.unique(shelf); err != nil {
+		return err
+	}
+	shelf.Updated = Progress.Now()
+	result, err := store.DB.Exec("UPDATE Shelves SET Name=$1, Query=$2, Updated=$3 WHERE Username=$4 AND ID=$5",
+		shelf.Name, shelf.Query, shelf.Updated, shelf.Username, shelf.ID)
+	return affected(result, err)
+}
+
+// Delete removes the shelf of the user with the id, but not its books. sql.ErrNoRows is returned if the user has no such shelf.
+func (store *Store) Delete(username string, id string) error {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM Shelves WHERE Username=$1 AND ID=$2", username, id)
+	if err = affected(result, err); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM ShelfBooks WHERE Shelf=$1", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// unique returns ErrExists if the user has another shelf with the name of the shelf.
+func (store *Store) unique(shelf *Shelf) error {
+	var count int
+	err := store.DB.QueryRow("SELECT COUNT(*) FROM Shelves WHERE Username=$1 AND Name=$2 AND ID<>$3", shelf.Username, shelf.Name, shelf.ID).Scan(&count)
+	if err == nil && count > 0 {
+		err = ErrExists
+	}
+	return err
+}
+
+// AddBook puts the book with the hash on the shelf. Adding a book that is on the shelf does nothing.
+func (store *Store) AddBook(shelf *Shelf, hash string) error {
+	if shelf.Smart() {
+		return ErrSmart
+	}
+	_, err := store.DB.Exec("INSERT OR IGNORE INTO ShelfBooks (Shelf, Hash, Added) VALUES (?,?,?)", shelf.ID, hash, Progress.Now())
+	return err
+}
+
+// RemoveBook takes the book with the hash off the shelf. sql.ErrNoRows is returned if the book isn't on the shelf.
+func (store *Store) RemoveBook(shelf *Shelf, hash string) error {
+	if shelf.Smart() {
+		return ErrSmart
+	}
+	result, err := store.DB.Exec("DELETE FROM ShelfBooks WHERE Shelf=$1 AND Hash=$2", shelf.ID, hash)
+	return affected(result, err)
+}
+
+// Hashes returns the hashes of the books on the shelf, in the order they were added.
+func (store *Store) Hashes(shelf *Shelf) ([]string, error) {
+	result, err := store.DB.Query("SELECT Hash FROM ShelfBooks WHERE Shelf=$1 ORDER BY Added, Hash", shelf.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	hashes := []string{}
+	for result.Next() {
+		var hash string
+		if err := result.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, result.Err()
+}
+
+// < ----- Tags ----- >
+
+// Tags returns the tags the user gave the book with the hash, in alphabetical order.
+func (store *Store) Tags(username string, hash string) ([]string, error) {
+	result, err := store.DB.Query("SELECT Tag FROM UserTags WHERE Username=$1 AND Hash=$2 ORDER BY Tag COLLATE NOCASE", username, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	tags := []string{}
+	for result.Next() {
+		var tag string
+		if err := result.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, result.Err()
+}
+
+// SetTags replaces the tags the user gave the book with the hash. Blank and repeated tags are left out.
+func (store *Store) SetTags(username string, hash string, tags []string) ([]string, error) {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM UserTags WHERE Username=$1 AND Hash=$2", username, hash)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		_, err = tx.Exec("INSERT OR IGNORE INTO UserTags (Username, Hash, Tag) VALUES (?,?,?)", username, hash, tag)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return store.Tags(username, hash)
+}
+
+// AllTags returns the tags of the user with the number of books each was given, in alphabetical order.
+func (store *Store) AllTags(username string) ([]Tag, error) {
+	result, err := store.DB.Query("SELECT Tag, COUNT(*) FROM UserTags WHERE Username=$1 GROUP BY Tag ORDER BY Tag COLLATE NOCASE", username)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	tags := []Tag{}
+	for result.Next() {
+		tag := Tag{}
+		if err := result.Scan(&tag.Name, &tag.Books); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, result.Err()
+}
+
+// TagMap returns the tags of the user by the hashes of the books, for the catalog search.
+func (store *Store) TagMap(username string) (map[string][]string, error) {
+	result, err := store.DB.Query("SELECT Hash, Tag FROM UserTags WHERE Username=$1", username)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	tags := make(map[string][]string)
+	for result.Next() {
+		var hash, tag string
+		if err := result.Scan(&hash, &tag); err != nil {
+			return nil, err
+		}
+		tags[hash] = append(tags[hash], tag)
+	}
+	for _, list := range tags {
+		sort.Strings(list)
+	}
+	return tags, result.Err()
+}
+
+// < ----- Folders ----- >
+
+// WalkFolder lists the shelves of the user like Volume.WalkFolder lists a folder, as the folders of Files.ShelvesVolume.
+// The root holds a folder for each shelf, and the folder of a shelf holds its books where they are in the volumes.
+// sql.ErrNoRows is returned if the user has no shelf at the path.
+func (store *Store) WalkFolder(username string, path string, volumes Files.Volumes) (Files.Files, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		shelves, err := store.List(username)
+		if err != nil {
+			return nil, err
+		}
+		files := Files.Files{}
+		for _, shelf := range shelves {
+			files = append(files, Files.File{Name: shelf.Name, Path: "/" + shelf.ID, IsDir: true, FileCount: shelf.Books, Volume: Files.ShelvesVolume, Hash: shelf.ID})
+		}
+		return files, nil
+	}
+	shelf, err := store.Get(username, path)
+	if err != nil {
+		return nil, err
+	}
+	return store.Files(&shelf, volumes)
+}
+
+// ListFolder lists the folder at the path of the volume, or the shelves of the user if the volume is Files.ShelvesVolume.
+// The volume is returned with the files. sql.ErrNoRows is returned if the user has no shelf at the path,
+// and a Files.UnknownVolumeError if there is no such volume.
+func (store *Store) ListFolder(username string, volumeName string, path string, volumes Files.Volumes) (*Files.Volume, Files.Files, error) {
+	if volumeName == Files.ShelvesVolume {
+		files, err := store.WalkFolder(username, path, volumes)
+		return &Files.Volume{Name: Files.ShelvesVolume}, files, err
+	}
+	volume, err := volumes.Get(volumeName)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := volume.WalkFolder(path)
+	return volume, files, err
+}
+
+// Files returns the books on the shelf where they are in the volumes. Books that aren't in any of the volumes are left out.
+func (store *Store) Files(shelf *Shelf, volumes Files.Volumes) (Files.Files, error) {
+	var library []string
+	for _, volume := range volumes {
+		library = append(library, volume.Name)
+	}
+	var entries []Files.CatalogEntry
+	if shelf.Smart() {
+		query, err := shelf.CatalogQuery()
+		if err != nil {
+			return nil, err
+		}
+		query.Library = library
+		query.UserTags, err = store.TagMap(shelf.Username)
+		if err != nil {
+			return nil, err
+		}
+		catalog := Files.Catalog{DB: store.DB}
+		results, err := catalog.Search(query)
+		if err != nil {
+			return nil, err
+		}
+		entries = results.Entries
+	} else {
+		hashes, err := store.Hashes(shelf)
+		if err != nil {
+			return nil, err
+		}
+		index := Files.Index{DB: store.DB}
+		for _, hash := range hashes {
+			locations, err := index.LookupHash(hash)
+			if err != nil {
+				return nil, err
+			}
+			if location, ok := locate(locations, library); ok {
+				entries = append(entries, Files.CatalogEntry{Volume: location.Volume, Path: location.Path, Hash: hash})
+			}
+		}
+	}
+	return volumes.Files(entries)
+}
+
+// locate returns the first of the places of a book that is in one of the volumes and isn't hidden.
+func locate(locations []Files.IndexEntry, library []string) (Files.IndexEntry, bool) {
+	for _, location := range locations {
+		if Files.IsHidden(location.Path) {
+			continue
+		}
+		for _, name := range library {
+			if location.Volume == name {
+				return location, true
+			}
+		}
+	}
+	return Files.IndexEntry{}, false
+}
+
+func affected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
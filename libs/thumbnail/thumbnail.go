@@ -0,0 +1,319 @@
+package thumbnail
+
+import (
+	"context"
+	"errors"
+	"image"
+	_ "image/gif" // Decodes gif covers and pages.
+	"image/jpeg"
+	_ "image/png" // Decodes png covers and pages.
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	Comic "../comic"
+	Epub "../epub"
+	_ "golang.org/x/image/bmp" // Decodes bmp pages.
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Decodes webp pages.
+)
+
+// < ----- Thumbnails ----- >
+
+// DefaultSize is the width of the thumbnails generated when the files are listed.
+const DefaultSize = 256
+
+// Sizes are the widths thumbnails can be generated in. Other sizes are rounded up, so the cache stays small.
+var Sizes = []int{128, 256, 512}
+
+// PDFToPPM is the command used to render the first page of a PDF.
+var PDFToPPM = "pdftoppm"
+
+// RetryAfter is how long a thumbnail that couldn't be generated isn't tried again. It's tried again right away if the file changes.
+var RetryAfter = 10 * time.Minute
+
+// ErrNoThumbnail is returned when a thumbnail can't be made for a file.
+var ErrNoThumbnail = errors.New("thumbnail: the file has no thumbnail")
+
+// Generator returns the image the thumbnail of the file is made from. The size is the width of the thumbnail.
+type Generator func(path string, size int) (image.Image, error)
+
+// Generators are the generators used for each file extension.
+var Generators = map[string]Generator{
+	".pdf":  PDFPage,
+	".epub": EPUBCover,
+	".cbz":  ComicPage,
+	".cbr":  ComicPage,
+	".cb7":  ComicPage,
+}
+
+// Cache stores the thumbnails in a folder by the hash of the file, so a file that changes gets a new thumbnail.
+// The thumbnails are generated by a fixed number of workers, both when the files are listed and when a missing thumbnail is requested.
+type Cache struct {
+	Folder  string
+	Workers int
+
+	jobs     chan job
+	inflight map[string]*call   // The thumbnails that are being generated.
+	failed   map[string]failure // The thumbnails that couldn't be generated.
+	mutex    sync.Mutex
+}
+
+type job struct {
+	path     string
+	hash     string
+	size     int
+	modified time.Time // The modification time of the file when the job was queued.
+	call     *call
+}
+
+// failure is a thumbnail that couldn't be generated from the file as it was modified at the time.
+type failure struct {
+	modified time.Time
+	retry    time.Time
+}
+
+type call struct {
+	done chan struct{}
+	err  error
+}
+
+// Start creates the folder and starts the workers.
+func (cache *Cache) Start() error {
+	err := os.MkdirAll(cache.Folder, 0755)
+	if err != nil {
+		return err
+	}
+	if cache.Workers < 1 {
+		cache.Workers = 1
+	}
+	cache.jobs = make(chan job, 256)
+	cache.inflight = make(map[string]*call)
+	cache.failed = make(map[string]failure)
+	for i := 0; i < cache.Workers; i++ {
+		go cache.work()
+	}
+	return nil
+}
+
+// Thumbnail returns the URL of the thumbnail of the file, and generates it in the background if it isn't cached.
+// It implements files.Thumbnailer.
+func (cache *Cache) Thumbnail(path string, hash string) string {
+	if _, ok := Generators[strings.ToLower(filepath.Ext(path))]; !ok || !isHash(hash) {
+		return ""
+	}
+	if _, err := os.Stat(cache.file(hash, DefaultSize)); os.IsNotExist(err) {
+		cache.schedule(path, hash, DefaultSize, false)
+	}
+	return "/thumb/" + hash
+}
+
+// Get returns the path of the thumbnail of the file in the given size, and waits for it to be generated if it isn't cached.
+func (cache *Cache) Get(path string, hash string, size int) (string, error) {
+	if _, ok := Generators[strings.ToLower(filepath.Ext(path))]; !ok || !isHash(hash) {
+		return "", ErrNoThumbnail
+	}
+	size = Fit(size)
+	file := cache.file(hash, size)
+	if _, err := os.Stat(file); err == nil {
+		return file, nil
+	}
+	call := cache.schedule(path, hash, size, true)
+	if call == nil {
+		return "", ErrNoThumbnail
+	}
+	<-call.done
+	if call.err != nil {
+		return "", call.err
+	}
+	return file, nil
+}
+
+// Fit returns the smallest of the Sizes that is at least the given size.
+func Fit(size int) int {
+	for _, fit := range Sizes {
+		if size <= fit {
+			return fit
+		}
+	}
+	return Sizes[len(Sizes)-1]
+}
+
+// schedule queues the thumbnail to be generated, unless it already is or it recently failed for the same file.
+// If wait is false the thumbnail is skipped when the queue is full, as it is generated when it is requested.
+func (cache *Cache) schedule(path string, hash string, size int, wait bool) *call {
+	key := hash + "-" + strconv.Itoa(size)
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime()
+	}
+	cache.mutex.Lock()
+	if failed, ok := cache.failed[key]; ok {
+		if failed.modified.Equal(modified) && time.Now().Before(failed.retry) {
+			cache.mutex.Unlock()
+			return nil
+		}
+		delete(cache.failed, key)
+	}
+	if inflight, ok := cache.inflight[key]; ok {
+		cache.mutex.Unlock()
+		return inflight
+	}
+	call := &call{done: make(chan struct{})}
+	cache.inflight[key] = call
+	cache.mutex.Unlock()
+
+	next := job{path: path, hash: hash, size: size, modified: modified, call: call}
+	if wait {
+		cache.jobs <- next
+		return call
+	}
+	select {
+	case cache.jobs <- next:
+	default:
+		cache.mutex.Lock()
+		delete(cache.inflight, key)
+		cache.mutex.Unlock()
+		call.err = ErrNoThumbnail
+		close(call.done)
+	}
+	return call
+}
+
+// work generates the queued thumbnails.
+func (cache *Cache) work() {
+	for job := range cache.jobs {
+		err := cache.generate(job.path, job.hash, job.size)
+		key := job.hash + "-" + strconv.Itoa(job.size)
+		cache.mutex.Lock()
+		delete(cache.inflight, key)
+		if err != nil {
+			cache.failed[key] = failure{modified: job.modified, retry: time.Now().Add(RetryAfter)}
+		}
+		cache.mutex.Unlock()
+		job.call.err = err
+		close(job.call.done)
+	}
+}
+
+// generate renders the thumbnail and writes it to the cache.
+func (cache *Cache) generate(path string, hash string, size int) error {
+	generator := Generators[strings.ToLower(filepath.Ext(path))]
+	source, err := generator(path, size)
+	if err != nil {
+		return err
+	}
+	bounds := source.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return ErrNoThumbnail
+	}
+	// The thumbnail is scaled to the width, and very tall images are cut off at twice the width.
+	height := bounds.Dy() * size / bounds.Dx()
+	if height > size*2 {
+		height = size * 2
+		bounds.Max.Y = bounds.Min.Y + bounds.Dx()*2
+	}
+	if height < 1 {
+		height = 1
+	}
+	thumbnail := image.NewRGBA(image.Rect(0, 0, size, height))
+	draw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), source, bounds, draw.Src, nil)
+
+	file := cache.file(hash, size)
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	// The thumbnail is written to a temporary file first, so a half written thumbnail is never served.
+	temporary, err := ioutil.TempFile(filepath.Dir(file), ".thumbnail-")
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(temporary, thumbnail, &jpeg.Options{Quality: 80})
+	temporary.Close()
+	if err != nil {
+		os.Remove(temporary.Name())
+		return err
+	}
+	return os.Rename(temporary.Name(), file)
+}
+
+// file returns the path the thumbnail is cached at.
+func (cache *Cache) file(hash string, size int) string {
+	return filepath.Join(cache.Folder, hash[:2], hash+"-"+strconv.Itoa(size)+".jpg")
+}
+
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{16,128}$`)
+
+// isHash reports whether the hash is a hex encoded hash, so it can be used in a path.
+func isHash(hash string) bool {
+	return hashPattern.MatchString(hash)
+}
+
+// < ----- Generators ----- >
+
+// PDFPage renders the first page of the PDF with pdftoppm.
+func PDFPage(path string, size int) (image.Image, error) {
+	folder, err := ioutil.TempDir("", "thumbnail")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(folder)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	output := filepath.Join(folder, "page")
+	err = exec.CommandContext(ctx, PDFToPPM, "-jpeg", "-singlefile", "-f", "1", "-l", "1", "-scale-to", strconv.Itoa(size*2), path, output).Run()
+	if err != nil {
+		return nil, err
+	}
+	return decodeFile(output + ".jpg")
+}
+
+// EPUBCover decodes the cover image of the EPUB.
+func EPUBCover(path string, size int) (image.Image, error) {
+	book, err := Epub.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer book.Close()
+	if book.Cover == "" {
+		return nil, ErrNoThumbnail
+	}
+	cover, err := book.Open(book.Cover)
+	if err != nil {
+		return nil, err
+	}
+	defer cover.Close()
+	img, _, err := image.Decode(cover)
+	return img, err
+}
+
+// ComicPage decodes the first page of the comic archive.
+func ComicPage(path string, size int) (image.Image, error) {
+	page, _, err := Comic.OpenPage(path, 0)
+	if err == Comic.ErrNoPage {
+		return nil, ErrNoThumbnail
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer page.Close()
+	img, _, err := image.Decode(page)
+	return img, err
+}
+
+func decodeFile(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	return img, err
+}
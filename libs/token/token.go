@@ -0,0 +1,224 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// < ----- API tokens ----- >
+
+// Prefix starts every token, so they can be told apart from the JWT tokens of the signed in users.
+const Prefix = "ert_"
+
+// The scopes a token can be given. A token can do what any of its scopes allow.
+const (
+	ScopeRead     = "read"     // Read anything, with GET and HEAD requests.
+	ScopeProgress = "progress" // Read and store the reading progress and the annotations.
+	ScopeUpload   = "upload"   // Upload files.
+)
+
+// Scopes are the scopes a token can be given.
+var Scopes = []string{ScopeRead, ScopeProgress, ScopeUpload}
+
+// ErrInvalid is returned when a token has no name or an unknown scope.
+var ErrInvalid = errors.New("invalid token")
+
+// Token is a long-lived token a user made for a script or a device. Only the hash of the token is stored,
+// so the token itself is only known when it's created.
+type Token struct {
+	ID       string   `json:"ID"`
+	Username string   `json:"-"`
+	Name     string   `json:"Name"`
+	Scopes   []string `json:"Scopes"`
+	Created  int64    `json:"Created"`  // In unix time.
+	LastUsed int64    `json:"LastUsed"` // In unix time, 0 if the token hasn't been used.
+	Token    string   `json:"Token,omitempty"`
+}
+
+// Tokens is a list of tokens.
+type Tokens []Token
+
+// Validate returns ErrInvalid if the token has no name or an unknown scope. The scopes are sorted and duplicates are removed.
+func (token *Token) Validate() error {
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" || len(token.Name) > 100 || len(token.Scopes) == 0 {
+		return ErrInvalid
+	}
+	scopes := []string{}
+	for _, scope := range token.Scopes {
+		if !contains(Scopes, scope) {
+			return ErrInvalid
+		}
+		if !contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+	token.Scopes = scopes
+	return nil
+}
+
+// Allows reports whether the scopes of the token allow the request. Tokens can't be used to manage tokens.
+func (token *Token) Allows(method string, path string) bool {
+	// Routes are matched case insensitively.
+	path = strings.ToLower(path)
+	if path == "/api/v1/tokens" || strings.HasPrefix(path, "/api/v1/tokens/") {
+		return false
+	}
+	for _, scope := range token.Scopes {
+		switch scope {
+		case ScopeRead:
+			if method == "GET" || method == "HEAD" {
+				return true
+			}
+		case ScopeProgress:
+			if strings.HasPrefix(path, "/api/v1/progress/") || strings.HasPrefix(path, "/api/v1/annotations/") {
+				return true
+			}
+		case ScopeUpload:
+			if path == "/upload" || strings.HasPrefix(path, "/upload/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Hash returns the hash the token is stored by.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store stores the tokens of the users in the ApiTokens table.
+type Store struct {
+	DB *sql.DB
+}
+
+// InitTable creates the tokens table if it doesn't exist.
+func (store *Store) InitTable() error {
+	statement, err := store.DB.Prepare(`
+		CREATE TABLE IF NOT EXISTS ApiTokens(
+			ID TEXT NOT NULL PRIMARY KEY,
+			Username TEXT NOT NULL,
+			Name TEXT,
+			Scopes TEXT,
+			Hash TEXT NOT NULL UNIQUE,
+			Created INTEGER,
+			LastUsed INTEGER
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec()
+	return err
+}
+
+// List returns the tokens of the user, newest first. The tokens themselves aren't known.
+func (store *Store) List(username string) (Tokens, error) {
+	result, err := store.DB.Query("SELECT ID, Name, Scopes, Created, LastUsed FROM ApiTokens WHERE Username=$1 ORDER BY Created DESC, Name", username)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	tokens := Tokens{}
+	for result.Next() {
+		token := Token{Username: username}
+		var scopes string
+		err := result.Scan(&token.ID, &token.Name, &scopes, &token.Created, &token.LastUsed)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Split(scopes, ",")
+		tokens = append(tokens, token)
+	}
+	return tokens, result.Err()
+}
+
+// Create stores the token with a new id and a new random token, which is set in the Token field.
+func (store *Store) Create(token *Token) error {
+	if err := token.Validate(); err != nil {
+		return err
+	}
+	id, err := random(16)
+	if err != nil {
+		return err
+	}
+	secret, err := random(32)
+	if err != nil {
+		return err
+	}
+	token.ID = id
+	token.Token = Prefix + secret
+	token.Created = time.Now().Unix()
+	token.LastUsed = 0
+	statement, err := store.DB.Prepare("INSERT INTO ApiTokens (ID, Username, Name, Scopes, Hash, Created, LastUsed) VALUES (?,?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(token.ID, token.Username, token.Name, strings.Join(token.Scopes, ","), Hash(token.Token), token.Created, token.LastUsed)
+	return err
+}
+
+// Delete revokes the token of the user with the id. sql.ErrNoRows is returned if the user has no such token.
+func (store *Store) Delete(username string, id string) error {
+	result, err := store.DB.Exec("DELETE FROM ApiTokens WHERE Username=$1 AND ID=$2", username, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+// Authenticate returns the stored token matching the token, and marks it as used.
+// sql.ErrNoRows is returned if there is no such token.
+func (store *Store) Authenticate(secret string) (Token, error) {
+	token := Token{}
+	if !strings.HasPrefix(secret, Prefix) {
+		return token, sql.ErrNoRows
+	}
+	var scopes string
+	result := store.DB.QueryRow("SELECT ID, Username, Name, Scopes, Created, LastUsed FROM ApiTokens WHERE Hash=$1", Hash(secret))
+	err := result.Scan(&token.ID, &token.Username, &token.Name, &scopes, &token.Created, &token.LastUsed)
+	if err != nil {
+		return token, err
+	}
+	token.Scopes = strings.Split(scopes, ",")
+	// The time is only written once a minute, so scripts making many requests don't write on every request.
+	now := time.Now().Unix()
+	if now-token.LastUsed >= 60 {
+		token.LastUsed = now
+		_, err = store.DB.Exec("UPDATE ApiTokens SET LastUsed=$1 WHERE ID=$2", now, token.ID)
+	}
+	return token, err
+}
+
+// random returns n random bytes in hex.
+func random(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	Files "../files"
+	"github.com/fsnotify/fsnotify"
+)
+
+// < ----- Watcher ----- >
+
+// Debounce is how long a file has to be left alone before it is hashed again after being written to.
+const Debounce = 2 * time.Second
+
+// Watcher keeps the file index in sync with the volumes by watching them for changes.
+// When a file shows up with a hash that has progress pointing at a path that is gone, the progress is moved to the new path.
+type Watcher struct {
+	Volumes Files.Volumes
+	Index   *Files.Index
+
+	watcher *fsnotify.Watcher
+	roots   map[string]*Files.Volume // The resolved root of each volume.
+	timers  map[string]*time.Timer
+	mutex   sync.Mutex
+}
+
+// Start starts watching all the volumes in the background.
+// The volumes are walked in the background too, so files changed while the server was stopped are indexed.
+func (watcher *Watcher) Start() error {
+	var err error
+	watcher.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	watcher.roots = make(map[string]*Files.Volume)
+	watcher.timers = make(map[string]*time.Timer)
+	for i := range watcher.Volumes {
+		root, err := watcher.Volumes[i].Root()
+		if err != nil {
+			return err
+		}
+		watcher.roots[root] = &watcher.Volumes[i]
+	}
+	go watcher.run()
+	go func() {
+		for root := range watcher.roots {
+			err := watcher.watchFolder(root)
+			if err != nil {
+				fmt.Println("Watcher:", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops watching the volumes.
+func (watcher *Watcher) Close() error {
+	return watcher.watcher.Close()
+}
+
+// run handles the events until the watcher is closed.
+func (watcher *Watcher) run() {
+	for {
+		select {
+		case event, ok := <-watcher.watcher.Events:
+			if !ok {
+				return
+			}
+			watcher.handle(event)
+		case err, ok := <-watcher.watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Println("Watcher:", err.Error())
+		}
+	}
+}
+
+// handle updates the index for a single event.
+func (watcher *Watcher) handle(event fsnotify.Event) {
+	volume := watcher.volume(event.Name)
+	if volume == nil || Files.IsHidden(volume.Rel(event.Name)) {
+		return
+	}
+	switch {
+	case event.Op&fsnotify.Create == fsnotify.Create:
+		info, err := os.Stat(event.Name)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			// Moved in folders are indexed right away, so the progress of the files inside moves with them.
+			err = watcher.watchFolder(event.Name)
+			if err != nil {
+				fmt.Println("Watcher:", err.Error())
+			}
+			return
+		}
+		watcher.schedule(volume, event.Name)
+	case event.Op&fsnotify.Write == fsnotify.Write:
+		watcher.schedule(volume, event.Name)
+	case event.Op&fsnotify.Remove == fsnotify.Remove, event.Op&fsnotify.Rename == fsnotify.Rename:
+		watcher.cancel(event.Name)
+		err := watcher.Index.Remove(volume.Name, volume.Rel(event.Name))
+		if err != nil {
+			fmt.Println("Watcher:", err.Error())
+		}
+	}
+}
+
+// watchFolder watches the folder and all the folders inside it, and indexes the files inside them.
+func (watcher *Watcher) watchFolder(folder string) error {
+	return filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files can disappear while walking, they are removed from the index by their own event.
+			return nil
+		}
+		if volume := watcher.volume(path); volume != nil && Files.IsHidden(volume.Rel(path)) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() {
+			return watcher.watcher.Add(path)
+		}
+		if volume := watcher.volume(path); volume != nil && info.Mode().IsRegular() {
+			watcher.index(volume, path)
+		}
+		return nil
+	})
+}
+
+// schedule indexes the file once it hasn't been written to for the Debounce duration.
+func (watcher *Watcher) schedule(volume *Files.Volume, path string) {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	if timer, ok := watcher.timers[path]; ok {
+		timer.Reset(Debounce)
+		return
+	}
+	watcher.timers[path] = time.AfterFunc(Debounce, func() {
+		watcher.mutex.Lock()
+		delete(watcher.timers, path)
+		watcher.mutex.Unlock()
+		watcher.index(volume, path)
+	})
+}
+
+// cancel stops a scheduled indexing of the file.
+func (watcher *Watcher) cancel(path string) {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	if timer, ok := watcher.timers[path]; ok {
+		timer.Stop()
+		delete(watcher.timers, path)
+	}
+}
+
+// index hashes the file, stores it in the index, moves any progress left behind at an old path and reads its metadata.
+func (watcher *Watcher) index(volume *Files.Volume, path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return
+	}
+	relative := volume.Rel(path)
+	hash, err := watcher.Index.Hash(volume.Name, relative, info, func() (string, error) {
+		return volume.HashFile(&Files.File{Path: path})
+	})
+	if err != nil {
+		fmt.Println("Watcher:", err.Error())
+		return
+	}
+	_, err = watcher.Index.Digest(volume.Name, relative, path)
+	if err != nil {
+		fmt.Println("Watcher:", err.Error())
+	}
+	err = watcher.Index.MigrateProgress(volume, hash, relative)
+	if err != nil {
+		fmt.Println("Watcher:", err.Error())
+	}
+	// The metadata is read now, so the book can be found by the catalog search before it has been browsed to.
+	if volume.Catalog != nil {
+		_, err = volume.Catalog.Book(path, hash)
+		if err != nil {
+			fmt.Println("Watcher:", err.Error())
+		}
+	}
+}
+
+// volume returns the volume the path belongs to. If volumes are nested the innermost volume is used.
+func (watcher *Watcher) volume(path string) *Files.Volume {
+	var match *Files.Volume
+	longest := -1
+	for root, volume := range watcher.roots {
+		if (path == root || strings.HasPrefix(path, root+string(filepath.Separator))) && len(root) > longest {
+			match = volume
+			longest = len(root)
+		}
+	}
+	return match
+}
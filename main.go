@@ -7,12 +7,21 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	API "./libs/api"
 	ExtensionAPI "./libs/extension"
 	files "./libs/files"
+	Progress "./libs/progress"
+	search "./libs/search"
 	Server "./libs/server"
+	thumbnail "./libs/thumbnail"
+	watcher "./libs/watcher"
 
+	"github.com/eknkc/amber"
 	"github.com/gofiber/fiber"
 	jwtware "github.com/gofiber/jwt"
 	"github.com/gofiber/logger"
@@ -26,13 +35,22 @@ func main() {
 	flags(server)
 	// Setup the database
 	server.InitDB()
-	// setup the volume for the server.
-	server.Volume = files.Volume{Name: "C:", Path: "./files"}
+	err := server.InitEnricher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if server.ImportCalibre != "" {
+		importCalibre(server)
+		return
+	}
 	// Setup fiber
 	settings := fiber.Settings{
-		ETag: server.Etag,
+		ETag:      server.Etag,
+		BodyLimit: server.BodyLimit,
 	}
 	app := fiber.New(&settings)
+	amber.FuncMap["encodeURIComponent"] = encodeURIComponent
+	amber.FuncMap["encodePath"] = encodePath
 	app.Settings.TemplateEngine = template.Amber()
 	// setup logger middleware
 	app.Use(logger.New())
@@ -54,36 +72,119 @@ func main() {
 	app.Post("/signin", server.Signin)
 	app.Post("/signup", server.Signup)
 
+	// < ----- OPDS ROUTES ----- >
+
+	opds := app.Group("/opds", server.BasicAuth)
+	opds.Get("/", server.OPDSRoot)
+	opds.Get("/opensearch.xml", server.OPDSOpenSearch)
+	opds.Get("/search", server.OPDSSearch)
+	opds.Get("/volumes/:volume", server.OPDSFolder)
+	opds.Get("/volumes/:volume/*", server.OPDSFolder)
+	opds.Get("/download/:volume/*", server.OPDSDownload)
+	opds.Get("/cover/:hash", server.GetCover)
+	opds.Get("/thumb/:hash", server.GetThumbnail)
+
+	// < ----- KOREADER SYNC ROUTES ----- >
+
+	kosync := app.Group("/kosync")
+	kosync.Post("/users/create", server.KOSyncCreateUser)
+	kosync.Get("/users/auth", server.KOSyncAuth, server.KOSyncAuthorize)
+	kosync.Put("/syncs/progress", server.KOSyncAuth, server.KOSyncUpdateProgress)
+	kosync.Get("/syncs/progress/:document", server.KOSyncAuth, server.KOSyncGetProgress)
+
+	// < ----- API ----- >
+
+	// The API is set up before the protected routes, so its OpenAPI document is public.
+	api := &API.API{App: app}
+	err = api.Init(strconv.Itoa(server.Port), "http")
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// < ----- PROTECTET ROUTES ----- >
 
+	// API tokens are read before the JWT token, which isn't needed when a request has an API token.
+	app.Use(server.TokenAuth)
 	app.Use(jwtware.New(jwtware.Config{
+		Filter:       server.SignedInWithToken,
 		SigningKey:   []byte(server.Secret),
 		TokenLookup:  "cookie:token",
 		ErrorHandler: server.JwtErrorHandler,
 	}))
 
-	// < ----- STATIC ROUTES ----- >
-
-	app.Static("/volume", server.Volume.Path)
-
 	// < ----- GET ROUTES ----- >
 
 	app.Get("/settings", server.Settings)
 	app.Get("/files", server.GetFiles)
+	app.Get("/volumes", server.GetVolumes)
+	app.Get("/volume/:volume/*", server.GetVolumeFile)
+	app.Get("/epub/:hash", server.GetEPUB)
+	app.Get("/epub/:hash/*", server.GetEPUBResource)
+	app.Get("/comic/:volume/*", server.GetComic)
+	app.Get("/thumb/:hash", server.GetThumbnail)
+	app.Get("/cover/:hash", server.GetCover)
+	app.Get("/metadata/reviews", server.GetReviews)
 
 	// < ----- POST ROUTES ----- >
 
 	app.Post("/updateSetting", server.UpdateSetting)
 	app.Post("/query", server.Query)
+	app.Post("/upload", server.Upload)
+	app.Head("/upload/:id", server.UploadStatus)
+	app.Patch("/upload/:id", server.UploadChunk)
+	app.Delete("/upload/:id", server.CancelUpload)
+	app.Post("/files/mkdir", server.CreateFolder)
+	app.Post("/files/rename", server.RenameFile)
+	app.Post("/files/move", server.MoveFile)
+	app.Post("/files/copy", server.CopyFile)
+	app.Post("/files/delete", server.DeleteFile)
+	app.Get("/trash", server.GetTrash)
+	app.Post("/trash/restore", server.RestoreFile)
+	app.Post("/trash/empty", server.EmptyTrash)
+	app.Post("/metadata/enrich", server.Enrich)
+	app.Post("/metadata/reviews/:id", server.ResolveReview)
+
+	// < ----- API ROUTES ----- >
+
+	server.RegisterV1(api.V1)
 	// < ----- EXTENSIONS ----- >
 
 	Extensions := ExtensionAPI.Extensions{DB: server.DB}
-	Extensions.LoadExtensions(app, server.DB, server.Volume)
+	Extensions.LoadExtensions(app, server.DB, server.Volumes)
+	server.Extensions = &Extensions
+	server.Index.ProgressTables = append(Extensions.ProgressTables(), Progress.Table)
+
+	// < ----- WATCHER ----- >
+
+	if server.Watch {
+		fileWatcher := &watcher.Watcher{Volumes: server.Volumes, Index: server.Index}
+		err := fileWatcher.Start()
+		if err != nil {
+			fmt.Println("Error starting the file watcher:", err.Error())
+		}
+	}
+
+	// < ----- SEARCH ----- >
+
+	if server.Search != nil && server.SearchInterval >= 0 {
+		indexer := &search.Indexer{Index: server.Search, Volumes: server.Volumes}
+		indexer.Start(server.SearchInterval)
+	}
+
+	// < ----- UPLOADS ----- >
+
+	if server.UploadExpiry > 0 {
+		server.ExpireUploadsEvery(time.Hour)
+	}
+
+	// < ----- METADATA ----- >
+
+	go server.ImportMetadata()
 
 	// < ----- TEST ----- >
-	test(server.DB, app, &server.Volume)
+	test(server.DB, app, server.Volumes)
 	// start the server on the server.port
-	log.Fatal(app.Listen(server.Port))
+	log.Fatal(server.Listen(app))
 }
 
 // < ----- FLAGS ----- >
@@ -95,15 +196,94 @@ func flags(server *Server.Server) {
 	username := flag.String("username", "admin", "The Username is for the database to ensure the data is protected")
 	password := flag.String("password", "admin", "The Password is for the database to ensure the data is protected")
 	etag := flag.Bool("etag", false, "Enables or disables ETAG generation")
+	volumes := flag.String("volumes", "C:=./files", "The volumes are the folders served by the server, given as a comma separated list of name=path pairs")
+	quota := flag.Int64("quota", 0, "The quota is the number of megabytes each user can upload, 0 means there is no limit")
+	bodyLimit := flag.Int("bodyLimit", 32, "The body limit is the largest request in megabytes, larger files have to be uploaded in chunks")
+	watch := flag.Bool("watch", true, "Watch enables the file watcher, which keeps the file index and the progress in sync with changes to the volumes")
+	thumbnails := flag.String("thumbnails", "./thumbnails", "Thumbnails is the folder the thumbnails of the books are cached in")
+	thumbnailWorkers := flag.Int("thumbnailWorkers", 2, "ThumbnailWorkers is the number of thumbnails generated at the same time")
+	metadataDumps := flag.String("metadataDumps", "", "MetadataDumps is a comma separated list of Calibre metadata.db files and Open Library dumps the books are enriched from")
+	dumpCovers := flag.String("dumpCovers", "", "DumpCovers is a folder with the covers of the Open Library dumps, named by their cover id")
+	openLibrary := flag.String("openLibrary", "", "OpenLibrary is the URL of Open Library, or a local service with the same API, used to enrich the books. It isn't used if it's empty")
+	openLibraryCovers := flag.String("openLibraryCovers", "https://covers.openlibrary.org", "OpenLibraryCovers is the URL the covers from the OpenLibrary URL are downloaded from")
+	importCalibre := flag.String("importCalibre", "", "ImportCalibre imports the Calibre library given as name=path as a volume and exits, the library is served as a volume from then on")
+	partialHash := flag.String("partialHash", "", "PartialHash is a comma separated list of volumes where huge files are identified by a hash of their head, tail and size instead of the whole file")
+	uploadExpiry := flag.Int("uploadExpiry", 24, "UploadExpiry is the number of hours a chunked upload can take, unfinished uploads are removed after it and 0 keeps them")
+	searchInterval := flag.Int("searchInterval", 10, "SearchInterval is the number of minutes between looking for new books to index for the full-text search, 0 only indexes at startup and a negative number disables the indexing")
 	flag.Parse()
+	var err error
+	server.Volumes, err = files.ParseVolumes(*volumes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range deleteEmpty(strings.Split(*partialHash, ",")) {
+		volume, err := server.Volumes.Get(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		volume.HashMode = files.PartialHash
+	}
+	server.Thumbnails = &thumbnail.Cache{Folder: *thumbnails, Workers: *thumbnailWorkers}
+	err = server.Thumbnails.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
 	server.Secret = *secret
 	server.Port = *port
 	server.Etag = *etag
+	server.Watch = *watch
+	server.SearchInterval = time.Duration(*searchInterval) * time.Minute
+	server.Quota = *quota * 1000 * 1000
+	server.BodyLimit = *bodyLimit * 1000 * 1000
+	server.UploadExpiry = time.Duration(*uploadExpiry) * time.Hour
 	server.HomePath = *homePath
+	server.MetadataDumps = deleteEmpty(strings.Split(*metadataDumps, ","))
+	server.DumpCovers = *dumpCovers
+	server.OpenLibrary = *openLibrary
+	server.OpenLibraryCovers = *openLibraryCovers
+	server.ImportCalibre = *importCalibre
 	server.Username = *username
 	server.Password = *password
 }
 
+// importCalibre imports the Calibre library given by the importCalibre flag and prints what was imported.
+func importCalibre(server *Server.Server) {
+	parts := strings.SplitN(server.ImportCalibre, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+		log.Fatal("invalid Calibre library " + server.ImportCalibre + ", expected name=path")
+	}
+	result, err := server.ImportCalibreLibrary(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Imported", result.Books, "books with", result.Files, "files and", result.Covers, "covers,", result.Missing, "files are missing")
+}
+
+// deleteEmpty removes the empty and blank strings from the list.
+func deleteEmpty(s []string) []string {
+	var r []string
+	for _, str := range s {
+		if str = strings.TrimSpace(str); str != "" {
+			r = append(r, str)
+		}
+	}
+	return r
+}
+
+// encodeURIComponent escapes the string to be used in a link, like encodeURIComponent of javascript.
+func encodeURIComponent(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// encodePath escapes each name of the slash separated path to be used in a link.
+func encodePath(path string) string {
+	names := strings.Split(path, "/")
+	for i, name := range names {
+		names[i] = encodeURIComponent(name)
+	}
+	return strings.Join(names, "/")
+}
+
 // < ----- Random Generators ----- >
 const charset = "abcdefghijklmnopqrstuvwxyz" +
 	"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
@@ -120,9 +300,9 @@ func stringWithCharset(length int, charset string) string {
 	return string(b)
 }
 
-func test(DB *sql.DB, app *fiber.App, Volume *files.Volume) {
+func test(DB *sql.DB, app *fiber.App, Volumes files.Volumes) {
 	//databaseTest(DB)
-	//viewTest(DB, app, Volume)
+	//viewTest(DB, app, Volumes)
 	//configTest()
 }
 
@@ -137,66 +317,75 @@ func databaseTest(DB *sql.DB) {
 	if err != nil {
 		fmt.Println(err.Error())
 	}
+	// The tables the queries are validated against.
+	pdfTable := ExtensionAPI.DatabaseTable{TableName: "PDFS", Items: ExtensionAPI.DatabaseItems{
+		"Username": ExtensionAPI.TEXT,
+		"Hash":     ExtensionAPI.TEXT,
+		"Path":     ExtensionAPI.TEXT,
+		"Page":     ExtensionAPI.INTEGER,
+	}}
+	tables := ExtensionAPI.DatabaseTables{dataBaseTable, pdfTable}
 	// Add item to a table
 	DatabaseQuery := ExtensionAPI.DatabaseQuery{TableName: "PDFS", DatabaseOperation: ExtensionAPI.INSERT, Contains: make(map[string]string)}
-	DatabaseQuery.Contains["Username"] = "\"LowkeyCoding\""
-	DatabaseQuery.Contains["Hash"] = "\"somehash\""
-	DatabaseQuery.Contains["Path"] = "\"/test\""
-	DatabaseQuery.Contains["Page"] = "1"
+	DatabaseQuery.Set = make(map[string]string)
+	DatabaseQuery.Set["Username"] = "LowkeyCoding"
+	DatabaseQuery.Set["Hash"] = "somehash"
+	DatabaseQuery.Set["Path"] = "/test"
+	DatabaseQuery.Set["Page"] = "1"
 
-	_, err = DatabaseQuery.GenerateQuery(DB)
+	_, err = DatabaseQuery.GenerateQuery(DB, tables)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
 
 	// Get the item from a table
 	DatabaseQuery = ExtensionAPI.DatabaseQuery{TableName: "PDFS", DatabaseOperation: ExtensionAPI.SELECT, Contains: make(map[string]string)}
-	DatabaseQuery.Contains["Hash"] = "\"somehash\""
+	DatabaseQuery.Contains["Hash"] = "somehash"
 
-	_, err = DatabaseQuery.GenerateQuery(DB)
+	_, err = DatabaseQuery.GenerateQuery(DB, tables)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
 
 	// Update item form a table
 	DatabaseQuery = ExtensionAPI.DatabaseQuery{TableName: "PDFS", DatabaseOperation: ExtensionAPI.UPDATE, Contains: make(map[string]string), Set: make(map[string]string)}
-	DatabaseQuery.Contains["Hash"] = "\"somehash\""
+	DatabaseQuery.Contains["Hash"] = "somehash"
 	DatabaseQuery.Set["Page"] = "2"
 
-	_, err = DatabaseQuery.GenerateQuery(DB)
+	_, err = DatabaseQuery.GenerateQuery(DB, tables)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
 
 	// Get the item from a table
 	DatabaseQuery = ExtensionAPI.DatabaseQuery{TableName: "PDFS", DatabaseOperation: ExtensionAPI.SELECT, Contains: make(map[string]string)}
-	DatabaseQuery.Contains["Hash"] = "\"somehash\""
+	DatabaseQuery.Contains["Hash"] = "somehash"
 
-	_, err = DatabaseQuery.GenerateQuery(DB)
+	_, err = DatabaseQuery.GenerateQuery(DB, tables)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
 
 	// Delete item form a table
 	DatabaseQuery = ExtensionAPI.DatabaseQuery{TableName: "PDFS", DatabaseOperation: ExtensionAPI.DELETE, Contains: make(map[string]string)}
-	DatabaseQuery.Contains["Hash"] = "\"somehash\""
+	DatabaseQuery.Contains["Hash"] = "somehash"
 
-	_, err = DatabaseQuery.GenerateQuery(DB)
+	_, err = DatabaseQuery.GenerateQuery(DB, tables)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
 
 	// Get the item from a table
 	DatabaseQuery = ExtensionAPI.DatabaseQuery{TableName: "PDFS", DatabaseOperation: ExtensionAPI.SELECT, Contains: make(map[string]string)}
-	DatabaseQuery.Contains["Hash"] = "\"somehash\""
+	DatabaseQuery.Contains["Hash"] = "somehash"
 
-	_, err = DatabaseQuery.GenerateQuery(DB)
+	_, err = DatabaseQuery.GenerateQuery(DB, tables)
 	if err != nil {
 		fmt.Println(err.Error())
 	}
 }
 
-func viewTest(DB *sql.DB, app *fiber.App, Volume files.Volume) {
+func viewTest(DB *sql.DB, app *fiber.App, Volumes files.Volumes) {
 	// Create the viewQueryVariableNames array
 	var viewQueryVariableNames []string
 	viewQueryVariableNames = append(viewQueryVariableNames, "Hash")
@@ -239,7 +428,7 @@ func viewTest(DB *sql.DB, app *fiber.App, Volume files.Volume) {
 	var pdfReaderViews []ExtensionAPI.View
 	pdfReaderViews = append(pdfReaderViews, pdfReaderView)
 	// Add the database table to a list of database tables
-	var pdfDatabaseTables []ExtensionAPI.DatabaseTable
+	var pdfDatabaseTables ExtensionAPI.DatabaseTables
 	pdfDatabaseTables = append(pdfDatabaseTables, databaseTable)
 	extension := ExtensionAPI.Extension{
 		Name:           "PDFREADER",
@@ -250,7 +439,7 @@ func viewTest(DB *sql.DB, app *fiber.App, Volume files.Volume) {
 		databaseTable.GenerateTable(DB)
 	}
 	for _, view := range extension.Views {
-		view.GenerateView(app, DB, Volume)
+		view.GenerateView(app, DB, Volumes, extension.DatabaseTables)
 	}
 	test, err := json.Marshal(&extension)
 	if err != nil {